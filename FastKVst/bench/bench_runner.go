@@ -33,6 +33,7 @@ type Config struct {
     Workload    WorkloadType
     KeySize     int          // bytes per key
     ValueSize   int          // bytes per value
+    Binary      bool         // random []byte value per key, via kv.SetBytes/GetBytes
 }
 
 // Result holds measured metrics.
@@ -43,6 +44,12 @@ type Result struct {
     WriteOpsPerSec float64
     ReadLatencies  []time.Duration
     MemAllocBytes  uint64
+    Bloom          *kv.BloomStats // set for stores with Bloom filters
+}
+
+// bloomReporter is implemented by stores that keep Bloom filter counters.
+type bloomReporter interface {
+    BloomStats() kv.BloomStats
 }
 
 // generateWorkload builds a slice of keys according to cfg.Workload.
@@ -78,11 +85,21 @@ func generateWorkload(cfg Config) []string {
 
 // RunBenchmark runs concurrent Sets, then measures per‑Get latency.
 func RunBenchmark(cfg Config) (Result, error) {
-    // 1. Generate keys & a constant value
+    // 1. Generate keys & a constant value (or one binary value per key)
     keys := generateWorkload(cfg)
     valBytes := make([]byte, cfg.ValueSize)
     rand.Read(valBytes)
     val := string(valBytes)
+    var keyBytes, binVals [][]byte
+    if cfg.Binary {
+        keyBytes = make([][]byte, cfg.NumKeys)
+        binVals = make([][]byte, cfg.NumKeys)
+        for i := range binVals {
+            keyBytes[i] = []byte(keys[i])
+            binVals[i] = make([]byte, cfg.ValueSize)
+            rand.Read(binVals[i])
+        }
+    }
 
     // 2. Concurrent writes
     startW := time.Now()
@@ -92,7 +109,13 @@ func RunBenchmark(cfg Config) (Result, error) {
         go func(c int) {
             defer wg.Done()
             for i := c; i < cfg.NumKeys; i += cfg.Concurrency {
-                if err := cfg.Store.Set(keys[i], val); err != nil {
+                var err error
+                if cfg.Binary {
+                    err = kv.SetBytes(cfg.Store, keyBytes[i], binVals[i])
+                } else {
+                    err = cfg.Store.Set(keys[i], val)
+                }
+                if err != nil {
                     panic(err) // you could collect errors instead
                 }
             }
@@ -115,7 +138,13 @@ func RunBenchmark(cfg Config) (Result, error) {
             defer wg.Done()
             for i := c; i < cfg.NumKeys; i += cfg.Concurrency {
                 t0 := time.Now()
-                if _, err := cfg.Store.Get(keys[i]); err != nil {
+                var err error
+                if cfg.Binary {
+                    _, err = kv.GetBytes(cfg.Store, keyBytes[i])
+                } else {
+                    _, err = cfg.Store.Get(keys[i])
+                }
+                if err != nil {
                     panic(err)
                 }
                 readLatencies[i] = time.Since(t0)
@@ -124,14 +153,31 @@ func RunBenchmark(cfg Config) (Result, error) {
     }
     wg.Wait()
 
-    return Result{
+    res := Result{
         StoreName:      cfg.StoreName,
         NumKeys:        cfg.NumKeys,
         Concurrency:    cfg.Concurrency,
         WriteOpsPerSec: writeOpsPerSec,
         ReadLatencies:  readLatencies,
         MemAllocBytes:  m.Alloc,
-    }, nil
+    }
+
+    // 5. Lookups for absent keys to measure Bloom filter effectiveness
+    if br, ok := cfg.Store.(bloomReporter); ok {
+        before := br.BloomStats()
+        for i := 0; i < cfg.NumKeys/10; i++ {
+            if _, err := cfg.Store.Get(fmt.Sprintf("absent-%d", i)); err != kv.ErrNotFound {
+                return res, fmt.Errorf("absent key lookup: %v", err)
+            }
+        }
+        after := br.BloomStats()
+        res.Bloom = &kv.BloomStats{
+            Checks:         after.Checks - before.Checks,
+            Negatives:      after.Negatives - before.Negatives,
+            FalsePositives: after.FalsePositives - before.FalsePositives,
+        }
+    }
+    return res, nil
 }
 
 // WriteResults writes bench results to a CSV at path.
@@ -148,7 +194,7 @@ func WriteResults(path string, results []Result) error {
     // header
     if err := w.Write([]string{
         "Store", "NumKeys", "Concurrency", "Writes/sec",
-        "AvgReadLatency(ms)", "MemAllocBytes",
+        "AvgReadLatency(ms)", "MemAllocBytes", "BloomFPRate",
     }); err != nil {
         return err
     }
@@ -160,6 +206,10 @@ func WriteResults(path string, results []Result) error {
             sum += d
         }
         avgMs := float64(sum.Milliseconds()) / float64(len(r.ReadLatencies))
+        fpRate := ""
+        if r.Bloom != nil {
+            fpRate = fmt.Sprintf("%.4f", r.Bloom.FalsePositiveRate())
+        }
 
         record := []string{
             r.StoreName,
@@ -168,6 +218,7 @@ func WriteResults(path string, results []Result) error {
             fmt.Sprintf("%.2f", r.WriteOpsPerSec),
             fmt.Sprintf("%.2f", avgMs),
             fmt.Sprintf("%d", r.MemAllocBytes),
+            fpRate,
         }
         if err := w.Write(record); err != nil {
             return err
@@ -0,0 +1,52 @@
+// Command kvhttp serves a FastKVst store over an HTTP/JSON API.
+package main
+
+import (
+    "context"
+    "flag"
+    "log"
+    "net/http"
+    "os"
+    "os/signal"
+    "syscall"
+    "time"
+
+    "github.com/thilakshekharshriyan/m/httpapi"
+    "github.com/thilakshekharshriyan/m/internal/backend"
+)
+
+func main() {
+    addr := flag.String("addr", ":8080", "listen address")
+    storeName := flag.String("store", "bptree", backend.Usage())
+    dir := flag.String("dir", "", "data directory for the hash and lsm stores; empty keeps data in memory")
+    maxValue := flag.Int64("maxvalue", 1<<20, "largest accepted value in bytes")
+    flag.Parse()
+
+    store, closeStore, err := backend.Open(*storeName, *dir)
+    if err != nil {
+        log.Fatal(err)
+    }
+    api := httpapi.NewServer(store, httpapi.Options{MaxValueBytes: *maxValue})
+    srv := &http.Server{
+        Addr:              *addr,
+        Handler:           api.Routes(),
+        ReadHeaderTimeout: 10 * time.Second,
+    }
+
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+    go func() {
+        <-sig
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        defer cancel()
+        srv.Shutdown(ctx)
+    }()
+
+    log.Printf("serving %s store over HTTP on %s", *storeName, *addr)
+    if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+        log.Fatal(err)
+    }
+    if err := closeStore(); err != nil {
+        log.Fatalf("closing store: %v", err)
+    }
+}
@@ -0,0 +1,50 @@
+// Command kvserver serves a FastKVst store over the Redis protocol.
+package main
+
+import (
+    "flag"
+    "log"
+    "os"
+    "os/signal"
+    "syscall"
+    "time"
+
+    "github.com/thilakshekharshriyan/m/internal/backend"
+    "github.com/thilakshekharshriyan/m/resp"
+)
+
+func main() {
+    addr := flag.String("addr", ":6379", "listen address")
+    storeName := flag.String("store", "hash", backend.Usage())
+    dir := flag.String("dir", "", "data directory for the hash and lsm stores; empty keeps data in memory")
+    maxConns := flag.Int("maxconns", 10000, "maximum concurrent client connections")
+    idle := flag.Duration("idle", 0, "close client connections idle this long (0 never)")
+    flag.Parse()
+
+    store, closeStore, err := backend.Open(*storeName, *dir)
+    if err != nil {
+        log.Fatal(err)
+    }
+    srv := resp.NewServer(store, resp.Options{
+        MaxConns:    *maxConns,
+        IdleTimeout: *idle,
+        Logger:      log.Default(),
+    })
+
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+    go func() {
+        <-sig
+        srv.Close()
+    }()
+
+    log.Printf("serving %s store on %s", *storeName, *addr)
+    start := time.Now()
+    if err := srv.ListenAndServe(*addr); err != resp.ErrServerClosed {
+        log.Fatal(err)
+    }
+    if err := closeStore(); err != nil {
+        log.Fatalf("closing store: %v", err)
+    }
+    log.Printf("shut down after %s", time.Since(start).Round(time.Second))
+}
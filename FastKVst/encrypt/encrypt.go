@@ -0,0 +1,242 @@
+// Package encrypt provides AES-256-GCM encryption for data at rest. Keys
+// are named by an ID, which callers store next to the data so it can be
+// decrypted after the current key has been rotated.
+package encrypt
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// KeySize is the length of an AES-256 key in bytes.
+const KeySize = 32
+
+// MaxIDLen bounds key IDs so they fit in small file headers.
+const MaxIDLen = 255
+
+var (
+    // ErrUnknownKey is returned for a key ID the provider does not hold.
+    ErrUnknownKey = errors.New("encrypt: unknown key id")
+    // ErrDecrypt is returned when a message fails authentication, i.e. it
+    // was corrupted or encrypted under a different key.
+    ErrDecrypt = errors.New("encrypt: message authentication failed")
+)
+
+// KeyProvider supplies encryption keys.
+type KeyProvider interface {
+    // CurrentKey returns the key new data should be encrypted with.
+    CurrentKey() (id string, key []byte, err error)
+    // Key returns the key with the given ID, or ErrUnknownKey.
+    Key(id string) ([]byte, error)
+}
+
+// Cipher seals and opens messages with one key. It is safe for concurrent
+// use.
+type Cipher struct {
+    id   string
+    aead cipher.AEAD
+}
+
+// NewCipher returns a Cipher for a KeySize-byte key.
+func NewCipher(id string, key []byte) (*Cipher, error) {
+    if len(id) > MaxIDLen {
+        return nil, fmt.Errorf("encrypt: key id longer than %d bytes", MaxIDLen)
+    }
+    if len(key) != KeySize {
+        return nil, fmt.Errorf("encrypt: key %q is %d bytes, want %d", id, len(key), KeySize)
+    }
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    aead, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, err
+    }
+    return &Cipher{id: id, aead: aead}, nil
+}
+
+// Current returns a Cipher for p's current key.
+func Current(p KeyProvider) (*Cipher, error) {
+    id, key, err := p.CurrentKey()
+    if err != nil {
+        return nil, err
+    }
+    return NewCipher(id, key)
+}
+
+// ForID returns a Cipher for the key p holds under id.
+func ForID(p KeyProvider, id string) (*Cipher, error) {
+    key, err := p.Key(id)
+    if err != nil {
+        return nil, err
+    }
+    return NewCipher(id, key)
+}
+
+// ID returns the ID of the Cipher's key.
+func (c *Cipher) ID() string {
+    return c.id
+}
+
+// Overhead is the number of bytes Seal adds to a message.
+func (c *Cipher) Overhead() int {
+    return c.aead.NonceSize() + c.aead.Overhead()
+}
+
+// Seal encrypts and authenticates plaintext and additional data ad, and
+// appends nonce||ciphertext to dst. ad is not encrypted, but Open fails
+// unless given the same ad, which binds a message to its context.
+func (c *Cipher) Seal(dst, plaintext, ad []byte) []byte {
+    nonce := make([]byte, c.aead.NonceSize())
+    if _, err := rand.Read(nonce); err != nil {
+        panic(err) // crypto/rand does not fail on supported platforms
+    }
+    dst = append(dst, nonce...)
+    return c.aead.Seal(dst, nonce, plaintext, ad)
+}
+
+// Open decrypts a message produced by Seal and appends the plaintext to dst.
+func (c *Cipher) Open(dst, sealed, ad []byte) ([]byte, error) {
+    n := c.aead.NonceSize()
+    if len(sealed) < n {
+        return nil, ErrDecrypt
+    }
+    out, err := c.aead.Open(dst, sealed[:n], sealed[n:], ad)
+    if err != nil {
+        return nil, ErrDecrypt
+    }
+    return out, nil
+}
+
+// FileKeyProvider keeps keys in a directory: one <id>.key file per key
+// holding it hex-encoded, and a CURRENT file naming the active key. IDs
+// are k1, k2, ... in creation order. It is meant for tests and single
+// machines; production keys belong in a KMS.
+type FileKeyProvider struct {
+    mu      sync.Mutex
+    dir     string
+    keys    map[string][]byte
+    current string
+    next    int // number of the next generated key
+}
+
+const (
+    currentFile = "CURRENT"
+    keySuffix   = ".key"
+)
+
+// OpenFileKeyProvider loads the keys in dir, creating the directory and a
+// first key if there are none.
+func OpenFileKeyProvider(dir string) (*FileKeyProvider, error) {
+    if err := os.MkdirAll(dir, 0o700); err != nil {
+        return nil, err
+    }
+    p := &FileKeyProvider{dir: dir, keys: make(map[string][]byte), next: 1}
+    ents, err := os.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    for _, e := range ents {
+        id, ok := strings.CutSuffix(e.Name(), keySuffix)
+        if !ok {
+            continue
+        }
+        data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+        if err != nil {
+            return nil, err
+        }
+        key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+        if err != nil || len(key) != KeySize {
+            return nil, fmt.Errorf("encrypt: bad key file %s", e.Name())
+        }
+        p.keys[id] = key
+        if n, err := strconv.Atoi(strings.TrimPrefix(id, "k")); err == nil && n >= p.next {
+            p.next = n + 1
+        }
+    }
+    cur, err := os.ReadFile(filepath.Join(dir, currentFile))
+    if errors.Is(err, os.ErrNotExist) {
+        if _, err := p.Rotate(); err != nil {
+            return nil, err
+        }
+        return p, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    p.current = strings.TrimSpace(string(cur))
+    if p.keys[p.current] == nil {
+        return nil, fmt.Errorf("%w: CURRENT names %q", ErrUnknownKey, p.current)
+    }
+    return p, nil
+}
+
+// CurrentKey returns the active key.
+func (p *FileKeyProvider) CurrentKey() (string, []byte, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.current, p.keys[p.current], nil
+}
+
+// Key returns the key with the given ID.
+func (p *FileKeyProvider) Key(id string) ([]byte, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    key, ok := p.keys[id]
+    if !ok {
+        return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+    }
+    return key, nil
+}
+
+// Rotate generates a new key and makes it current. Older keys are kept so
+// existing data stays readable until it has been rewritten.
+func (p *FileKeyProvider) Rotate() (string, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    key := make([]byte, KeySize)
+    if _, err := rand.Read(key); err != nil {
+        return "", err
+    }
+    id := "k" + strconv.Itoa(p.next)
+    if err := writeFileSync(filepath.Join(p.dir, id+keySuffix), []byte(hex.EncodeToString(key)+"\n")); err != nil {
+        return "", err
+    }
+    if err := writeFileSync(filepath.Join(p.dir, currentFile), []byte(id+"\n")); err != nil {
+        return "", err
+    }
+    p.keys[id], p.current = key, id
+    p.next++
+    return id, nil
+}
+
+// writeFileSync atomically replaces path with data.
+func writeFileSync(path string, data []byte) error {
+    tmp := path + ".tmp"
+    f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+    if err != nil {
+        return err
+    }
+    if _, err := f.Write(data); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
@@ -0,0 +1,65 @@
+package encrypt
+
+import (
+    "bytes"
+    "errors"
+    "testing"
+)
+
+func TestCipherSealOpen(t *testing.T) {
+    c, err := NewCipher("k", bytes.Repeat([]byte{7}, KeySize))
+    if err != nil {
+        t.Fatal(err)
+    }
+    msg := []byte("customer data")
+    sealed := c.Seal(nil, msg, []byte("ad"))
+    if len(sealed) != len(msg)+c.Overhead() || bytes.Contains(sealed, msg) {
+        t.Fatalf("sealed message is %d bytes or contains plaintext", len(sealed))
+    }
+    if out, err := c.Open(nil, sealed, []byte("ad")); err != nil || !bytes.Equal(out, msg) {
+        t.Fatalf("Open = %q, %v", out, err)
+    }
+    if _, err := c.Open(nil, sealed, []byte("other")); err != ErrDecrypt {
+        t.Fatalf("wrong ad: expected ErrDecrypt, got %v", err)
+    }
+    sealed[len(sealed)-1] ^= 1
+    if _, err := c.Open(nil, sealed, []byte("ad")); err != ErrDecrypt {
+        t.Fatalf("tampered: expected ErrDecrypt, got %v", err)
+    }
+    if _, err := NewCipher("k", []byte("short")); err == nil {
+        t.Fatal("expected error for short key")
+    }
+}
+
+func TestFileKeyProvider(t *testing.T) {
+    dir := t.TempDir()
+    p, err := OpenFileKeyProvider(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    id1, key1, _ := p.CurrentKey()
+    if id1 != "k1" || len(key1) != KeySize {
+        t.Fatalf("first key %q, %d bytes", id1, len(key1))
+    }
+    id2, err := p.Rotate()
+    if err != nil || id2 != "k2" {
+        t.Fatalf("Rotate = %q, %v", id2, err)
+    }
+
+    p, err = OpenFileKeyProvider(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if id, _, _ := p.CurrentKey(); id != "k2" {
+        t.Fatalf("current after reopen = %q", id)
+    }
+    if k, err := p.Key("k1"); err != nil || !bytes.Equal(k, key1) {
+        t.Fatalf("old key not kept: %v", err)
+    }
+    if _, err := p.Key("k9"); !errors.Is(err, ErrUnknownKey) {
+        t.Fatalf("expected ErrUnknownKey, got %v", err)
+    }
+    if id, _ := p.Rotate(); id != "k3" {
+        t.Fatalf("third key %q", id)
+    }
+}
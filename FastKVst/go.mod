@@ -2,4 +2,7 @@ module github.com/thilakshekharshriyan/m
 
 go 1.24.5
 
-require github.com/google/btree v1.1.3
+require (
+	github.com/google/btree v1.1.3
+	github.com/gorilla/mux v1.8.1
+)
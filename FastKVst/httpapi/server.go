@@ -0,0 +1,196 @@
+// Package httpapi serves a kv.KVStore over HTTP:
+//
+//   GET    /kv/{key}            value as the raw response body
+//   PUT    /kv/{key}[?ttl=30s]  raw request body as the value
+//   DELETE /kv/{key}
+//   GET    /kv?start=&end=      {"keys": [...]} in [start, end)
+//   POST   /flush
+//
+// Errors are JSON bodies {"error": "..."}. ErrNotFound maps to 404 and
+// ErrUnsupported to 501.
+package httpapi
+
+import (
+    "encoding/json"
+    "errors"
+    "io"
+    "log"
+    "net/http"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/thilakshekharshriyan/m/kv"
+)
+
+// Options configures a Server. Zero values select the defaults.
+type Options struct {
+    MaxKeyBytes   int   // longest accepted key (default 4 KiB)
+    MaxValueBytes int64 // largest accepted PUT body (default 1 MiB)
+}
+
+func (o *Options) setDefaults() {
+    if o.MaxKeyBytes <= 0 {
+        o.MaxKeyBytes = 4 << 10
+    }
+    if o.MaxValueBytes <= 0 {
+        o.MaxValueBytes = 1 << 20
+    }
+}
+
+// Server wraps a store with HTTP handlers.
+type Server struct {
+    Store kv.KVStore
+    opts  Options
+}
+
+// NewServer returns a Server for store.
+func NewServer(store kv.KVStore, opts Options) *Server {
+    opts.setDefaults()
+    return &Server{Store: store, opts: opts}
+}
+
+// Routes returns the API's handler.
+func (s *Server) Routes() http.Handler {
+    r := mux.NewRouter()
+    // Keys may contain slashes or dots; do not let the router rewrite them.
+    r.SkipClean(true)
+    r.HandleFunc("/kv", s.RangeHandler).Methods("GET")
+    r.HandleFunc("/kv/{key:.+}", s.GetHandler).Methods("GET")
+    r.HandleFunc("/kv/{key:.+}", s.PutHandler).Methods("PUT")
+    r.HandleFunc("/kv/{key:.+}", s.DeleteHandler).Methods("DELETE")
+    r.HandleFunc("/flush", s.FlushHandler).Methods("POST")
+    r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        writeError(w, http.StatusNotFound, "no such endpoint")
+    })
+    r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+    })
+    return r
+}
+
+// key returns the {key} path variable, replying 400 if it is too long.
+func (s *Server) key(w http.ResponseWriter, r *http.Request) (string, bool) {
+    key := mux.Vars(r)["key"]
+    if len(key) > s.opts.MaxKeyBytes {
+        writeError(w, http.StatusBadRequest, "key too long")
+        return "", false
+    }
+    return key, true
+}
+
+// GetHandler replies with the value of /kv/{key}.
+func (s *Server) GetHandler(w http.ResponseWriter, r *http.Request) {
+    key, ok := s.key(w, r)
+    if !ok {
+        return
+    }
+    v, err := s.Store.Get(key)
+    if err != nil {
+        writeStoreError(w, err)
+        return
+    }
+    w.Header().Set("Content-Type", "application/octet-stream")
+    io.WriteString(w, v)
+}
+
+// PutHandler stores the request body under /kv/{key}, with a TTL if the
+// ttl query parameter (a Go duration such as 30s) is set.
+func (s *Server) PutHandler(w http.ResponseWriter, r *http.Request) {
+    key, ok := s.key(w, r)
+    if !ok {
+        return
+    }
+    var ttl time.Duration
+    if q := r.URL.Query().Get("ttl"); q != "" {
+        var err error
+        if ttl, err = time.ParseDuration(q); err != nil || ttl <= 0 {
+            writeError(w, http.StatusBadRequest, "invalid ttl")
+            return
+        }
+    }
+    body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.opts.MaxValueBytes))
+    if err != nil {
+        var tooBig *http.MaxBytesError
+        if errors.As(err, &tooBig) {
+            writeError(w, http.StatusRequestEntityTooLarge, "value too large")
+            return
+        }
+        writeError(w, http.StatusBadRequest, "invalid request")
+        return
+    }
+    if ttl > 0 {
+        err = kv.SetWithTTL(s.Store, key, string(body), ttl)
+    } else {
+        err = s.Store.Set(key, string(body))
+    }
+    if err != nil {
+        writeStoreError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteHandler removes /kv/{key}.
+func (s *Server) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+    key, ok := s.key(w, r)
+    if !ok {
+        return
+    }
+    if err := s.Store.Delete(key); err != nil {
+        writeStoreError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// RangeHandler replies with the keys in [start, end); end is required.
+func (s *Server) RangeHandler(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    if q.Get("end") == "" {
+        writeError(w, http.StatusBadRequest, "missing end")
+        return
+    }
+    keys, err := s.Store.Range(q.Get("start"), q.Get("end"))
+    if err != nil {
+        writeStoreError(w, err)
+        return
+    }
+    if keys == nil {
+        keys = []string{}
+    }
+    writeJSON(w, http.StatusOK, map[string][]string{"keys": keys})
+}
+
+// FlushHandler flushes the store.
+func (s *Server) FlushHandler(w http.ResponseWriter, r *http.Request) {
+    if err := s.Store.Flush(); err != nil {
+        writeStoreError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// writeStoreError maps a store error to a status code.
+func writeStoreError(w http.ResponseWriter, err error) {
+    switch {
+    case errors.Is(err, kv.ErrNotFound):
+        writeError(w, http.StatusNotFound, err.Error())
+    case errors.Is(err, kv.ErrUnsupported):
+        writeError(w, http.StatusNotImplemented, err.Error())
+    case errors.Is(err, kv.ErrInvalidTTL):
+        writeError(w, http.StatusBadRequest, err.Error())
+    default:
+        log.Printf("httpapi: store error: %v", err)
+        writeError(w, http.StatusInternalServerError, err.Error())
+    }
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+    writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
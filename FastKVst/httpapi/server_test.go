@@ -0,0 +1,66 @@
+package httpapi
+
+import (
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/thilakshekharshriyan/m/kv"
+)
+
+// do sends a request and returns the status and body.
+func do(t *testing.T, h http.Handler, method, url, body string) (int, string) {
+    req := httptest.NewRequest(method, url, strings.NewReader(body))
+    rec := httptest.NewRecorder()
+    h.ServeHTTP(rec, req)
+    data, _ := io.ReadAll(rec.Result().Body)
+    return rec.Code, string(data)
+}
+
+func TestAPI(t *testing.T) {
+    h := NewServer(kv.NewBTreeStore(), Options{MaxValueBytes: 16}).Routes()
+    for _, tc := range []struct {
+        method, url, body string
+        status            int
+        want              string
+    }{
+        {"GET", "/kv/a", "", 404, `{"error":"key not found"}`},
+        {"PUT", "/kv/a", "1", 204, ""},
+        {"PUT", "/kv/dir/b.txt", "2", 204, ""},
+        {"PUT", "/kv/c", "value far too large", 413, `{"error":"value too large"}`},
+        {"PUT", "/kv/t?ttl=soon", "x", 400, `{"error":"invalid ttl"}`},
+        {"PUT", "/kv/t?ttl=1h", "x", 204, ""},
+        {"GET", "/kv/a", "", 200, "1"},
+        {"GET", "/kv/dir/b.txt", "", 200, "2"},
+        {"GET", "/kv?start=a&end=e", "", 200, `{"keys":["a","dir/b.txt"]}`},
+        {"GET", "/kv?start=x&end=y", "", 200, `{"keys":[]}`},
+        {"GET", "/kv", "", 400, `{"error":"missing end"}`},
+        {"DELETE", "/kv/a", "", 204, ""},
+        {"GET", "/kv/a", "", 404, `{"error":"key not found"}`},
+        {"POST", "/flush", "", 204, ""},
+        {"POST", "/kv/a", "", 405, `{"error":"method not allowed"}`},
+        {"GET", "/nope", "", 404, `{"error":"no such endpoint"}`},
+    } {
+        status, body := do(t, h, tc.method, tc.url, tc.body)
+        if status != tc.status || strings.TrimSpace(body) != tc.want {
+            t.Fatalf("%s %s: got %d %q, want %d %q", tc.method, tc.url, status, body, tc.status, tc.want)
+        }
+    }
+}
+
+func TestUnsupported(t *testing.T) {
+    h := NewServer(kv.NewHashStore(), Options{}).Routes()
+    status, body := do(t, h, "GET", "/kv?start=a&end=b", "")
+    var e struct{ Error string }
+    if status != http.StatusNotImplemented || json.Unmarshal([]byte(body), &e) != nil || e.Error != kv.ErrUnsupported.Error() {
+        t.Fatalf("got %d %q", status, body)
+    }
+
+    h = NewServer(kv.NewHashStore(), Options{MaxKeyBytes: 4}).Routes()
+    if status, _ := do(t, h, "PUT", "/kv/longkey", "v"); status != http.StatusBadRequest {
+        t.Fatalf("long key: got %d", status)
+    }
+}
@@ -0,0 +1,63 @@
+// Package backend opens a kv store chosen by name, for the commands that
+// serve one.
+package backend
+
+import (
+    "fmt"
+    "path/filepath"
+    "strings"
+
+    "github.com/thilakshekharshriyan/m/kv"
+)
+
+// Names lists the backends Open accepts.
+var Names = []string{"hash", "sharded", "bptree", "lsm", "skiplist", "trie"}
+
+// Usage describes the choices, for flag help text.
+func Usage() string {
+    return "store backend: " + strings.Join(Names, ", ")
+}
+
+// Open returns the named store and a function that flushes and closes it.
+// With a dir, the hash store is dumped to dir/hash.dump on close and the
+// lsm store keeps its tables in dir; the other backends are in-memory
+// only.
+func Open(name, dir string) (kv.KVStore, func() error, error) {
+    switch name {
+    case "hash":
+        if dir == "" {
+            return kv.NewHashStore(), nop, nil
+        }
+        h, err := kv.OpenHashStore(filepath.Join(dir, "hash.dump"))
+        if err != nil {
+            return nil, nil, err
+        }
+        return h, h.Flush, nil
+    case "sharded":
+        return kv.NewShardedHashStore(0), nop, nil
+    case "bptree":
+        return kv.NewBTreeStore(), nop, nil
+    case "lsm":
+        if dir == "" {
+            return kv.NewLSMStore(), nop, nil
+        }
+        l, err := kv.OpenLSMStore(dir)
+        if err != nil {
+            return nil, nil, err
+        }
+        return l, func() error {
+            if err := l.Flush(); err != nil {
+                l.Close()
+                return err
+            }
+            return l.Close()
+        }, nil
+    case "skiplist":
+        return kv.NewSkipListStore(), nop, nil
+    case "trie":
+        return kv.NewTrieStore(), nop, nil
+    }
+    return nil, nil, fmt.Errorf("unknown store %q (want one of %s)", name, strings.Join(Names, ", "))
+}
+
+func nop() error { return nil }
@@ -0,0 +1,24 @@
+// Package wire holds the length-prefixed string encoding shared by the
+// replication packages' log and frame formats.
+package wire
+
+import "encoding/binary"
+
+// AppendStrings appends each string with a uvarint length prefix.
+func AppendStrings(buf []byte, ss ...string) []byte {
+    for _, s := range ss {
+        buf = binary.AppendUvarint(buf, uint64(len(s)))
+        buf = append(buf, s...)
+    }
+    return buf
+}
+
+// ReadString decodes a uvarint length-prefixed string from the front of
+// buf and returns it with the rest of buf.
+func ReadString(buf []byte) (string, []byte, bool) {
+    n, k := binary.Uvarint(buf)
+    if k <= 0 || n > uint64(len(buf)-k) {
+        return "", buf, false
+    }
+    return string(buf[k : k+int(n)]), buf[k+int(n):], true
+}
@@ -0,0 +1,21 @@
+package wire
+
+import "testing"
+
+func TestStrings(t *testing.T) {
+    buf := AppendStrings([]byte{0xff}, "", "key", "bin\x00")
+    rest := buf[1:]
+    for _, want := range []string{"", "key", "bin\x00"} {
+        var got string
+        var ok bool
+        if got, rest, ok = ReadString(rest); !ok || got != want {
+            t.Fatalf("ReadString = %q, %v; want %q", got, ok, want)
+        }
+    }
+    if len(rest) != 0 {
+        t.Fatalf("%d bytes left over", len(rest))
+    }
+    if _, _, ok := ReadString([]byte{5, 'a'}); ok {
+        t.Fatal("short string decoded")
+    }
+}
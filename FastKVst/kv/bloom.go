@@ -0,0 +1,115 @@
+package kv
+
+import (
+    "encoding/binary"
+    "math"
+    "sync/atomic"
+)
+
+const defaultBloomBitsPerKey = 10
+
+// bloomFilter is a fixed-size Bloom filter using double hashing
+// (Kirsch-Mitzenmacher) over a 64-bit FNV-1a hash.
+type bloomFilter struct {
+    bits []uint64
+    k    uint32 // number of probes
+}
+
+// newBloomFilter builds a filter over the given key hashes.
+func newBloomFilter(hashes []uint64, bitsPerKey int) *bloomFilter {
+    nbits := len(hashes) * bitsPerKey
+    if nbits < 64 {
+        nbits = 64
+    }
+    k := uint32(math.Round(float64(bitsPerKey) * math.Ln2))
+    if k < 1 {
+        k = 1
+    }
+    if k > 30 {
+        k = 30
+    }
+    b := &bloomFilter{bits: make([]uint64, (nbits+63)/64), k: k}
+    for _, h := range hashes {
+        b.addHash(h)
+    }
+    return b
+}
+
+// bloomHash is FNV-1a followed by a 64-bit finalizer so both halves used
+// for double hashing are well mixed.
+func bloomHash(key string) uint64 {
+    h := uint64(14695981039346656037)
+    for i := 0; i < len(key); i++ {
+        h ^= uint64(key[i])
+        h *= 1099511628211
+    }
+    h ^= h >> 33
+    h *= 0xff51afd7ed558ccd
+    h ^= h >> 33
+    return h
+}
+
+func (b *bloomFilter) addHash(h uint64) {
+    n := uint64(len(b.bits) * 64)
+    h1, h2 := h, h>>33|h<<31
+    for i := uint32(0); i < b.k; i++ {
+        bit := (h1 + uint64(i)*h2) % n
+        b.bits[bit/64] |= 1 << (bit % 64)
+    }
+}
+
+// mayContain reports false only if key was definitely never added.
+func (b *bloomFilter) mayContain(key string) bool {
+    h := bloomHash(key)
+    n := uint64(len(b.bits) * 64)
+    h1, h2 := h, h>>33|h<<31
+    for i := uint32(0); i < b.k; i++ {
+        bit := (h1 + uint64(i)*h2) % n
+        if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+            return false
+        }
+    }
+    return true
+}
+
+// encode serializes the filter as k u32 followed by the bit words.
+func (b *bloomFilter) encode() []byte {
+    buf := make([]byte, 4+8*len(b.bits))
+    binary.LittleEndian.PutUint32(buf, b.k)
+    for i, w := range b.bits {
+        binary.LittleEndian.PutUint64(buf[4+8*i:], w)
+    }
+    return buf
+}
+
+func decodeBloomFilter(buf []byte) (*bloomFilter, bool) {
+    if len(buf) < 4 || (len(buf)-4)%8 != 0 || len(buf) == 4 {
+        return nil, false
+    }
+    b := &bloomFilter{k: binary.LittleEndian.Uint32(buf), bits: make([]uint64, (len(buf)-4)/8)}
+    for i := range b.bits {
+        b.bits[i] = binary.LittleEndian.Uint64(buf[4+8*i:])
+    }
+    return b, true
+}
+
+// BloomStats counts how point lookups interacted with run Bloom filters.
+type BloomStats struct {
+    Checks         uint64 // runs whose filter was consulted
+    Negatives      uint64 // runs skipped because the filter ruled the key out
+    FalsePositives uint64 // runs the filter let through that lacked the key
+}
+
+// FalsePositiveRate is the fraction of lookups for absent keys that the
+// filters failed to reject.
+func (s BloomStats) FalsePositiveRate() float64 {
+    absent := s.Negatives + s.FalsePositives
+    if absent == 0 {
+        return 0
+    }
+    return float64(s.FalsePositives) / float64(absent)
+}
+
+type bloomCounters struct {
+    checks, negatives, falsePositives atomic.Uint64
+}
@@ -0,0 +1,286 @@
+package kv
+
+import (
+    "container/list"
+    "hash/maphash"
+)
+
+// cacheEntry is one cached key. Policies keep their own bookkeeping in it.
+type cacheEntry struct {
+    key, value string
+    cost       int64
+    expires    int64         // deadline of the backing key, Unix nanoseconds; 0 for none
+    elem       *list.Element // position in the policy's list for the entry
+    freq       int           // access count (LFU)
+    seg        cacheSegment  // segment holding the entry (W-TinyLFU)
+}
+
+// cachePolicy decides which entry a CacheStore evicts. Methods are called
+// with the store's lock held.
+type cachePolicy interface {
+    // access records a lookup of key, whether or not it is cached.
+    access(key string)
+    // insert starts tracking a new entry.
+    insert(e *cacheEntry)
+    // touch records a hit on a tracked entry.
+    touch(e *cacheEntry)
+    // remove stops tracking e.
+    remove(e *cacheEntry)
+    // victim returns the entry to evict to make room for a new one. It
+    // stays tracked until removed.
+    victim() *cacheEntry
+}
+
+func newCachePolicy(opts CacheOptions) cachePolicy {
+    switch opts.Policy {
+    case LFU:
+        return newLFUPolicy()
+    case TinyLFU:
+        return newTinyLFUPolicy(opts)
+    }
+    return &lruPolicy{l: list.New()}
+}
+
+// lruPolicy evicts the least recently used entry.
+type lruPolicy struct {
+    l *list.List // most recent at the front
+}
+
+func (p *lruPolicy) access(string) {}
+
+func (p *lruPolicy) insert(e *cacheEntry) {
+    e.elem = p.l.PushFront(e)
+}
+
+func (p *lruPolicy) touch(e *cacheEntry) {
+    p.l.MoveToFront(e.elem)
+}
+
+func (p *lruPolicy) remove(e *cacheEntry) {
+    p.l.Remove(e.elem)
+}
+
+func (p *lruPolicy) victim() *cacheEntry {
+    if b := p.l.Back(); b != nil {
+        return b.Value.(*cacheEntry)
+    }
+    return nil
+}
+
+// lfuPolicy evicts the least frequently used entry, breaking ties by
+// recency. Entries are bucketed by access count so every operation is O(1)
+// except finding a new minimum after a removal.
+type lfuPolicy struct {
+    buckets map[int]*list.List // freq -> entries, most recent at the front
+    minFreq int
+}
+
+func newLFUPolicy() *lfuPolicy {
+    return &lfuPolicy{buckets: make(map[int]*list.List)}
+}
+
+func (p *lfuPolicy) access(string) {}
+
+func (p *lfuPolicy) push(e *cacheEntry) {
+    b := p.buckets[e.freq]
+    if b == nil {
+        b = list.New()
+        p.buckets[e.freq] = b
+    }
+    e.elem = b.PushFront(e)
+}
+
+// unlink removes e from its bucket, dropping the bucket if it empties.
+func (p *lfuPolicy) unlink(e *cacheEntry) {
+    b := p.buckets[e.freq]
+    b.Remove(e.elem)
+    if b.Len() == 0 {
+        delete(p.buckets, e.freq)
+    }
+}
+
+func (p *lfuPolicy) insert(e *cacheEntry) {
+    e.freq = 1
+    p.push(e)
+    p.minFreq = 1
+}
+
+func (p *lfuPolicy) touch(e *cacheEntry) {
+    p.unlink(e)
+    if e.freq == p.minFreq && p.buckets[e.freq] == nil {
+        p.minFreq++
+    }
+    e.freq++
+    p.push(e)
+}
+
+func (p *lfuPolicy) remove(e *cacheEntry) {
+    p.unlink(e)
+}
+
+func (p *lfuPolicy) victim() *cacheEntry {
+    if len(p.buckets) == 0 {
+        return nil
+    }
+    if p.buckets[p.minFreq] == nil {
+        first := true
+        for f := range p.buckets {
+            if first || f < p.minFreq {
+                p.minFreq, first = f, false
+            }
+        }
+    }
+    return p.buckets[p.minFreq].Back().Value.(*cacheEntry)
+}
+
+// cacheSegment is the area of a W-TinyLFU cache holding an entry.
+type cacheSegment uint8
+
+const (
+    segWindow cacheSegment = iota
+    segProbation
+    segProtected
+)
+
+// tinyLFUPolicy implements W-TinyLFU. New entries enter a small LRU window
+// (1% of the budget) and overflow from it into the probation segment of a
+// segmented LRU; entries hit there move to the protected segment (80% of
+// the budget). When space is needed the newest probation entry competes
+// with the oldest, and whichever a frequency sketch says is used less is
+// evicted, so one-off keys cannot flush out popular ones.
+type tinyLFUPolicy struct {
+    segs         [3]*list.List // by cacheSegment, most recent at the front
+    cost         [3]int64
+    windowMax    int64
+    protectedMax int64
+    sketch       *cmSketch
+}
+
+func newTinyLFUPolicy(opts CacheOptions) *tinyLFUPolicy {
+    budget := opts.budget()
+    p := &tinyLFUPolicy{
+        windowMax:    max(1, budget/100),
+        protectedMax: max(1, budget*80/100),
+        sketch:       newCMSketch(opts.expectedEntries()),
+    }
+    for i := range p.segs {
+        p.segs[i] = list.New()
+    }
+    return p
+}
+
+func (p *tinyLFUPolicy) access(key string) {
+    p.sketch.add(key)
+}
+
+func (p *tinyLFUPolicy) place(e *cacheEntry, seg cacheSegment) {
+    e.seg = seg
+    e.elem = p.segs[seg].PushFront(e)
+    p.cost[seg] += e.cost
+}
+
+func (p *tinyLFUPolicy) insert(e *cacheEntry) {
+    p.place(e, segWindow)
+    for p.cost[segWindow] > p.windowMax && p.segs[segWindow].Len() > 1 {
+        old := p.segs[segWindow].Back().Value.(*cacheEntry)
+        p.remove(old)
+        p.place(old, segProbation)
+    }
+}
+
+func (p *tinyLFUPolicy) touch(e *cacheEntry) {
+    switch e.seg {
+    case segWindow, segProtected:
+        p.segs[e.seg].MoveToFront(e.elem)
+    case segProbation:
+        p.remove(e)
+        p.place(e, segProtected)
+        // Demote the oldest protected entries back to probation.
+        for p.cost[segProtected] > p.protectedMax && p.segs[segProtected].Len() > 1 {
+            old := p.segs[segProtected].Back().Value.(*cacheEntry)
+            p.remove(old)
+            p.place(old, segProbation)
+        }
+    }
+}
+
+func (p *tinyLFUPolicy) remove(e *cacheEntry) {
+    p.segs[e.seg].Remove(e.elem)
+    p.cost[e.seg] -= e.cost
+}
+
+func (p *tinyLFUPolicy) victim() *cacheEntry {
+    probation := p.segs[segProbation]
+    if probation.Len() >= 2 {
+        candidate := probation.Front().Value.(*cacheEntry)
+        oldest := probation.Back().Value.(*cacheEntry)
+        if p.sketch.estimate(candidate.key) > p.sketch.estimate(oldest.key) {
+            return oldest
+        }
+        return candidate
+    }
+    for _, seg := range []cacheSegment{segProbation, segProtected, segWindow} {
+        if b := p.segs[seg].Back(); b != nil {
+            return b.Value.(*cacheEntry)
+        }
+    }
+    return nil
+}
+
+// cmSketch is a count-min sketch of 4-bit counters estimating how often
+// keys were accessed. All counters are halved every resetAt additions so
+// the estimates favour recent popularity.
+type cmSketch struct {
+    seed    maphash.Seed
+    rows    [4][]uint8
+    mask    uint64
+    adds    int
+    resetAt int
+}
+
+func newCMSketch(entries int) *cmSketch {
+    width := 64
+    for width < entries && width < 1<<24 {
+        width <<= 1
+    }
+    s := &cmSketch{seed: maphash.MakeSeed(), mask: uint64(width - 1), resetAt: 10 * width}
+    for i := range s.rows {
+        s.rows[i] = make([]uint8, width)
+    }
+    return s
+}
+
+// slots returns the counter index of key in each row.
+func (s *cmSketch) slots(key string) [4]uint64 {
+    h := maphash.String(s.seed, key)
+    lo, hi := h, h>>32|h<<32
+    var out [4]uint64
+    for i := range out {
+        out[i] = (lo + uint64(i)*hi) & s.mask
+    }
+    return out
+}
+
+func (s *cmSketch) add(key string) {
+    for i, j := range s.slots(key) {
+        if s.rows[i][j] < 15 {
+            s.rows[i][j]++
+        }
+    }
+    if s.adds++; s.adds >= s.resetAt {
+        s.adds = 0
+        for _, row := range s.rows {
+            for j := range row {
+                row[j] >>= 1
+            }
+        }
+    }
+}
+
+func (s *cmSketch) estimate(key string) uint8 {
+    est := uint8(15)
+    for i, j := range s.slots(key) {
+        est = min(est, s.rows[i][j])
+    }
+    return est
+}
@@ -0,0 +1,70 @@
+package kv
+
+import (
+    "bytes"
+    "compress/flate"
+    "fmt"
+    "io"
+    "sync"
+)
+
+// ErrBadCompression is returned when a compressed value or block cannot
+// be decoded. It wraps ErrCorrupted.
+var ErrBadCompression = fmt.Errorf("kv: malformed compressed data: %w", ErrCorrupted)
+
+// Compression selects the codec for compressed values and SSTable blocks.
+// Its numeric value is written to disk, so existing values must not change.
+type Compression uint8
+
+const (
+    NoCompression    Compression = 0
+    FlateCompression Compression = 1 // compress/flate (DEFLATE)
+)
+
+// flateWriters pools writers by level (flate.HuffmanOnly..BestCompression),
+// since each one allocates sizeable tables.
+var flateWriters [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+// compress encodes src with c at the given flate level and appends the
+// result to dst. It reports false, leaving dst unchanged, if c is
+// NoCompression or the result would not be smaller than src.
+func compress(dst, src []byte, c Compression, level int) ([]byte, bool) {
+    if c != FlateCompression || len(src) == 0 {
+        return dst, false
+    }
+    if level < flate.HuffmanOnly || level > flate.BestCompression {
+        level = flate.DefaultCompression
+    }
+    buf := bytes.NewBuffer(dst)
+    pool := &flateWriters[level-flate.HuffmanOnly]
+    fw, _ := pool.Get().(*flate.Writer)
+    if fw == nil {
+        fw, _ = flate.NewWriter(buf, level)
+    } else {
+        fw.Reset(buf)
+    }
+    fw.Write(src)
+    fw.Close()
+    pool.Put(fw)
+    if buf.Len()-len(dst) >= len(src) {
+        return dst, false
+    }
+    return buf.Bytes(), true
+}
+
+// decompress decodes src, which was encoded with c.
+func decompress(src []byte, c Compression) ([]byte, error) {
+    switch c {
+    case NoCompression:
+        return src, nil
+    case FlateCompression:
+        fr := flate.NewReader(bytes.NewReader(src))
+        defer fr.Close()
+        out, err := io.ReadAll(fr)
+        if err != nil {
+            return nil, ErrBadCompression
+        }
+        return out, nil
+    }
+    return nil, ErrBadCompression
+}
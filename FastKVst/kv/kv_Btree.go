@@ -3,11 +3,14 @@ package kv
 import (
     "github.com/google/btree"
     "sync"
+    "sync/atomic"
+    "time"
 )
 
 // btreeItem wraps a key-value pair for the B-tree.
 type btreeItem struct {
     key, value string
+    expires    int64 // Unix nanoseconds; 0 for no expiry
 }
 
 func (a btreeItem) Less(b btree.Item) bool {
@@ -18,6 +21,7 @@ func (a btreeItem) Less(b btree.Item) bool {
 type BTreeStore struct {
     mu   sync.RWMutex
     tree *btree.BTree
+    ttl  ttlIndex // keys with an expiry, for the sweeper
 }
 
 // NewBTreeStore constructs a ready-to-use BTreeStore.
@@ -30,43 +34,316 @@ func NewBTreeStore() *BTreeStore {
 func (b *BTreeStore) Set(key, value string) error {
     b.mu.Lock()
     defer b.mu.Unlock()
-    b.tree.ReplaceOrInsert(&btreeItem{key, value})
+    b.tree.ReplaceOrInsert(&btreeItem{key: key, value: value})
+    b.ttl.set(key, 0)
     return nil
 }
 
+// SetWithTTL inserts or updates a key that expires after ttl.
+func (b *BTreeStore) SetWithTTL(key, value string, ttl time.Duration) error {
+    if ttl <= 0 {
+        return ErrInvalidTTL
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    d := deadline(ttl)
+    b.tree.ReplaceOrInsert(&btreeItem{key: key, value: value, expires: d})
+    b.ttl.set(key, d)
+    return nil
+}
+
+// Get retrieves a key, or ErrNotFound. An expired key is removed.
 func (b *BTreeStore) Get(key string) (string, error) {
     b.mu.RLock()
-    defer b.mu.RUnlock()
     item := b.tree.Get(&btreeItem{key: key})
+    b.mu.RUnlock()
     if item == nil {
         return "", ErrNotFound
     }
-    return item.(*btreeItem).value, nil
+    it := item.(*btreeItem)
+    if expiredAt(it.expires, clock().UnixNano()) {
+        b.expire(key)
+        return "", ErrNotFound
+    }
+    return it.value, nil
+}
+
+// TTL returns the time left before key expires.
+func (b *BTreeStore) TTL(key string) (time.Duration, error) {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    now := clock().UnixNano()
+    item := b.tree.Get(&btreeItem{key: key})
+    if item == nil || expiredAt(item.(*btreeItem).expires, now) {
+        return 0, ErrNotFound
+    }
+    return remaining(item.(*btreeItem).expires, now), nil
+}
+
+// ExpiredKeys returns how many keys have expired so far.
+func (b *BTreeStore) ExpiredKeys() uint64 {
+    return b.ttl.expired.Load()
+}
+
+// Expire sets key to expire after ttl, or deletes it if ttl is not
+// positive, and reports whether key existed.
+func (b *BTreeStore) Expire(key string, ttl time.Duration) (bool, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.expireLocked(key, clock().UnixNano()) {
+        return false, nil
+    }
+    item := b.tree.Get(&btreeItem{key: key})
+    if item == nil {
+        return false, nil
+    }
+    if ttl <= 0 {
+        b.tree.Delete(item)
+        b.ttl.set(key, 0)
+        return true, nil
+    }
+    // Replace rather than update the item, which snapshots may share.
+    d := deadline(ttl)
+    b.tree.ReplaceOrInsert(&btreeItem{key: key, value: item.(*btreeItem).value, expires: d})
+    b.ttl.set(key, d)
+    return true, nil
+}
+
+// expire removes key if it is still expired once the write lock is held.
+func (b *BTreeStore) expire(key string) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.expireLocked(key, clock().UnixNano())
+}
+
+func (b *BTreeStore) expireLocked(key string, now int64) bool {
+    item := b.tree.Get(&btreeItem{key: key})
+    if item == nil || !expiredAt(item.(*btreeItem).expires, now) {
+        return false
+    }
+    b.tree.Delete(item)
+    b.ttl.set(key, 0)
+    b.ttl.expired.Add(1)
+    return true
+}
+
+// StartSweeper removes expired keys in the background, examining at most
+// batch keys with a TTL per lock acquisition, every interval. Call the
+// returned function to stop it.
+func (b *BTreeStore) StartSweeper(interval time.Duration, batch int) (stop func()) {
+    return startSweeper(interval, batch, func(limit int) int {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+        return b.ttl.sweep(limit, clock().UnixNano(), func(key string) {
+            b.tree.Delete(&btreeItem{key: key})
+        })
+    })
 }
 
 func (b *BTreeStore) Delete(key string) error {
     b.mu.Lock()
     defer b.mu.Unlock()
+    if b.expireLocked(key, clock().UnixNano()) {
+        return ErrNotFound
+    }
     item := b.tree.Delete(&btreeItem{key: key})
     if item == nil {
         return ErrNotFound
     }
+    b.ttl.set(key, 0)
     return nil
 }
 
-// Range returns all keys in [start, end).
+// Write applies every operation in b under a single lock.
+func (b *BTreeStore) Write(batch *WriteBatch) error {
+    if err := batch.check(true); err != nil {
+        return err
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    for _, op := range batch.ops {
+        switch {
+        case op.delete:
+            b.tree.Delete(&btreeItem{key: op.key})
+            b.ttl.set(op.key, 0)
+        case op.withTTL:
+            d := deadline(op.ttl)
+            b.tree.ReplaceOrInsert(&btreeItem{key: op.key, value: op.value, expires: d})
+            b.ttl.set(op.key, d)
+        default:
+            b.tree.ReplaceOrInsert(&btreeItem{key: op.key, value: op.value})
+            b.ttl.set(op.key, 0)
+        }
+    }
+    return nil
+}
+
+// CompareAndSwap sets key to new if its current value is old.
+func (b *BTreeStore) CompareAndSwap(key, old, new string) (bool, error) {
+    return b.conditional(condSwap, key, old, new, 0)
+}
+
+// SetIfAbsent sets key to value if key does not exist.
+func (b *BTreeStore) SetIfAbsent(key, value string) (bool, error) {
+    return b.conditional(condIfAbsent, key, "", value, 0)
+}
+
+// DeleteIfValue deletes key if its current value is value.
+func (b *BTreeStore) DeleteIfValue(key, value string) (bool, error) {
+    return b.conditional(condDeleteIf, key, value, "", 0)
+}
+
+// SetIfAbsentWithTTL sets key to value, expiring after ttl, if key does
+// not exist.
+func (b *BTreeStore) SetIfAbsentWithTTL(key, value string, ttl time.Duration) (bool, error) {
+    if ttl <= 0 {
+        return false, ErrInvalidTTL
+    }
+    return b.conditional(condIfAbsent, key, "", value, deadline(ttl))
+}
+
+// conditional applies op under the write lock; a written value expires
+// at deadline d, or never if d is 0.
+func (b *BTreeStore) conditional(op condOp, key, want, value string, d int64) (bool, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.expireLocked(key, clock().UnixNano())
+    var cur string
+    item := b.tree.Get(&btreeItem{key: key})
+    if item != nil {
+        cur = item.(*btreeItem).value
+    }
+    if !op.holds(cur, item != nil, want) {
+        return false, nil
+    }
+    if op == condDeleteIf {
+        b.tree.Delete(item)
+    } else {
+        b.tree.ReplaceOrInsert(&btreeItem{key: key, value: value, expires: d})
+    }
+    b.ttl.set(key, d)
+    return true, nil
+}
+
+// Range returns all keys in [start, end). It scans a copy-on-write clone
+// of the tree, so writers are only blocked while the clone is taken.
 func (b *BTreeStore) Range(start, end string) ([]string, error) {
-    b.mu.RLock()
-    defer b.mu.RUnlock()
+    b.mu.Lock()
+    tree := b.tree.Clone()
+    b.mu.Unlock()
+    now := clock().UnixNano()
     var keys []string
-    b.tree.AscendRange(&btreeItem{key: start}, &btreeItem{key: end}, func(i btree.Item) bool {
-        keys = append(keys, i.(*btreeItem).key)
+    tree.AscendRange(&btreeItem{key: start}, &btreeItem{key: end}, func(i btree.Item) bool {
+        if it := i.(*btreeItem); !expiredAt(it.expires, now) {
+            keys = append(keys, it.key)
+        }
         return true
     })
     return keys, nil
 }
 
+// Snapshot returns a read-only view of the store as of now, backed by a
+// copy-on-write clone of the tree. Nodes are shared with the live tree
+// until a write copies them, so taking a snapshot is O(1).
+func (b *BTreeStore) Snapshot() Snapshot {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    s := &btreeSnapshot{}
+    s.store.Store(&BTreeStore{tree: b.tree.Clone()})
+    return s
+}
+
+// NewIterator returns an ordered iterator over the tree.
+func (b *BTreeStore) NewIterator() Iterator {
+    return newCursorIterator(b)
+}
+
+func (b *BTreeStore) ceiling(key string, inclusive bool) (k, v string, ok bool, err error) {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    now := clock().UnixNano()
+    b.tree.AscendGreaterOrEqual(&btreeItem{key: key}, func(i btree.Item) bool {
+        it := i.(*btreeItem)
+        if (!inclusive && it.key == key) || expiredAt(it.expires, now) {
+            return true
+        }
+        k, v, ok = it.key, it.value, true
+        return false
+    })
+    return k, v, ok, nil
+}
+
+func (b *BTreeStore) lower(key string) (k, v string, ok bool, err error) {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    now := clock().UnixNano()
+    b.tree.DescendLessOrEqual(&btreeItem{key: key}, func(i btree.Item) bool {
+        it := i.(*btreeItem)
+        if it.key == key || expiredAt(it.expires, now) {
+            return true
+        }
+        k, v, ok = it.key, it.value, true
+        return false
+    })
+    return k, v, ok, nil
+}
+
+func (b *BTreeStore) last() (k, v string, ok bool, err error) {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    now := clock().UnixNano()
+    b.tree.Descend(func(i btree.Item) bool {
+        it := i.(*btreeItem)
+        if expiredAt(it.expires, now) {
+            return true
+        }
+        k, v, ok = it.key, it.value, true
+        return false
+    })
+    return k, v, ok, nil
+}
+
 // Flush is a no-op for in-memory B-tree.
 func (b *BTreeStore) Flush() error {
     return nil
-}
\ No newline at end of file
+}
+
+// btreeSnapshot is a Snapshot of a BTreeStore: a private BTreeStore over
+// a clone of the tree, dropped on Release.
+type btreeSnapshot struct {
+    store atomic.Pointer[BTreeStore]
+}
+
+func (s *btreeSnapshot) Get(key string) (string, error) {
+    b := s.store.Load()
+    if b == nil {
+        return "", ErrSnapshotReleased
+    }
+    return b.Get(key)
+}
+
+func (s *btreeSnapshot) Range(start, end string) ([]string, error) {
+    b := s.store.Load()
+    if b == nil {
+        return nil, ErrSnapshotReleased
+    }
+    return b.Range(start, end)
+}
+
+func (s *btreeSnapshot) NewIterator() Iterator {
+    b := s.store.Load()
+    if b == nil {
+        return &sliceIterator{i: -1, err: ErrSnapshotReleased}
+    }
+    return b.NewIterator()
+}
+
+func (s *btreeSnapshot) Set(string, string) error { return ErrReadOnly }
+func (s *btreeSnapshot) Delete(string) error      { return ErrReadOnly }
+func (s *btreeSnapshot) Flush() error             { return ErrReadOnly }
+
+// Release drops the clone, letting nodes the live tree no longer shares
+// be garbage-collected.
+func (s *btreeSnapshot) Release() {
+    s.store.Store(nil)
+}
@@ -0,0 +1,108 @@
+package kv
+
+import (
+    "errors"
+    "time"
+)
+
+// batchOp is one write in a WriteBatch.
+type batchOp struct {
+    key, value string
+    delete     bool
+    withTTL    bool
+    ttl        time.Duration
+}
+
+// WriteBatch collects writes to apply atomically with a store's Write
+// method. The zero value is an empty batch ready to use.
+//
+// Within a batch, later operations on a key override earlier ones, and
+// deleting a missing key is not an error.
+type WriteBatch struct {
+    ops []batchOp
+}
+
+// Put queues a write of key→value.
+func (b *WriteBatch) Put(key, value string) {
+    b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+// PutWithTTL queues a write of key→value that expires ttl after the batch
+// is written. Write fails with ErrInvalidTTL unless ttl is positive, and
+// with ErrUnsupported if the store cannot expire keys.
+func (b *WriteBatch) PutWithTTL(key, value string, ttl time.Duration) {
+    b.ops = append(b.ops, batchOp{key: key, value: value, withTTL: true, ttl: ttl})
+}
+
+// Delete queues a delete of key.
+func (b *WriteBatch) Delete(key string) {
+    b.ops = append(b.ops, batchOp{key: key, delete: true})
+}
+
+// Clear empties the batch so it can be reused.
+func (b *WriteBatch) Clear() {
+    b.ops = b.ops[:0]
+}
+
+// Len returns the number of queued operations.
+func (b *WriteBatch) Len() int {
+    return len(b.ops)
+}
+
+// Each calls fn for every queued operation in order, so wrappers outside
+// this package can inspect a batch. withTTL is set for PutWithTTL, whose
+// ttl is passed through unchecked; ttl is 0 for everything else.
+func (b *WriteBatch) Each(fn func(key, value string, ttl time.Duration, withTTL, delete bool)) {
+    for _, op := range b.ops {
+        fn(op.key, op.value, op.ttl, op.withTTL, op.delete)
+    }
+}
+
+// check validates the batch before it is applied. Stores that cannot
+// expire keys pass ttlOK false.
+func (b *WriteBatch) check(ttlOK bool) error {
+    for _, op := range b.ops {
+        if !op.withTTL {
+            continue
+        }
+        if !ttlOK {
+            return ErrUnsupported
+        }
+        if op.ttl <= 0 {
+            return ErrInvalidTTL
+        }
+    }
+    return nil
+}
+
+// Batcher is implemented by stores that apply a WriteBatch atomically:
+// readers see either none or all of its operations.
+type Batcher interface {
+    Write(b *WriteBatch) error
+}
+
+// Write applies b to s atomically if s implements Batcher, and otherwise
+// one operation at a time, stopping at the first error.
+func Write(s KVStore, b *WriteBatch) error {
+    if bs, ok := s.(Batcher); ok {
+        return bs.Write(b)
+    }
+    _, ttlOK := s.(Expirer)
+    if err := b.check(ttlOK); err != nil {
+        return err
+    }
+    for _, op := range b.ops {
+        if op.withTTL {
+            if err := s.(Expirer).SetWithTTL(op.key, op.value, op.ttl); err != nil {
+                return err
+            }
+        } else if op.delete {
+            if err := s.Delete(op.key); err != nil && !errors.Is(err, ErrNotFound) {
+                return err
+            }
+        } else if err := s.Set(op.key, op.value); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,122 @@
+package kv
+
+import (
+    "fmt"
+    "testing"
+    "time"
+
+    "github.com/thilakshekharshriyan/m/wal"
+)
+
+func TestWriteBatch(t *testing.T) {
+    stores := orderedStores()
+    stores["hash"] = NewHashStore()
+    stores["sharded"] = NewShardedHashStore(4)
+    for name, s := range stores {
+        t.Run(name, func(t *testing.T) {
+            s.Set("old", "x")
+            var b WriteBatch
+            b.Put("a", "1")
+            b.Put("b", "2")
+            b.Put("a", "3")
+            b.Delete("old")
+            b.Delete("missing")
+            if b.Len() != 5 {
+                t.Fatalf("Len = %d, want 5", b.Len())
+            }
+            if err := Write(s, &b); err != nil {
+                t.Fatal(err)
+            }
+            if v, err := s.Get("a"); err != nil || v != "3" {
+                t.Fatalf("expected 3, got %q, err=%v", v, err)
+            }
+            if v, err := s.Get("b"); err != nil || v != "2" {
+                t.Fatalf("expected 2, got %q, err=%v", v, err)
+            }
+            if _, err := s.Get("old"); err != ErrNotFound {
+                t.Fatalf("expected ErrNotFound, got %v", err)
+            }
+            b.Clear()
+            if b.Len() != 0 {
+                t.Fatalf("Len after Clear = %d", b.Len())
+            }
+        })
+    }
+}
+
+func TestWriteBatchEach(t *testing.T) {
+    var b WriteBatch
+    b.Put("a", "1")
+    b.PutWithTTL("b", "2", 0)
+    b.PutWithTTL("c", "3", time.Second)
+    b.Delete("d")
+    var got []string
+    b.Each(func(key, value string, ttl time.Duration, withTTL, delete bool) {
+        got = append(got, fmt.Sprintf("%s=%s/%v/%v/%v", key, value, ttl, withTTL, delete))
+    })
+    want := "[a=1/0s/false/false b=2/0s/true/false c=3/1s/true/false d=/0s/false/true]"
+    if fmt.Sprint(got) != want {
+        t.Fatalf("Each saw %v, want %s", got, want)
+    }
+}
+
+func TestWriteBatchLSMSingleFlush(t *testing.T) {
+    lsm, _ := NewLSMStoreWithOptions(LSMOptions{MemtableSize: 4, L0Trigger: 100})
+    var b WriteBatch
+    for i := 0; i < 10; i++ {
+        b.Put(fmt.Sprintf("k%d", i), "v")
+    }
+    if err := lsm.Write(&b); err != nil {
+        t.Fatal(err)
+    }
+    // The whole batch lands in one run rather than being split at the
+    // memtable limit.
+    if n := len(lsm.levels[0]); n != 1 {
+        t.Fatalf("expected 1 L0 run, got %d", n)
+    }
+}
+
+func TestWriteBatchDurable(t *testing.T) {
+    dir := t.TempDir()
+    d, err := OpenDurableStore(dir, NewBTreeStore(), wal.Options{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    d.Set("gone", "x")
+    var b WriteBatch
+    b.Put("a", "1")
+    b.Put("b", "")
+    b.Delete("gone")
+    if err := d.Write(&b); err != nil {
+        t.Fatal(err)
+    }
+    d.Close()
+
+    h := NewHashStore()
+    d, err = OpenDurableStore(dir, h, wal.Options{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer d.Close()
+    if v, err := h.Get("a"); err != nil || v != "1" {
+        t.Fatalf("expected 1, got %q, err=%v", v, err)
+    }
+    if v, err := h.Get("b"); err != nil || v != "" {
+        t.Fatalf("expected empty value, got %q, err=%v", v, err)
+    }
+    if _, err := h.Get("gone"); err != ErrNotFound {
+        t.Fatalf("expected ErrNotFound, got %v", err)
+    }
+}
+
+func TestDecodeWALRecordMalformed(t *testing.T) {
+    var b WriteBatch
+    b.Put("a", "1")
+    b.Put("b", "2")
+    rec := encodeWALBatch(&b)
+    for i := 0; i < len(rec); i++ {
+        if _, err := decodeWALRecord(rec[:i]); err == nil {
+            t.Fatalf("truncated record of %d bytes decoded", i)
+        }
+    }
+}
@@ -0,0 +1,67 @@
+package kv
+
+import "unsafe"
+
+// BytesStore is implemented by stores with a native byte-slice API, such
+// as HashStore and TrieStore, which read and write without copying. The
+// package functions SetBytes, GetBytes and DeleteBytes use it when present
+// and otherwise adapt any KVStore without copying.
+//
+// Ownership rules, for both BytesStore and the package functions:
+//   - SetBytes takes ownership of key and value. The caller must not
+//     modify either slice afterwards, since the store may keep them.
+//   - GetBytes returns a slice that may share memory with the store. The
+//     caller must not modify it; copy it first if it needs changing.
+//   - Keys passed to GetBytes and DeleteBytes are only read during the
+//     call and may be reused afterwards.
+type BytesStore interface {
+    SetBytes(key, value []byte) error
+    GetBytes(key []byte) ([]byte, error)
+    DeleteBytes(key []byte) error
+}
+
+// SetBytes writes key→value to s. See BytesStore for ownership rules.
+func SetBytes(s KVStore, key, value []byte) error {
+    if bs, ok := s.(BytesStore); ok {
+        return bs.SetBytes(key, value)
+    }
+    return s.Set(bytesToString(key), bytesToString(value))
+}
+
+// GetBytes reads key from s. See BytesStore for ownership rules.
+func GetBytes(s KVStore, key []byte) ([]byte, error) {
+    if bs, ok := s.(BytesStore); ok {
+        return bs.GetBytes(key)
+    }
+    // The caller may reuse key, so it is copied rather than aliased.
+    v, err := s.Get(string(key))
+    if err != nil {
+        return nil, err
+    }
+    return stringToBytes(v), nil
+}
+
+// DeleteBytes deletes key from s.
+func DeleteBytes(s KVStore, key []byte) error {
+    if bs, ok := s.(BytesStore); ok {
+        return bs.DeleteBytes(key)
+    }
+    return s.Delete(string(key))
+}
+
+// bytesToString returns a string sharing b's memory. b must not be
+// modified afterwards.
+func bytesToString(b []byte) string {
+    if len(b) == 0 {
+        return ""
+    }
+    return unsafe.String(unsafe.SliceData(b), len(b))
+}
+
+// stringToBytes returns a read-only slice sharing s's memory.
+func stringToBytes(s string) []byte {
+    if s == "" {
+        return nil
+    }
+    return unsafe.Slice(unsafe.StringData(s), len(s))
+}
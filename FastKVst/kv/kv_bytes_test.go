@@ -0,0 +1,69 @@
+package kv
+
+import (
+    "bytes"
+    "testing"
+)
+
+var (
+    _ BytesStore = (*HashStore)(nil)
+    _ BytesStore = (*TrieStore)(nil)
+)
+
+func TestBytesAPI(t *testing.T) {
+    stores := orderedStores()
+    stores["hash"] = NewHashStore()
+    stores["sharded"] = NewShardedHashStore(4)
+    for name, s := range stores {
+        t.Run(name, func(t *testing.T) {
+            key := []byte{0x00, 0xff, 'k'}
+            val := []byte{0x01, 0x00, 0xfe, 0x80}
+            if err := SetBytes(s, key, val); err != nil {
+                t.Fatal(err)
+            }
+            // Lookup keys are borrowed: reusing the buffer is fine.
+            probe := append([]byte(nil), key...)
+            got, err := GetBytes(s, probe)
+            if err != nil || !bytes.Equal(got, val) {
+                t.Fatalf("GetBytes = %x, %v; want %x", got, err, val)
+            }
+            probe[2] = 'x'
+            if _, err := GetBytes(s, probe); err != ErrNotFound {
+                t.Fatalf("expected ErrNotFound, got %v", err)
+            }
+            if v, err := s.Get("\x00\xffk"); err != nil || v != string(val) {
+                t.Fatalf("Get = %q, %v", v, err)
+            }
+            if err := SetBytes(s, []byte("empty"), nil); err != nil {
+                t.Fatal(err)
+            }
+            if v, err := GetBytes(s, []byte("empty")); err != nil || len(v) != 0 {
+                t.Fatalf("GetBytes(empty) = %x, %v", v, err)
+            }
+            if err := DeleteBytes(s, key); err != nil {
+                t.Fatal(err)
+            }
+            if _, err := GetBytes(s, key); err != ErrNotFound {
+                t.Fatalf("after delete: expected ErrNotFound, got %v", err)
+            }
+        })
+    }
+}
+
+func TestBytesBinaryKeysDistinct(t *testing.T) {
+    stores := orderedStores()
+    stores["hash"] = NewHashStore()
+    for name, s := range stores {
+        t.Run(name, func(t *testing.T) {
+            // Invalid UTF-8 bytes must not be folded together.
+            SetBytes(s, []byte{0xfe}, []byte("a"))
+            SetBytes(s, []byte{0xff}, []byte("b"))
+            if v, err := GetBytes(s, []byte{0xfe}); err != nil || string(v) != "a" {
+                t.Fatalf("GetBytes(fe) = %q, %v", v, err)
+            }
+            if v, err := GetBytes(s, []byte{0xff}); err != nil || string(v) != "b" {
+                t.Fatalf("GetBytes(ff) = %q, %v", v, err)
+            }
+        })
+    }
+}
@@ -0,0 +1,324 @@
+package kv
+
+import (
+    "errors"
+    "sync"
+    "sync/atomic"
+)
+
+// ErrTooLarge is returned by a standalone CacheStore's Set for an entry
+// larger than MaxBytes.
+var ErrTooLarge = errors.New("entry exceeds cache byte budget")
+
+// EvictionPolicy selects how a CacheStore picks entries to evict.
+type EvictionPolicy int
+
+const (
+    LRU     EvictionPolicy = iota // least recently used
+    LFU                           // least frequently used, ties by recency
+    TinyLFU                       // W-TinyLFU: LRU window, frequency-based admission
+)
+
+// CacheOptions configures a CacheStore. If neither budget is set,
+// MaxEntries defaults to 10000.
+type CacheOptions struct {
+    MaxEntries int   // entries kept; 0 for no entry limit
+    MaxBytes   int64 // len(key)+len(value) summed over entries; 0 for no byte limit
+    Policy     EvictionPolicy
+
+    // Backing, if set, is the store being cached: writes go through to it
+    // and misses are filled from it. Without it the cache is a store of its
+    // own and evicted keys are gone.
+    Backing KVStore
+
+    // OnEvict, if set, is called with each entry evicted to stay within
+    // budget (not for Delete or overwrites). It runs after the cache lock
+    // is released.
+    OnEvict func(key, value string)
+}
+
+func (o *CacheOptions) setDefaults() {
+    if o.MaxEntries <= 0 && o.MaxBytes <= 0 {
+        o.MaxEntries = 10000
+    }
+}
+
+// budget returns the capacity in the unit entry costs are measured in.
+func (o *CacheOptions) budget() int64 {
+    if o.MaxBytes > 0 {
+        return o.MaxBytes
+    }
+    return int64(o.MaxEntries)
+}
+
+// expectedEntries estimates how many entries fit, to size the sketch.
+func (o *CacheOptions) expectedEntries() int {
+    if o.MaxEntries > 0 {
+        return o.MaxEntries
+    }
+    return int(o.MaxBytes / 64)
+}
+
+// CacheStats counts cache activity.
+type CacheStats struct {
+    Hits, Misses, Evictions uint64
+}
+
+// HitRate returns Hits / (Hits + Misses), or 0 before any lookup.
+func (s CacheStats) HitRate() float64 {
+    if s.Hits+s.Misses == 0 {
+        return 0
+    }
+    return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// CacheStore is a KVStore bounded by an entry or byte budget, evicting by
+// a pluggable policy. It either stands alone or caches a backing store.
+type CacheStore struct {
+    mu      sync.Mutex
+    opts    CacheOptions
+    entries map[string]*cacheEntry
+    policy  cachePolicy
+    bytes   int64  // len(key)+len(value) over entries
+    writes  uint64 // bumped by every write, so fills can detect races
+
+    hits, misses, evictions atomic.Uint64
+}
+
+// NewCacheStore constructs a CacheStore from opts.
+func NewCacheStore(opts CacheOptions) *CacheStore {
+    opts.setDefaults()
+    return &CacheStore{
+        opts:    opts,
+        entries: make(map[string]*cacheEntry),
+        policy:  newCachePolicy(opts),
+    }
+}
+
+// Stats returns the hit, miss and eviction counters.
+func (c *CacheStore) Stats() CacheStats {
+    return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load(), Evictions: c.evictions.Load()}
+}
+
+// Len returns the number of cached entries.
+func (c *CacheStore) Len() int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return len(c.entries)
+}
+
+// Bytes returns len(key)+len(value) summed over cached entries.
+func (c *CacheStore) Bytes() int64 {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.bytes
+}
+
+// Set writes key to the backing store, if any, then caches it. An entry
+// larger than MaxBytes is only written to the backing store; without one,
+// Set fails with ErrTooLarge and leaves the cache unchanged.
+func (c *CacheStore) Set(key, value string) error {
+    if c.opts.Backing == nil {
+        if c.tooLarge(key, value) {
+            return ErrTooLarge
+        }
+        c.mu.Lock()
+        c.writes++
+        c.policy.access(key)
+        evicted := c.put(key, value, 0)
+        c.mu.Unlock()
+        c.notify(evicted)
+        return nil
+    }
+    writes := c.invalidate(key)
+    if err := c.opts.Backing.Set(key, value); err != nil {
+        return err
+    }
+    c.mu.Lock()
+    c.writes++
+    var evicted []*cacheEntry
+    if c.writes == writes+1 {
+        // No other write overlapped ours, so value is still current.
+        c.policy.access(key)
+        evicted = c.put(key, value, 0)
+    }
+    c.mu.Unlock()
+    c.notify(evicted)
+    return nil
+}
+
+// invalidate drops key ahead of a write to the backing store, which is
+// made without the lock, and returns the write count. Bumping it here and
+// again once the write is done stops fills that read around the write
+// from caching what they read.
+func (c *CacheStore) invalidate(key string) uint64 {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.writes++
+    if e, ok := c.entries[key]; ok {
+        c.drop(e)
+    }
+    return c.writes
+}
+
+// Get returns a cached value, or on a miss reads the backing store and
+// caches the result. A value filled from a backing Expirer is cached only
+// until the backing key expires.
+func (c *CacheStore) Get(key string) (string, error) {
+    c.mu.Lock()
+    c.policy.access(key)
+    if e, ok := c.entries[key]; ok {
+        if !expiredAt(e.expires, clock().UnixNano()) {
+            c.policy.touch(e)
+            c.mu.Unlock()
+            c.hits.Add(1)
+            return e.value, nil
+        }
+        c.drop(e)
+    }
+    c.misses.Add(1)
+    if c.opts.Backing == nil {
+        c.mu.Unlock()
+        return "", ErrNotFound
+    }
+    writes := c.writes
+    c.mu.Unlock()
+
+    v, err := c.opts.Backing.Get(key)
+    if err != nil {
+        return "", err
+    }
+    expires, ok := c.backingDeadline(key)
+    c.mu.Lock()
+    var evicted []*cacheEntry
+    if ok && c.writes == writes {
+        // Nothing was written while we read, so v is still current.
+        evicted = c.put(key, v, expires)
+    }
+    c.mu.Unlock()
+    c.notify(evicted)
+    return v, nil
+}
+
+// Delete removes key from the cache and the backing store, if any.
+func (c *CacheStore) Delete(key string) error {
+    if c.opts.Backing == nil {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+        c.writes++
+        e, ok := c.entries[key]
+        if !ok {
+            return ErrNotFound
+        }
+        c.drop(e)
+        return nil
+    }
+    c.invalidate(key)
+    err := c.opts.Backing.Delete(key)
+    c.mu.Lock()
+    c.writes++
+    c.mu.Unlock()
+    return err
+}
+
+// Range lists keys of the backing store; a standalone cache does not
+// support it.
+func (c *CacheStore) Range(start, end string) ([]string, error) {
+    if c.opts.Backing == nil {
+        return nil, ErrUnsupported
+    }
+    return c.opts.Backing.Range(start, end)
+}
+
+// Flush flushes the backing store, if any.
+func (c *CacheStore) Flush() error {
+    if c.opts.Backing == nil {
+        return nil
+    }
+    return c.opts.Backing.Flush()
+}
+
+// backingDeadline returns when key expires in the backing store, 0 if it
+// does not, and false if the key is already gone.
+func (c *CacheStore) backingDeadline(key string) (int64, bool) {
+    e, ok := c.opts.Backing.(Expirer)
+    if !ok {
+        return 0, true
+    }
+    ttl, err := e.TTL(key)
+    switch {
+    case errors.Is(err, ErrUnsupported):
+        return 0, true
+    case err != nil:
+        return 0, false
+    case ttl == NoExpiry:
+        return 0, true
+    }
+    return deadline(ttl), true
+}
+
+// put caches key→value until expires (0 for no limit), first evicting
+// entries to make room, and returns the evicted entries. An entry larger
+// than the byte budget is not cached, and any older value of key is
+// dropped. Callers hold c.mu.
+func (c *CacheStore) put(key, value string, expires int64) []*cacheEntry {
+    if e, ok := c.entries[key]; ok {
+        c.drop(e)
+    }
+    if c.tooLarge(key, value) {
+        return nil
+    }
+    e := &cacheEntry{key: key, value: value, cost: c.cost(key, value), expires: expires}
+    size := int64(len(key) + len(value))
+
+    var evicted []*cacheEntry
+    for c.full(size) {
+        v := c.policy.victim()
+        if v == nil {
+            break
+        }
+        c.drop(v)
+        evicted = append(evicted, v)
+    }
+    c.evictions.Add(uint64(len(evicted)))
+    c.entries[key] = e
+    c.bytes += size
+    c.policy.insert(e)
+    return evicted
+}
+
+// cost is an entry's size in the policy's unit: bytes under a byte
+// budget, otherwise one per entry.
+func (c *CacheStore) cost(key, value string) int64 {
+    if c.opts.MaxBytes > 0 {
+        return int64(len(key) + len(value))
+    }
+    return 1
+}
+
+// tooLarge reports whether key→value alone exceeds the byte budget.
+func (c *CacheStore) tooLarge(key, value string) bool {
+    return c.opts.MaxBytes > 0 && int64(len(key)+len(value)) > c.opts.MaxBytes
+}
+
+// full reports whether an entry of size bytes would exceed the budget.
+func (c *CacheStore) full(size int64) bool {
+    return (c.opts.MaxEntries > 0 && len(c.entries) >= c.opts.MaxEntries) ||
+        (c.opts.MaxBytes > 0 && c.bytes+size > c.opts.MaxBytes)
+}
+
+// drop removes e from the cache. Callers hold c.mu.
+func (c *CacheStore) drop(e *cacheEntry) {
+    c.policy.remove(e)
+    delete(c.entries, e.key)
+    c.bytes -= int64(len(e.key) + len(e.value))
+}
+
+func (c *CacheStore) notify(evicted []*cacheEntry) {
+    if c.opts.OnEvict == nil {
+        return
+    }
+    for _, e := range evicted {
+        c.opts.OnEvict(e.key, e.value)
+    }
+}
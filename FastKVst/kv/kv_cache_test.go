@@ -0,0 +1,237 @@
+package kv
+
+import (
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestCacheLRU(t *testing.T) {
+    var evicted []string
+    c := NewCacheStore(CacheOptions{MaxEntries: 3, OnEvict: func(k, v string) {
+        evicted = append(evicted, k)
+    }})
+    c.Set("a", "1")
+    c.Set("b", "2")
+    c.Set("c", "3")
+    c.Get("a") // b is now least recent
+    c.Set("d", "4")
+    if _, err := c.Get("b"); err != ErrNotFound {
+        t.Fatalf("b: expected ErrNotFound, got %v", err)
+    }
+    for _, k := range []string{"a", "c", "d"} {
+        if _, err := c.Get(k); err != nil {
+            t.Fatalf("%s: %v", k, err)
+        }
+    }
+    if len(evicted) != 1 || evicted[0] != "b" {
+        t.Fatalf("evicted %v, want [b]", evicted)
+    }
+    if st := c.Stats(); st.Hits != 4 || st.Misses != 1 || st.Evictions != 1 {
+        t.Fatalf("stats %+v", st)
+    }
+}
+
+func TestCacheLFU(t *testing.T) {
+    c := NewCacheStore(CacheOptions{MaxEntries: 3, Policy: LFU})
+    c.Set("a", "1")
+    c.Set("b", "2")
+    c.Set("c", "3")
+    for i := 0; i < 3; i++ {
+        c.Get("a")
+        c.Get("c")
+    }
+    c.Get("b")
+    c.Set("d", "4") // evicts b, the least used
+    c.Set("e", "5") // evicts d, used once
+    for k, want := range map[string]bool{"a": true, "b": false, "c": true, "d": false, "e": true} {
+        if _, err := c.Get(k); (err == nil) != want {
+            t.Fatalf("%s cached = %v, want %v", k, err == nil, want)
+        }
+    }
+}
+
+func TestCacheTinyLFUResistsScans(t *testing.T) {
+    c := NewCacheStore(CacheOptions{MaxEntries: 100, Policy: TinyLFU})
+    hot := func(i int) string { return fmt.Sprint("hot", i) }
+    for round := 0; round < 5; round++ {
+        for i := 0; i < 50; i++ {
+            if _, err := c.Get(hot(i)); err != nil {
+                c.Set(hot(i), "v")
+            }
+        }
+    }
+    // A long scan of keys seen once must not displace the hot set.
+    for i := 0; i < 1000; i++ {
+        c.Set(fmt.Sprint("scan", i), "v")
+    }
+    kept := 0
+    for i := 0; i < 50; i++ {
+        if _, err := c.Get(hot(i)); err == nil {
+            kept++
+        }
+    }
+    if kept < 45 {
+        t.Fatalf("only %d of 50 hot keys survived the scan", kept)
+    }
+    if c.Len() > 100 {
+        t.Fatalf("Len = %d, over budget", c.Len())
+    }
+}
+
+func TestCacheByteBudget(t *testing.T) {
+    for _, p := range []EvictionPolicy{LRU, LFU, TinyLFU} {
+        c := NewCacheStore(CacheOptions{MaxBytes: 100, Policy: p})
+        for i := 0; i < 50; i++ {
+            c.Set(fmt.Sprintf("k%02d", i), "0123456") // 10 bytes each
+            if c.Bytes() > 100 {
+                t.Fatalf("policy %d: Bytes = %d after %d sets", p, c.Bytes(), i+1)
+            }
+        }
+        if c.Len() != 10 {
+            t.Fatalf("policy %d: Len = %d, want 10", p, c.Len())
+        }
+        // An entry larger than the whole budget is refused, not evicted.
+        evictions := c.Stats().Evictions
+        if err := c.Set("k00", string(make([]byte, 200))); err != ErrTooLarge {
+            t.Fatalf("policy %d: oversized Set = %v", p, err)
+        }
+        if c.Stats().Evictions != evictions || c.Len() != 10 {
+            t.Fatalf("policy %d: oversized Set changed the cache", p)
+        }
+    }
+
+    // With a backing store the write goes through and is simply not cached.
+    var evicted []string
+    backing := NewHashStore()
+    c := NewCacheStore(CacheOptions{MaxBytes: 100, Backing: backing, OnEvict: func(k, _ string) {
+        evicted = append(evicted, k)
+    }})
+    c.Set("big", "small")
+    big := string(make([]byte, 200))
+    if err := c.Set("big", big); err != nil {
+        t.Fatal(err)
+    }
+    if v, err := c.Get("big"); err != nil || v != big || c.Len() != 0 {
+        t.Fatalf("Get(big) = %d bytes, %v; Len = %d", len(v), err, c.Len())
+    }
+    if len(evicted) != 0 || c.Stats().Evictions != 0 {
+        t.Fatalf("oversized entry reported as evicted: %v", evicted)
+    }
+}
+
+func TestCacheBacking(t *testing.T) {
+    backing := NewHashStore()
+    backing.Set("x", "1")
+    c := NewCacheStore(CacheOptions{MaxEntries: 1, Backing: backing})
+    if v, err := c.Get("x"); err != nil || v != "1" {
+        t.Fatalf("Get(x) = %q, %v", v, err)
+    }
+    c.Set("y", "2") // evicts x from the cache only
+    if v, err := backing.Get("y"); err != nil || v != "2" {
+        t.Fatalf("write-through: %q, %v", v, err)
+    }
+    if v, err := c.Get("x"); err != nil || v != "1" {
+        t.Fatalf("refill: %q, %v", v, err)
+    }
+    if err := c.Delete("x"); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := backing.Get("x"); err != ErrNotFound {
+        t.Fatalf("Delete did not reach backing store: %v", err)
+    }
+    if st := c.Stats(); st.Hits != 0 || st.Misses != 2 {
+        t.Fatalf("stats %+v", st)
+    }
+}
+
+func TestCacheBackingTTL(t *testing.T) {
+    now := fakeClock(t)
+    backing := NewHashStore()
+    backing.SetWithTTL("k", "v", time.Second)
+    c := NewCacheStore(CacheOptions{Backing: backing})
+    for i := 0; i < 2; i++ {
+        if v, err := c.Get("k"); err != nil || v != "v" {
+            t.Fatalf("Get(k) = %q, %v", v, err)
+        }
+    }
+    *now = now.Add(2 * time.Second)
+    if _, err := c.Get("k"); err != ErrNotFound {
+        t.Fatalf("expired key served from cache: %v", err)
+    }
+    if st := c.Stats(); st.Hits != 1 || st.Misses != 2 || c.Len() != 0 {
+        t.Fatalf("stats %+v, Len %d", st, c.Len())
+    }
+}
+
+// gatedStore holds each Set until gate is closed.
+type gatedStore struct {
+    KVStore
+    entered, gate chan struct{}
+}
+
+func (s *gatedStore) Set(key, value string) error {
+    s.entered <- struct{}{}
+    <-s.gate
+    return s.KVStore.Set(key, value)
+}
+
+func TestCacheSlowBacking(t *testing.T) {
+    backing := &gatedStore{KVStore: NewHashStore(), entered: make(chan struct{}), gate: make(chan struct{})}
+    backing.KVStore.Set("x", "1")
+    backing.KVStore.Set("y", "old")
+    c := NewCacheStore(CacheOptions{Backing: backing})
+    c.Get("x")
+
+    done := make(chan error)
+    go func() { done <- c.Set("y", "new") }()
+    <-backing.entered
+    // A cache hit does not wait for the backing write.
+    got := make(chan string)
+    go func() {
+        v, _ := c.Get("x")
+        got <- v
+    }()
+    select {
+    case v := <-got:
+        if v != "1" {
+            t.Fatalf("Get(x) = %q", v)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("Get blocked behind a backing write")
+    }
+    c.Get("y") // reads the old value while the write is in flight
+    close(backing.gate)
+    if err := <-done; err != nil {
+        t.Fatal(err)
+    }
+    if v, err := c.Get("y"); err != nil || v != "new" {
+        t.Fatalf("Get(y) = %q, %v", v, err)
+    }
+}
+
+func TestCacheConcurrency(t *testing.T) {
+    for _, p := range []EvictionPolicy{LRU, LFU, TinyLFU} {
+        c := NewCacheStore(CacheOptions{MaxEntries: 64, Policy: p, Backing: NewHashStore()})
+        var wg sync.WaitGroup
+        for g := 0; g < 8; g++ {
+            wg.Add(1)
+            go func(g int) {
+                defer wg.Done()
+                for i := 0; i < 500; i++ {
+                    k := fmt.Sprint((g*7 + i) % 200)
+                    c.Set(k, "v")
+                    c.Get(k)
+                    if i%10 == 0 {
+                        c.Delete(k)
+                    }
+                }
+            }(g)
+        }
+        wg.Wait()
+        if c.Len() > 64 {
+            t.Fatalf("policy %d: Len = %d", p, c.Len())
+        }
+    }
+}
@@ -0,0 +1,125 @@
+package kv
+
+import (
+    "encoding/binary"
+    "fmt"
+    "hash/crc32"
+    "time"
+)
+
+// errValueChecksum is returned for a value that fails its checksum.
+var errValueChecksum = fmt.Errorf("kv: value checksum mismatch: %w", ErrCorrupted)
+
+// ChecksumStore guards values held by the wrapped store with a CRC32C, so
+// memory corruption or a buggy store is reported as ErrCorrupted instead
+// of returning garbage. Each stored value is followed by its four-byte
+// checksum. Values must all be written through the ChecksumStore.
+type ChecksumStore struct {
+    store KVStore
+}
+
+// NewChecksumStore wraps store.
+func NewChecksumStore(store KVStore) *ChecksumStore {
+    return &ChecksumStore{store: store}
+}
+
+// sumValue appends value's checksum to it.
+func sumValue(value string) string {
+    b := make([]byte, 0, len(value)+4)
+    b = append(b, value...)
+    b = binary.LittleEndian.AppendUint32(b, crc32.Checksum(b, castagnoli))
+    return bytesToString(b)
+}
+
+// checkValue verifies and strips the checksum of a stored value.
+func checkValue(stored string) (string, error) {
+    if len(stored) < 4 {
+        return "", errValueChecksum
+    }
+    n := len(stored) - 4
+    if crc32.Checksum(stringToBytes(stored[:n]), castagnoli) != binary.LittleEndian.Uint32(stringToBytes(stored[n:])) {
+        return "", errValueChecksum
+    }
+    return stored[:n], nil
+}
+
+// Set writes value with its checksum.
+func (s *ChecksumStore) Set(key, value string) error {
+    return s.store.Set(key, sumValue(value))
+}
+
+// Get reads key, returning ErrCorrupted if its checksum does not match.
+func (s *ChecksumStore) Get(key string) (string, error) {
+    v, err := s.store.Get(key)
+    if err != nil {
+        return "", err
+    }
+    if v, err = checkValue(v); err != nil {
+        return "", fmt.Errorf("%w: key %q", err, key)
+    }
+    return v, nil
+}
+
+// Delete deletes key from the wrapped store.
+func (s *ChecksumStore) Delete(key string) error {
+    return s.store.Delete(key)
+}
+
+// Write applies b to the wrapped store with every value checksummed.
+func (s *ChecksumStore) Write(b *WriteBatch) error {
+    enc := WriteBatch{ops: make([]batchOp, len(b.ops))}
+    for i, op := range b.ops {
+        if !op.delete {
+            op.value = sumValue(op.value)
+        }
+        enc.ops[i] = op
+    }
+    return Write(s.store, &enc)
+}
+
+// SetWithTTL writes value with its checksum and a TTL. It fails with
+// ErrUnsupported if the wrapped store cannot expire keys.
+func (s *ChecksumStore) SetWithTTL(key, value string, ttl time.Duration) error {
+    return SetWithTTL(s.store, key, sumValue(value), ttl)
+}
+
+// Range reads straight from the wrapped store; keys are not checksummed.
+func (s *ChecksumStore) Range(start, end string) ([]string, error) {
+    return s.store.Range(start, end)
+}
+
+// NewIterator iterates the wrapped store, verifying values. The first
+// mismatch is reported by Err.
+func (s *ChecksumStore) NewIterator() Iterator {
+    it, err := NewIterator(s.store)
+    if err != nil {
+        return &sliceIterator{i: -1, err: err}
+    }
+    return newDecodingIterator(it, checkValue)
+}
+
+// Flush flushes the wrapped store.
+func (s *ChecksumStore) Flush() error {
+    return s.store.Flush()
+}
+
+// Verify checks the wrapped store first, if it is a Verifier, then every
+// value's checksum.
+func (s *ChecksumStore) Verify() (VerifyReport, error) {
+    r, err := Verify(s.store)
+    if err != nil && err != ErrUnsupported {
+        return r, err
+    }
+    it, err := NewIterator(s.store)
+    if err != nil {
+        return r, err
+    }
+    defer it.Close()
+    for it.Next() {
+        r.Checked++
+        if _, err := checkValue(it.Value()); err != nil {
+            r.CorruptKeys = append(r.CorruptKeys, it.Key())
+        }
+    }
+    return r, it.Err()
+}
@@ -0,0 +1,64 @@
+package kv
+
+import (
+    "errors"
+    "testing"
+)
+
+func TestChecksumStore(t *testing.T) {
+    inner := NewBTreeStore()
+    s := NewChecksumStore(inner)
+    s.Set("a", "apple")
+    s.Set("empty", "")
+    var b WriteBatch
+    b.Put("b", "banana")
+    if err := s.Write(&b); err != nil {
+        t.Fatal(err)
+    }
+    for k, want := range map[string]string{"a": "apple", "b": "banana", "empty": ""} {
+        if v, err := s.Get(k); err != nil || v != want {
+            t.Fatalf("Get(%s) = %q, %v", k, v, err)
+        }
+    }
+    if raw, _ := inner.Get("a"); len(raw) != len("apple")+4 {
+        t.Fatalf("stored %q", raw)
+    }
+
+    // Corrupt a value behind the store's back.
+    raw, _ := inner.Get("b")
+    inner.Set("b", "B"+raw[1:])
+    if _, err := s.Get("b"); !errors.Is(err, ErrCorrupted) {
+        t.Fatalf("expected ErrCorrupted, got %v", err)
+    }
+    it := s.NewIterator()
+    for it.Next() {
+        it.Value()
+    }
+    if !errors.Is(it.Err(), ErrCorrupted) {
+        t.Fatalf("iterator: expected ErrCorrupted, got %v", it.Err())
+    }
+
+    r, err := s.Verify()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if r.Checked != 3 || len(r.CorruptKeys) != 1 || r.CorruptKeys[0] != "b" {
+        t.Fatalf("report %+v", r)
+    }
+}
+
+func TestChecksumStoreScanHash(t *testing.T) {
+    inner := NewHashStore()
+    s := NewChecksumStore(inner)
+    s.Set("b", "2")
+    s.Set("a", "1")
+    res, err := Scan(s, ScanOptions{})
+    if err != nil || len(res.Pairs) != 2 || res.Pairs[0] != (KV{"a", "1"}) || res.Pairs[1] != (KV{"b", "2"}) {
+        t.Fatalf("Scan = %v, %v", res, err)
+    }
+    raw, _ := inner.Get("a")
+    inner.Set("a", "x"+raw[1:])
+    if _, err := Scan(s, ScanOptions{}); !errors.Is(err, ErrCorrupted) {
+        t.Fatalf("expected ErrCorrupted, got %v", err)
+    }
+}
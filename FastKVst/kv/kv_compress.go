@@ -0,0 +1,169 @@
+package kv
+
+import (
+    "compress/flate"
+    "time"
+)
+
+// CompressOptions configures a CompressStore. Zero values select the
+// defaults.
+type CompressOptions struct {
+    Threshold int         // values shorter than this are stored raw (default 64)
+    Codec     Compression // default FlateCompression
+    Level     int         // flate level (default flate.DefaultCompression)
+}
+
+func (o *CompressOptions) setDefaults() {
+    if o.Threshold <= 0 {
+        o.Threshold = 64
+    }
+    if o.Codec == NoCompression {
+        o.Codec = FlateCompression
+    }
+    if o.Level == 0 {
+        o.Level = flate.DefaultCompression
+    }
+}
+
+// CompressStore compresses values before handing them to the wrapped
+// store. Every stored value starts with a one-byte header naming its codec
+// (NoCompression for values below the threshold or that do not shrink),
+// so compressed and raw values coexist and the options can change between
+// runs. Values must all be written through the CompressStore.
+type CompressStore struct {
+    store KVStore
+    opts  CompressOptions
+}
+
+// NewCompressStore wraps store.
+func NewCompressStore(store KVStore, opts CompressOptions) *CompressStore {
+    opts.setDefaults()
+    return &CompressStore{store: store, opts: opts}
+}
+
+// encode adds the header, compressing value if worthwhile.
+func (s *CompressStore) encode(value string) string {
+    if len(value) >= s.opts.Threshold {
+        if out, ok := compress([]byte{byte(s.opts.Codec)}, []byte(value), s.opts.Codec, s.opts.Level); ok {
+            return bytesToString(out)
+        }
+    }
+    return string([]byte{byte(NoCompression)}) + value
+}
+
+// decodeValue strips the header from a stored value and decompresses it.
+func decodeValue(stored string) (string, error) {
+    if stored == "" {
+        return "", ErrBadCompression
+    }
+    c, body := Compression(stored[0]), stored[1:]
+    if c == NoCompression {
+        return body, nil
+    }
+    out, err := decompress([]byte(body), c)
+    if err != nil {
+        return "", err
+    }
+    return bytesToString(out), nil
+}
+
+// Set compresses value and writes it.
+func (s *CompressStore) Set(key, value string) error {
+    return s.store.Set(key, s.encode(value))
+}
+
+// Get reads and decompresses key.
+func (s *CompressStore) Get(key string) (string, error) {
+    v, err := s.store.Get(key)
+    if err != nil {
+        return "", err
+    }
+    return decodeValue(v)
+}
+
+// Delete deletes key from the wrapped store.
+func (s *CompressStore) Delete(key string) error {
+    return s.store.Delete(key)
+}
+
+// Write applies b to the wrapped store with every value compressed.
+func (s *CompressStore) Write(b *WriteBatch) error {
+    enc := WriteBatch{ops: make([]batchOp, len(b.ops))}
+    for i, op := range b.ops {
+        if !op.delete {
+            op.value = s.encode(op.value)
+        }
+        enc.ops[i] = op
+    }
+    return Write(s.store, &enc)
+}
+
+// SetWithTTL compresses value and writes it with a TTL. It fails with
+// ErrUnsupported if the wrapped store cannot expire keys.
+func (s *CompressStore) SetWithTTL(key, value string, ttl time.Duration) error {
+    return SetWithTTL(s.store, key, s.encode(value), ttl)
+}
+
+// Range reads straight from the wrapped store; keys are not compressed.
+func (s *CompressStore) Range(start, end string) ([]string, error) {
+    return s.store.Range(start, end)
+}
+
+// NewIterator iterates the wrapped store, decompressing values. If that
+// store cannot iterate, the iterator is empty and Err reports
+// ErrUnsupported.
+func (s *CompressStore) NewIterator() Iterator {
+    it, err := NewIterator(s.store)
+    if err != nil {
+        return &sliceIterator{i: -1, err: err}
+    }
+    return newDecodingIterator(it, decodeValue)
+}
+
+// Flush flushes the wrapped store.
+func (s *CompressStore) Flush() error {
+    return s.store.Flush()
+}
+
+// decodingIterator decodes the values of an iterator over a wrapping
+// store's inner store.
+type decodingIterator struct {
+    Iterator
+    decode func(string) (string, error)
+    err    error
+}
+
+// newDecodingIterator wraps it to decode values. An unordered iterator is
+// decoded up front into another one, so that Scan still sorts it; the
+// first value that fails to decode ends it and is reported by Err.
+func newDecodingIterator(it Iterator, decode func(string) (string, error)) Iterator {
+    si, ok := it.(*sliceIterator)
+    if !ok {
+        return &decodingIterator{Iterator: it, decode: decode}
+    }
+    out := &sliceIterator{i: -1, err: si.err}
+    for _, p := range si.pairs {
+        v, err := decode(p.Value)
+        if err != nil {
+            out.err = err
+            break
+        }
+        out.pairs = append(out.pairs, KV{p.Key, v})
+    }
+    return out
+}
+
+func (it *decodingIterator) Value() string {
+    v, err := it.decode(it.Iterator.Value())
+    if err != nil && it.err == nil {
+        it.err = err
+    }
+    return v
+}
+
+func (it *decodingIterator) Err() error {
+    if err := it.Iterator.Err(); err != nil {
+        return err
+    }
+    return it.err
+}
@@ -0,0 +1,100 @@
+package kv
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+)
+
+func TestCompressStore(t *testing.T) {
+    inner := NewBTreeStore()
+    s := NewCompressStore(inner, CompressOptions{Threshold: 32})
+    big := strings.Repeat(`{"name":"value","n":1}`, 20)
+    s.Set("small", "tiny")
+    s.Set("big", big)
+    s.Set("empty", "")
+
+    for k, want := range map[string]string{"small": "tiny", "big": big, "empty": ""} {
+        if v, err := s.Get(k); err != nil || v != want {
+            t.Fatalf("Get(%s) = %q, %v", k, v, err)
+        }
+    }
+    raw, _ := inner.Get("big")
+    if raw[0] != byte(FlateCompression) || len(raw) >= len(big)/2 {
+        t.Fatalf("big stored as %d bytes with header %d", len(raw), raw[0])
+    }
+    if raw, _ := inner.Get("small"); raw != "\x00tiny" {
+        t.Fatalf("small stored as %q", raw)
+    }
+
+    var b WriteBatch
+    b.Put("batch", big)
+    b.Delete("small")
+    if err := s.Write(&b); err != nil {
+        t.Fatal(err)
+    }
+    if v, err := s.Get("batch"); err != nil || v != big {
+        t.Fatalf("batch value: %v", err)
+    }
+
+    var got []string
+    it := s.NewIterator()
+    for it.Next() {
+        got = append(got, fmt.Sprintf("%s=%d", it.Key(), len(it.Value())))
+    }
+    if err := it.Err(); err != nil {
+        t.Fatal(err)
+    }
+    want := fmt.Sprintf("[batch=%d big=%d empty=0]", len(big), len(big))
+    if fmt.Sprint(got) != want {
+        t.Fatalf("iterated %v, want %v", got, want)
+    }
+
+    inner.Set("corrupt", "\x01not flate")
+    if _, err := s.Get("corrupt"); err != ErrBadCompression {
+        t.Fatalf("expected ErrBadCompression, got %v", err)
+    }
+}
+
+func TestCompressStoreScanHash(t *testing.T) {
+    s := NewCompressStore(NewHashStore(), CompressOptions{Threshold: 32})
+    big := strings.Repeat("x", 100)
+    s.Set("b", big)
+    s.Set("a", "tiny")
+    s.Set("c", "")
+    res, err := Scan(s, ScanOptions{Limit: 2})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if fmt.Sprint(res.Pairs) != fmt.Sprintf("[{a tiny} {b %s}]", big) || res.NextCursor == "" {
+        t.Fatalf("Scan = %v", res)
+    }
+}
+
+func TestLSMCompressedTables(t *testing.T) {
+    dir := t.TempDir()
+    opts := LSMOptions{Dir: dir, MemtableSize: 100, Compression: FlateCompression}
+    l, err := NewLSMStoreWithOptions(opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    val := strings.Repeat("abcdefgh", 16)
+    for i := 0; i < 1000; i++ {
+        l.Set(fmt.Sprintf("key%04d", i), val)
+    }
+    l.Flush()
+    l.Close()
+
+    // Reopen without compression: old compressed tables stay readable.
+    opts.Compression = NoCompression
+    l, err = NewLSMStoreWithOptions(opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    for _, i := range []int{0, 500, 999} {
+        if v, err := l.Get(fmt.Sprintf("key%04d", i)); err != nil || v != val {
+            t.Fatalf("key%04d: %v", i, err)
+        }
+    }
+}
@@ -0,0 +1,79 @@
+package kv
+
+import "time"
+
+// CondWriter is implemented by stores that support conditional writes.
+// Each operation checks and writes atomically and reports whether the
+// write happened. Expired keys count as absent.
+type CondWriter interface {
+    // CompareAndSwap sets key to new if its current value is old.
+    CompareAndSwap(key, old, new string) (bool, error)
+    // SetIfAbsent sets key to value if key does not exist.
+    SetIfAbsent(key, value string) (bool, error)
+    // DeleteIfValue deletes key if its current value is value.
+    DeleteIfValue(key, value string) (bool, error)
+}
+
+// CompareAndSwap sets key to new in s if its current value is old, or
+// returns ErrUnsupported if s has no conditional writes.
+func CompareAndSwap(s KVStore, key, old, new string) (bool, error) {
+    c, ok := s.(CondWriter)
+    if !ok {
+        return false, ErrUnsupported
+    }
+    return c.CompareAndSwap(key, old, new)
+}
+
+// SetIfAbsent sets key to value in s if key does not exist, or returns
+// ErrUnsupported if s has no conditional writes.
+func SetIfAbsent(s KVStore, key, value string) (bool, error) {
+    c, ok := s.(CondWriter)
+    if !ok {
+        return false, ErrUnsupported
+    }
+    return c.SetIfAbsent(key, value)
+}
+
+// DeleteIfValue deletes key from s if its current value is value, or
+// returns ErrUnsupported if s has no conditional writes.
+func DeleteIfValue(s KVStore, key, value string) (bool, error) {
+    c, ok := s.(CondWriter)
+    if !ok {
+        return false, ErrUnsupported
+    }
+    return c.DeleteIfValue(key, value)
+}
+
+// TTLCondWriter is implemented by stores that can set a key with a TTL
+// only if it does not exist, checking and writing atomically.
+type TTLCondWriter interface {
+    SetIfAbsentWithTTL(key, value string, ttl time.Duration) (bool, error)
+}
+
+// SetIfAbsentWithTTL sets key to value in s, expiring after ttl, if key
+// does not exist. It returns ErrUnsupported if s cannot do so atomically.
+func SetIfAbsentWithTTL(s KVStore, key, value string, ttl time.Duration) (bool, error) {
+    c, ok := s.(TTLCondWriter)
+    if !ok {
+        return false, ErrUnsupported
+    }
+    return c.SetIfAbsentWithTTL(key, value, ttl)
+}
+
+// condOp selects one of the CondWriter operations.
+type condOp int
+
+const (
+    condSwap condOp = iota
+    condIfAbsent
+    condDeleteIf
+)
+
+// holds reports whether op applies to a key whose current value is cur
+// (present is false if the key does not exist).
+func (op condOp) holds(cur string, present bool, want string) bool {
+    if op == condIfAbsent {
+        return !present
+    }
+    return present && cur == want
+}
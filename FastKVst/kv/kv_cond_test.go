@@ -0,0 +1,125 @@
+package kv
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/thilakshekharshriyan/m/wal"
+)
+
+func TestCondWrites(t *testing.T) {
+    stores := orderedStores()
+    stores["hash"] = NewHashStore()
+    stores["sharded"] = NewShardedHashStore(4)
+    d, err := OpenDurableStore(t.TempDir(), NewHashStore(), wal.Options{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer d.Close()
+    stores["durable"] = d
+    for name, s := range stores {
+        t.Run(name, func(t *testing.T) {
+            check := func(what string, got bool, err error, want bool) {
+                t.Helper()
+                if err != nil || got != want {
+                    t.Fatalf("%s = %v, %v; want %v", what, got, err, want)
+                }
+            }
+            ok, err := SetIfAbsent(s, "k", "1")
+            check("SetIfAbsent(absent)", ok, err, true)
+            ok, err = SetIfAbsent(s, "k", "2")
+            check("SetIfAbsent(present)", ok, err, false)
+            ok, err = CompareAndSwap(s, "k", "2", "3")
+            check("CompareAndSwap(wrong old)", ok, err, false)
+            ok, err = CompareAndSwap(s, "k", "1", "3")
+            check("CompareAndSwap", ok, err, true)
+            ok, err = CompareAndSwap(s, "missing", "", "x")
+            check("CompareAndSwap(absent)", ok, err, false)
+            ok, err = DeleteIfValue(s, "k", "1")
+            check("DeleteIfValue(wrong value)", ok, err, false)
+            if v, _ := s.Get("k"); v != "3" {
+                t.Fatalf("expected 3, got %q", v)
+            }
+            ok, err = DeleteIfValue(s, "k", "3")
+            check("DeleteIfValue", ok, err, true)
+            if _, err := s.Get("k"); err != ErrNotFound {
+                t.Fatalf("expected ErrNotFound, got %v", err)
+            }
+        })
+    }
+}
+
+func TestCondWritesExpired(t *testing.T) {
+    now := fakeClock(t)
+    for name, s := range map[string]KVStore{"hash": NewHashStore(), "btree": NewBTreeStore(), "lsm": NewLSMStore()} {
+        s.(Expirer).SetWithTTL("lease", "owner", time.Second)
+        if ok, _ := SetIfAbsent(s, "lease", "other"); ok {
+            t.Fatalf("%s: live lease was taken", name)
+        }
+        *now = now.Add(2 * time.Second)
+        if ok, err := SetIfAbsent(s, "lease", "other"); !ok || err != nil {
+            t.Fatalf("%s: expired lease not taken: %v", name, err)
+        }
+        *now = now.Add(-2 * time.Second)
+    }
+}
+
+func TestSetIfAbsentWithTTL(t *testing.T) {
+    now := fakeClock(t)
+    for name, s := range map[string]KVStore{"hash": NewHashStore(), "sharded": NewShardedHashStore(4), "btree": NewBTreeStore(), "lsm": NewLSMStore()} {
+        if _, err := SetIfAbsentWithTTL(s, "lock", "a", 0); err != ErrInvalidTTL {
+            t.Fatalf("%s: zero TTL = %v", name, err)
+        }
+        if ok, err := SetIfAbsentWithTTL(s, "lock", "a", time.Second); !ok || err != nil {
+            t.Fatalf("%s: first take = %v, %v", name, ok, err)
+        }
+        if ok, _ := SetIfAbsentWithTTL(s, "lock", "b", time.Second); ok {
+            t.Fatalf("%s: held lock was taken", name)
+        }
+        if ttl, err := s.(Expirer).TTL("lock"); err != nil || ttl != time.Second {
+            t.Fatalf("%s: TTL = %v, %v", name, ttl, err)
+        }
+        *now = now.Add(2 * time.Second)
+        if ok, err := SetIfAbsentWithTTL(s, "lock", "b", time.Second); !ok || err != nil {
+            t.Fatalf("%s: expired lock not taken: %v", name, err)
+        }
+        *now = now.Add(-2 * time.Second)
+    }
+    if _, err := SetIfAbsentWithTTL(NewTrieStore(), "k", "v", time.Second); err != ErrUnsupported {
+        t.Fatalf("trie: expected ErrUnsupported, got %v", err)
+    }
+}
+
+func TestCompareAndSwapCounter(t *testing.T) {
+    for name, s := range map[string]KVStore{"hash": NewHashStore(), "btree": NewBTreeStore(), "trie": NewTrieStore(), "skiplist": NewSkipListStore(), "lsm": NewLSMStore()} {
+        t.Run(name, func(t *testing.T) {
+            s.Set("n", "0")
+            var wg sync.WaitGroup
+            var retries atomic.Int64
+            for i := 0; i < 8; i++ {
+                wg.Add(1)
+                go func() {
+                    defer wg.Done()
+                    for j := 0; j < 50; j++ {
+                        for {
+                            v, _ := s.Get("n")
+                            var n int
+                            fmt.Sscan(v, &n)
+                            if ok, _ := CompareAndSwap(s, "n", v, fmt.Sprint(n+1)); ok {
+                                break
+                            }
+                            retries.Add(1)
+                        }
+                    }
+                }()
+            }
+            wg.Wait()
+            if v, _ := s.Get("n"); v != "400" {
+                t.Fatalf("expected 400 after %d retries, got %s", retries.Load(), v)
+            }
+        })
+    }
+}
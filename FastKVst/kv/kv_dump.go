@@ -0,0 +1,276 @@
+package kv
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// Dump stream format:
+//
+//   magic "FSKVDUMP" | u32 version | record* | end record
+//
+// A record is u8(1) uvarint(len(key)) key uvarint(len(value)) value
+// varint(expires) u32 crc, where expires is the expiry time in Unix
+// nanoseconds (0 for none) and crc is the CRC32C of the record's bytes
+// before it. The end record is u8(0) u64 count u32 crc, count being the
+// number of records, so a truncated stream is detected.
+const (
+    dumpMagic   = "FSKVDUMP"
+    dumpVersion = 1
+)
+
+var errBadDump = fmt.Errorf("kv: malformed dump: %w", ErrCorrupted)
+
+// Dump writes every live key of s, with its TTL if s is an Expirer, to w.
+// It needs s to be Iterable and returns ErrUnsupported otherwise. The
+// dump is consistent only if s is not written meanwhile, or s iterates
+// over a snapshot.
+func Dump(s KVStore, w io.Writer) error {
+    bw := bufio.NewWriter(w)
+    hdr := binary.LittleEndian.AppendUint32([]byte(dumpMagic), dumpVersion)
+    if _, err := bw.Write(hdr); err != nil {
+        return err
+    }
+    var rec []byte
+    var count uint64
+    err := EachEntry(s, func(key, value string, expires int64) error {
+        rec = append(rec[:0], 1)
+        rec = binary.AppendUvarint(rec, uint64(len(key)))
+        rec = append(rec, key...)
+        rec = binary.AppendUvarint(rec, uint64(len(value)))
+        rec = append(rec, value...)
+        rec = binary.AppendVarint(rec, expires)
+        rec = binary.LittleEndian.AppendUint32(rec, crc32.Checksum(rec, castagnoli))
+        count++
+        _, err := bw.Write(rec)
+        return err
+    })
+    if err != nil {
+        return err
+    }
+    rec = binary.LittleEndian.AppendUint64(append(rec[:0], 0), count)
+    rec = binary.LittleEndian.AppendUint32(rec, crc32.Checksum(rec, castagnoli))
+    if _, err := bw.Write(rec); err != nil {
+        return err
+    }
+    return bw.Flush()
+}
+
+// EachEntry calls fn for every live key of s with its expiry time in Unix
+// nanoseconds, 0 if it has none, stopping at the first error. It needs s
+// to be Iterable; like Dump, it sees a consistent view only if s is not
+// written meanwhile.
+func EachEntry(s KVStore, fn func(key, value string, expires int64) error) error {
+    it, err := NewIterator(s)
+    if err != nil {
+        return err
+    }
+    defer it.Close()
+    exp, _ := s.(Expirer)
+    for it.Next() {
+        var expires int64
+        if exp != nil {
+            ttl, err := exp.TTL(it.Key())
+            if err == ErrNotFound {
+                continue // expired or deleted since the iterator started
+            }
+            if err != nil {
+                return err
+            }
+            if ttl != NoExpiry {
+                expires = clock().Add(ttl).UnixNano()
+            }
+        }
+        if err := fn(it.Key(), it.Value(), expires); err != nil {
+            return err
+        }
+    }
+    return it.Err()
+}
+
+// Load reads a stream written by Dump into s, overwriting keys it already
+// holds. Keys that expired since the dump are skipped. Records are applied
+// as they are read, so on error (ErrCorrupted for a damaged or truncated
+// stream) s may hold a prefix of the dump.
+func Load(s KVStore, r io.Reader) error {
+    br := bufio.NewReader(r)
+    hdr := make([]byte, len(dumpMagic)+4)
+    if _, err := io.ReadFull(br, hdr); err != nil {
+        return errBadDump
+    }
+    if string(hdr[:len(dumpMagic)]) != dumpMagic {
+        return errBadDump
+    }
+    if v := binary.LittleEndian.Uint32(hdr[len(dumpMagic):]); v != dumpVersion {
+        return fmt.Errorf("kv: unsupported dump version %d", v)
+    }
+    cr := &crcReader{r: br}
+    var count uint64
+    for {
+        cr.crc = 0
+        kind, err := cr.ReadByte()
+        if err != nil {
+            return errBadDump
+        }
+        if kind == 0 {
+            var n [8]byte
+            if _, err := io.ReadFull(cr, n[:]); err != nil {
+                return errBadDump
+            }
+            if err := cr.check(); err != nil {
+                return err
+            }
+            if binary.LittleEndian.Uint64(n[:]) != count {
+                return errBadDump
+            }
+            return nil
+        }
+        if kind != 1 {
+            return errBadDump
+        }
+        key, err := cr.readString()
+        if err != nil {
+            return err
+        }
+        value, err := cr.readString()
+        if err != nil {
+            return err
+        }
+        expires, err := binary.ReadVarint(cr)
+        if err != nil {
+            return errBadDump
+        }
+        if err := cr.check(); err != nil {
+            return err
+        }
+        count++
+        if _, err := restore(s, key, value, expires); err != nil {
+            return fmt.Errorf("kv: load %q: %w", key, err)
+        }
+    }
+}
+
+// restore writes key→value to s with the given expiry time, unless that
+// has passed, and reports whether it wrote.
+func restore(s KVStore, key, value string, expires int64) (bool, error) {
+    if expires == 0 {
+        return true, s.Set(key, value)
+    }
+    ttl := time.Duration(expires - clock().UnixNano())
+    if ttl <= 0 {
+        return false, nil
+    }
+    return true, SetWithTTL(s, key, value, ttl)
+}
+
+// crcReader checksums the bytes read through it.
+type crcReader struct {
+    r   *bufio.Reader
+    crc uint32
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+    n, err := c.r.Read(p)
+    c.crc = crc32.Update(c.crc, castagnoli, p[:n])
+    return n, err
+}
+
+func (c *crcReader) ReadByte() (byte, error) {
+    b, err := c.r.ReadByte()
+    if err == nil {
+        c.crc = crc32.Update(c.crc, castagnoli, []byte{b})
+    }
+    return b, err
+}
+
+// readString reads a uvarint length-prefixed string.
+func (c *crcReader) readString() (string, error) {
+    n, err := binary.ReadUvarint(c)
+    if err != nil {
+        return "", errBadDump
+    }
+    // Read through a limit rather than allocating n bytes up front, so a
+    // corrupt length cannot exhaust memory.
+    buf, err := io.ReadAll(io.LimitReader(c, int64(n)))
+    if err != nil || uint64(len(buf)) != n {
+        return "", errBadDump
+    }
+    return bytesToString(buf), nil
+}
+
+// check reads a record's stored checksum and compares it with the bytes
+// read so far.
+func (c *crcReader) check() error {
+    var sum [4]byte
+    if _, err := io.ReadFull(c.r, sum[:]); err != nil {
+        return errBadDump
+    }
+    if binary.LittleEndian.Uint32(sum[:]) != c.crc {
+        return fmt.Errorf("kv: dump record checksum mismatch: %w", ErrCorrupted)
+    }
+    return nil
+}
+
+// Migrate copies every live key of src, with its TTL, into dst and
+// returns how many were copied. It needs src to be Iterable.
+func Migrate(dst, src KVStore) (int, error) {
+    n := 0
+    err := EachEntry(src, func(key, value string, expires int64) error {
+        ok, err := restore(dst, key, value, expires)
+        if err != nil {
+            return fmt.Errorf("kv: migrate %q: %w", key, err)
+        }
+        if ok {
+            n++
+        }
+        return nil
+    })
+    return n, err
+}
+
+// dumpFile atomically replaces path with a dump of s.
+func dumpFile(s KVStore, path string) error {
+    tmp := path + ".tmp"
+    f, err := os.Create(tmp)
+    if err != nil {
+        return err
+    }
+    if err := Dump(s, f); err != nil {
+        f.Close()
+        os.Remove(tmp)
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        os.Remove(tmp)
+        return err
+    }
+    if err := f.Close(); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        return err
+    }
+    return syncDir(filepath.Dir(path))
+}
+
+// loadFile loads the dump at path into s; a missing file is not an error.
+func loadFile(s KVStore, path string) error {
+    f, err := os.Open(path)
+    if errors.Is(err, os.ErrNotExist) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    return Load(s, f)
+}
@@ -0,0 +1,148 @@
+package kv
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "path/filepath"
+    "sort"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestDumpLoad(t *testing.T) {
+    now := fakeClock(t)
+    stores := orderedStores()
+    stores["hash"] = NewHashStore()
+    stores["sharded"] = NewShardedHashStore(4)
+    for name, s := range stores {
+        t.Run(name, func(t *testing.T) {
+            s.Set("a", "1")
+            s.Set("b", "")
+            s.Set("bin\x00\xff", "v\x00")
+            SetWithTTL(s, "short", "x", time.Second)
+            SetWithTTL(s, "long", "y", time.Hour)
+            var buf bytes.Buffer
+            if err := Dump(s, &buf); err != nil {
+                t.Fatal(err)
+            }
+
+            *now = now.Add(time.Minute)
+            dst := NewBTreeStore()
+            if err := Load(dst, bytes.NewReader(buf.Bytes())); err != nil {
+                t.Fatal(err)
+            }
+            want := "[a=1 b= bin\x00\xff=v\x00]"
+            if _, ok := s.(Expirer); ok {
+                want = "[a=1 b= bin\x00\xff=v\x00 long=y]"
+            }
+            if got := fmt.Sprint(collect(dst.NewIterator(), true)); got != want {
+                t.Fatalf("loaded %q, want %q", got, want)
+            }
+            if _, ok := s.(Expirer); ok {
+                if ttl, _ := dst.TTL("long"); ttl != time.Hour-time.Minute {
+                    t.Fatalf("long ttl %v", ttl)
+                }
+            }
+        })
+    }
+}
+
+func TestLoadCorrupt(t *testing.T) {
+    s := NewHashStore()
+    for i := 0; i < 10; i++ {
+        s.Set(fmt.Sprintf("key%d", i), "value")
+    }
+    var buf bytes.Buffer
+    if err := Dump(s, &buf); err != nil {
+        t.Fatal(err)
+    }
+    dump := buf.Bytes()
+
+    flipped := append([]byte(nil), dump...)
+    flipped[len(flipped)/2] ^= 1
+    for name, data := range map[string][]byte{
+        "flipped":   flipped,
+        "truncated": dump[:len(dump)-3],
+        "cut":       dump[:len(dump)/2],
+        "empty":     nil,
+    } {
+        if err := Load(NewHashStore(), bytes.NewReader(data)); !errors.Is(err, ErrCorrupted) {
+            t.Fatalf("%s: expected ErrCorrupted, got %v", name, err)
+        }
+    }
+    if err := Dump(&TxnStore{}, &buf); err != ErrUnsupported {
+        t.Fatalf("expected ErrUnsupported, got %v", err)
+    }
+}
+
+func TestMigrate(t *testing.T) {
+    src := NewHashStore()
+    for i := 0; i < 500; i++ {
+        src.Set(fmt.Sprintf("key%03d", i), fmt.Sprint(i))
+    }
+    dst, err := OpenLSMStore(t.TempDir())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer dst.Close()
+    if n, err := Migrate(dst, src); err != nil || n != 500 {
+        t.Fatalf("Migrate = %d, %v", n, err)
+    }
+    if v, err := dst.Get("key123"); err != nil || v != "123" {
+        t.Fatalf("key123 = %q, %v", v, err)
+    }
+}
+
+func TestHashStoreFlush(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "hash.dump")
+    h, err := OpenHashStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    h.Set("a", "1")
+    h.Set("b", "2")
+    if err := h.Flush(); err != nil {
+        t.Fatal(err)
+    }
+    h.Set("c", "unflushed")
+
+    h, err = OpenHashStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var keys []string
+    for it := h.NewIterator(); it.Next(); {
+        keys = append(keys, it.Key()+"="+it.Value())
+    }
+    sort.Strings(keys)
+    if fmt.Sprint(keys) != "[a=1 b=2]" {
+        t.Fatalf("reopened with %v", keys)
+    }
+
+    // Concurrent Flushes share the temporary file one at a time.
+    var wg sync.WaitGroup
+    errs := make(chan error, 8)
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            h.Set(fmt.Sprint("k", i), "v")
+            errs <- h.Flush()
+        }()
+    }
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    if h, err = OpenHashStore(path); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := h.Get("k7"); err != nil {
+        t.Fatalf("Get(k7) after concurrent flushes: %v", err)
+    }
+}
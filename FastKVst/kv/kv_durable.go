@@ -0,0 +1,326 @@
+package kv
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "sync"
+    "time"
+
+    "github.com/thilakshekharshriyan/m/wal"
+)
+
+// WAL record operations.
+const (
+    walOpSet byte = iota + 1
+    walOpDelete
+    walOpBatch
+    walOpSetTTL // a set followed by uvarint(expiry in Unix nanoseconds)
+)
+
+// errBadWALRecord is returned for a log record that cannot be decoded.
+var errBadWALRecord = fmt.Errorf("kv: malformed wal record: %w", ErrCorrupted)
+
+// DurableStore makes any KVStore crash-safe by appending every mutation to
+// a write-ahead log before applying it.
+type DurableStore struct {
+    mu    sync.Mutex // keeps log order identical to apply order
+    store KVStore
+    log   *wal.Log
+}
+
+// OpenDurableStore opens the WAL in dir, replays it into store and returns
+// a DurableStore that logs further writes. store should be empty (or hold
+// only what its own persistence restored).
+func OpenDurableStore(dir string, store KVStore, opts wal.Options) (*DurableStore, error) {
+    log, err := wal.Open(dir, opts)
+    if err != nil {
+        return nil, err
+    }
+    if err := Recover(store, log); err != nil {
+        log.Close()
+        return nil, err
+    }
+    return &DurableStore{store: store, log: log}, nil
+}
+
+// Recover replays every record in log into store. A corrupt log yields
+// an error wrapping ErrCorrupted.
+func Recover(store KVStore, log *wal.Log) error {
+    err := log.Replay(func(rec []byte) error {
+        b, err := decodeWALRecord(rec)
+        if err != nil {
+            return err
+        }
+        return Write(store, b)
+    })
+    if errors.Is(err, wal.ErrCorrupt) {
+        return fmt.Errorf("%w: %w", ErrCorrupted, err)
+    }
+    return err
+}
+
+// Set logs and applies a write.
+func (d *DurableStore) Set(key, value string) error {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if err := d.log.Append(encodeWALRecord(walOpSet, key, value)); err != nil {
+        return err
+    }
+    return d.store.Set(key, value)
+}
+
+// Get reads straight from the wrapped store.
+func (d *DurableStore) Get(key string) (string, error) {
+    return d.store.Get(key)
+}
+
+// Delete logs and applies a delete.
+func (d *DurableStore) Delete(key string) error {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if err := d.log.Append(encodeWALRecord(walOpDelete, key, "")); err != nil {
+        return err
+    }
+    return d.store.Delete(key)
+}
+
+// Write logs b as a single record and applies it. The batch is applied
+// atomically if the wrapped store implements Batcher.
+func (d *DurableStore) Write(b *WriteBatch) error {
+    if b.Len() == 0 {
+        return nil
+    }
+    _, ttlOK := d.store.(Expirer)
+    if err := b.check(ttlOK); err != nil {
+        return err
+    }
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if err := d.log.Append(encodeWALBatch(b)); err != nil {
+        return err
+    }
+    return Write(d.store, b)
+}
+
+// SetWithTTL logs and applies a write that expires after ttl. It fails
+// with ErrUnsupported if the wrapped store cannot expire keys.
+func (d *DurableStore) SetWithTTL(key, value string, ttl time.Duration) error {
+    var b WriteBatch
+    b.PutWithTTL(key, value, ttl)
+    return d.Write(&b)
+}
+
+// TTL reads straight from the wrapped store.
+func (d *DurableStore) TTL(key string) (time.Duration, error) {
+    e, ok := d.store.(Expirer)
+    if !ok {
+        return 0, ErrUnsupported
+    }
+    return e.TTL(key)
+}
+
+// ExpiredKeys reports the wrapped store's count, or 0 if it cannot expire
+// keys.
+func (d *DurableStore) ExpiredKeys() uint64 {
+    if e, ok := d.store.(Expirer); ok {
+        return e.ExpiredKeys()
+    }
+    return 0
+}
+
+// Expire logs and applies a change to key's TTL, deleting it if ttl is
+// not positive. d.mu makes it atomic with respect to every other write
+// through d. It fails with ErrUnsupported if the wrapped store cannot
+// expire keys.
+func (d *DurableStore) Expire(key string, ttl time.Duration) (bool, error) {
+    if _, ok := d.store.(Expirer); !ok {
+        return false, ErrUnsupported
+    }
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    cur, err := d.store.Get(key)
+    if err == ErrNotFound {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    var b WriteBatch
+    if ttl <= 0 {
+        b.Delete(key)
+    } else {
+        b.PutWithTTL(key, cur, ttl)
+    }
+    if err := d.log.Append(encodeWALBatch(&b)); err != nil {
+        return false, err
+    }
+    return true, Write(d.store, &b)
+}
+
+// CompareAndSwap sets key to new if its current value is old.
+func (d *DurableStore) CompareAndSwap(key, old, new string) (bool, error) {
+    return d.conditional(condSwap, key, old, new)
+}
+
+// SetIfAbsent sets key to value if key does not exist.
+func (d *DurableStore) SetIfAbsent(key, value string) (bool, error) {
+    return d.conditional(condIfAbsent, key, "", value)
+}
+
+// DeleteIfValue deletes key if its current value is value.
+func (d *DurableStore) DeleteIfValue(key, value string) (bool, error) {
+    return d.conditional(condDeleteIf, key, value, "")
+}
+
+// conditional checks op against the wrapped store and logs and applies
+// the write if it holds. d.mu makes the check and write atomic with
+// respect to every other write through d.
+func (d *DurableStore) conditional(op condOp, key, want, value string) (bool, error) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    cur, err := d.store.Get(key)
+    if err != nil && err != ErrNotFound {
+        return false, err
+    }
+    if !op.holds(cur, err == nil, want) {
+        return false, nil
+    }
+    if op == condDeleteIf {
+        if err := d.log.Append(encodeWALRecord(walOpDelete, key, "")); err != nil {
+            return false, err
+        }
+        return true, d.store.Delete(key)
+    }
+    if err := d.log.Append(encodeWALRecord(walOpSet, key, value)); err != nil {
+        return false, err
+    }
+    return true, d.store.Set(key, value)
+}
+
+// Range reads straight from the wrapped store.
+func (d *DurableStore) Range(start, end string) ([]string, error) {
+    return d.store.Range(start, end)
+}
+
+// NewIterator iterates the wrapped store. If that store cannot iterate, the
+// iterator is empty and Err reports ErrUnsupported.
+func (d *DurableStore) NewIterator() Iterator {
+    if it, ok := d.store.(Iterable); ok {
+        return it.NewIterator()
+    }
+    return &sliceIterator{i: -1, err: ErrUnsupported}
+}
+
+// Flush flushes the wrapped store. If that store persists its own data
+// (an LSMStore with a directory) the log is checkpointed, since everything
+// in it is now on disk elsewhere.
+func (d *DurableStore) Flush() error {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if err := d.store.Flush(); err != nil {
+        return err
+    }
+    if p, ok := d.store.(interface{ persistent() bool }); ok && p.persistent() {
+        return d.log.Checkpoint()
+    }
+    return d.log.Sync()
+}
+
+// Close closes the log and, if it has a Close method, the wrapped store.
+func (d *DurableStore) Close() error {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    err := d.log.Close()
+    if c, ok := d.store.(io.Closer); ok {
+        if cerr := c.Close(); err == nil {
+            err = cerr
+        }
+    }
+    return err
+}
+
+// encodeWALRecord encodes op uvarint(len(key)) key uvarint(len(value)) value.
+func encodeWALRecord(op byte, key, value string) []byte {
+    buf := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(key)+len(value))
+    return appendWALOp(buf, op, key, value)
+}
+
+// encodeWALBatch encodes walOpBatch uvarint(count) followed by count
+// operations in encodeWALRecord's format. TTLs are logged as absolute
+// expiry times so replay does not extend them.
+func encodeWALBatch(b *WriteBatch) []byte {
+    buf := []byte{walOpBatch}
+    buf = binary.AppendUvarint(buf, uint64(len(b.ops)))
+    for _, op := range b.ops {
+        switch {
+        case op.delete:
+            buf = appendWALOp(buf, walOpDelete, op.key, "")
+        case op.withTTL:
+            buf = appendWALOp(buf, walOpSetTTL, op.key, op.value)
+            buf = binary.AppendUvarint(buf, uint64(deadline(op.ttl)))
+        default:
+            buf = appendWALOp(buf, walOpSet, op.key, op.value)
+        }
+    }
+    return buf
+}
+
+func appendWALOp(buf []byte, op byte, key, value string) []byte {
+    buf = append(buf, op)
+    buf = binary.AppendUvarint(buf, uint64(len(key)))
+    buf = append(buf, key...)
+    buf = binary.AppendUvarint(buf, uint64(len(value)))
+    buf = append(buf, value...)
+    return buf
+}
+
+// decodeWALRecord decodes a single-operation or batch record into a batch.
+// A TTL write whose expiry has passed becomes a delete.
+func decodeWALRecord(rec []byte) (*WriteBatch, error) {
+    if len(rec) == 0 {
+        return nil, errBadWALRecord
+    }
+    n, rest := uint64(1), rec
+    if rec[0] == walOpBatch {
+        var ok bool
+        if n, rest, ok = readUvarint(rec[1:]); !ok {
+            return nil, errBadWALRecord
+        }
+    }
+    b := &WriteBatch{}
+    for i := uint64(0); i < n; i++ {
+        if len(rest) == 0 {
+            return nil, errBadWALRecord
+        }
+        op := rest[0]
+        var key, value string
+        var ok bool
+        if key, rest, ok = readString(rest[1:]); !ok {
+            return nil, errBadWALRecord
+        }
+        if value, rest, ok = readString(rest); !ok {
+            return nil, errBadWALRecord
+        }
+        switch op {
+        case walOpSet:
+            b.Put(key, value)
+        case walOpSetTTL:
+            var exp uint64
+            if exp, rest, ok = readUvarint(rest); !ok {
+                return nil, errBadWALRecord
+            }
+            if ttl := remaining(int64(exp), clock().UnixNano()); ttl > 0 {
+                b.PutWithTTL(key, value, ttl)
+            } else {
+                b.Delete(key)
+            }
+        case walOpDelete:
+            b.Delete(key)
+        default:
+            return nil, fmt.Errorf("%w: unknown op %d", errBadWALRecord, op)
+        }
+    }
+    return b, nil
+}
@@ -0,0 +1,71 @@
+package kv
+
+import (
+    "testing"
+
+    "github.com/thilakshekharshriyan/m/wal"
+)
+
+func TestDurableStoreRecover(t *testing.T) {
+    dir := t.TempDir()
+    d, err := OpenDurableStore(dir, NewHashStore(), wal.Options{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    d.Set("a", "1")
+    d.Set("b", "2")
+    d.Set("a", "3")
+    d.Delete("b")
+    if err := d.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    // Rebuild a different store type from the same log.
+    bt := NewBTreeStore()
+    d, err = OpenDurableStore(dir, bt, wal.Options{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer d.Close()
+    if v, err := bt.Get("a"); err != nil || v != "3" {
+        t.Fatalf("expected 3, got %q, err=%v", v, err)
+    }
+    if _, err := bt.Get("b"); err != ErrNotFound {
+        t.Fatalf("expected ErrNotFound, got %v", err)
+    }
+}
+
+func TestDurableStoreCheckpoint(t *testing.T) {
+    dir := t.TempDir()
+    lsm, err := OpenLSMStore(dir + "/data")
+    if err != nil {
+        t.Fatal(err)
+    }
+    d, err := OpenDurableStore(dir+"/wal", lsm, wal.Options{Sync: wal.SyncNever})
+    if err != nil {
+        t.Fatal(err)
+    }
+    d.Set("flushed", "1")
+    if err := d.Flush(); err != nil {
+        t.Fatal(err)
+    }
+    d.Set("logged", "2")
+    if err := d.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    lsm, err = OpenLSMStore(dir + "/data")
+    if err != nil {
+        t.Fatal(err)
+    }
+    d, err = OpenDurableStore(dir+"/wal", lsm, wal.Options{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer d.Close()
+    for k, want := range map[string]string{"flushed": "1", "logged": "2"} {
+        if v, err := d.Get(k); err != nil || v != want {
+            t.Fatalf("%s: expected %s, got %q, err=%v", k, want, v, err)
+        }
+    }
+}
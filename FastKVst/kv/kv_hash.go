@@ -2,12 +2,17 @@ package kv
 
 import (
     "sync"
+    "time"
 )
 
 // HashStore is a simple in‑memory hashmap with RWMutex for concurrency.
 type HashStore struct {
     mu    sync.RWMutex
     store map[string]string
+    ttl   ttlIndex
+    path  string // dump file written by Flush; "" for a purely in-memory store
+
+    flushMu sync.Mutex // one Flush at a time, so dumps land in order
 }
 
 // NewHashStore constructs a ready‑to‑use HashStore.
@@ -17,46 +22,251 @@ func NewHashStore() *HashStore {
     }
 }
 
+// OpenHashStore returns a HashStore loaded from the dump file at path, if
+// it exists, whose Flush rewrites that file.
+func OpenHashStore(path string) (*HashStore, error) {
+    h := NewHashStore()
+    h.path = path
+    if err := loadFile(h, path); err != nil {
+        return nil, err
+    }
+    return h, nil
+}
+
 // Set inserts or updates a key.
 func (h *HashStore) Set(key, value string) error {
     h.mu.Lock()
     defer h.mu.Unlock()
 
     h.store[key] = value
+    h.ttl.set(key, 0)
+    return nil
+}
+
+// SetWithTTL inserts or updates a key that expires after ttl.
+func (h *HashStore) SetWithTTL(key, value string, ttl time.Duration) error {
+    if ttl <= 0 {
+        return ErrInvalidTTL
+    }
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.store[key] = value
+    h.ttl.set(key, deadline(ttl))
     return nil
 }
 
-// Get retrieves a key, or ErrNotFound.
+// Get retrieves a key, or ErrNotFound. An expired key is removed.
 func (h *HashStore) Get(key string) (string, error) {
     h.mu.RLock()
-    defer h.mu.RUnlock()
-
     v, ok := h.store[key]
+    d := h.ttl.get(key)
+    h.mu.RUnlock()
+
     if !ok {
         return "", ErrNotFound
     }
+    if expiredAt(d, clock().UnixNano()) {
+        h.expire(key)
+        return "", ErrNotFound
+    }
     return v, nil
 }
 
+// TTL returns the time left before key expires.
+func (h *HashStore) TTL(key string) (time.Duration, error) {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    now := clock().UnixNano()
+    d := h.ttl.get(key)
+    if _, ok := h.store[key]; !ok || expiredAt(d, now) {
+        return 0, ErrNotFound
+    }
+    return remaining(d, now), nil
+}
+
+// ExpiredKeys returns how many keys have expired so far.
+func (h *HashStore) ExpiredKeys() uint64 {
+    return h.ttl.expired.Load()
+}
+
+// Expire sets key to expire after ttl, or deletes it if ttl is not
+// positive, and reports whether key existed.
+func (h *HashStore) Expire(key string, ttl time.Duration) (bool, error) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if _, ok := h.store[key]; !ok || h.expireLocked(key, clock().UnixNano()) {
+        return false, nil
+    }
+    if ttl <= 0 {
+        delete(h.store, key)
+        h.ttl.set(key, 0)
+        return true, nil
+    }
+    h.ttl.set(key, deadline(ttl))
+    return true, nil
+}
+
+// expire removes key if it is still expired once the write lock is held.
+func (h *HashStore) expire(key string) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.expireLocked(key, clock().UnixNano())
+}
+
+func (h *HashStore) expireLocked(key string, now int64) bool {
+    if !expiredAt(h.ttl.get(key), now) {
+        return false
+    }
+    delete(h.store, key)
+    h.ttl.set(key, 0)
+    h.ttl.expired.Add(1)
+    return true
+}
+
+// StartSweeper removes expired keys in the background, examining at most
+// batch keys with a TTL per lock acquisition, every interval. Call the
+// returned function to stop it.
+func (h *HashStore) StartSweeper(interval time.Duration, batch int) (stop func()) {
+    return startSweeper(interval, batch, func(limit int) int {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        return h.ttl.sweep(limit, clock().UnixNano(), func(key string) {
+            delete(h.store, key)
+        })
+    })
+}
+
 // Delete removes a key.
 func (h *HashStore) Delete(key string) error {
     h.mu.Lock()
     defer h.mu.Unlock()
 	
-    if _, ok := h.store[key]; !ok {
+    if _, ok := h.store[key]; !ok || h.expireLocked(key, clock().UnixNano()) {
         return ErrNotFound
     }
     delete(h.store, key)
+    h.ttl.set(key, 0)
     return nil
 }
 
+// SetBytes writes key→value, keeping both slices. See BytesStore.
+func (h *HashStore) SetBytes(key, value []byte) error {
+    return h.Set(bytesToString(key), bytesToString(value))
+}
+
+// GetBytes returns the value of key without copying it or key.
+func (h *HashStore) GetBytes(key []byte) ([]byte, error) {
+    v, err := h.Get(bytesToString(key))
+    if err != nil {
+        return nil, err
+    }
+    return stringToBytes(v), nil
+}
+
+// DeleteBytes removes key without copying it.
+func (h *HashStore) DeleteBytes(key []byte) error {
+    return h.Delete(bytesToString(key))
+}
+
+// Write applies every operation in b under a single lock.
+func (h *HashStore) Write(b *WriteBatch) error {
+    if err := b.check(true); err != nil {
+        return err
+    }
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    for _, op := range b.ops {
+        h.applyLocked(op)
+    }
+    return nil
+}
+
+// applyLocked applies one batch operation. Callers hold the write lock.
+func (h *HashStore) applyLocked(op batchOp) {
+    switch {
+    case op.delete:
+        delete(h.store, op.key)
+        h.ttl.set(op.key, 0)
+    case op.withTTL:
+        h.store[op.key] = op.value
+        h.ttl.set(op.key, deadline(op.ttl))
+    default:
+        h.store[op.key] = op.value
+        h.ttl.set(op.key, 0)
+    }
+}
+
+// CompareAndSwap sets key to new if its current value is old.
+func (h *HashStore) CompareAndSwap(key, old, new string) (bool, error) {
+    return h.conditional(condSwap, key, old, new, 0)
+}
+
+// SetIfAbsent sets key to value if key does not exist.
+func (h *HashStore) SetIfAbsent(key, value string) (bool, error) {
+    return h.conditional(condIfAbsent, key, "", value, 0)
+}
+
+// DeleteIfValue deletes key if its current value is value.
+func (h *HashStore) DeleteIfValue(key, value string) (bool, error) {
+    return h.conditional(condDeleteIf, key, value, "", 0)
+}
+
+// SetIfAbsentWithTTL sets key to value, expiring after ttl, if key does
+// not exist.
+func (h *HashStore) SetIfAbsentWithTTL(key, value string, ttl time.Duration) (bool, error) {
+    if ttl <= 0 {
+        return false, ErrInvalidTTL
+    }
+    return h.conditional(condIfAbsent, key, "", value, deadline(ttl))
+}
+
+// conditional applies op under the write lock; a written value expires
+// at deadline d, or never if d is 0.
+func (h *HashStore) conditional(op condOp, key, want, value string, d int64) (bool, error) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.expireLocked(key, clock().UnixNano())
+    cur, ok := h.store[key]
+    if !op.holds(cur, ok, want) {
+        return false, nil
+    }
+    if op == condDeleteIf {
+        delete(h.store, key)
+    } else {
+        h.store[key] = value
+    }
+    h.ttl.set(key, d)
+    return true, nil
+}
+
 // Range is unsupported for HashStore.
 func (h *HashStore) Range(start, end string) ([]string, error) {
     return nil, ErrUnsupported
 }
 
-// Flush is a no‑op for in‑memory store; here you could dump to disk.
+// NewIterator returns an unordered iterator over a copy of the store taken
+// now, without expired keys. Seek is unsupported and fails with
+// ErrUnsupported.
+func (h *HashStore) NewIterator() Iterator {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    now := clock().UnixNano()
+    pairs := make([]KV, 0, len(h.store))
+    for k, v := range h.store {
+        if !expiredAt(h.ttl.get(k), now) {
+            pairs = append(pairs, KV{k, v})
+        }
+    }
+    return &sliceIterator{pairs: pairs, i: -1}
+}
+
+// Flush writes the store to its dump file, if it was opened with one.
+// Writes that race with Flush may or may not be included.
 func (h *HashStore) Flush() error {
-    // e.g. write h.store to file if you want
-    return nil
+    if h.path == "" {
+        return nil
+    }
+    h.flushMu.Lock()
+    defer h.flushMu.Unlock()
+    return dumpFile(h, h.path)
 }
@@ -0,0 +1,212 @@
+package kv
+
+import "errors"
+
+// ErrIteratorClosed is returned by Err after an iterator has been closed.
+var ErrIteratorClosed = errors.New("iterator closed")
+
+// Iterator walks a store's key/value pairs in ascending key order.
+//
+// A new iterator is positioned before the first key: Next moves to the
+// first key and Prev to the last. Once Next (or Prev) runs off an end,
+// Prev (or Next) brings the iterator back to the last (or first) key.
+// Key and Value are only meaningful after a call that returned true.
+type Iterator interface {
+    // Seek moves to the first key >= key and reports whether one exists.
+    Seek(key string) bool
+    // Next moves to the following key and reports whether one exists.
+    Next() bool
+    // Prev moves to the preceding key and reports whether one exists.
+    Prev() bool
+    Key() string
+    Value() string
+    // Err returns the first error hit while iterating, if any.
+    Err() error
+    Close() error
+}
+
+// KV is a key/value pair.
+type KV struct {
+    Key   string
+    Value string
+}
+
+// Iterable is implemented by stores that can produce an Iterator.
+type Iterable interface {
+    NewIterator() Iterator
+}
+
+// NewIterator returns an iterator over s, or ErrUnsupported if s cannot
+// iterate.
+func NewIterator(s KVStore) (Iterator, error) {
+    it, ok := s.(Iterable)
+    if !ok {
+        return nil, ErrUnsupported
+    }
+    return it.NewIterator(), nil
+}
+
+// orderedSource is the positioning primitive a cursorIterator needs from an
+// ordered store. Each call takes the store's lock only for its own duration,
+// so iterating never blocks writers for longer than one step.
+type orderedSource interface {
+    // ceiling returns the first pair with key >= key, or > key if !inclusive.
+    ceiling(key string, inclusive bool) (k, v string, ok bool, err error)
+    // lower returns the last pair with key < key.
+    lower(key string) (k, v string, ok bool, err error)
+    // last returns the pair with the greatest key.
+    last() (k, v string, ok bool, err error)
+}
+
+type iterPos int
+
+const (
+    posNew    iterPos = iota // not yet positioned
+    posBefore                // before the first key
+    posAt                    // at key
+    posAfter                 // past the last key
+)
+
+// cursorIterator implements Iterator by re-seeking an orderedSource
+// relative to the current key on every step. It observes writes made
+// while it is open.
+type cursorIterator struct {
+    src        orderedSource
+    pos        iterPos
+    key, value string
+    err        error
+}
+
+func newCursorIterator(src orderedSource) *cursorIterator {
+    return &cursorIterator{src: src}
+}
+
+func (it *cursorIterator) move(k, v string, ok bool, err error, miss iterPos) bool {
+    if err != nil {
+        it.err = err
+    }
+    if it.err != nil || !ok {
+        it.pos, it.key, it.value = miss, "", ""
+        return false
+    }
+    it.pos, it.key, it.value = posAt, k, v
+    return true
+}
+
+func (it *cursorIterator) Seek(key string) bool {
+    if it.err != nil {
+        return false
+    }
+    k, v, ok, err := it.src.ceiling(key, true)
+    return it.move(k, v, ok, err, posAfter)
+}
+
+func (it *cursorIterator) Next() bool {
+    if it.err != nil {
+        return false
+    }
+    switch it.pos {
+    case posNew, posBefore:
+        k, v, ok, err := it.src.ceiling("", true)
+        return it.move(k, v, ok, err, posAfter)
+    case posAt:
+        k, v, ok, err := it.src.ceiling(it.key, false)
+        return it.move(k, v, ok, err, posAfter)
+    }
+    return false
+}
+
+func (it *cursorIterator) Prev() bool {
+    if it.err != nil {
+        return false
+    }
+    switch it.pos {
+    case posNew, posAfter:
+        k, v, ok, err := it.src.last()
+        return it.move(k, v, ok, err, posBefore)
+    case posAt:
+        k, v, ok, err := it.src.lower(it.key)
+        return it.move(k, v, ok, err, posBefore)
+    }
+    return false
+}
+
+func (it *cursorIterator) Key() string   { return it.key }
+func (it *cursorIterator) Value() string { return it.value }
+func (it *cursorIterator) Err() error    { return it.err }
+
+func (it *cursorIterator) Close() error {
+    if it.err == nil {
+        it.err = ErrIteratorClosed
+    }
+    return nil
+}
+
+// NewErrorIterator returns an empty iterator whose Err reports err, for
+// wrappers that could not open the iterator they would return.
+func NewErrorIterator(err error) Iterator {
+    return &sliceIterator{i: -1, err: err}
+}
+
+// sliceIterator iterates a fixed slice of pairs in the order given. It
+// cannot Seek, since the order carries no meaning.
+type sliceIterator struct {
+    pairs []KV
+    i     int // index of current pair; -1 before, len(pairs) after
+    moved bool
+    err   error
+}
+
+func (it *sliceIterator) Seek(string) bool {
+    if it.err == nil {
+        it.err = ErrUnsupported
+    }
+    return false
+}
+
+func (it *sliceIterator) Next() bool {
+    if it.err != nil || it.i >= len(it.pairs) {
+        return false
+    }
+    it.moved = true
+    it.i++
+    return it.i < len(it.pairs)
+}
+
+func (it *sliceIterator) Prev() bool {
+    if it.err != nil {
+        return false
+    }
+    if !it.moved {
+        it.moved, it.i = true, len(it.pairs)
+    }
+    if it.i < 0 {
+        return false
+    }
+    it.i--
+    return it.i >= 0
+}
+
+func (it *sliceIterator) Key() string {
+    if it.i < 0 || it.i >= len(it.pairs) {
+        return ""
+    }
+    return it.pairs[it.i].Key
+}
+
+func (it *sliceIterator) Value() string {
+    if it.i < 0 || it.i >= len(it.pairs) {
+        return ""
+    }
+    return it.pairs[it.i].Value
+}
+
+func (it *sliceIterator) Err() error { return it.err }
+
+func (it *sliceIterator) Close() error {
+    it.pairs = nil
+    if it.err == nil {
+        it.err = ErrIteratorClosed
+    }
+    return nil
+}
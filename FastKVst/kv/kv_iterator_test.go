@@ -0,0 +1,141 @@
+package kv
+
+import (
+    "fmt"
+    "sort"
+    "testing"
+)
+
+func orderedStores() map[string]KVStore {
+    lsm, _ := NewLSMStoreWithOptions(LSMOptions{MemtableSize: 4, L0Trigger: 2})
+    return map[string]KVStore{
+        "btree":    NewBTreeStore(),
+        "skiplist": NewSkipListStore(),
+        "trie":     NewTrieStore(),
+        "lsm":      lsm,
+    }
+}
+
+func collect(it Iterator, forward bool) []string {
+    var keys []string
+    step := it.Next
+    if !forward {
+        step = it.Prev
+    }
+    for step() {
+        keys = append(keys, it.Key()+"="+it.Value())
+    }
+    return keys
+}
+
+func TestIteratorOrdered(t *testing.T) {
+    for name, s := range orderedStores() {
+        t.Run(name, func(t *testing.T) {
+            var want []string
+            for i := 0; i < 20; i++ {
+                k := fmt.Sprintf("k%02d", i)
+                s.Set(k, "old")
+                s.Set(k, fmt.Sprint(i))
+                if i%3 == 0 {
+                    s.Delete(k)
+                    continue
+                }
+                want = append(want, k+"="+fmt.Sprint(i))
+            }
+            it, err := NewIterator(s)
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer it.Close()
+
+            if got := collect(it, true); fmt.Sprint(got) != fmt.Sprint(want) {
+                t.Fatalf("forward: got %v, want %v", got, want)
+            }
+            // Off the end, Prev walks back from the last key.
+            got := collect(it, false)
+            sort.Strings(got)
+            if fmt.Sprint(got) != fmt.Sprint(want) {
+                t.Fatalf("reverse: got %v, want %v", got, want)
+            }
+
+            if !it.Seek("k03") || it.Key() != "k04" {
+                t.Fatalf("Seek(k03) = %q, want k04", it.Key())
+            }
+            if !it.Prev() || it.Key() != "k02" {
+                t.Fatalf("Prev after Seek = %q, want k02", it.Key())
+            }
+            if it.Seek("z") {
+                t.Fatalf("Seek past end returned %q", it.Key())
+            }
+            if !it.Prev() || it.Key() != "k19" {
+                t.Fatalf("Prev from end = %q, want k19", it.Key())
+            }
+            if it.Err() != nil {
+                t.Fatal(it.Err())
+            }
+            it.Close()
+            if it.Next() || it.Err() != ErrIteratorClosed {
+                t.Fatalf("after Close: err=%v", it.Err())
+            }
+        })
+    }
+}
+
+func TestIteratorSeesWrites(t *testing.T) {
+    b := NewBTreeStore()
+    b.Set("a", "1")
+    b.Set("c", "3")
+    it := b.NewIterator()
+    if !it.Next() || it.Key() != "a" {
+        t.Fatalf("expected a, got %q", it.Key())
+    }
+    b.Set("b", "2")
+    if !it.Next() || it.Key() != "b" {
+        t.Fatalf("expected b, got %q", it.Key())
+    }
+}
+
+func TestIteratorLSMFlushed(t *testing.T) {
+    lsm, err := NewLSMStoreWithOptions(LSMOptions{Dir: t.TempDir()})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer lsm.Close()
+    for i := 0; i < 500; i++ {
+        lsm.Set(fmt.Sprintf("k%04d", i), "v")
+    }
+    lsm.Flush()
+    for i := 0; i < 500; i += 2 {
+        lsm.Delete(fmt.Sprintf("k%04d", i))
+    }
+
+    it := lsm.NewIterator()
+    n := 0
+    for it.Next() {
+        if want := fmt.Sprintf("k%04d", 2*n+1); it.Key() != want {
+            t.Fatalf("got %q, want %q", it.Key(), want)
+        }
+        n++
+    }
+    if it.Err() != nil || n != 250 {
+        t.Fatalf("iterated %d keys, err=%v", n, it.Err())
+    }
+}
+
+func TestIteratorHashUnordered(t *testing.T) {
+    h := NewHashStore()
+    h.Set("a", "1")
+    h.Set("b", "2")
+    it, err := NewIterator(h)
+    if err != nil {
+        t.Fatal(err)
+    }
+    got := collect(it, true)
+    sort.Strings(got)
+    if fmt.Sprint(got) != "[a=1 b=2]" {
+        t.Fatalf("unexpected pairs: %v", got)
+    }
+    if it.Seek("a") || it.Err() != ErrUnsupported {
+        t.Fatalf("Seek: err=%v, want ErrUnsupported", it.Err())
+    }
+}
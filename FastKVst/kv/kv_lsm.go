@@ -1,138 +1,430 @@
 package kv
 
 import (
-    "sort"
+    "fmt"
+    "math"
+    "os"
+    "path/filepath"
     "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/google/btree"
+    "github.com/thilakshekharshriyan/m/encrypt"
 )
 
-// lsmEntry represents a key-value pair.
+// lsmEntry is a versioned key-value pair. Deletes are recorded as
+// entries with deleted set (tombstones) so they shadow older values.
 type lsmEntry struct {
     key, value string
+    seq        uint64 // monotonically increasing write sequence number
+    deleted    bool
+    expires    int64 // Unix nanoseconds; 0 for no expiry
+}
+
+// dead reports whether e hides its key at now: a tombstone or an expired
+// value.
+func (e lsmEntry) dead(now int64) bool {
+    return e.deleted || expiredAt(e.expires, now)
+}
+
+// LSMOptions tunes an LSMStore. Zero values select the defaults.
+type LSMOptions struct {
+    Dir           string // data directory; empty keeps everything in memory
+    MemtableSize  int    // entries buffered before a flush (default 1000)
+    L0Trigger     int    // L0 runs that trigger compaction into L1 (default 4)
+    LevelRatio    int    // size ratio between adjacent levels (default 10)
+    BaseLevelSize int64  // target size of L1 in bytes (default 8MiB)
+    MaxLevels     int    // levels including L0 (default 7)
+
+    // BloomBitsPerKey sizes the per-run Bloom filters (default 10, about a
+    // 1% false-positive rate). A negative value disables the filters.
+    BloomBitsPerKey int
+
+    // Compression is the codec for SSTable data blocks (default none).
+    // Tables written with any setting can be read with any other.
+    Compression Compression
+
+    // Keys, if set, encrypts new SSTables with its current key. Tables
+    // under an older key stay readable while the provider still has it;
+    // compaction rewrites them under the current key, and Reencrypt does
+    // so for every table at once.
+    Keys encrypt.KeyProvider
 }
 
-// LSMStore is a minimal in-memory LSM-tree with two levels.
+func (o *LSMOptions) setDefaults() {
+    if o.MemtableSize <= 0 {
+        o.MemtableSize = 1000
+    }
+    if o.L0Trigger <= 0 {
+        o.L0Trigger = 4
+    }
+    if o.LevelRatio <= 1 {
+        o.LevelRatio = 10
+    }
+    if o.BaseLevelSize <= 0 {
+        o.BaseLevelSize = 8 << 20
+    }
+    if o.MaxLevels < 2 {
+        o.MaxLevels = 7
+    }
+    if o.BloomBitsPerKey == 0 {
+        o.BloomBitsPerKey = defaultBloomBitsPerKey
+    }
+}
+
+// LSMStore is a leveled LSM-tree. Writes go to a memtable which is
+// flushed as a sorted run into L0; L0 runs are merged into L1 and each
+// level Ln is merged into Ln+1 once it outgrows its size budget. Runs are
+// kept in memory, or written as SSTable files when a data directory is set.
 type LSMStore struct {
-    mu        sync.RWMutex
-    memtable  map[string]string      // mutable
-    immuTable []lsmEntry            // immutable, sorted
-    threshold int                   // flush threshold
+    mu       sync.RWMutex
+    opts     LSMOptions
+    memtable *btree.BTreeG[lsmEntry] // mutable, ordered by key
+    levels   [][]lsmRun          // levels[0] oldest first; one run per deeper level
+    seq      uint64              // last assigned sequence number
+    nextFile uint64              // number of the next table file
+    bloom    bloomCounters
+    snaps    map[uint64]int // live snapshot sequence -> reference count
+    expired  atomic.Uint64  // expired values dropped by flush or compaction
 }
 
-// NewLSMStore constructs a ready-to-use LSMStore.
+// NewLSMStore constructs a ready-to-use in-memory LSMStore.
 func NewLSMStore() *LSMStore {
-    return &LSMStore{
-        memtable:  make(map[string]string),
-        threshold: 1000, // flush after 1000 keys (tune as needed)
+    l, _ := NewLSMStoreWithOptions(LSMOptions{})
+    return l
+}
+
+// OpenLSMStore opens (or creates) an LSMStore persisted in dir.
+func OpenLSMStore(dir string) (*LSMStore, error) {
+    return NewLSMStoreWithOptions(LSMOptions{Dir: dir})
+}
+
+// NewLSMStoreWithOptions constructs an LSMStore from opts. With a Dir set,
+// tables listed in the directory's manifest are reopened and table files
+// the manifest does not reference are removed.
+func NewLSMStoreWithOptions(opts LSMOptions) (*LSMStore, error) {
+    opts.setDefaults()
+    l := &LSMStore{
+        opts:     opts,
+        memtable: newMemtable(),
+        levels:   make([][]lsmRun, opts.MaxLevels),
+        nextFile: 1,
+    }
+    if opts.Dir == "" {
+        return l, nil
+    }
+
+    if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+        return nil, err
+    }
+    m, err := readManifest(opts.Dir)
+    if err != nil {
+        return nil, err
+    }
+    if len(m.Levels) > opts.MaxLevels {
+        return nil, fmt.Errorf("kv: manifest has %d levels, store allows %d", len(m.Levels), opts.MaxLevels)
+    }
+    if err := removeOrphans(opts.Dir, m); err != nil {
+        return nil, err
+    }
+    l.nextFile, l.seq = m.NextFile, m.LastSeq
+    for i, names := range m.Levels {
+        for _, name := range names {
+            t, err := openSSTable(filepath.Join(opts.Dir, name), opts.Keys)
+            if err != nil {
+                l.Close()
+                return nil, err
+            }
+            l.levels[i] = append(l.levels[i], t)
+        }
+    }
+    return l, nil
+}
+
+// persistent reports whether flushed data survives a restart.
+func (l *LSMStore) persistent() bool {
+    return l.opts.Dir != ""
+}
+
+// Close releases open table files. Unflushed memtable contents are lost;
+// call Flush first to persist them.
+func (l *LSMStore) Close() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    var firstErr error
+    for i, level := range l.levels {
+        for _, r := range level {
+            if err := r.close(); err != nil && firstErr == nil {
+                firstErr = err
+            }
+        }
+        l.levels[i] = nil
     }
+    return firstErr
 }
 
 // Set inserts or updates a key.
 func (l *LSMStore) Set(key, value string) error {
     l.mu.Lock()
     defer l.mu.Unlock()
-    l.memtable[key] = value
-    if len(l.memtable) >= l.threshold {
-        l.flush()
-    }
-    return nil
+    return l.apply(lsmEntry{key: key, value: value})
 }
 
-// Get retrieves a key, or ErrNotFound.
+// Get retrieves a key, or ErrNotFound if it is absent or deleted.
 func (l *LSMStore) Get(key string) (string, error) {
     l.mu.RLock()
     defer l.mu.RUnlock()
-    if v, ok := l.memtable[key]; ok {
-        return v, nil
+    e, ok, err := l.lookup(key, l.seq)
+    if err != nil {
+        return "", err
     }
-    // Binary search in immutable table
-    i := sort.Search(len(l.immuTable), func(i int) bool {
-        return l.immuTable[i].key >= key
-    })
-    if i < len(l.immuTable) && l.immuTable[i].key == key {
-        return l.immuTable[i].value, nil
+    if !ok || e.dead(clock().UnixNano()) {
+        return "", ErrNotFound
     }
-    return "", ErrNotFound
+    return e.value, nil
 }
 
-// Delete marks a key as deleted (tombstone).
-func (l *LSMStore) Delete(key string) error {
+// SetWithTTL inserts or updates a key that expires after ttl. Expired
+// values are hidden from reads and dropped by flushes and compactions.
+func (l *LSMStore) SetWithTTL(key, value string, ttl time.Duration) error {
+    if ttl <= 0 {
+        return ErrInvalidTTL
+    }
     l.mu.Lock()
     defer l.mu.Unlock()
-    l.memtable[key] = "" // empty string as tombstone
-    return nil
+    return l.apply(lsmEntry{key: key, value: value, expires: deadline(ttl)})
 }
 
-// Range returns all keys in [start, end).
-func (l *LSMStore) Range(start, end string) ([]string, error) {
+// TTL returns the time left before key expires.
+func (l *LSMStore) TTL(key string) (time.Duration, error) {
     l.mu.RLock()
     defer l.mu.RUnlock()
-    keySet := make(map[string]struct{})
-    // From memtable
-    for k := range l.memtable {
-        if k >= start && k < end && l.memtable[k] != "" {
-            keySet[k] = struct{}{}
+    e, ok, err := l.lookup(key, l.seq)
+    if err != nil {
+        return 0, err
+    }
+    now := clock().UnixNano()
+    if !ok || e.dead(now) {
+        return 0, ErrNotFound
+    }
+    return remaining(e.expires, now), nil
+}
+
+// ExpiredKeys returns how many expired values flushes and compactions have
+// dropped so far.
+func (l *LSMStore) ExpiredKeys() uint64 {
+    return l.expired.Load()
+}
+
+// Expire sets key to expire after ttl, or deletes it if ttl is not
+// positive, and reports whether key existed.
+func (l *LSMStore) Expire(key string, ttl time.Duration) (bool, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    e, ok, err := l.lookup(key, l.seq)
+    if err != nil {
+        return false, err
+    }
+    if !ok || e.dead(clock().UnixNano()) {
+        return false, nil
+    }
+    if ttl <= 0 {
+        return true, l.apply(lsmEntry{key: key, deleted: true})
+    }
+    return true, l.apply(lsmEntry{key: key, value: e.value, expires: deadline(ttl)})
+}
+
+// lookup finds the newest entry for key with sequence <= seq: memtable
+// first, then L0 newest to oldest, then each deeper level. Every source
+// holds only writes older than those before it, so the first hit wins.
+func (l *LSMStore) lookup(key string, seq uint64) (lsmEntry, bool, error) {
+    if e, ok, _ := visibleGet(memtableSeeker{l.memtable}, key, seq); ok {
+        return e, true, nil
+    }
+    for i := len(l.levels[0]) - 1; i >= 0; i-- {
+        if e, ok, err := l.getFromRun(l.levels[0][i], key, seq); err != nil || ok {
+            return e, ok, err
         }
     }
-    // From immutable table
-    for _, e := range l.immuTable {
-        if e.key >= start && e.key < end && e.value != "" {
-            keySet[e.key] = struct{}{}
+    for _, level := range l.levels[1:] {
+        for _, r := range level {
+            if e, ok, err := l.getFromRun(r, key, seq); err != nil || ok {
+                return e, ok, err
+            }
+        }
+    }
+    return lsmEntry{}, false, nil
+}
+
+// getFromRun consults the run's Bloom filter before searching it.
+func (l *LSMStore) getFromRun(r lsmRun, key string, seq uint64) (lsmEntry, bool, error) {
+    f := r.filter()
+    if f == nil {
+        return visibleGet(r, key, seq)
+    }
+    l.bloom.checks.Add(1)
+    if !f.mayContain(key) {
+        l.bloom.negatives.Add(1)
+        return lsmEntry{}, false, nil
+    }
+    e, ok, err := visibleGet(r, key, seq)
+    if err == nil && !ok {
+        // A snapshot read can miss a key the run only holds in newer
+        // versions; the filter was right about those.
+        if _, newer, err := visibleGet(r, key, math.MaxUint64); err == nil && !newer {
+            l.bloom.falsePositives.Add(1)
         }
     }
-    // Collect and sort
-    keys := make([]string, 0, len(keySet))
-    for k := range keySet {
-        keys = append(keys, k)
+    return e, ok, err
+}
+
+// BloomStats reports how effective the run Bloom filters have been.
+func (l *LSMStore) BloomStats() BloomStats {
+    return BloomStats{
+        Checks:         l.bloom.checks.Load(),
+        Negatives:      l.bloom.negatives.Load(),
+        FalsePositives: l.bloom.falsePositives.Load(),
     }
-    sort.Strings(keys)
-    return keys, nil
 }
 
-// Flush moves memtable to immutable table.
-func (l *LSMStore) Flush() error {
+// Delete writes a tombstone for key.
+func (l *LSMStore) Delete(key string) error {
     l.mu.Lock()
     defer l.mu.Unlock()
-    l.flush()
+    return l.apply(lsmEntry{key: key, deleted: true})
+}
+
+// Write applies every operation in b under a single lock. The memtable is
+// flushed at most once, after the whole batch is in it, so a batch is never
+// split across runs.
+func (l *LSMStore) Write(b *WriteBatch) error {
+    if err := b.check(true); err != nil {
+        return err
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    entries := make([]lsmEntry, len(b.ops))
+    for i, op := range b.ops {
+        entries[i] = lsmEntry{key: op.key, value: op.value, deleted: op.delete}
+        if op.withTTL {
+            entries[i].expires = deadline(op.ttl)
+        }
+    }
+    return l.apply(entries...)
+}
+
+// CompareAndSwap sets key to new if its current value is old.
+func (l *LSMStore) CompareAndSwap(key, old, new string) (bool, error) {
+    return l.conditional(condSwap, key, old, new, 0)
+}
+
+// SetIfAbsent sets key to value if key does not exist.
+func (l *LSMStore) SetIfAbsent(key, value string) (bool, error) {
+    return l.conditional(condIfAbsent, key, "", value, 0)
+}
+
+// DeleteIfValue deletes key if its current value is value.
+func (l *LSMStore) DeleteIfValue(key, value string) (bool, error) {
+    return l.conditional(condDeleteIf, key, value, "", 0)
+}
+
+// SetIfAbsentWithTTL sets key to value, expiring after ttl, if key does
+// not exist.
+func (l *LSMStore) SetIfAbsentWithTTL(key, value string, ttl time.Duration) (bool, error) {
+    if ttl <= 0 {
+        return false, ErrInvalidTTL
+    }
+    return l.conditional(condIfAbsent, key, "", value, deadline(ttl))
+}
+
+// conditional applies op under the write lock; a written value expires
+// at deadline d, or never if d is 0.
+func (l *LSMStore) conditional(op condOp, key, want, value string, d int64) (bool, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    e, ok, err := l.lookup(key, l.seq)
+    if err != nil {
+        return false, err
+    }
+    ok = ok && !e.dead(clock().UnixNano())
+    if !op.holds(e.value, ok, want) {
+        return false, nil
+    }
+    return true, l.apply(lsmEntry{key: key, value: value, deleted: op == condDeleteIf, expires: d})
+}
+
+// apply stamps each entry with the next sequence number and adds it to the
+// memtable, flushing when the memtable is full. Older versions of the key
+// are kept only while a snapshot can see them.
+func (l *LSMStore) apply(entries ...lsmEntry) error {
+    snaps := l.liveSnapshots()
+    for _, e := range entries {
+        l.seq++
+        e.seq = l.seq
+        l.memtable.ReplaceOrInsert(e)
+        l.pruneMemtable(e.key, snaps)
+    }
+    if l.memtable.Len() >= l.opts.MemtableSize {
+        return l.flush()
+    }
     return nil
 }
 
-// flush (internal): moves memtable to immutable, sorted.
-func (l *LSMStore) flush() {
-    entries := make([]lsmEntry, 0, len(l.memtable))
-    for k, v := range l.memtable {
-        entries = append(entries, lsmEntry{k, v})
+// Range returns all live keys in [start, end). It reads from a snapshot
+// one step at a time rather than holding the lock for the whole scan.
+func (l *LSMStore) Range(start, end string) ([]string, error) {
+    snap := l.Snapshot()
+    defer snap.Release()
+    return snap.Range(start, end)
+}
+
+// Flush moves the memtable into a new L0 run and compacts as needed.
+func (l *LSMStore) Flush() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.flush()
+}
+
+// flush (internal): sorts the memtable into an L0 run, then compacts.
+func (l *LSMStore) flush() error {
+    if l.memtable.Len() == 0 {
+        return nil
     }
-    sort.Slice(entries, func(i, j int) bool {
-        return entries[i].key < entries[j].key
+    entries := make([]lsmEntry, 0, l.memtable.Len())
+    l.memtable.Ascend(func(e lsmEntry) bool {
+        entries = append(entries, e)
+        return true
     })
-    l.immuTable = mergeLSMEntries(l.immuTable, entries)
-    l.memtable = make(map[string]string)
-}
-
-// mergeLSMEntries merges two sorted slices, newer values overwrite older.
-func mergeLSMEntries(a, b []lsmEntry) []lsmEntry {
-    out := make([]lsmEntry, 0, len(a)+len(b))
-    i, j := 0, 0
-    for i < len(a) && j < len(b) {
-        if a[i].key < b[j].key {
-            out = append(out, a[i])
-            i++
-        } else if a[i].key > b[j].key {
-            out = append(out, b[j])
-            j++
-        } else {
-            out = append(out, b[j]) // prefer newer
-            i++
-            j++
-        }
+    // Merging the memtable with itself drops versions that snapshots
+    // released since they were written no longer need.
+    r, err := l.newRun(l.newMergeCursor([]runCursor{sliceCursor(entries)}, false))
+    if err != nil {
+        return err
+    }
+    l.levels[0] = append(l.levels[0], r)
+    if err := l.commit(); err != nil {
+        l.levels[0] = l.levels[0][:len(l.levels[0])-1]
+        r.remove()
+        return err
     }
-    for i < len(a) {
-        out = append(out, a[i])
-        i++
+    l.memtable = newMemtable()
+    return l.compact()
+}
+
+// commit records the current level layout in the manifest. It is a no-op
+// for in-memory stores.
+func (l *LSMStore) commit() error {
+    if l.opts.Dir == "" {
+        return nil
     }
-    for j < len(b) {
-        out = append(out, b[j])
-        j++
+    m := lsmManifest{NextFile: l.nextFile, LastSeq: l.seq}
+    for _, level := range l.levels {
+        var names []string
+        for _, r := range level {
+            names = append(names, filepath.Base(r.(*sstable).path))
+        }
+        m.Levels = append(m.Levels, names)
     }
-    return out
-}
\ No newline at end of file
+    return writeManifest(l.opts.Dir, m)
+}
@@ -1,9 +1,14 @@
 package kv
 
 import (
+	"bytes"
 	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+
+	"github.com/thilakshekharshriyan/m/encrypt"
 )
 
 func TestLSMStoreBasic(t *testing.T) {
@@ -23,10 +28,19 @@ func TestLSMStoreBasic(t *testing.T) {
 		fmt.Print(err)
         t.Fatal(err)
     }
-    if v, err := lsm.Get("foo"); err == ErrNotFound || v != "" {
+    if v, err := lsm.Get("foo"); err != ErrNotFound {
 		fmt.Print(err)
-        t.Fatalf("expected ErrNotFound or tombstone, got %q, err=%v", v, err)
+        t.Fatalf("expected ErrNotFound, got %q, err=%v", v, err)
+    }
+
+    // Empty values are not tombstones
+    if err := lsm.Set("empty", ""); err != nil {
+        t.Fatal(err)
+    }
+    if v, err := lsm.Get("empty"); err != nil || v != "" {
+        t.Fatalf("expected empty value, got %q, err=%v", v, err)
     }
+    lsm.Delete("empty")
 
     // Range
     lsm.Set("a", "1")
@@ -85,4 +99,234 @@ func TestLSMStoreConcurrency(t *testing.T) {
     }
 
     wg.Wait()
-}
\ No newline at end of file
+}
+
+func TestLSMStorePersistence(t *testing.T) {
+    dir := t.TempDir()
+    lsm, err := OpenLSMStore(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    lsm.Set("a", "1")
+    lsm.Set("b", "2")
+    if err := lsm.Flush(); err != nil {
+        t.Fatal(err)
+    }
+    lsm.Set("b", "22")
+    lsm.Set("c", "3")
+    lsm.Delete("a")
+    if err := lsm.Flush(); err != nil {
+        t.Fatal(err)
+    }
+    if err := lsm.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    // Reopen and read back from the SSTables
+    lsm, err = OpenLSMStore(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer lsm.Close()
+    if v, err := lsm.Get("b"); err != nil || v != "22" {
+        t.Fatalf("expected 22, got %q, err=%v", v, err)
+    }
+    if v, err := lsm.Get("c"); err != nil || v != "3" {
+        t.Fatalf("expected 3, got %q, err=%v", v, err)
+    }
+    if _, err := lsm.Get("zz"); err != ErrNotFound {
+        t.Fatalf("expected ErrNotFound, got %v", err)
+    }
+    keys, err := lsm.Range("a", "z")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(keys) != 2 || keys[0] != "b" || keys[1] != "c" {
+        t.Fatalf("unexpected range result: %v", keys)
+    }
+}
+
+func TestLSMStoreCompaction(t *testing.T) {
+    lsm, err := NewLSMStoreWithOptions(LSMOptions{
+        Dir:           t.TempDir(),
+        MemtableSize:  10,
+        L0Trigger:     2,
+        BaseLevelSize: 512,
+        MaxLevels:     4,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer lsm.Close()
+
+    for i := 0; i < 200; i++ {
+        if err := lsm.Set(fmt.Sprintf("key%03d", i), fmt.Sprintf("val%03d", i)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    for i := 0; i < 200; i += 2 {
+        if err := lsm.Delete(fmt.Sprintf("key%03d", i)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := lsm.Flush(); err != nil {
+        t.Fatal(err)
+    }
+    if len(lsm.levels[0]) >= 2 {
+        t.Fatalf("expected L0 to be compacted, has %d runs", len(lsm.levels[0]))
+    }
+
+    for i := 0; i < 200; i++ {
+        v, err := lsm.Get(fmt.Sprintf("key%03d", i))
+        if i%2 == 0 && err != ErrNotFound {
+            t.Fatalf("key%03d: expected ErrNotFound, got %q, err=%v", i, v, err)
+        }
+        if i%2 == 1 && (err != nil || v != fmt.Sprintf("val%03d", i)) {
+            t.Fatalf("key%03d: got %q, err=%v", i, v, err)
+        }
+    }
+    keys, err := lsm.Range("key000", "key010")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(keys) != 5 || keys[0] != "key001" {
+        t.Fatalf("unexpected range result: %v", keys)
+    }
+
+    // The bottom level must not carry tombstones.
+    var bottom lsmRun
+    for _, level := range lsm.levels[1:] {
+        if len(level) > 0 {
+            bottom = level[0]
+        }
+    }
+    if bottom == nil {
+        t.Fatal("expected data below L0")
+    }
+    c := bottom.cursor()
+    for {
+        e, ok, err := c.next()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !ok {
+            break
+        }
+        if e.deleted {
+            t.Fatalf("tombstone for %s survived bottom-level compaction", e.key)
+        }
+    }
+}
+
+func TestLSMStoreBloomFilter(t *testing.T) {
+    for _, dir := range []string{"", t.TempDir()} {
+        lsm, err := NewLSMStoreWithOptions(LSMOptions{Dir: dir, MemtableSize: 100, L0Trigger: 100})
+        if err != nil {
+            t.Fatal(err)
+        }
+        for i := 0; i < 1000; i++ {
+            lsm.Set(fmt.Sprintf("key%04d", i), "v")
+        }
+        for i := 0; i < 1000; i++ {
+            if _, err := lsm.Get(fmt.Sprintf("missing%04d", i)); err != ErrNotFound {
+                t.Fatalf("expected ErrNotFound, got %v", err)
+            }
+        }
+        if v, err := lsm.Get("key0500"); err != nil || v != "v" {
+            t.Fatalf("expected v, got %q, err=%v", v, err)
+        }
+        st := lsm.BloomStats()
+        // 1000 misses against 10 runs; ~1% may slip through.
+        if st.Negatives < 9500 || st.FalsePositiveRate() > 0.05 {
+            t.Fatalf("filters ineffective: %+v", st)
+        }
+        lsm.Close()
+    }
+}
+
+func TestLSMStoreBloomSnapshotMisses(t *testing.T) {
+    lsm, err := NewLSMStoreWithOptions(LSMOptions{MemtableSize: 100, L0Trigger: 100})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer lsm.Close()
+    lsm.Set("old", "v")
+    snap := lsm.Snapshot()
+    defer snap.Release()
+    for i := 0; i < 100; i++ {
+        lsm.Set(fmt.Sprintf("new%03d", i), "v")
+    }
+    lsm.Flush()
+    before := lsm.BloomStats()
+    for i := 0; i < 100; i++ {
+        if _, err := snap.Get(fmt.Sprintf("new%03d", i)); err != ErrNotFound {
+            t.Fatalf("snapshot sees a newer key: %v", err)
+        }
+    }
+    // The keys are in the runs, just newer than the snapshot: the filters
+    // were right to pass them.
+    if st := lsm.BloomStats(); st.Checks == before.Checks || st.FalsePositives != before.FalsePositives {
+        t.Fatalf("stats went from %+v to %+v", before, st)
+    }
+}
+
+// onlyKey hides every key of a provider except its current one.
+type onlyKey struct{ encrypt.KeyProvider }
+
+func (o onlyKey) Key(id string) ([]byte, error) {
+    if cur, _, _ := o.CurrentKey(); id != cur {
+        return nil, encrypt.ErrUnknownKey
+    }
+    return o.KeyProvider.Key(id)
+}
+
+func TestLSMEncryptedTables(t *testing.T) {
+    dir := t.TempDir()
+    keys, err := encrypt.OpenFileKeyProvider(filepath.Join(dir, "keys"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    dataDir := filepath.Join(dir, "data")
+    opts := LSMOptions{Dir: dataDir, MemtableSize: 50, L0Trigger: 100, Keys: keys}
+    l, err := NewLSMStoreWithOptions(opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 200; i++ {
+        l.Set(fmt.Sprintf("key%03d", i), "secret-value")
+    }
+    l.Flush()
+    tables, _ := filepath.Glob(filepath.Join(dataDir, "*.sst"))
+    if len(tables) == 0 {
+        t.Fatal("no tables written")
+    }
+    for _, path := range tables {
+        data, _ := os.ReadFile(path)
+        if bytes.Contains(data, []byte("secret")) || bytes.Contains(data, []byte("key1")) {
+            t.Fatalf("%s holds plaintext", path)
+        }
+    }
+
+    // Rotate and re-encrypt: afterwards the old key is no longer needed.
+    keys.Rotate()
+    if err := l.Reencrypt(); err != nil {
+        t.Fatal(err)
+    }
+    l.Close()
+    opts.Keys = onlyKey{keys}
+    l, err = NewLSMStoreWithOptions(opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    for _, i := range []int{0, 123, 199} {
+        if v, err := l.Get(fmt.Sprintf("key%03d", i)); err != nil || v != "secret-value" {
+            t.Fatalf("key%03d = %q, %v", i, v, err)
+        }
+    }
+
+    opts.Keys = nil
+    if _, err := NewLSMStoreWithOptions(opts); err == nil {
+        t.Fatal("opened encrypted tables without keys")
+    }
+}
@@ -0,0 +1,175 @@
+package kv
+
+import (
+    "encoding/base64"
+    "errors"
+    "sort"
+    "strings"
+)
+
+// ErrInvalidCursor is returned by Scan for a cursor it did not produce.
+var ErrInvalidCursor = errors.New("invalid scan cursor")
+
+// ScanOptions selects the pairs returned by Scan.
+type ScanOptions struct {
+    Start string // first key, inclusive
+    End   string // last key, exclusive; empty means no upper bound
+
+    // Prefix restricts the scan to keys starting with Prefix, intersected
+    // with [Start, End).
+    Prefix string
+
+    Limit   int  // maximum pairs per page; <= 0 means no limit
+    Reverse bool // descending key order
+
+    // Cursor resumes a previous scan from its NextCursor. The other options
+    // should be the same as for the page that returned it.
+    Cursor string
+}
+
+// ScanResult is one page of a Scan.
+type ScanResult struct {
+    Pairs []KV
+    // NextCursor continues the scan after the last pair returned. It is
+    // empty when the scan is complete.
+    NextCursor string
+}
+
+// Scan returns key/value pairs of s in key order according to opts. Stores
+// whose iterator is unordered (HashStore) are copied and sorted on every
+// call, which costs O(n log n) per page. Scan returns ErrUnsupported if s
+// cannot iterate.
+//
+// Pages are consistent in that a cursor always resumes strictly after (or,
+// in reverse, before) the last key returned, so no key present throughout
+// the scan is skipped or repeated.
+func Scan(s KVStore, opts ScanOptions) (ScanResult, error) {
+    it, err := NewIterator(s)
+    if err != nil {
+        return ScanResult{}, err
+    }
+    defer it.Close()
+    if si, ok := it.(*sliceIterator); ok {
+        if si.err != nil {
+            return ScanResult{}, si.err
+        }
+        it = newCursorIterator(sortPairs(si.pairs))
+    }
+
+    start, end := opts.Start, opts.End
+    if opts.Prefix != "" {
+        if opts.Prefix > start {
+            start = opts.Prefix
+        }
+        if pe := prefixEnd(opts.Prefix); pe != "" && (end == "" || pe < end) {
+            end = pe
+        }
+    }
+    inRange := func(k string) bool {
+        return k >= start && (end == "" || k < end) && strings.HasPrefix(k, opts.Prefix)
+    }
+
+    var ok bool
+    switch {
+    case opts.Cursor != "":
+        after, err := decodeCursor(opts.Cursor)
+        if err != nil {
+            return ScanResult{}, err
+        }
+        ok = it.Seek(after)
+        if opts.Reverse {
+            ok = it.Prev()
+        } else if ok && it.Key() == after {
+            ok = it.Next()
+        }
+    case opts.Reverse:
+        // Prev from the first key >= end, or from past the last key if
+        // there is none, lands on the last key < end.
+        if end != "" {
+            it.Seek(end)
+        }
+        ok = it.Prev()
+    default:
+        ok = it.Seek(start)
+    }
+
+    var res ScanResult
+    step := it.Next
+    if opts.Reverse {
+        step = it.Prev
+    }
+    for ; ok && inRange(it.Key()); ok = step() {
+        if opts.Limit > 0 && len(res.Pairs) == opts.Limit {
+            res.NextCursor = encodeCursor(res.Pairs[len(res.Pairs)-1].Key)
+            break
+        }
+        res.Pairs = append(res.Pairs, KV{it.Key(), it.Value()})
+    }
+    if err := it.Err(); err != nil {
+        return ScanResult{}, err
+    }
+    return res, nil
+}
+
+// prefixEnd returns the smallest key greater than every key with the given
+// prefix, or "" if there is none (the prefix is all 0xff bytes).
+func prefixEnd(prefix string) string {
+    b := []byte(prefix)
+    for i := len(b) - 1; i >= 0; i-- {
+        if b[i] < 0xff {
+            b[i]++
+            return string(b[:i+1])
+        }
+    }
+    return ""
+}
+
+const cursorVersion = 'k'
+
+func encodeCursor(key string) string {
+    return base64.RawURLEncoding.EncodeToString(append([]byte{cursorVersion}, key...))
+}
+
+func decodeCursor(c string) (string, error) {
+    b, err := base64.RawURLEncoding.DecodeString(c)
+    if err != nil || len(b) == 0 || b[0] != cursorVersion {
+        return "", ErrInvalidCursor
+    }
+    return string(b[1:]), nil
+}
+
+// sortedPairs is an orderedSource over pairs sorted by key.
+type sortedPairs []KV
+
+func sortPairs(pairs []KV) sortedPairs {
+    sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+    return sortedPairs(pairs)
+}
+
+func (p sortedPairs) ceiling(key string, inclusive bool) (string, string, bool, error) {
+    i := sort.Search(len(p), func(i int) bool {
+        if inclusive {
+            return p[i].Key >= key
+        }
+        return p[i].Key > key
+    })
+    if i == len(p) {
+        return "", "", false, nil
+    }
+    return p[i].Key, p[i].Value, true, nil
+}
+
+func (p sortedPairs) lower(key string) (string, string, bool, error) {
+    i := sort.Search(len(p), func(i int) bool { return p[i].Key >= key }) - 1
+    if i < 0 {
+        return "", "", false, nil
+    }
+    return p[i].Key, p[i].Value, true, nil
+}
+
+func (p sortedPairs) last() (string, string, bool, error) {
+    if len(p) == 0 {
+        return "", "", false, nil
+    }
+    return p[len(p)-1].Key, p[len(p)-1].Value, true, nil
+}
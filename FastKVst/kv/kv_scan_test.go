@@ -0,0 +1,108 @@
+package kv
+
+import (
+    "fmt"
+    "testing"
+)
+
+func scanKeys(pairs []KV) string {
+    var keys []string
+    for _, p := range pairs {
+        keys = append(keys, p.Key)
+    }
+    return fmt.Sprint(keys)
+}
+
+func TestScan(t *testing.T) {
+    stores := orderedStores()
+    stores["hash"] = NewHashStore()
+    for name, s := range stores {
+        t.Run(name, func(t *testing.T) {
+            for _, k := range []string{"a", "b", "ba", "bb", "bc", "c", "d"} {
+                s.Set(k, "v"+k)
+            }
+            s.Delete("d")
+
+            cases := []struct {
+                opts ScanOptions
+                want string
+            }{
+                {ScanOptions{}, "[a b ba bb bc c]"},
+                {ScanOptions{Start: "b", End: "c"}, "[b ba bb bc]"},
+                {ScanOptions{Start: "b", End: "c", Reverse: true}, "[bc bb ba b]"},
+                {ScanOptions{Reverse: true}, "[c bc bb ba b a]"},
+                {ScanOptions{Prefix: "b"}, "[b ba bb bc]"},
+                {ScanOptions{Prefix: "b", Start: "bb"}, "[bb bc]"},
+                {ScanOptions{Prefix: "b", Reverse: true, Limit: 2}, "[bc bb]"},
+                {ScanOptions{Start: "zz"}, "[]"},
+            }
+            for _, c := range cases {
+                res, err := Scan(s, c.opts)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if got := scanKeys(res.Pairs); got != c.want {
+                    t.Errorf("Scan(%+v) = %s, want %s", c.opts, got, c.want)
+                }
+            }
+
+            res, _ := Scan(s, ScanOptions{Start: "b", Limit: 1})
+            if len(res.Pairs) != 1 || res.Pairs[0].Value != "vb" {
+                t.Fatalf("unexpected pairs %v", res.Pairs)
+            }
+        })
+    }
+}
+
+func TestScanPaging(t *testing.T) {
+    for _, reverse := range []bool{false, true} {
+        b := NewBTreeStore()
+        for i := 0; i < 25; i++ {
+            b.Set(fmt.Sprintf("k%02d", i), "v")
+        }
+        opts := ScanOptions{Limit: 10, Reverse: reverse}
+        var all []KV
+        pages := 0
+        for {
+            res, err := Scan(b, opts)
+            if err != nil {
+                t.Fatal(err)
+            }
+            all = append(all, res.Pairs...)
+            pages++
+            if res.NextCursor == "" {
+                break
+            }
+            opts.Cursor = res.NextCursor
+            // Writes behind the cursor do not show up in later pages.
+            if reverse {
+                b.Set("k99", "v")
+            } else {
+                b.Set("k00a", "v")
+            }
+        }
+        if pages != 3 || len(all) != 25 {
+            t.Fatalf("reverse=%v: %d pages, %d pairs", reverse, pages, len(all))
+        }
+        for i := 1; i < len(all); i++ {
+            if (all[i].Key > all[i-1].Key) == reverse {
+                t.Fatalf("reverse=%v: out of order at %d: %s", reverse, i, scanKeys(all))
+            }
+        }
+    }
+}
+
+func TestScanErrors(t *testing.T) {
+    if _, err := Scan(NewBTreeStore(), ScanOptions{Cursor: "!!"}); err != ErrInvalidCursor {
+        t.Fatalf("expected ErrInvalidCursor, got %v", err)
+    }
+    if _, err := Scan(NewBTreeStore(), ScanOptions{Cursor: encodeCursor("a")[1:]}); err != ErrInvalidCursor {
+        t.Fatalf("expected ErrInvalidCursor, got %v", err)
+    }
+    if got := prefixEnd("a\xff"); got != "b" {
+        t.Fatalf("prefixEnd = %q", got)
+    }
+    if got := prefixEnd("\xff"); got != "" {
+        t.Fatalf("prefixEnd = %q", got)
+    }
+}
@@ -0,0 +1,172 @@
+package kv
+
+import (
+    "hash/maphash"
+    "runtime"
+    "sort"
+    "time"
+)
+
+// ShardedHashStore partitions keys across independently locked HashStores
+// so writes to different shards proceed in parallel. It offers the same
+// operations as HashStore.
+type ShardedHashStore struct {
+    seed   maphash.Seed
+    shards []*HashStore
+}
+
+// NewShardedHashStore constructs a store with n shards, or with 4 per
+// GOMAXPROCS if n <= 0.
+func NewShardedHashStore(n int) *ShardedHashStore {
+    if n <= 0 {
+        n = 4 * runtime.GOMAXPROCS(0)
+    }
+    s := &ShardedHashStore{seed: maphash.MakeSeed(), shards: make([]*HashStore, n)}
+    for i := range s.shards {
+        s.shards[i] = NewHashStore()
+    }
+    return s
+}
+
+// Shards returns the number of shards.
+func (s *ShardedHashStore) Shards() int {
+    return len(s.shards)
+}
+
+func (s *ShardedHashStore) index(key string) int {
+    return int(maphash.String(s.seed, key) % uint64(len(s.shards)))
+}
+
+func (s *ShardedHashStore) shard(key string) *HashStore {
+    return s.shards[s.index(key)]
+}
+
+// Set inserts or updates a key.
+func (s *ShardedHashStore) Set(key, value string) error {
+    return s.shard(key).Set(key, value)
+}
+
+// SetWithTTL inserts or updates a key that expires after ttl.
+func (s *ShardedHashStore) SetWithTTL(key, value string, ttl time.Duration) error {
+    return s.shard(key).SetWithTTL(key, value, ttl)
+}
+
+// Expire sets key to expire after ttl, or deletes it if ttl is not
+// positive, and reports whether key existed.
+func (s *ShardedHashStore) Expire(key string, ttl time.Duration) (bool, error) {
+    return s.shard(key).Expire(key, ttl)
+}
+
+// Get retrieves a key, or ErrNotFound.
+func (s *ShardedHashStore) Get(key string) (string, error) {
+    return s.shard(key).Get(key)
+}
+
+// TTL returns the time left before key expires.
+func (s *ShardedHashStore) TTL(key string) (time.Duration, error) {
+    return s.shard(key).TTL(key)
+}
+
+// ExpiredKeys returns how many keys have expired so far.
+func (s *ShardedHashStore) ExpiredKeys() uint64 {
+    var n uint64
+    for _, h := range s.shards {
+        n += h.ExpiredKeys()
+    }
+    return n
+}
+
+// StartSweeper removes expired keys in the background, visiting every
+// shard each interval and examining at most batch keys with a TTL per
+// shard lock acquisition. Call the returned function to stop it.
+func (s *ShardedHashStore) StartSweeper(interval time.Duration, batch int) (stop func()) {
+    return startSweeper(interval, batch, func(limit int) int {
+        most := 0
+        for _, h := range s.shards {
+            h.mu.Lock()
+            n := h.ttl.sweep(limit, clock().UnixNano(), func(key string) {
+                delete(h.store, key)
+            })
+            h.mu.Unlock()
+            most = max(most, n)
+        }
+        return most
+    })
+}
+
+// Delete removes a key.
+func (s *ShardedHashStore) Delete(key string) error {
+    return s.shard(key).Delete(key)
+}
+
+// Write applies b atomically: it locks every shard b touches, in shard
+// order, before applying any operation.
+func (s *ShardedHashStore) Write(b *WriteBatch) error {
+    if err := b.check(true); err != nil {
+        return err
+    }
+    idx := make([]int, len(b.ops))
+    seen := make(map[int]bool)
+    var locked []int
+    for i, op := range b.ops {
+        idx[i] = s.index(op.key)
+        if !seen[idx[i]] {
+            seen[idx[i]] = true
+            locked = append(locked, idx[i])
+        }
+    }
+    sort.Ints(locked)
+    for _, i := range locked {
+        s.shards[i].mu.Lock()
+    }
+    for i, op := range b.ops {
+        s.shards[idx[i]].applyLocked(op)
+    }
+    for _, i := range locked {
+        s.shards[i].mu.Unlock()
+    }
+    return nil
+}
+
+// CompareAndSwap sets key to new if its current value is old.
+func (s *ShardedHashStore) CompareAndSwap(key, old, new string) (bool, error) {
+    return s.shard(key).CompareAndSwap(key, old, new)
+}
+
+// SetIfAbsent sets key to value if key does not exist.
+func (s *ShardedHashStore) SetIfAbsent(key, value string) (bool, error) {
+    return s.shard(key).SetIfAbsent(key, value)
+}
+
+// SetIfAbsentWithTTL sets key to value, expiring after ttl, if key does
+// not exist.
+func (s *ShardedHashStore) SetIfAbsentWithTTL(key, value string, ttl time.Duration) (bool, error) {
+    return s.shard(key).SetIfAbsentWithTTL(key, value, ttl)
+}
+
+// DeleteIfValue deletes key if its current value is value.
+func (s *ShardedHashStore) DeleteIfValue(key, value string) (bool, error) {
+    return s.shard(key).DeleteIfValue(key, value)
+}
+
+// Range is unsupported for ShardedHashStore.
+func (s *ShardedHashStore) Range(start, end string) ([]string, error) {
+    return nil, ErrUnsupported
+}
+
+// NewIterator returns an unordered iterator over a copy of each shard.
+// Shards are copied one at a time, so the iterator may see a batch that
+// spans shards only in part. Seek is unsupported and fails with
+// ErrUnsupported.
+func (s *ShardedHashStore) NewIterator() Iterator {
+    var pairs []KV
+    for _, h := range s.shards {
+        pairs = append(pairs, h.NewIterator().(*sliceIterator).pairs...)
+    }
+    return &sliceIterator{pairs: pairs, i: -1}
+}
+
+// Flush is a no-op for the in-memory store.
+func (s *ShardedHashStore) Flush() error {
+    return nil
+}
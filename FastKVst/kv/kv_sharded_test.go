@@ -0,0 +1,61 @@
+package kv
+
+import (
+    "fmt"
+    "runtime"
+    "sort"
+    "sync"
+    "testing"
+)
+
+func TestShardedHashStoreBasic(t *testing.T) {
+    s := NewShardedHashStore(0)
+    if s.Shards() != 4*runtime.GOMAXPROCS(0) {
+        t.Fatalf("Shards = %d", s.Shards())
+    }
+    for i := 0; i < 100; i++ {
+        s.Set(fmt.Sprint("k", i), fmt.Sprint(i))
+    }
+    if v, err := s.Get("k42"); err != nil || v != "42" {
+        t.Fatalf("Get(k42) = %q, %v", v, err)
+    }
+    if err := s.Delete("k42"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Delete("k42"); err != ErrNotFound {
+        t.Fatalf("second Delete: expected ErrNotFound, got %v", err)
+    }
+    if _, err := s.Range("a", "z"); err != ErrUnsupported {
+        t.Fatalf("Range: expected ErrUnsupported, got %v", err)
+    }
+    keys := collect(s.NewIterator(), true)
+    sort.Strings(keys)
+    if len(keys) != 99 || keys[0] != "k0=0" {
+        t.Fatalf("iterator saw %d keys, first %q", len(keys), keys[0])
+    }
+}
+
+func TestShardedHashStoreConcurrency(t *testing.T) {
+    s := NewShardedHashStore(8)
+    var wg sync.WaitGroup
+    for g := 0; g < 16; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            for i := 0; i < 200; i++ {
+                key := fmt.Sprint("g", g, "-", i)
+                s.Set(key, "v")
+                var b WriteBatch
+                b.Put(key+"a", "v")
+                b.Delete(key)
+                s.Write(&b)
+                s.Get(key + "a")
+                s.CompareAndSwap(key+"a", "v", "w")
+            }
+        }(g)
+    }
+    wg.Wait()
+    if n := len(collect(s.NewIterator(), true)); n != 16*200 {
+        t.Fatalf("got %d keys, want %d", n, 16*200)
+    }
+}
@@ -2,6 +2,7 @@ package kv
 
 import (
     "math/rand"
+    "sync"
     "time"
 )
 
@@ -13,28 +14,42 @@ type skipListNode struct {
     next       []*skipListNode
 }
 
+// SkipListStore is a thread-safe skiplist-based KV store. Readers share a
+// read lock; writers take the write lock.
 type SkipListStore struct {
+    mu    sync.RWMutex
     head  *skipListNode
     level int
+    rng   *rand.Rand // guarded by mu's write lock
 }
 
+// NewSkipListStore constructs a ready-to-use SkipListStore.
 func NewSkipListStore() *SkipListStore {
-    rand.Seed(time.Now().UnixNano())
     return &SkipListStore{
         head:  &skipListNode{next: make([]*skipListNode, maxLevel)},
         level: 1,
+        rng:   rand.New(rand.NewSource(time.Now().UnixNano())),
     }
 }
 
-func randomLevel() int {
+// randomLevel picks a level for a new node. Callers hold the write lock.
+func (s *SkipListStore) randomLevel() int {
     lvl := 1
-    for lvl < maxLevel && rand.Float64() < p {
+    for lvl < maxLevel && s.rng.Float64() < p {
         lvl++
     }
     return lvl
 }
 
+// Set inserts or updates a key.
 func (s *SkipListStore) Set(key, value string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.set(key, value)
+    return nil
+}
+
+func (s *SkipListStore) set(key, value string) {
     update := make([]*skipListNode, maxLevel)
     x := s.head
     for i := s.level - 1; i >= 0; i-- {
@@ -45,9 +60,9 @@ func (s *SkipListStore) Set(key, value string) error {
     }
     if x.next[0] != nil && x.next[0].key == key {
         x.next[0].value = value
-        return nil
+        return
     }
-    lvl := randomLevel()
+    lvl := s.randomLevel()
     if lvl > s.level {
         for i := s.level; i < lvl; i++ {
             update[i] = s.head
@@ -63,10 +78,20 @@ func (s *SkipListStore) Set(key, value string) error {
         newNode.next[i] = update[i].next[i]
         update[i].next[i] = newNode
     }
-    return nil
 }
 
+// Get retrieves a key, or ErrNotFound.
 func (s *SkipListStore) Get(key string) (string, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    v, ok := s.get(key)
+    if !ok {
+        return "", ErrNotFound
+    }
+    return v, nil
+}
+
+func (s *SkipListStore) get(key string) (string, bool) {
     x := s.head
     for i := s.level - 1; i >= 0; i-- {
         for x.next[i] != nil && x.next[i].key < key {
@@ -75,12 +100,22 @@ func (s *SkipListStore) Get(key string) (string, error) {
     }
     x = x.next[0]
     if x != nil && x.key == key {
-        return x.value, nil
+        return x.value, true
     }
-    return "", ErrNotFound
+    return "", false
 }
 
+// Delete removes a key.
 func (s *SkipListStore) Delete(key string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if !s.delete(key) {
+        return ErrNotFound
+    }
+    return nil
+}
+
+func (s *SkipListStore) delete(key string) bool {
     update := make([]*skipListNode, maxLevel)
     x := s.head
     found := false
@@ -104,14 +139,61 @@ func (s *SkipListStore) Delete(key string) error {
             s.level--
         }
     }
-    if !found {
-        return ErrNotFound
+    return found
+}
+
+// Write applies every operation in b under a single lock.
+func (s *SkipListStore) Write(b *WriteBatch) error {
+    if err := b.check(false); err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, op := range b.ops {
+        if op.delete {
+            s.delete(op.key)
+        } else {
+            s.set(op.key, op.value)
+        }
     }
     return nil
 }
 
+// CompareAndSwap sets key to new if its current value is old.
+func (s *SkipListStore) CompareAndSwap(key, old, new string) (bool, error) {
+    return s.conditional(condSwap, key, old, new)
+}
+
+// SetIfAbsent sets key to value if key does not exist.
+func (s *SkipListStore) SetIfAbsent(key, value string) (bool, error) {
+    return s.conditional(condIfAbsent, key, "", value)
+}
+
+// DeleteIfValue deletes key if its current value is value.
+func (s *SkipListStore) DeleteIfValue(key, value string) (bool, error) {
+    return s.conditional(condDeleteIf, key, value, "")
+}
+
+// conditional applies op under the write lock.
+func (s *SkipListStore) conditional(op condOp, key, want, value string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    cur, ok := s.get(key)
+    if !op.holds(cur, ok, want) {
+        return false, nil
+    }
+    if op == condDeleteIf {
+        s.delete(key)
+    } else {
+        s.set(key, value)
+    }
+    return true, nil
+}
+
 // Range returns all keys in [start, end).
 func (s *SkipListStore) Range(start, end string) ([]string, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
     var keys []string
     x := s.head
     // Find the first node >= start
@@ -128,6 +210,56 @@ func (s *SkipListStore) Range(start, end string) ([]string, error) {
     return keys, nil
 }
 
+// NewIterator returns an ordered iterator over the skiplist.
+func (s *SkipListStore) NewIterator() Iterator {
+    return newCursorIterator(s)
+}
+
+func (s *SkipListStore) ceiling(key string, inclusive bool) (k, v string, ok bool, err error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    x := s.head
+    for i := s.level - 1; i >= 0; i-- {
+        for x.next[i] != nil && (x.next[i].key < key || (!inclusive && x.next[i].key == key)) {
+            x = x.next[i]
+        }
+    }
+    if x = x.next[0]; x != nil {
+        return x.key, x.value, true, nil
+    }
+    return "", "", false, nil
+}
+
+func (s *SkipListStore) lower(key string) (k, v string, ok bool, err error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    x := s.head
+    for i := s.level - 1; i >= 0; i-- {
+        for x.next[i] != nil && x.next[i].key < key {
+            x = x.next[i]
+        }
+    }
+    if x != s.head {
+        return x.key, x.value, true, nil
+    }
+    return "", "", false, nil
+}
+
+func (s *SkipListStore) last() (k, v string, ok bool, err error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    x := s.head
+    for i := s.level - 1; i >= 0; i-- {
+        for x.next[i] != nil {
+            x = x.next[i]
+        }
+    }
+    if x != s.head {
+        return x.key, x.value, true, nil
+    }
+    return "", "", false, nil
+}
+
 // Flush is a no-op for in-memory skiplist.
 func (s *SkipListStore) Flush() error {
     return nil
@@ -1,6 +1,7 @@
 package kv
 
 import (
+    "strconv"
     "sync"
     "testing"
 )
@@ -81,4 +82,36 @@ func TestSkipListStoreConcurrency(t *testing.T) {
     }
 
     wg.Wait()
-}
\ No newline at end of file
+}
+
+func TestSkipListStoreConcurrentCAS(t *testing.T) {
+    s := NewSkipListStore()
+    s.Set("n", "0")
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for done := 0; done < 50; {
+                cur, _ := s.Get("n")
+                next := strconv.Itoa(atoiOrZero(cur) + 1)
+                if ok, _ := s.CompareAndSwap("n", cur, next); ok {
+                    done++
+                }
+                it := s.NewIterator()
+                for it.Next() {
+                }
+                it.Close()
+            }
+        }()
+    }
+    wg.Wait()
+    if v, _ := s.Get("n"); v != "400" {
+        t.Fatalf("counter = %s, want 400", v)
+    }
+}
+
+func atoiOrZero(s string) int {
+    n, _ := strconv.Atoi(s)
+    return n
+}
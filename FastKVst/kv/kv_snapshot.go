@@ -0,0 +1,46 @@
+package kv
+
+import "errors"
+
+var (
+    // ErrReadOnly is returned by writes to a Snapshot.
+    ErrReadOnly = errors.New("snapshot is read-only")
+    // ErrSnapshotReleased is returned by reads from a released Snapshot.
+    ErrSnapshotReleased = errors.New("snapshot released")
+)
+
+// Snapshot is a read-only view of a store fixed at the moment it was
+// taken. Writes made to the store afterwards are not visible through it.
+// Set, Delete and Flush fail with ErrReadOnly.
+type Snapshot interface {
+    KVStore
+    Iterable
+    // Release frees the versions the snapshot pins. Reads after Release
+    // fail with ErrSnapshotReleased.
+    Release()
+}
+
+// Snapshotter is implemented by stores that can take snapshots.
+type Snapshotter interface {
+    Snapshot() Snapshot
+}
+
+// NewSnapshot takes a snapshot of s, or returns ErrUnsupported if s cannot
+// take one.
+func NewSnapshot(s KVStore) (Snapshot, error) {
+    ss, ok := s.(Snapshotter)
+    if !ok {
+        return nil, ErrUnsupported
+    }
+    return ss.Snapshot(), nil
+}
+
+// iterRange collects the keys in [start, end) from it and closes it.
+func iterRange(it Iterator, start, end string) ([]string, error) {
+    defer it.Close()
+    var keys []string
+    for ok := it.Seek(start); ok && it.Key() < end; ok = it.Next() {
+        keys = append(keys, it.Key())
+    }
+    return keys, it.Err()
+}
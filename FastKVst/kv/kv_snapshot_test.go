@@ -0,0 +1,172 @@
+package kv
+
+import (
+    "fmt"
+    "testing"
+)
+
+func TestSnapshotIsolation(t *testing.T) {
+    lsm, _ := NewLSMStoreWithOptions(LSMOptions{MemtableSize: 8, L0Trigger: 2, BaseLevelSize: 1})
+    for name, s := range map[string]KVStore{"btree": NewBTreeStore(), "lsm": lsm} {
+        t.Run(name, func(t *testing.T) {
+            for i := 0; i < 50; i++ {
+                s.Set(fmt.Sprintf("k%02d", i), "v1")
+            }
+            snap, err := NewSnapshot(s)
+            if err != nil {
+                t.Fatal(err)
+            }
+            // Overwrite, delete and add enough to force flushes and
+            // compactions underneath the snapshot.
+            for i := 0; i < 50; i++ {
+                k := fmt.Sprintf("k%02d", i)
+                s.Set(k, "v2")
+                if i%2 == 0 {
+                    s.Delete(k)
+                }
+                s.Set(fmt.Sprintf("new%02d", i), "x")
+            }
+            s.Flush()
+
+            for i := 0; i < 50; i++ {
+                k := fmt.Sprintf("k%02d", i)
+                if v, err := snap.Get(k); err != nil || v != "v1" {
+                    t.Fatalf("snapshot %s: got %q, err=%v", k, v, err)
+                }
+            }
+            if _, err := snap.Get("new00"); err != ErrNotFound {
+                t.Fatalf("snapshot sees later write: err=%v", err)
+            }
+            keys, err := snap.Range("", "z")
+            if err != nil || len(keys) != 50 {
+                t.Fatalf("snapshot range: %d keys, err=%v", len(keys), err)
+            }
+            res, err := Scan(snap, ScanOptions{Prefix: "k", Reverse: true, Limit: 3})
+            if err != nil || scanKeys(res.Pairs) != "[k49 k48 k47]" || res.Pairs[0].Value != "v1" {
+                t.Fatalf("snapshot scan: %v err=%v", res.Pairs, err)
+            }
+            if err := snap.Set("a", "b"); err != ErrReadOnly {
+                t.Fatalf("expected ErrReadOnly, got %v", err)
+            }
+
+            if v, err := s.Get("k01"); err != nil || v != "v2" {
+                t.Fatalf("live k01: got %q, err=%v", v, err)
+            }
+            if _, err := s.Get("k00"); err != ErrNotFound {
+                t.Fatalf("live k00: expected ErrNotFound, got %v", err)
+            }
+
+            snap.Release()
+            snap.Release()
+            if _, err := snap.Get("k01"); err != ErrSnapshotReleased {
+                t.Fatalf("expected ErrSnapshotReleased, got %v", err)
+            }
+        })
+    }
+}
+
+func TestSnapshotGarbageCollection(t *testing.T) {
+    lsm, _ := NewLSMStoreWithOptions(LSMOptions{MemtableSize: 1000})
+    lsm.Set("k", "v0")
+    snap := lsm.Snapshot()
+    for i := 1; i <= 10; i++ {
+        lsm.Set("k", fmt.Sprint("v", i))
+    }
+    // The live version and the one the snapshot sees.
+    if n := lsm.memtable.Len(); n != 2 {
+        t.Fatalf("expected 2 versions in memtable, got %d", n)
+    }
+    snap.Release()
+    lsm.Set("k", "v11")
+    if n := lsm.memtable.Len(); n != 1 {
+        t.Fatalf("expected 1 version after release, got %d", n)
+    }
+}
+
+func TestSnapshotCompaction(t *testing.T) {
+    lsm, err := NewLSMStoreWithOptions(LSMOptions{Dir: t.TempDir(), L0Trigger: 2})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer lsm.Close()
+    lsm.Set("a", "1")
+    lsm.Set("b", "1")
+    lsm.Flush()
+    snap := lsm.Snapshot()
+    lsm.Set("a", "2")
+    lsm.Delete("b")
+    lsm.Flush() // compacts both runs into the bottom level
+
+    if v, err := snap.Get("a"); err != nil || v != "1" {
+        t.Fatalf("snapshot a: got %q, err=%v", v, err)
+    }
+    if v, err := snap.Get("b"); err != nil || v != "1" {
+        t.Fatalf("snapshot b: got %q, err=%v", v, err)
+    }
+    snap.Release()
+
+    // Once released, the next compaction keeps only live versions.
+    lsm.Set("c", "1")
+    lsm.Flush()
+    lsm.Set("d", "1")
+    lsm.Flush()
+    var n int
+    c := lsm.levels[1][0].cursor()
+    for {
+        _, ok, err := c.next()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !ok {
+            break
+        }
+        n++
+    }
+    if n != 3 {
+        t.Fatalf("expected a, c, d after compaction, got %d entries", n)
+    }
+}
+
+// Versions of one key that straddle a sparse index sample must still be
+// found newest first, and iterated past in both directions.
+func TestSnapshotSparseBoundary(t *testing.T) {
+    lsm := NewLSMStore()
+    for i := 0; i < sparseInterval-1; i++ {
+        lsm.Set(fmt.Sprintf("a%02d", i), "x")
+    }
+    lsm.Set("b", "old")
+    snap := lsm.Snapshot()
+    defer snap.Release()
+    lsm.Set("b", "new")
+    lsm.Set("c00", "x")
+    if err := lsm.Flush(); err != nil {
+        t.Fatal(err)
+    }
+
+    if v, err := lsm.Get("b"); err != nil || v != "new" {
+        t.Fatalf("Get(b) = %q, %v", v, err)
+    }
+    if v, err := snap.Get("b"); err != nil || v != "old" {
+        t.Fatalf("snapshot Get(b) = %q, %v", v, err)
+    }
+    it := lsm.NewIterator()
+    defer it.Close()
+    if !it.Seek("c00") {
+        t.Fatal("Seek(c00) failed")
+    }
+    var n int
+    for it.Prev() {
+        if n++; n > sparseInterval {
+            t.Fatalf("Prev did not terminate, at %q", it.Key())
+        }
+    }
+    if n != sparseInterval {
+        t.Fatalf("Prev visited %d keys, want %d", n, sparseInterval)
+    }
+}
+
+func TestSnapshotUnsupported(t *testing.T) {
+    if _, err := NewSnapshot(NewHashStore()); err != ErrUnsupported {
+        t.Fatalf("expected ErrUnsupported, got %v", err)
+    }
+}
@@ -5,6 +5,9 @@ import "errors"
 var (
     ErrNotFound    = errors.New("key not found")
     ErrUnsupported = errors.New("operation unsupported")
+    // ErrCorrupted is returned (possibly wrapped) when stored data fails
+    // its checksum or cannot be decoded.
+    ErrCorrupted   = errors.New("data corrupted")
 )
 
 // KVStore defines the minimal operations for a key-value store.
@@ -18,8 +21,9 @@ type KVStore interface {
     // Delete removes the key from the store.
     Delete(key string) error
 
-    // Range returns all values for keys in [start, end).
-    // If unsupported, implement as ErrUnsupported.
+    // Range returns all keys in [start, end), in ascending order.
+    // If unsupported, implement as ErrUnsupported. Use Scan to get
+    // key/value pairs.
     Range(start, end string) ([]string, error)
 
     // Flush simulates persisting in-memory state to disk.
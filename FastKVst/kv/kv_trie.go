@@ -1,12 +1,15 @@
 package kv
 
 import (
+    "sort"
+    "strings"
     "sync"
 )
 
-// trieNode represents a node in the Trie.
+// trieNode represents a node in the Trie. Children are keyed by byte so
+// that any binary key is stored exactly.
 type trieNode struct {
-    children map[rune]*trieNode
+    children map[byte]*trieNode
     value    *string
 }
 
@@ -19,7 +22,7 @@ type TrieStore struct {
 // NewTrieStore constructs a ready-to-use TrieStore.
 func NewTrieStore() *TrieStore {
     return &TrieStore{
-        root: &trieNode{children: make(map[rune]*trieNode)},
+        root: &trieNode{children: make(map[byte]*trieNode)},
     }
 }
 
@@ -27,55 +30,154 @@ func NewTrieStore() *TrieStore {
 func (t *TrieStore) Set(key, value string) error {
     t.mu.Lock()
     defer t.mu.Unlock()
+    t.set(key, value)
+    return nil
+}
+
+func (t *TrieStore) set(key, value string) {
     node := t.root
-    for _, ch := range key {
+    for i := 0; i < len(key); i++ {
+        ch := key[i]
         if node.children[ch] == nil {
-            node.children[ch] = &trieNode{children: make(map[rune]*trieNode)}
+            node.children[ch] = &trieNode{children: make(map[byte]*trieNode)}
         }
         node = node.children[ch]
     }
     node.value = &value
-    return nil
 }
 
 // Get retrieves a key, or ErrNotFound.
 func (t *TrieStore) Get(key string) (string, error) {
     t.mu.RLock()
     defer t.mu.RUnlock()
+    v, ok := t.get(key)
+    if !ok {
+        return "", ErrNotFound
+    }
+    return v, nil
+}
+
+func (t *TrieStore) get(key string) (string, bool) {
     node := t.root
-    for _, ch := range key {
+    for i := 0; i < len(key); i++ {
+        ch := key[i]
         if node.children[ch] == nil {
-            return "", ErrNotFound
+            return "", false
         }
         node = node.children[ch]
     }
     if node.value == nil {
-        return "", ErrNotFound
+        return "", false
     }
-    return *node.value, nil
+    return *node.value, true
 }
 
 // Delete removes a key.
 func (t *TrieStore) Delete(key string) error {
     t.mu.Lock()
     defer t.mu.Unlock()
+    if !t.delete(key) {
+        return ErrNotFound
+    }
+    return nil
+}
+
+// delete removes key, pruning nodes left empty, and reports whether it
+// was present.
+func (t *TrieStore) delete(key string) bool {
     var parents []*trieNode
     node := t.root
-    for _, ch := range key {
+    for i := 0; i < len(key); i++ {
+        ch := key[i]
         if node.children[ch] == nil {
-            return ErrNotFound
+            return false
         }
         parents = append(parents, node)
         node = node.children[ch]
     }
     if node.value == nil {
-        return ErrNotFound
+        return false
     }
     node.value = nil
-    // Optional: prune empty nodes (not implemented for simplicity)
+    // Prune nodes left without a value or children, deepest first.
+    for i := len(parents) - 1; i >= 0; i-- {
+        child := parents[i].children[key[i]]
+        if child.value != nil || len(child.children) > 0 {
+            break
+        }
+        delete(parents[i].children, key[i])
+    }
+    return true
+}
+
+// SetBytes writes key→value, keeping value. The key is only walked, never
+// stored. See BytesStore.
+func (t *TrieStore) SetBytes(key, value []byte) error {
+    return t.Set(bytesToString(key), bytesToString(value))
+}
+
+// GetBytes returns the value of key without copying it or key.
+func (t *TrieStore) GetBytes(key []byte) ([]byte, error) {
+    v, err := t.Get(bytesToString(key))
+    if err != nil {
+        return nil, err
+    }
+    return stringToBytes(v), nil
+}
+
+// DeleteBytes removes key without copying it.
+func (t *TrieStore) DeleteBytes(key []byte) error {
+    return t.Delete(bytesToString(key))
+}
+
+// Write applies every operation in b under a single lock.
+func (t *TrieStore) Write(b *WriteBatch) error {
+    if err := b.check(false); err != nil {
+        return err
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for _, op := range b.ops {
+        if op.delete {
+            t.delete(op.key)
+        } else {
+            t.set(op.key, op.value)
+        }
+    }
     return nil
 }
 
+// CompareAndSwap sets key to new if its current value is old.
+func (t *TrieStore) CompareAndSwap(key, old, new string) (bool, error) {
+    return t.conditional(condSwap, key, old, new)
+}
+
+// SetIfAbsent sets key to value if key does not exist.
+func (t *TrieStore) SetIfAbsent(key, value string) (bool, error) {
+    return t.conditional(condIfAbsent, key, "", value)
+}
+
+// DeleteIfValue deletes key if its current value is value.
+func (t *TrieStore) DeleteIfValue(key, value string) (bool, error) {
+    return t.conditional(condDeleteIf, key, value, "")
+}
+
+// conditional applies op under the write lock.
+func (t *TrieStore) conditional(op condOp, key, want, value string) (bool, error) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    cur, ok := t.get(key)
+    if !op.holds(cur, ok, want) {
+        return false, nil
+    }
+    if op == condDeleteIf {
+        t.delete(key)
+    } else {
+        t.set(key, value)
+    }
+    return true, nil
+}
+
 // Range returns all keys in [start, end).
 func (t *TrieStore) Range(start, end string) ([]string, error) {
     t.mu.RLock()
@@ -87,13 +189,137 @@ func (t *TrieStore) Range(start, end string) ([]string, error) {
             keys = append(keys, prefix)
         }
         for ch, child := range node.children {
-            dfs(child, prefix+string(ch))
+            dfs(child, prefix+string([]byte{ch}))
         }
     }
     dfs(t.root, "")
+    sort.Strings(keys)
     return keys, nil
 }
 
+// NewIterator returns an ordered iterator over the trie.
+func (t *TrieStore) NewIterator() Iterator {
+    return newCursorIterator(t)
+}
+
+func (t *TrieStore) ceiling(key string, inclusive bool) (k, v string, ok bool, err error) {
+    t.mu.RLock()
+    defer t.mu.RUnlock()
+    k, v, ok = t.root.ceiling("", key, inclusive)
+    return k, v, ok, nil
+}
+
+func (t *TrieStore) lower(key string) (k, v string, ok bool, err error) {
+    t.mu.RLock()
+    defer t.mu.RUnlock()
+    k, v, ok = t.root.lower("", key)
+    return k, v, ok, nil
+}
+
+func (t *TrieStore) last() (k, v string, ok bool, err error) {
+    t.mu.RLock()
+    defer t.mu.RUnlock()
+    k, v, ok = t.root.max("")
+    return k, v, ok, nil
+}
+
+// sortedBytes returns the node's child bytes in ascending order.
+func (n *trieNode) sortedBytes() []byte {
+    rs := make([]byte, 0, len(n.children))
+    for r := range n.children {
+        rs = append(rs, r)
+    }
+    sort.Slice(rs, func(i, j int) bool { return rs[i] < rs[j] })
+    return rs
+}
+
+// min returns the smallest key stored under n, whose own key is prefix.
+func (n *trieNode) min(prefix string) (string, string, bool) {
+    if n.value != nil {
+        return prefix, *n.value, true
+    }
+    for _, r := range n.sortedBytes() {
+        if k, v, ok := n.children[r].min(prefix + string([]byte{r})); ok {
+            return k, v, true
+        }
+    }
+    return "", "", false
+}
+
+// max returns the largest key stored under n, whose own key is prefix.
+func (n *trieNode) max(prefix string) (string, string, bool) {
+    rs := n.sortedBytes()
+    for i := len(rs) - 1; i >= 0; i-- {
+        if k, v, ok := n.children[rs[i]].max(prefix + string([]byte{rs[i]})); ok {
+            return k, v, true
+        }
+    }
+    if n.value != nil {
+        return prefix, *n.value, true
+    }
+    return "", "", false
+}
+
+// ceiling returns the smallest key under n that is >= target (> target
+// when !inclusive).
+func (n *trieNode) ceiling(prefix, target string, inclusive bool) (string, string, bool) {
+    if !strings.HasPrefix(target, prefix) {
+        // Every key below shares prefix, so compares to target as prefix does.
+        if prefix > target {
+            return n.min(prefix)
+        }
+        return "", "", false
+    }
+    if prefix == target {
+        if inclusive && n.value != nil {
+            return prefix, *n.value, true
+        }
+        for _, r := range n.sortedBytes() {
+            if k, v, ok := n.children[r].min(prefix + string([]byte{r})); ok {
+                return k, v, true
+            }
+        }
+        return "", "", false
+    }
+    next := target[len(prefix)]
+    for _, r := range n.sortedBytes() {
+        if r < next {
+            continue
+        }
+        if k, v, ok := n.children[r].ceiling(prefix+string([]byte{r}), target, inclusive); ok {
+            return k, v, true
+        }
+    }
+    return "", "", false
+}
+
+// lower returns the largest key under n that is < target.
+func (n *trieNode) lower(prefix, target string) (string, string, bool) {
+    if !strings.HasPrefix(target, prefix) {
+        if prefix < target {
+            return n.max(prefix)
+        }
+        return "", "", false
+    }
+    if prefix == target {
+        return "", "", false // n and all its descendants are >= target
+    }
+    next := target[len(prefix)]
+    rs := n.sortedBytes()
+    for i := len(rs) - 1; i >= 0; i-- {
+        if rs[i] > next {
+            continue
+        }
+        if k, v, ok := n.children[rs[i]].lower(prefix+string([]byte{rs[i]}), target); ok {
+            return k, v, true
+        }
+    }
+    if n.value != nil {
+        return prefix, *n.value, true
+    }
+    return "", "", false
+}
+
 // Flush is a no-op for in-memory Trie.
 func (t *TrieStore) Flush() error {
     return nil
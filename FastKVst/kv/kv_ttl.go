@@ -0,0 +1,152 @@
+package kv
+
+import (
+    "errors"
+    "sync/atomic"
+    "time"
+)
+
+// ErrInvalidTTL is returned for a TTL that is not positive.
+var ErrInvalidTTL = errors.New("ttl must be positive")
+
+// NoExpiry is returned by TTL for a key that never expires.
+const NoExpiry time.Duration = -1
+
+// Expirer is implemented by stores whose keys can expire. Expired keys
+// behave as if deleted: reads return ErrNotFound and scans skip them.
+type Expirer interface {
+    // SetWithTTL writes key→value, expiring it after ttl.
+    SetWithTTL(key, value string, ttl time.Duration) error
+    // TTL returns the time left before key expires, NoExpiry if it has no
+    // TTL, or ErrNotFound if it is absent or expired.
+    TTL(key string) (time.Duration, error)
+    // ExpiredKeys returns how many keys have expired so far.
+    ExpiredKeys() uint64
+}
+
+// SetWithTTL writes key→value with a TTL, or returns ErrUnsupported if s
+// cannot expire keys.
+func SetWithTTL(s KVStore, key, value string, ttl time.Duration) error {
+    e, ok := s.(Expirer)
+    if !ok {
+        return ErrUnsupported
+    }
+    return e.SetWithTTL(key, value, ttl)
+}
+
+// KeyExpirer is implemented by stores that can change the TTL of an
+// existing key, checking and writing atomically.
+type KeyExpirer interface {
+    // Expire sets key to expire after ttl, or deletes it if ttl is not
+    // positive, and reports whether key existed.
+    Expire(key string, ttl time.Duration) (bool, error)
+}
+
+// Expire sets an existing key of s to expire after ttl, deleting it if
+// ttl is not positive. It returns ErrUnsupported if s cannot do so
+// atomically.
+func Expire(s KVStore, key string, ttl time.Duration) (bool, error) {
+    e, ok := s.(KeyExpirer)
+    if !ok {
+        return false, ErrUnsupported
+    }
+    return e.Expire(key, ttl)
+}
+
+// clock is the time source for expiry; tests replace it.
+var clock = time.Now
+
+// deadline converts a TTL into an absolute expiry time in Unix nanoseconds.
+func deadline(ttl time.Duration) int64 {
+    return clock().Add(ttl).UnixNano()
+}
+
+// expiredAt reports whether a deadline (0 for none) has passed at now.
+func expiredAt(deadline, now int64) bool {
+    return deadline != 0 && deadline <= now
+}
+
+// remaining converts a deadline (0 for none) into a TTL as of now.
+func remaining(deadline, now int64) time.Duration {
+    if deadline == 0 {
+        return NoExpiry
+    }
+    return time.Duration(deadline - now)
+}
+
+// ttlIndex records the deadlines of keys that have one, so a sweeper can
+// find them without walking the whole store. It is guarded by the owning
+// store's lock, except for the expired counter.
+type ttlIndex struct {
+    deadlines map[string]int64
+    expired   atomic.Uint64
+}
+
+// set records key's deadline; 0 clears it.
+func (x *ttlIndex) set(key string, deadline int64) {
+    if deadline == 0 {
+        delete(x.deadlines, key)
+        return
+    }
+    if x.deadlines == nil {
+        x.deadlines = make(map[string]int64)
+    }
+    x.deadlines[key] = deadline
+}
+
+func (x *ttlIndex) get(key string) int64 {
+    return x.deadlines[key]
+}
+
+// sweep examines up to limit keys with deadlines and calls remove for
+// each one expired at now. It returns the number removed.
+func (x *ttlIndex) sweep(limit int, now int64, remove func(key string)) int {
+    n, seen := 0, 0
+    for key, d := range x.deadlines {
+        if seen == limit {
+            break
+        }
+        seen++
+        if expiredAt(d, now) {
+            remove(key)
+            delete(x.deadlines, key)
+            n++
+        }
+    }
+    x.expired.Add(uint64(n))
+    return n
+}
+
+// startSweeper calls sweep every interval until the returned stop function
+// is called; stop waits for a running sweep to finish. When a sweep removes
+// a whole batch it runs again right away, since more keys have likely
+// expired.
+func startSweeper(interval time.Duration, batch int, sweep func(limit int) int) (stop func()) {
+    done, exited := make(chan struct{}), make(chan struct{})
+    go func() {
+        defer close(exited)
+        t := time.NewTicker(interval)
+        defer t.Stop()
+        for {
+            select {
+            case <-done:
+                return
+            case <-t.C:
+                for sweep(batch) == batch {
+                    select {
+                    case <-done:
+                        return
+                    default:
+                    }
+                }
+            }
+        }
+    }()
+    var stopped atomic.Bool
+    return func() {
+        if !stopped.Swap(true) {
+            close(done)
+        }
+        <-exited
+    }
+}
@@ -0,0 +1,216 @@
+package kv
+
+import (
+    "fmt"
+    "testing"
+    "time"
+
+    "github.com/thilakshekharshriyan/m/wal"
+)
+
+// fakeClock replaces clock for the duration of a test.
+func fakeClock(t *testing.T) *time.Time {
+    now := time.Unix(1_000_000, 0)
+    clock = func() time.Time { return now }
+    t.Cleanup(func() { clock = time.Now })
+    return &now
+}
+
+func TestTTL(t *testing.T) {
+    now := fakeClock(t)
+    stores := map[string]KVStore{
+        "hash":    NewHashStore(),
+        "sharded": NewShardedHashStore(4),
+        "btree":   NewBTreeStore(),
+        "lsm":     NewLSMStore(),
+    }
+    for name, s := range stores {
+        t.Run(name, func(t *testing.T) {
+            e := s.(Expirer)
+            if err := e.SetWithTTL("temp", "v", 0); err != ErrInvalidTTL {
+                t.Fatalf("expected ErrInvalidTTL, got %v", err)
+            }
+            e.SetWithTTL("temp", "v", time.Minute)
+            e.SetWithTTL("reset", "v", time.Minute)
+            s.Set("reset", "v2") // a plain Set clears the TTL
+            s.Set("perm", "v")
+
+            if d, err := e.TTL("temp"); err != nil || d != time.Minute {
+                t.Fatalf("TTL(temp) = %v, %v", d, err)
+            }
+            if d, err := e.TTL("perm"); err != nil || d != NoExpiry {
+                t.Fatalf("TTL(perm) = %v, %v", d, err)
+            }
+            if _, err := e.TTL("absent"); err != ErrNotFound {
+                t.Fatalf("TTL(absent): expected ErrNotFound, got %v", err)
+            }
+
+            *now = now.Add(30 * time.Second)
+            if v, err := s.Get("temp"); err != nil || v != "v" {
+                t.Fatalf("before expiry: got %q, err=%v", v, err)
+            }
+            *now = now.Add(31 * time.Second)
+            if _, err := s.Get("temp"); err != ErrNotFound {
+                t.Fatalf("after expiry: expected ErrNotFound, got %v", err)
+            }
+            if _, err := e.TTL("temp"); err != ErrNotFound {
+                t.Fatalf("TTL after expiry: expected ErrNotFound, got %v", err)
+            }
+            if v, err := s.Get("reset"); err != nil || v != "v2" {
+                t.Fatalf("reset: got %q, err=%v", v, err)
+            }
+
+            res, err := Scan(s, ScanOptions{})
+            if err != nil || scanKeys(res.Pairs) != "[perm reset]" {
+                t.Fatalf("scan: %v, err=%v", res.Pairs, err)
+            }
+        })
+    }
+}
+
+func TestExpire(t *testing.T) {
+    now := fakeClock(t)
+    d, err := OpenDurableStore(t.TempDir(), NewHashStore(), wal.Options{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer d.Close()
+    stores := map[string]KVStore{
+        "hash":    NewHashStore(),
+        "sharded": NewShardedHashStore(4),
+        "btree":   NewBTreeStore(),
+        "lsm":     NewLSMStore(),
+        "durable": d,
+    }
+    for name, s := range stores {
+        t.Run(name, func(t *testing.T) {
+            s.Set("k", "v")
+            s.Set("gone", "v")
+            if ok, err := Expire(s, "k", time.Minute); !ok || err != nil {
+                t.Fatalf("Expire(k) = %v, %v", ok, err)
+            }
+            if ok, err := Expire(s, "absent", time.Minute); ok || err != nil {
+                t.Fatalf("Expire(absent) = %v, %v", ok, err)
+            }
+            if ok, err := Expire(s, "gone", 0); !ok || err != nil {
+                t.Fatalf("Expire(gone, 0) = %v, %v", ok, err)
+            }
+            if _, err := s.Get("gone"); err != ErrNotFound {
+                t.Fatalf("Expire(gone, 0) left the key: %v", err)
+            }
+            if ttl, err := s.(Expirer).TTL("k"); err != nil || ttl != time.Minute {
+                t.Fatalf("TTL(k) = %v, %v", ttl, err)
+            }
+            *now = now.Add(2 * time.Minute)
+            if ok, err := Expire(s, "k", time.Minute); ok || err != nil {
+                t.Fatalf("Expire(expired) = %v, %v", ok, err)
+            }
+            if _, err := s.Get("k"); err != ErrNotFound {
+                t.Fatalf("expired key came back: %v", err)
+            }
+            *now = now.Add(-2 * time.Minute)
+        })
+    }
+    if _, err := Expire(NewTrieStore(), "k", time.Minute); err != ErrUnsupported {
+        t.Fatalf("trie: expected ErrUnsupported, got %v", err)
+    }
+}
+
+func TestTTLSweeper(t *testing.T) {
+    now := fakeClock(t)
+    for name, s := range map[string]interface {
+        KVStore
+        Expirer
+        StartSweeper(time.Duration, int) func()
+    }{
+        "hash":    NewHashStore(),
+        "sharded": NewShardedHashStore(4),
+        "btree":   NewBTreeStore(),
+    } {
+        t.Run(name, func(t *testing.T) {
+            for i := 0; i < 100; i++ {
+                s.SetWithTTL(fmt.Sprint("k", i), "v", time.Second)
+            }
+            s.Set("perm", "v")
+            *now = now.Add(2 * time.Second)
+
+            stop := s.StartSweeper(time.Millisecond, 10)
+            deadline := time.Now().Add(5 * time.Second)
+            for s.ExpiredKeys() < 100 && time.Now().Before(deadline) {
+                time.Sleep(time.Millisecond)
+            }
+            stop()
+            stop()
+            if n := s.ExpiredKeys(); n != 100 {
+                t.Fatalf("expected 100 expired keys, got %d", n)
+            }
+            if _, err := s.Get("perm"); err != nil {
+                t.Fatal(err)
+            }
+        })
+    }
+}
+
+func TestTTLLSMCompaction(t *testing.T) {
+    now := fakeClock(t)
+    lsm, err := NewLSMStoreWithOptions(LSMOptions{Dir: t.TempDir(), L0Trigger: 2})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer lsm.Close()
+    lsm.Set("a", "old")
+    lsm.Flush()
+    lsm.SetWithTTL("a", "new", time.Second)
+    lsm.SetWithTTL("b", "x", time.Hour)
+    lsm.Flush()
+    // Persisted expiry survives the SSTable round trip.
+    if d, err := lsm.TTL("b"); err != nil || d != time.Hour {
+        t.Fatalf("TTL(b) = %v, %v", d, err)
+    }
+
+    *now = now.Add(2 * time.Second)
+    // The expired value must keep shadowing the older one.
+    if _, err := lsm.Get("a"); err != ErrNotFound {
+        t.Fatalf("expected ErrNotFound, got %v", err)
+    }
+    lsm.Set("c", "1")
+    lsm.Flush()
+    lsm.Set("d", "1")
+    lsm.Flush()
+    if n := lsm.ExpiredKeys(); n != 1 {
+        t.Fatalf("expected 1 expired key, got %d", n)
+    }
+    if _, err := lsm.Get("a"); err != ErrNotFound {
+        t.Fatalf("after compaction: expected ErrNotFound, got %v", err)
+    }
+}
+
+func TestTTLDurable(t *testing.T) {
+    now := fakeClock(t)
+    dir := t.TempDir()
+    d, err := OpenDurableStore(dir, NewHashStore(), wal.Options{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    d.SetWithTTL("short", "v", time.Second)
+    d.SetWithTTL("long", "v", time.Hour)
+    d.Close()
+
+    *now = now.Add(time.Minute)
+    h := NewHashStore()
+    d, err = OpenDurableStore(dir, h, wal.Options{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer d.Close()
+    if _, err := h.Get("short"); err != ErrNotFound {
+        t.Fatalf("expected ErrNotFound, got %v", err)
+    }
+    if ttl, err := h.TTL("long"); err != nil || ttl != time.Hour-time.Minute {
+        t.Fatalf("TTL(long) = %v, %v", ttl, err)
+    }
+
+    if err := SetWithTTL(NewTrieStore(), "k", "v", time.Second); err != ErrUnsupported {
+        t.Fatalf("expected ErrUnsupported, got %v", err)
+    }
+}
@@ -0,0 +1,229 @@
+package kv
+
+import (
+    "errors"
+    "sync"
+)
+
+var (
+    // ErrConflict is returned by Commit when a key the transaction read
+    // was written after the transaction began.
+    ErrConflict = errors.New("transaction conflict")
+    // ErrTxnDone is returned when using a committed or rolled back
+    // transaction.
+    ErrTxnDone = errors.New("transaction already committed or rolled back")
+)
+
+// TxnStore adds optimistic multi-key transactions to any KVStore. Each
+// key remembers the commit number that last wrote it; a transaction
+// commits only if none of the keys it read were written since it began.
+//
+// All writes must go through the TxnStore (directly or in a transaction)
+// for conflicts to be detected. Commit numbers older than every open
+// transaction are forgotten, so every transaction should end in Commit or
+// Rollback.
+type TxnStore struct {
+    mu       sync.Mutex // serializes commits and plain writes
+    store    KVStore
+    commit   uint64            // number of the last commit
+    versions map[string]uint64 // key -> commit that last wrote it
+    active   map[uint64]int    // start -> open transactions that began there
+    pruneAt  int               // size of versions that triggers a prune
+}
+
+// minPrune is the smallest versions map worth pruning.
+const minPrune = 1024
+
+// NewTxnStore wraps store.
+func NewTxnStore(store KVStore) *TxnStore {
+    return &TxnStore{
+        store:    store,
+        versions: make(map[string]uint64),
+        active:   make(map[uint64]int),
+        pruneAt:  minPrune,
+    }
+}
+
+// Begin starts a transaction.
+func (s *TxnStore) Begin() *Txn {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.active[s.commit]++
+    return &Txn{s: s, start: s.commit, reads: make(map[string]struct{}), pending: make(map[string]int)}
+}
+
+// bump records that keys were written by a new commit. Callers hold s.mu.
+func (s *TxnStore) bump(b *WriteBatch) {
+    s.commit++
+    for _, op := range b.ops {
+        s.versions[op.key] = s.commit
+    }
+    s.prune()
+}
+
+// finish removes t from the open transactions. Callers hold s.mu.
+func (s *TxnStore) finish(t *Txn) {
+    if s.active[t.start]--; s.active[t.start] == 0 {
+        delete(s.active, t.start)
+    }
+    if len(s.active) == 0 && len(s.versions) > 0 {
+        // Nothing is left that could conflict.
+        s.versions = make(map[string]uint64)
+        s.pruneAt = minPrune
+        return
+    }
+    s.prune()
+}
+
+// prune drops the commit numbers no open transaction can conflict with:
+// those at or below the oldest start. It runs once versions has doubled
+// since the last prune, so its cost is amortized over the writes.
+// Callers hold s.mu.
+func (s *TxnStore) prune() {
+    if len(s.versions) < s.pruneAt {
+        return
+    }
+    oldest := s.commit
+    for start := range s.active {
+        oldest = min(oldest, start)
+    }
+    for key, v := range s.versions {
+        if v <= oldest {
+            delete(s.versions, key)
+        }
+    }
+    s.pruneAt = max(2*len(s.versions), minPrune)
+}
+
+// Set writes key as a single-key transaction.
+func (s *TxnStore) Set(key, value string) error {
+    var b WriteBatch
+    b.Put(key, value)
+    return s.Write(&b)
+}
+
+// Get reads straight from the wrapped store.
+func (s *TxnStore) Get(key string) (string, error) {
+    return s.store.Get(key)
+}
+
+// Delete deletes key as a single-key transaction.
+func (s *TxnStore) Delete(key string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := s.store.Delete(key); err != nil {
+        return err
+    }
+    s.commit++
+    s.versions[key] = s.commit
+    s.prune()
+    return nil
+}
+
+// Write applies b without validation, as a transaction that read nothing.
+func (s *TxnStore) Write(b *WriteBatch) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := Write(s.store, b); err != nil {
+        return err
+    }
+    s.bump(b)
+    return nil
+}
+
+// Range reads straight from the wrapped store.
+func (s *TxnStore) Range(start, end string) ([]string, error) {
+    return s.store.Range(start, end)
+}
+
+// Flush flushes the wrapped store.
+func (s *TxnStore) Flush() error {
+    return s.store.Flush()
+}
+
+// Txn is an optimistic transaction. Writes are buffered until Commit;
+// reads see the transaction's own writes. A Txn is not safe for
+// concurrent use.
+type Txn struct {
+    s       *TxnStore
+    start   uint64              // s.commit when the transaction began
+    reads   map[string]struct{} // keys read from the store
+    writes  WriteBatch
+    pending map[string]int // key -> index of its latest op in writes
+    done    bool
+}
+
+// Get returns the value of key as seen by the transaction.
+func (t *Txn) Get(key string) (string, error) {
+    if t.done {
+        return "", ErrTxnDone
+    }
+    if i, ok := t.pending[key]; ok {
+        op := t.writes.ops[i]
+        if op.delete {
+            return "", ErrNotFound
+        }
+        return op.value, nil
+    }
+    t.reads[key] = struct{}{}
+    return t.s.store.Get(key)
+}
+
+// Set buffers a write of key.
+func (t *Txn) Set(key, value string) error {
+    if t.done {
+        return ErrTxnDone
+    }
+    t.pending[key] = t.writes.Len()
+    t.writes.Put(key, value)
+    return nil
+}
+
+// Delete buffers a delete of key.
+func (t *Txn) Delete(key string) error {
+    if t.done {
+        return ErrTxnDone
+    }
+    t.pending[key] = t.writes.Len()
+    t.writes.Delete(key)
+    return nil
+}
+
+// Commit applies the buffered writes if no key the transaction read has
+// been written since it began, and returns ErrConflict otherwise. The
+// writes are applied atomically if the wrapped store implements Batcher.
+// The transaction is finished either way.
+func (t *Txn) Commit() error {
+    if t.done {
+        return ErrTxnDone
+    }
+    t.done = true
+    s := t.s
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    defer s.finish(t)
+    for key := range t.reads {
+        if s.versions[key] > t.start {
+            return ErrConflict
+        }
+    }
+    if t.writes.Len() == 0 {
+        return nil
+    }
+    if err := Write(s.store, &t.writes); err != nil {
+        return err
+    }
+    s.bump(&t.writes)
+    return nil
+}
+
+// Rollback discards the transaction.
+func (t *Txn) Rollback() {
+    if t.done {
+        return
+    }
+    t.done = true
+    t.s.mu.Lock()
+    defer t.s.mu.Unlock()
+    t.s.finish(t)
+}
@@ -0,0 +1,163 @@
+package kv
+
+import (
+    "strconv"
+    "sync"
+    "testing"
+)
+
+func TestTxnBasic(t *testing.T) {
+    s := NewTxnStore(NewBTreeStore())
+    s.Set("a", "1")
+
+    tx := s.Begin()
+    tx.Set("a", "2")
+    tx.Delete("b")
+    if v, err := tx.Get("a"); err != nil || v != "2" {
+        t.Fatalf("read-your-writes: got %q, err=%v", v, err)
+    }
+    if v, _ := s.Get("a"); v != "1" {
+        t.Fatalf("uncommitted write visible: %q", v)
+    }
+    if err := tx.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    if v, _ := s.Get("a"); v != "2" {
+        t.Fatalf("expected 2 after commit, got %q", v)
+    }
+    if err := tx.Commit(); err != ErrTxnDone {
+        t.Fatalf("expected ErrTxnDone, got %v", err)
+    }
+}
+
+func TestTxnConflict(t *testing.T) {
+    s := NewTxnStore(NewHashStore())
+    s.Set("a", "1")
+
+    t1 := s.Begin()
+    t2 := s.Begin()
+    t1.Get("a")
+    t2.Get("a")
+    t1.Set("a", "from t1")
+    t2.Set("a", "from t2")
+    if err := t1.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    if err := t2.Commit(); err != ErrConflict {
+        t.Fatalf("expected ErrConflict, got %v", err)
+    }
+    if v, _ := s.Get("a"); v != "from t1" {
+        t.Fatalf("expected t1's write, got %q", v)
+    }
+
+    // A plain write after Begin also conflicts, even if read later.
+    t3 := s.Begin()
+    s.Set("a", "plain")
+    t3.Get("a")
+    t3.Set("b", "x")
+    if err := t3.Commit(); err != ErrConflict {
+        t.Fatalf("expected ErrConflict, got %v", err)
+    }
+
+    // Blind writes never conflict.
+    t4 := s.Begin()
+    s.Set("a", "again")
+    t4.Set("a", "blind")
+    if err := t4.Commit(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestTxnTransfer(t *testing.T) {
+    s := NewTxnStore(NewBTreeStore())
+    s.Set("alice", "100")
+    s.Set("bob", "100")
+
+    transfer := func(from, to string) {
+        for {
+            tx := s.Begin()
+            fv, _ := tx.Get(from)
+            tv, _ := tx.Get(to)
+            f, _ := strconv.Atoi(fv)
+            g, _ := strconv.Atoi(tv)
+            tx.Set(from, strconv.Itoa(f-1))
+            tx.Set(to, strconv.Itoa(g+1))
+            switch err := tx.Commit(); err {
+            case nil:
+                return
+            case ErrConflict:
+                continue
+            default:
+                t.Error(err)
+                return
+            }
+        }
+    }
+
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            for j := 0; j < 50; j++ {
+                if i%2 == 0 {
+                    transfer("alice", "bob")
+                } else {
+                    transfer("bob", "alice")
+                }
+            }
+        }(i)
+    }
+    wg.Wait()
+
+    a, _ := s.Get("alice")
+    b, _ := s.Get("bob")
+    x, _ := strconv.Atoi(a)
+    y, _ := strconv.Atoi(b)
+    if x+y != 200 {
+        t.Fatalf("balance not conserved: alice=%s bob=%s", a, b)
+    }
+}
+
+func TestTxnPrune(t *testing.T) {
+    s := NewTxnStore(NewHashStore())
+    old := s.Begin()
+    old.Get("k0")
+    for i := 0; i < 4*minPrune; i++ {
+        s.Set("k"+strconv.Itoa(i), "v")
+    }
+    // The open transaction pins every version written since it began.
+    if len(s.versions) != 4*minPrune {
+        t.Fatalf("versions pruned under an open transaction: %d", len(s.versions))
+    }
+    if err := old.Commit(); err != ErrConflict {
+        t.Fatalf("expected ErrConflict, got %v", err)
+    }
+
+    // With a transaction always open, versions stay bounded.
+    keep := s.Begin()
+    for i := 0; i < 4*minPrune; i++ {
+        s.Set("m"+strconv.Itoa(i), "v")
+        if i%minPrune == 0 {
+            keep.Rollback()
+            keep = s.Begin()
+        }
+    }
+    if len(s.versions) > 2*minPrune {
+        t.Fatalf("versions = %d with a recent transaction open", len(s.versions))
+    }
+    keep.Rollback()
+
+    for i := 0; i < 4*minPrune; i++ {
+        tx := s.Begin()
+        tx.Set("n"+strconv.Itoa(i), "v")
+        if i%2 == 0 {
+            tx.Commit()
+        } else {
+            tx.Rollback()
+        }
+    }
+    if len(s.versions) != 0 || len(s.active) != 0 {
+        t.Fatalf("versions = %d, active = %d after all transactions ended", len(s.versions), len(s.active))
+    }
+}
@@ -0,0 +1,91 @@
+package kv
+
+import (
+    "errors"
+    "fmt"
+    "path/filepath"
+
+    "github.com/thilakshekharshriyan/m/wal"
+)
+
+// Verifier is implemented by stores that can scan their data for
+// corruption.
+type Verifier interface {
+    // Verify reads all data, checking every checksum. Corruption is
+    // listed in the report; the error is for failures to read at all.
+    Verify() (VerifyReport, error)
+}
+
+// VerifyReport is the result of a Verify scan.
+type VerifyReport struct {
+    Checked       int      // keys, records or blocks checked
+    CorruptKeys   []string // keys whose values failed their checksum
+    CorruptBlocks []string // damaged blocks or records, as "file@offset"
+}
+
+// OK reports whether no corruption was found.
+func (r VerifyReport) OK() bool {
+    return len(r.CorruptKeys) == 0 && len(r.CorruptBlocks) == 0
+}
+
+// Verify scans s for corruption, or returns ErrUnsupported if s cannot
+// verify its data.
+func Verify(s KVStore) (VerifyReport, error) {
+    v, ok := s.(Verifier)
+    if !ok {
+        return VerifyReport{}, ErrUnsupported
+    }
+    return v.Verify()
+}
+
+// Verify reads every block of every SSTable. In-memory runs and the
+// memtable are not checked.
+func (l *LSMStore) Verify() (VerifyReport, error) {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+    var r VerifyReport
+    for _, level := range l.levels {
+        for _, run := range level {
+            t, ok := run.(*sstable)
+            if !ok {
+                continue
+            }
+            for i, ie := range t.index {
+                r.Checked++
+                _, err := t.readBlock(i)
+                if errors.Is(err, ErrCorrupted) {
+                    r.CorruptBlocks = append(r.CorruptBlocks, fmt.Sprintf("%s@%d", filepath.Base(t.path), ie.offset))
+                } else if err != nil {
+                    return r, err
+                }
+            }
+        }
+    }
+    return r, nil
+}
+
+// Verify replays the log, checking every record, then verifies the
+// wrapped store if it is a Verifier. The log is read up to its first
+// corrupt record only.
+func (d *DurableStore) Verify() (VerifyReport, error) {
+    var r VerifyReport
+    err := d.log.Replay(func(rec []byte) error {
+        r.Checked++
+        _, err := decodeWALRecord(rec)
+        return err
+    })
+    if err != nil {
+        if !errors.Is(err, wal.ErrCorrupt) && !errors.Is(err, ErrCorrupted) {
+            return r, err
+        }
+        r.CorruptBlocks = append(r.CorruptBlocks, "wal: "+err.Error())
+    }
+    inner, err := Verify(d.store)
+    if err == ErrUnsupported {
+        return r, nil
+    }
+    r.Checked += inner.Checked
+    r.CorruptKeys = append(r.CorruptKeys, inner.CorruptKeys...)
+    r.CorruptBlocks = append(r.CorruptBlocks, inner.CorruptBlocks...)
+    return r, err
+}
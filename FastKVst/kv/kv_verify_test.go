@@ -0,0 +1,67 @@
+package kv
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/thilakshekharshriyan/m/wal"
+)
+
+func TestLSMVerify(t *testing.T) {
+    dir := t.TempDir()
+    l, err := NewLSMStoreWithOptions(LSMOptions{Dir: dir, MemtableSize: 1000, L0Trigger: 100})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    for i := 0; i < 2000; i++ {
+        l.Set(fmt.Sprintf("key%04d", i), fmt.Sprintf("value%04d", i))
+    }
+    l.Flush()
+    r, err := l.Verify()
+    if err != nil || !r.OK() || r.Checked == 0 {
+        t.Fatalf("clean store: %+v, %v", r, err)
+    }
+
+    // Damage the first data block of one table.
+    tbl := l.levels[0][0].(*sstable)
+    f, err := os.OpenFile(tbl.path, os.O_RDWR, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.WriteAt([]byte("garbage"), int64(tbl.index[0].offset))
+    f.Close()
+
+    r, err = Verify(l)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := fmt.Sprintf("%s@%d", filepath.Base(tbl.path), tbl.index[0].offset)
+    if len(r.CorruptBlocks) != 1 || r.CorruptBlocks[0] != want {
+        t.Fatalf("corrupt blocks %v, want [%s]", r.CorruptBlocks, want)
+    }
+    if _, err := l.Get(tbl.index[0].lastKey); !errors.Is(err, ErrCorrupted) {
+        t.Fatalf("expected ErrCorrupted, got %v", err)
+    }
+}
+
+func TestDurableStoreVerify(t *testing.T) {
+    d, err := OpenDurableStore(t.TempDir(), NewChecksumStore(NewHashStore()), wal.Options{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer d.Close()
+    d.Set("a", "1")
+    d.Set("b", "2")
+    d.Delete("a")
+    r, err := d.Verify()
+    if err != nil || !r.OK() || r.Checked != 4 {
+        t.Fatalf("got %+v, %v", r, err)
+    }
+    if _, err := Verify(NewHashStore()); err != ErrUnsupported {
+        t.Fatalf("expected ErrUnsupported, got %v", err)
+    }
+}
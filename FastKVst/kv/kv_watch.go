@@ -0,0 +1,237 @@
+package kv
+
+import (
+    "strings"
+    "sync"
+    "time"
+)
+
+// EventType is the kind of a watch Event.
+type EventType int
+
+const (
+    EventPut    EventType = iota + 1 // key was set
+    EventDelete                      // key was deleted
+    // EventOverflow means the watcher fell behind and events were dropped.
+    // The subscriber should re-read the keys it cares about; events that
+    // follow are delivered as usual.
+    EventOverflow
+)
+
+func (t EventType) String() string {
+    switch t {
+    case EventPut:
+        return "put"
+    case EventDelete:
+        return "delete"
+    case EventOverflow:
+        return "overflow"
+    }
+    return "unknown"
+}
+
+// Event describes one mutation. Seq numbers increase by one per mutation
+// across the whole store; an EventOverflow carries the Seq of the first
+// event it dropped.
+type Event struct {
+    Type  EventType
+    Key   string
+    Value string // set for EventPut
+    Seq   uint64
+}
+
+// Watcher receives the events for one Watch call.
+type Watcher struct {
+    C <-chan Event
+
+    ch         chan Event
+    prefix     string
+    buffer     int
+    s          *WatchStore
+    overflowed bool // an overflow marker is queued and not yet read
+    after      int  // events queued behind that marker
+}
+
+// Close stops the watcher and closes C.
+func (w *Watcher) Close() {
+    w.s.mu.Lock()
+    defer w.s.mu.Unlock()
+    if _, ok := w.s.watchers[w]; ok {
+        delete(w.s.watchers, w)
+        close(w.ch)
+    }
+}
+
+// WatchStore publishes every mutation made through it to watchers. It
+// wraps any KVStore; writes made to the wrapped store directly, and keys
+// that expire, are not reported.
+//
+// Publishing never blocks: each watcher has a bounded buffer, and when it
+// is full events are dropped and an EventOverflow is queued instead.
+type WatchStore struct {
+    mu       sync.Mutex // orders writes so events match apply order
+    store    KVStore
+    seq      uint64
+    watchers map[*Watcher]struct{}
+}
+
+// NewWatchStore wraps store.
+func NewWatchStore(store KVStore) *WatchStore {
+    return &WatchStore{store: store, watchers: make(map[*Watcher]struct{})}
+}
+
+// DefaultWatchBuffer is the buffer size Watch uses when given 0.
+const DefaultWatchBuffer = 128
+
+// Watch subscribes to mutations of keys starting with prefix ("" for all
+// keys). buffer bounds the events queued for a slow reader; <= 0 selects
+// DefaultWatchBuffer.
+func (s *WatchStore) Watch(prefix string, buffer int) *Watcher {
+    if buffer <= 0 {
+        buffer = DefaultWatchBuffer
+    }
+    // One extra slot so an overflow event always fits.
+    ch := make(chan Event, buffer+1)
+    w := &Watcher{C: ch, ch: ch, prefix: prefix, buffer: buffer, s: s}
+    s.mu.Lock()
+    s.watchers[w] = struct{}{}
+    s.mu.Unlock()
+    return w
+}
+
+// publish assigns e the next sequence number and offers it to every
+// matching watcher. Callers hold s.mu.
+func (s *WatchStore) publish(typ EventType, key, value string) {
+    s.seq++
+    e := Event{Type: typ, Key: key, Value: value, Seq: s.seq}
+    for w := range s.watchers {
+        if !strings.HasPrefix(key, w.prefix) {
+            continue
+        }
+        if w.overflowed && len(w.ch) <= w.after {
+            w.overflowed = false // the reader is past the marker
+        }
+        if len(w.ch) < w.buffer {
+            w.ch <- e
+            if w.overflowed {
+                w.after++
+            }
+            continue
+        }
+        // Full: queue an overflow marker in the reserved slot, unless an
+        // unread one already covers this drop.
+        if !w.overflowed {
+            w.ch <- Event{Type: EventOverflow, Seq: e.Seq}
+            w.overflowed, w.after = true, 0
+        }
+    }
+}
+
+// Set writes key and publishes an EventPut.
+func (s *WatchStore) Set(key, value string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := s.store.Set(key, value); err != nil {
+        return err
+    }
+    s.publish(EventPut, key, value)
+    return nil
+}
+
+// Get reads straight from the wrapped store.
+func (s *WatchStore) Get(key string) (string, error) {
+    return s.store.Get(key)
+}
+
+// Delete deletes key and publishes an EventDelete if it existed.
+func (s *WatchStore) Delete(key string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := s.store.Delete(key); err != nil {
+        return err
+    }
+    s.publish(EventDelete, key, "")
+    return nil
+}
+
+// Write applies b and publishes one event per operation, in order. A
+// delete is reported even if the key did not exist.
+func (s *WatchStore) Write(b *WriteBatch) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := Write(s.store, b); err != nil {
+        return err
+    }
+    for _, op := range b.ops {
+        if op.delete {
+            s.publish(EventDelete, op.key, "")
+        } else {
+            s.publish(EventPut, op.key, op.value)
+        }
+    }
+    return nil
+}
+
+// SetWithTTL writes key with a TTL and publishes an EventPut. It fails
+// with ErrUnsupported if the wrapped store cannot expire keys.
+func (s *WatchStore) SetWithTTL(key, value string, ttl time.Duration) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := SetWithTTL(s.store, key, value, ttl); err != nil {
+        return err
+    }
+    s.publish(EventPut, key, value)
+    return nil
+}
+
+// CompareAndSwap swaps key and publishes an EventPut if it succeeds.
+func (s *WatchStore) CompareAndSwap(key, old, new string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    ok, err := CompareAndSwap(s.store, key, old, new)
+    if ok {
+        s.publish(EventPut, key, new)
+    }
+    return ok, err
+}
+
+// SetIfAbsent sets key and publishes an EventPut if it was absent.
+func (s *WatchStore) SetIfAbsent(key, value string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    ok, err := SetIfAbsent(s.store, key, value)
+    if ok {
+        s.publish(EventPut, key, value)
+    }
+    return ok, err
+}
+
+// DeleteIfValue deletes key and publishes an EventDelete if it held value.
+func (s *WatchStore) DeleteIfValue(key, value string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    ok, err := DeleteIfValue(s.store, key, value)
+    if ok {
+        s.publish(EventDelete, key, "")
+    }
+    return ok, err
+}
+
+// Range reads straight from the wrapped store.
+func (s *WatchStore) Range(start, end string) ([]string, error) {
+    return s.store.Range(start, end)
+}
+
+// NewIterator iterates the wrapped store. If that store cannot iterate, the
+// iterator is empty and Err reports ErrUnsupported.
+func (s *WatchStore) NewIterator() Iterator {
+    if it, ok := s.store.(Iterable); ok {
+        return it.NewIterator()
+    }
+    return &sliceIterator{i: -1, err: ErrUnsupported}
+}
+
+// Flush flushes the wrapped store.
+func (s *WatchStore) Flush() error {
+    return s.store.Flush()
+}
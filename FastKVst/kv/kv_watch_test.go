@@ -0,0 +1,104 @@
+package kv
+
+import (
+    "testing"
+)
+
+func TestWatchEvents(t *testing.T) {
+    s := NewWatchStore(NewBTreeStore())
+    all := s.Watch("", 0)
+    defer all.Close()
+    users := s.Watch("user/", 0)
+    defer users.Close()
+
+    s.Set("user/1", "a")
+    s.Set("post/1", "b")
+    var b WriteBatch
+    b.Put("user/2", "c")
+    b.Delete("post/1")
+    if err := s.Write(&b); err != nil {
+        t.Fatal(err)
+    }
+    s.Delete("user/1")
+    s.Delete("missing") // not found: no event
+    if ok, _ := CompareAndSwap(s, "user/2", "x", "y"); ok {
+        t.Fatal("CompareAndSwap with wrong old value succeeded")
+    }
+    SetIfAbsent(s, "user/3", "d")
+
+    want := []Event{
+        {EventPut, "user/1", "a", 1},
+        {EventPut, "post/1", "b", 2},
+        {EventPut, "user/2", "c", 3},
+        {EventDelete, "post/1", "", 4},
+        {EventDelete, "user/1", "", 5},
+        {EventPut, "user/3", "d", 6},
+    }
+    for _, e := range want {
+        if got := <-all.C; got != e {
+            t.Fatalf("all: got %+v, want %+v", got, e)
+        }
+    }
+    for _, e := range want {
+        if e.Key[:5] != "user/" {
+            continue
+        }
+        if got := <-users.C; got != e {
+            t.Fatalf("users: got %+v, want %+v", got, e)
+        }
+    }
+    select {
+    case e := <-all.C:
+        t.Fatalf("unexpected event %+v", e)
+    default:
+    }
+}
+
+func TestWatchOverflow(t *testing.T) {
+    s := NewWatchStore(NewHashStore())
+    w := s.Watch("", 2)
+    for _, k := range []string{"a", "b", "c", "d"} {
+        s.Set(k, "v") // never blocks on the slow watcher
+    }
+    want := []Event{
+        {EventPut, "a", "v", 1},
+        {EventPut, "b", "v", 2},
+        {Type: EventOverflow, Seq: 3},
+    }
+    for _, e := range want {
+        if got := <-w.C; got != e {
+            t.Fatalf("got %+v, want %+v", got, e)
+        }
+    }
+    // Once drained, delivery resumes.
+    s.Set("e", "v")
+    if got := <-w.C; got.Key != "e" || got.Seq != 5 {
+        t.Fatalf("after overflow got %+v", got)
+    }
+
+    // Drops while a marker is still unread share that marker.
+    for _, k := range []string{"f", "g", "h"} {
+        s.Set(k, "v")
+    }
+    <-w.C // f
+    s.Set("i", "v") // dropped, marker still queued
+    s.Set("j", "v")
+    want = []Event{
+        {EventPut, "g", "v", 7},
+        {Type: EventOverflow, Seq: 8},
+    }
+    for _, e := range want {
+        if got := <-w.C; got != e {
+            t.Fatalf("got %+v, want %+v", got, e)
+        }
+    }
+    if len(w.C) != 0 {
+        t.Fatalf("%d events queued after the marker, want 0", len(w.C))
+    }
+    w.Close()
+    if _, ok := <-w.C; ok {
+        t.Fatal("channel still open after Close")
+    }
+    w.Close()
+    s.Set("f", "v") // no watchers left
+}
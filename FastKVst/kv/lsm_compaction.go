@@ -0,0 +1,380 @@
+package kv
+
+import (
+    "fmt"
+    "path/filepath"
+    "sort"
+    "sync/atomic"
+
+    "github.com/thilakshekharshriyan/m/encrypt"
+)
+
+// lsmRun is an immutable run of entries in entryLess order, held either
+// in memory (memRun) or in an SSTable file (*sstable).
+type lsmRun interface {
+    entrySeeker
+    filter() *bloomFilter // nil if the run has no Bloom filter
+    cursor() runCursor
+    size() int64
+    close() error
+    remove() error
+}
+
+// runCursor yields a run's entries in key order.
+type runCursor interface {
+    next() (lsmEntry, bool, error)
+}
+
+// sparseInterval is the distance between sampled keys in a memRun's
+// sparse index.
+const sparseInterval = 64
+
+// memRun is an lsmRun backed by a sorted slice. Every sparseInterval-th
+// key is sampled into a small index so searches touch one window only.
+type memRun struct {
+    entries []lsmEntry
+    sparse  []string
+    bloom   *bloomFilter
+    bytes   int64
+}
+
+// seek returns the position of the first entry with key >= key, which is
+// the newest version of key if it is present.
+func (m *memRun) seek(key string) int {
+    // The window runs from the last sample below key to the first at or
+    // above it, so it starts before every version of key even when they
+    // straddle a sample.
+    w := sort.Search(len(m.sparse), func(i int) bool {
+        return m.sparse[i] >= key
+    })
+    lo := 0
+    if w > 0 {
+        lo = (w - 1) * sparseInterval
+    }
+    hi := len(m.entries)
+    if w*sparseInterval < hi {
+        hi = w * sparseInterval
+    }
+    return lo + sort.Search(hi-lo, func(i int) bool {
+        return m.entries[lo+i].key >= key
+    })
+}
+
+func (m *memRun) seekGE(key string, seq uint64) (lsmEntry, bool, error) {
+    i := m.seek(key)
+    for i < len(m.entries) && m.entries[i].key == key && m.entries[i].seq > seq {
+        i++
+    }
+    if i < len(m.entries) {
+        return m.entries[i], true, nil
+    }
+    return lsmEntry{}, false, nil
+}
+
+func (m *memRun) seekLT(key string) (lsmEntry, bool, error) {
+    if i := m.seek(key) - 1; i >= 0 {
+        return m.entries[i], true, nil
+    }
+    return lsmEntry{}, false, nil
+}
+
+func (m *memRun) last() (lsmEntry, bool, error) {
+    if len(m.entries) == 0 {
+        return lsmEntry{}, false, nil
+    }
+    return m.entries[len(m.entries)-1], true, nil
+}
+
+func (m *memRun) filter() *bloomFilter { return m.bloom }
+func (m *memRun) cursor() runCursor     { return sliceCursor(m.entries) }
+func (m *memRun) size() int64           { return m.bytes }
+func (m *memRun) close() error          { return nil }
+func (m *memRun) remove() error         { return nil }
+
+type sliceCur struct {
+    entries []lsmEntry
+    pos     int
+}
+
+// sliceCursor returns a cursor over already sorted entries.
+func sliceCursor(entries []lsmEntry) runCursor {
+    return &sliceCur{entries: entries}
+}
+
+func (c *sliceCur) next() (lsmEntry, bool, error) {
+    if c.pos >= len(c.entries) {
+        return lsmEntry{}, false, nil
+    }
+    c.pos++
+    return c.entries[c.pos-1], true, nil
+}
+
+// mergeCursor merges several cursors into one stream in entryLess order.
+// Of the versions of each key it keeps only those a reader can see: the
+// newest, plus the newest at or below each live snapshot. Values expired
+// at now become tombstones. A tombstone that would be the oldest version
+// kept is dropped if dropTombstones is set, which is only safe when no
+// older data lies beneath the merged runs.
+type mergeCursor struct {
+    inputs         []runCursor
+    heads          []lsmEntry
+    live           []bool
+    snaps          []uint64
+    now            int64
+    expired        *atomic.Uint64 // counts values turned into tombstones
+    dropTombstones bool
+    started        bool
+    pending        []lsmEntry // versions of the current key still to emit
+}
+
+// newMergeCursor merges inputs as of now, keeping the versions l's live
+// snapshots need. Callers hold l.mu.
+func (l *LSMStore) newMergeCursor(inputs []runCursor, dropTombstones bool) *mergeCursor {
+    return &mergeCursor{
+        inputs:         inputs,
+        heads:          make([]lsmEntry, len(inputs)),
+        live:           make([]bool, len(inputs)),
+        snaps:          l.liveSnapshots(),
+        now:            clock().UnixNano(),
+        expired:        &l.expired,
+        dropTombstones: dropTombstones,
+    }
+}
+
+func (m *mergeCursor) advance(i int) error {
+    e, ok, err := m.inputs[i].next()
+    if err != nil {
+        return err
+    }
+    m.heads[i], m.live[i] = e, ok
+    return nil
+}
+
+func (m *mergeCursor) next() (lsmEntry, bool, error) {
+    if !m.started {
+        m.started = true
+        for i := range m.inputs {
+            if err := m.advance(i); err != nil {
+                return lsmEntry{}, false, err
+            }
+        }
+    }
+    for len(m.pending) == 0 {
+        // Find the smallest key among the heads.
+        min := -1
+        for i, ok := range m.live {
+            if ok && (min < 0 || m.heads[i].key < m.heads[min].key) {
+                min = i
+            }
+        }
+        if min < 0 {
+            return lsmEntry{}, false, nil
+        }
+        // Gather every version of that key, newest first.
+        key := m.heads[min].key
+        var versions []lsmEntry
+        for i := range m.inputs {
+            for m.live[i] && m.heads[i].key == key {
+                e := m.heads[i]
+                if !e.deleted && expiredAt(e.expires, m.now) {
+                    e = lsmEntry{key: e.key, seq: e.seq, deleted: true}
+                    m.expired.Add(1)
+                }
+                versions = append(versions, e)
+                if err := m.advance(i); err != nil {
+                    return lsmEntry{}, false, err
+                }
+            }
+        }
+        sort.Slice(versions, func(i, j int) bool { return versions[i].seq > versions[j].seq })
+        versions = neededVersions(versions, m.snaps)
+        if m.dropTombstones {
+            for len(versions) > 0 && versions[len(versions)-1].deleted {
+                versions = versions[:len(versions)-1]
+            }
+        }
+        m.pending = versions
+    }
+    e := m.pending[0]
+    m.pending = m.pending[1:]
+    return e, true, nil
+}
+
+// newRun drains c into a new run: an SSTable file when the store has a
+// data directory, a memRun otherwise. It returns a nil run if c is empty.
+func (l *LSMStore) newRun(c runCursor) (lsmRun, error) {
+    if l.opts.Dir == "" {
+        m := &memRun{}
+        var hashes []uint64
+        for {
+            e, ok, err := c.next()
+            if err != nil {
+                return nil, err
+            }
+            if !ok {
+                break
+            }
+            if len(m.entries)%sparseInterval == 0 {
+                m.sparse = append(m.sparse, e.key)
+            }
+            if l.opts.BloomBitsPerKey > 0 {
+                hashes = append(hashes, bloomHash(e.key))
+            }
+            m.entries = append(m.entries, e)
+            m.bytes += int64(len(e.key) + len(e.value) + 16)
+        }
+        if len(m.entries) == 0 {
+            return nil, nil
+        }
+        if l.opts.BloomBitsPerKey > 0 {
+            m.bloom = newBloomFilter(hashes, l.opts.BloomBitsPerKey)
+        }
+        return m, nil
+    }
+
+    name := tableName(l.nextFile)
+    path := filepath.Join(l.opts.Dir, name)
+    var cipher *encrypt.Cipher
+    if l.opts.Keys != nil {
+        var err error
+        if cipher, err = encrypt.Current(l.opts.Keys); err != nil {
+            return nil, err
+        }
+    }
+    w, err := createSSTable(path, l.opts.BloomBitsPerKey, l.opts.Compression, cipher)
+    if err != nil {
+        return nil, err
+    }
+    for {
+        e, ok, err := c.next()
+        if err != nil {
+            w.abort()
+            return nil, err
+        }
+        if !ok {
+            break
+        }
+        if err := w.add(e); err != nil {
+            w.abort()
+            return nil, err
+        }
+    }
+    if w.count == 0 {
+        w.abort()
+        return nil, nil
+    }
+    if err := w.finish(); err != nil {
+        return nil, fmt.Errorf("kv: write %s: %w", name, err)
+    }
+    l.nextFile++
+    return openSSTable(path, l.opts.Keys)
+}
+
+// compact merges L0 into L1 once it holds L0Trigger runs, then pushes
+// each deeper level down while it exceeds its size budget.
+func (l *LSMStore) compact() error {
+    if len(l.levels[0]) >= l.opts.L0Trigger {
+        if err := l.compactLevel(0); err != nil {
+            return err
+        }
+    }
+    for i := 1; i < len(l.levels)-1; i++ {
+        if l.levelSize(i) > l.maxLevelSize(i) {
+            if err := l.compactLevel(i); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// compactLevel merges every run in level i together with level i+1 into a
+// single run at level i+1. Tombstones are dropped only when level i+1 is
+// the bottom of the tree, i.e. nothing older lies beneath it.
+func (l *LSMStore) compactLevel(i int) error {
+    inputs := append(append([]lsmRun{}, l.levels[i]...), l.levels[i+1]...)
+    bottom := true
+    for _, level := range l.levels[i+2:] {
+        if len(level) > 0 {
+            bottom = false
+        }
+    }
+    cursors := make([]runCursor, len(inputs))
+    for j, r := range inputs {
+        cursors[j] = r.cursor()
+    }
+    out, err := l.newRun(l.newMergeCursor(cursors, bottom))
+    if err != nil {
+        return err
+    }
+
+    oldUpper, oldLower := l.levels[i], l.levels[i+1]
+    l.levels[i], l.levels[i+1] = nil, nil
+    if out != nil {
+        l.levels[i+1] = []lsmRun{out}
+    }
+    if err := l.commit(); err != nil {
+        l.levels[i], l.levels[i+1] = oldUpper, oldLower
+        if out != nil {
+            out.remove()
+        }
+        return err
+    }
+    for _, r := range inputs {
+        r.remove()
+    }
+    return nil
+}
+
+// Reencrypt rewrites every SSTable not encrypted with the current key of
+// LSMOptions.Keys, so keys rotated out can be retired. Each table is
+// copied as is to a new one in the same place in its level.
+func (l *LSMStore) Reencrypt() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.opts.Keys == nil {
+        return nil
+    }
+    id, _, err := l.opts.Keys.CurrentKey()
+    if err != nil {
+        return err
+    }
+    for i, level := range l.levels {
+        for j, r := range level {
+            t, ok := r.(*sstable)
+            if !ok || t.keyID() == id {
+                continue
+            }
+            out, err := l.newRun(t.cursor())
+            if err != nil {
+                return err
+            }
+            l.levels[i][j] = out
+            if err := l.commit(); err != nil {
+                l.levels[i][j] = t
+                out.remove()
+                return err
+            }
+            t.remove()
+        }
+    }
+    return nil
+}
+
+func (l *LSMStore) levelSize(i int) int64 {
+    var n int64
+    for _, r := range l.levels[i] {
+        n += r.size()
+    }
+    return n
+}
+
+// maxLevelSize is the size budget of level i >= 1: BaseLevelSize for L1,
+// growing by LevelRatio per level.
+func (l *LSMStore) maxLevelSize(i int) int64 {
+    n := l.opts.BaseLevelSize
+    for ; i > 1; i-- {
+        n *= int64(l.opts.LevelRatio)
+    }
+    return n
+}
@@ -0,0 +1,229 @@
+package kv
+
+import (
+    "math"
+
+    "github.com/google/btree"
+)
+
+// Sources of lsmEntries (the memtable and every run) may hold several
+// versions of a key. Entries are ordered by key ascending, then by sequence
+// number descending, so the newest version of a key comes first.
+func entryLess(a, b lsmEntry) bool {
+    return a.key < b.key || (a.key == b.key && a.seq > b.seq)
+}
+
+// entrySeeker positions within one sorted source of lsmEntries.
+type entrySeeker interface {
+    // seekGE returns the first entry not less than (key, seq): the newest
+    // version of key with sequence <= seq, or failing that the first entry
+    // of the next key.
+    seekGE(key string, seq uint64) (lsmEntry, bool, error)
+    // seekLT returns the last entry with a key < key.
+    seekLT(key string) (lsmEntry, bool, error)
+    // last returns the last entry.
+    last() (lsmEntry, bool, error)
+}
+
+// visibleGet returns the newest version of key with sequence <= seq.
+func visibleGet(s entrySeeker, key string, seq uint64) (lsmEntry, bool, error) {
+    e, ok, err := s.seekGE(key, seq)
+    if err != nil || !ok || e.key != key {
+        return lsmEntry{}, false, err
+    }
+    return e, true, nil
+}
+
+// visibleCeiling returns the newest version visible at seq of the first
+// key >= key (> key if !inclusive) that has one.
+func visibleCeiling(s entrySeeker, key string, inclusive bool, seq uint64) (lsmEntry, bool, error) {
+    at := seq
+    if !inclusive {
+        at = 0 // sequence numbers start at 1, so this skips key entirely
+    }
+    for {
+        e, ok, err := s.seekGE(key, at)
+        if err != nil || !ok {
+            return lsmEntry{}, false, err
+        }
+        if e.seq <= seq {
+            return e, true, nil
+        }
+        // Every version of e.key from here on is newer than seq; look
+        // again for an older one.
+        key, at = e.key, seq
+    }
+}
+
+// visibleLower returns the newest version visible at seq of the last
+// key < key that has one.
+func visibleLower(s entrySeeker, key string, seq uint64) (lsmEntry, bool, error) {
+    for {
+        e, ok, err := s.seekLT(key)
+        if err != nil || !ok {
+            return lsmEntry{}, false, err
+        }
+        if v, ok, err := visibleGet(s, e.key, seq); err != nil || ok {
+            return v, ok, err
+        }
+        key = e.key
+    }
+}
+
+// visibleLast returns the newest version visible at seq of the greatest
+// key that has one.
+func visibleLast(s entrySeeker, seq uint64) (lsmEntry, bool, error) {
+    e, ok, err := s.last()
+    if err != nil || !ok {
+        return lsmEntry{}, false, err
+    }
+    if v, ok, err := visibleGet(s, e.key, seq); err != nil || ok {
+        return v, ok, err
+    }
+    return visibleLower(s, e.key, seq)
+}
+
+func newMemtable() *btree.BTreeG[lsmEntry] {
+    return btree.NewG(16, entryLess)
+}
+
+// memtableSeeker adapts the memtable B-tree to entrySeeker.
+type memtableSeeker struct {
+    t *btree.BTreeG[lsmEntry]
+}
+
+func (m memtableSeeker) seekGE(key string, seq uint64) (e lsmEntry, ok bool, err error) {
+    m.t.AscendGreaterOrEqual(lsmEntry{key: key, seq: seq}, func(x lsmEntry) bool {
+        e, ok = x, true
+        return false
+    })
+    return e, ok, nil
+}
+
+func (m memtableSeeker) seekLT(key string) (e lsmEntry, ok bool, err error) {
+    // Nothing with this key sorts before (key, MaxUint64).
+    m.t.DescendLessOrEqual(lsmEntry{key: key, seq: math.MaxUint64}, func(x lsmEntry) bool {
+        if x.key == key {
+            return true
+        }
+        e, ok = x, true
+        return false
+    })
+    return e, ok, nil
+}
+
+func (m memtableSeeker) last() (lsmEntry, bool, error) {
+    e, ok := m.t.Max()
+    return e, ok, nil
+}
+
+// seekers returns the memtable followed by every run. Callers hold l.mu.
+func (l *LSMStore) seekers() []entrySeeker {
+    out := []entrySeeker{memtableSeeker{l.memtable}}
+    for _, level := range l.levels {
+        for _, r := range level {
+            out = append(out, r)
+        }
+    }
+    return out
+}
+
+// pickEntry asks every source for a candidate and returns the newest
+// version of the smallest candidate key (or largest, if max is set).
+func pickEntry(srcs []entrySeeker, max bool, q func(entrySeeker) (lsmEntry, bool, error)) (lsmEntry, bool, error) {
+    var best lsmEntry
+    found := false
+    for _, s := range srcs {
+        e, ok, err := q(s)
+        if err != nil {
+            return lsmEntry{}, false, err
+        }
+        if !ok {
+            continue
+        }
+        switch {
+        case !found,
+            !max && e.key < best.key,
+            max && e.key > best.key,
+            e.key == best.key && e.seq > best.seq:
+            best, found = e, true
+        }
+    }
+    return best, found, nil
+}
+
+// NewIterator returns an ordered iterator merging the memtable and every
+// run. Deleted and expired keys are skipped.
+func (l *LSMStore) NewIterator() Iterator {
+    return newCursorIterator(lsmView{l, 0})
+}
+
+// lsmView is an orderedSource over l as of sequence number seq, or over
+// its latest state if seq is 0.
+type lsmView struct {
+    l   *LSMStore
+    seq uint64
+}
+
+// at returns the sequence number to read at. Callers hold l.mu.
+func (v lsmView) at() uint64 {
+    if v.seq == 0 {
+        return v.l.seq
+    }
+    return v.seq
+}
+
+func (v lsmView) ceiling(key string, inclusive bool) (string, string, bool, error) {
+    v.l.mu.RLock()
+    defer v.l.mu.RUnlock()
+    srcs, seq, now := v.l.seekers(), v.at(), clock().UnixNano()
+    for {
+        e, ok, err := pickEntry(srcs, false, func(s entrySeeker) (lsmEntry, bool, error) {
+            return visibleCeiling(s, key, inclusive, seq)
+        })
+        if err != nil || !ok {
+            return "", "", false, err
+        }
+        if !e.dead(now) {
+            return e.key, e.value, true, nil
+        }
+        key, inclusive = e.key, false
+    }
+}
+
+func (v lsmView) lower(key string) (string, string, bool, error) {
+    v.l.mu.RLock()
+    defer v.l.mu.RUnlock()
+    return v.lowerLocked(v.l.seekers(), key, v.at(), clock().UnixNano())
+}
+
+func (v lsmView) lowerLocked(srcs []entrySeeker, key string, seq uint64, now int64) (string, string, bool, error) {
+    for {
+        e, ok, err := pickEntry(srcs, true, func(s entrySeeker) (lsmEntry, bool, error) {
+            return visibleLower(s, key, seq)
+        })
+        if err != nil || !ok {
+            return "", "", false, err
+        }
+        if !e.dead(now) {
+            return e.key, e.value, true, nil
+        }
+        key = e.key
+    }
+}
+
+func (v lsmView) last() (string, string, bool, error) {
+    v.l.mu.RLock()
+    defer v.l.mu.RUnlock()
+    srcs, seq, now := v.l.seekers(), v.at(), clock().UnixNano()
+    e, ok, err := pickEntry(srcs, true, func(s entrySeeker) (lsmEntry, bool, error) {
+        return visibleLast(s, seq)
+    })
+    if err != nil || !ok {
+        return "", "", false, err
+    }
+    if !e.dead(now) {
+        return e.key, e.value, true, nil
+    }
+    return v.lowerLocked(srcs, e.key, seq, now)
+}
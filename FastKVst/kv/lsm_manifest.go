@@ -0,0 +1,104 @@
+package kv
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+const manifestName = "MANIFEST"
+
+// lsmManifest records which SSTables in a data directory are live and
+// the level each belongs to. Within L0 tables are listed oldest first.
+type lsmManifest struct {
+    NextFile uint64     `json:"next_file"`
+    LastSeq  uint64     `json:"last_seq"`
+    Levels   [][]string `json:"levels"`
+}
+
+// readManifest loads the manifest in dir. A missing manifest means an
+// empty store.
+func readManifest(dir string) (lsmManifest, error) {
+    m := lsmManifest{NextFile: 1}
+    data, err := os.ReadFile(filepath.Join(dir, manifestName))
+    if errors.Is(err, os.ErrNotExist) {
+        return m, nil
+    }
+    if err != nil {
+        return m, err
+    }
+    if err := json.Unmarshal(data, &m); err != nil {
+        return m, fmt.Errorf("kv: corrupt manifest: %w", err)
+    }
+    return m, nil
+}
+
+// writeManifest atomically replaces the manifest in dir.
+func writeManifest(dir string, m lsmManifest) error {
+    data, err := json.Marshal(m)
+    if err != nil {
+        return err
+    }
+    path := filepath.Join(dir, manifestName)
+    tmp := path + ".tmp"
+    f, err := os.Create(tmp)
+    if err != nil {
+        return err
+    }
+    if _, err := f.Write(data); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Close(); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        return err
+    }
+    return syncDir(dir)
+}
+
+// removeOrphans deletes table files in dir that the manifest does not
+// reference, e.g. tables written before a crash but never committed.
+func removeOrphans(dir string, m lsmManifest) error {
+    live := make(map[string]bool)
+    for _, level := range m.Levels {
+        for _, name := range level {
+            live[name] = true
+        }
+    }
+    ents, err := os.ReadDir(dir)
+    if err != nil {
+        return err
+    }
+    for _, e := range ents {
+        name := e.Name()
+        if (strings.HasSuffix(name, ".sst") && !live[name]) || strings.HasSuffix(name, ".tmp") {
+            if err := os.Remove(filepath.Join(dir, name)); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+func tableName(num uint64) string {
+    return fmt.Sprintf("%06d.sst", num)
+}
+
+// syncDir fsyncs a directory so renames inside it are durable.
+func syncDir(dir string) error {
+    d, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    defer d.Close()
+    return d.Sync()
+}
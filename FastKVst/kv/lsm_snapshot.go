@@ -0,0 +1,141 @@
+package kv
+
+import (
+    "math"
+    "sort"
+    "sync/atomic"
+)
+
+// Snapshot returns a read-only view of the store as of now. While it is
+// held, the versions it sees survive overwrites, deletes and compaction;
+// Release lets them be garbage-collected.
+//
+// Reads through the snapshot take the store's lock one step at a time, so
+// a long scan does not block writers.
+func (l *LSMStore) Snapshot() Snapshot {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.snaps == nil {
+        l.snaps = make(map[uint64]int)
+    }
+    // A snapshot of an empty store still needs a non-zero sequence, since
+    // lsmView treats 0 as "latest".
+    seq := l.seq
+    if seq == 0 {
+        l.seq++
+        seq = l.seq
+    }
+    l.snaps[seq]++
+    return &lsmSnapshot{view: lsmView{l, seq}}
+}
+
+func (l *LSMStore) releaseSnapshot(seq uint64) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.snaps[seq]--; l.snaps[seq] <= 0 {
+        delete(l.snaps, seq)
+    }
+}
+
+// liveSnapshots returns the sequence numbers of unreleased snapshots in
+// ascending order. Callers hold l.mu.
+func (l *LSMStore) liveSnapshots() []uint64 {
+    seqs := make([]uint64, 0, len(l.snaps))
+    for s := range l.snaps {
+        seqs = append(seqs, s)
+    }
+    sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+    return seqs
+}
+
+// neededVersions filters versions of one key, newest first, down to those
+// some reader can still see: the newest, plus each version that is the
+// newest one at or below a live snapshot.
+func neededVersions(versions []lsmEntry, snaps []uint64) []lsmEntry {
+    out := versions[:1]
+    for i := 1; i < len(versions); i++ {
+        // Is there a snapshot s with versions[i].seq <= s < versions[i-1].seq?
+        j := sort.Search(len(snaps), func(j int) bool { return snaps[j] >= versions[i].seq })
+        if j < len(snaps) && snaps[j] < versions[i-1].seq {
+            out = append(out, versions[i])
+        }
+    }
+    return out
+}
+
+// pruneMemtable drops versions of key in the memtable that no reader can
+// see any more. Callers hold l.mu.
+func (l *LSMStore) pruneMemtable(key string, snaps []uint64) {
+    var versions []lsmEntry
+    l.memtable.AscendGreaterOrEqual(lsmEntry{key: key, seq: math.MaxUint64}, func(e lsmEntry) bool {
+        if e.key != key {
+            return false
+        }
+        versions = append(versions, e)
+        return true
+    })
+    if len(versions) < 2 {
+        return
+    }
+    keep := neededVersions(append([]lsmEntry(nil), versions...), snaps)
+    for _, e := range versions {
+        kept := false
+        for _, k := range keep {
+            kept = kept || k.seq == e.seq
+        }
+        if !kept {
+            l.memtable.Delete(e)
+        }
+    }
+}
+
+// lsmSnapshot is a Snapshot of an LSMStore at a fixed sequence number.
+type lsmSnapshot struct {
+    view     lsmView
+    released atomic.Bool
+}
+
+// Seq returns the sequence number the snapshot reads at.
+func (s *lsmSnapshot) Seq() uint64 { return s.view.seq }
+
+func (s *lsmSnapshot) Get(key string) (string, error) {
+    if s.released.Load() {
+        return "", ErrSnapshotReleased
+    }
+    l := s.view.l
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+    e, ok, err := l.lookup(key, s.view.seq)
+    if err != nil {
+        return "", err
+    }
+    if !ok || e.dead(clock().UnixNano()) {
+        return "", ErrNotFound
+    }
+    return e.value, nil
+}
+
+// Range returns the live keys in [start, end) as of the snapshot.
+func (s *lsmSnapshot) Range(start, end string) ([]string, error) {
+    if s.released.Load() {
+        return nil, ErrSnapshotReleased
+    }
+    return iterRange(s.NewIterator(), start, end)
+}
+
+func (s *lsmSnapshot) NewIterator() Iterator {
+    if s.released.Load() {
+        return &sliceIterator{i: -1, err: ErrSnapshotReleased}
+    }
+    return newCursorIterator(s.view)
+}
+
+func (s *lsmSnapshot) Set(string, string) error { return ErrReadOnly }
+func (s *lsmSnapshot) Delete(string) error      { return ErrReadOnly }
+func (s *lsmSnapshot) Flush() error             { return ErrReadOnly }
+
+func (s *lsmSnapshot) Release() {
+    if !s.released.Swap(true) {
+        s.view.l.releaseSnapshot(s.view.seq)
+    }
+}
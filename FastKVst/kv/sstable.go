@@ -0,0 +1,597 @@
+package kv
+
+import (
+    "bufio"
+    "compress/flate"
+    "encoding/binary"
+    "fmt"
+    "hash/crc32"
+    "os"
+    "sort"
+    "sync"
+
+    "github.com/thilakshekharshriyan/m/encrypt"
+)
+
+// SSTable file layout:
+//
+//   [header] [data block 0] ... [data block n-1] [filter block] [index block] [footer]
+//
+// The header is u8(len(keyID)) keyID, naming the encryption key; an empty
+// ID means the table is not encrypted. The footer's checksum covers it.
+// In an encrypted table every data block (with its trailer), the filter
+// block and the index block are sealed with the key, authenticated
+// together with their file offset.
+//
+// A data block is a run of entries in entryLess order, each encoded as
+// uvarint(len(key)) key uvarint(seq) kind [uvarint(expires)] uvarint(len(value)) value,
+// where kind is 0 for a value, 1 for a tombstone and 2 for a value with an
+// expiry time (Unix nanoseconds), which is then present.
+// The filter block is an encoded Bloom filter over every key in the
+// table, or empty when filters are disabled. The index block is a sparse
+// index holding one entry per data block:
+// uvarint(len(lastKey)) lastKey uvarint(offset) uvarint(length).
+// All versions of a key are kept in the same block. Each stored block is
+// followed by a one-byte trailer naming the Compression of the bytes
+// before it; the indexed length includes the trailer.
+// Every stored block (data, filter and index, after any encryption) is
+// followed by u32 CRC32C of its bytes, which the indexed and footer
+// lengths include.
+// The footer is fixed size:
+// filterOffset u64 | filterLength u64 | indexOffset u64 | indexLength u64 | crc u32 | magic u64,
+// where crc is the CRC32C of the header followed by the four offsets and
+// lengths.
+const (
+    sstBlockSize  = 4 << 10 // target data block size in bytes (before compression)
+    sstFooterSize = 44
+    sstMagic      = 0x46534b5653535437 // "FSKVSST7"
+)
+
+var errBadSSTable = fmt.Errorf("kv: malformed sstable: %w", ErrCorrupted)
+
+// castagnoli is the CRC32C table used for SSTable block checksums.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// sstIndexEntry locates one data block inside an SSTable.
+type sstIndexEntry struct {
+    lastKey string
+    offset  uint64
+    length  uint64
+}
+
+// sstable is an immutable, sorted, block-indexed table on disk.
+// The index is held in memory; data blocks are read on demand.
+type sstable struct {
+    path     string
+    f        *os.File
+    index    []sstIndexEntry
+    bloom    *bloomFilter // nil when the table has no filter
+    fileSize int64
+    cipher   *encrypt.Cipher // nil for unencrypted tables
+
+    // The most recently decoded block, so sequential seeks by iterators
+    // do not decode the same block over and over.
+    cacheMu      sync.Mutex
+    cacheIdx     int
+    cacheEntries []lsmEntry
+}
+
+// sstWriter streams sorted entries into a new SSTable. The file is
+// written under a temporary name and only renamed into place by finish,
+// so a crash never leaves a partial table.
+type sstWriter struct {
+    path       string
+    f          *os.File
+    w          *bufio.Writer
+    header     []byte
+    offset     uint64
+    index      []sstIndexEntry
+    block      []byte
+    last       string
+    count      int
+    bitsPerKey int      // Bloom filter density; <= 0 disables the filter
+    hashes     []uint64 // key hashes for the filter
+    codec      Compression
+    scratch    []byte          // compressed block being written
+    cipher     *encrypt.Cipher // nil to write an unencrypted table
+}
+
+// createSSTable starts a table, encrypted with c unless it is nil.
+func createSSTable(path string, bitsPerKey int, codec Compression, c *encrypt.Cipher) (*sstWriter, error) {
+    f, err := os.Create(path + ".tmp")
+    if err != nil {
+        return nil, err
+    }
+    w := &sstWriter{path: path, f: f, w: bufio.NewWriter(f), bitsPerKey: bitsPerKey, codec: codec, cipher: c}
+    w.header = []byte{0}
+    if c != nil {
+        w.header = append([]byte{byte(len(c.ID()))}, c.ID()...)
+    }
+    w.w.Write(w.header)
+    w.offset = uint64(len(w.header))
+    return w, nil
+}
+
+// seal encrypts a block about to be written at off, if the table is
+// encrypted, and appends its checksum.
+func (w *sstWriter) seal(b []byte, off uint64) []byte {
+    if w.cipher != nil {
+        b = w.cipher.Seal(nil, b, offsetAD(off))
+    }
+    return binary.LittleEndian.AppendUint32(b, crc32.Checksum(b, castagnoli))
+}
+
+// offsetAD is the additional data authenticated with a block at off.
+func offsetAD(off uint64) []byte {
+    return binary.LittleEndian.AppendUint64(nil, off)
+}
+
+// add appends an entry; entries must arrive in entryLess order. A full
+// block is only cut at a key boundary.
+func (w *sstWriter) add(e lsmEntry) error {
+    if len(w.block) >= sstBlockSize && e.key != w.last {
+        if err := w.flushBlock(); err != nil {
+            return err
+        }
+    }
+    w.block = appendEntry(w.block, e)
+    w.last = e.key
+    w.count++
+    if w.bitsPerKey > 0 {
+        w.hashes = append(w.hashes, bloomHash(e.key))
+    }
+    return nil
+}
+
+func (w *sstWriter) flushBlock() error {
+    if len(w.block) == 0 {
+        return nil
+    }
+    out, codec := w.block, NoCompression
+    if c, ok := compress(w.scratch[:0], w.block, w.codec, flate.DefaultCompression); ok {
+        out, codec, w.scratch = c, w.codec, c
+    }
+    out = w.seal(append(out, byte(codec)), w.offset)
+    if _, err := w.w.Write(out); err != nil {
+        return err
+    }
+    w.index = append(w.index, sstIndexEntry{w.last, w.offset, uint64(len(out))})
+    w.offset += uint64(len(out))
+    w.block = w.block[:0]
+    return nil
+}
+
+// finish writes the index and footer, syncs and renames the table into
+// place.
+func (w *sstWriter) finish() error {
+    if err := w.flushBlock(); err != nil {
+        w.abort()
+        return err
+    }
+    var filter []byte
+    filterOff := w.offset
+    if w.bitsPerKey > 0 {
+        filter = w.seal(newBloomFilter(w.hashes, w.bitsPerKey).encode(), filterOff)
+    }
+    w.offset += uint64(len(filter))
+    var idx []byte
+    for _, ie := range w.index {
+        idx = binary.AppendUvarint(idx, uint64(len(ie.lastKey)))
+        idx = append(idx, ie.lastKey...)
+        idx = binary.AppendUvarint(idx, ie.offset)
+        idx = binary.AppendUvarint(idx, ie.length)
+    }
+    idx = w.seal(idx, w.offset)
+    footer := make([]byte, sstFooterSize)
+    binary.LittleEndian.PutUint64(footer[0:], filterOff)
+    binary.LittleEndian.PutUint64(footer[8:], uint64(len(filter)))
+    binary.LittleEndian.PutUint64(footer[16:], filterOff+uint64(len(filter)))
+    binary.LittleEndian.PutUint64(footer[24:], uint64(len(idx)))
+    binary.LittleEndian.PutUint32(footer[32:], footerChecksum(w.header, footer))
+    binary.LittleEndian.PutUint64(footer[36:], sstMagic)
+    w.w.Write(filter)
+    w.w.Write(idx)
+    w.w.Write(footer)
+    if err := w.w.Flush(); err != nil {
+        w.abort()
+        return err
+    }
+    if err := w.f.Sync(); err != nil {
+        w.abort()
+        return err
+    }
+    if err := w.f.Close(); err != nil {
+        os.Remove(w.path + ".tmp")
+        return err
+    }
+    return os.Rename(w.path+".tmp", w.path)
+}
+
+// footerChecksum is the CRC32C of header and the footer's offsets and
+// lengths.
+func footerChecksum(header, footer []byte) uint32 {
+    return crc32.Update(crc32.Checksum(header, castagnoli), castagnoli, footer[:32])
+}
+
+// abort discards a partially written table.
+func (w *sstWriter) abort() {
+    w.f.Close()
+    os.Remove(w.path + ".tmp")
+}
+
+// writeSSTable writes sorted entries to path in one go.
+func writeSSTable(path string, entries []lsmEntry, bitsPerKey int, codec Compression, c *encrypt.Cipher) error {
+    w, err := createSSTable(path, bitsPerKey, codec, c)
+    if err != nil {
+        return err
+    }
+    for _, e := range entries {
+        if err := w.add(e); err != nil {
+            w.abort()
+            return err
+        }
+    }
+    return w.finish()
+}
+
+// openSSTable opens a table and loads its block index. keys supplies the
+// key of an encrypted table.
+func openSSTable(path string, keys encrypt.KeyProvider) (*sstable, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    t := &sstable{path: path, f: f, cacheIdx: -1}
+    if err := t.loadIndex(keys); err != nil {
+        f.Close()
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    return t, nil
+}
+
+func (t *sstable) loadIndex(keys encrypt.KeyProvider) error {
+    st, err := t.f.Stat()
+    if err != nil {
+        return err
+    }
+    t.fileSize = st.Size()
+    if t.fileSize < sstFooterSize {
+        return errBadSSTable
+    }
+    footer := make([]byte, sstFooterSize)
+    if _, err := t.f.ReadAt(footer, t.fileSize-sstFooterSize); err != nil {
+        return err
+    }
+    if binary.LittleEndian.Uint64(footer[36:]) != sstMagic {
+        return errBadSSTable
+    }
+    hdr, err := t.readHeader()
+    if err != nil {
+        return err
+    }
+    if footerChecksum(hdr, footer) != binary.LittleEndian.Uint32(footer[32:]) {
+        return fmt.Errorf("kv: footer checksum mismatch: %w", ErrCorrupted)
+    }
+    if id := string(hdr[1:]); id != "" {
+        if keys == nil {
+            return fmt.Errorf("kv: table is encrypted with key %q but no key provider is set", id)
+        }
+        if t.cipher, err = encrypt.ForID(keys, id); err != nil {
+            return err
+        }
+    }
+    filterOff := binary.LittleEndian.Uint64(footer[0:])
+    filterLen := binary.LittleEndian.Uint64(footer[8:])
+    idxOff := binary.LittleEndian.Uint64(footer[16:])
+    idxLen := binary.LittleEndian.Uint64(footer[24:])
+    if filterOff+filterLen != idxOff || idxOff+idxLen+sstFooterSize != uint64(t.fileSize) {
+        return errBadSSTable
+    }
+    if filterLen > 0 {
+        buf, err := t.readAt(filterOff, filterLen)
+        if err != nil {
+            return err
+        }
+        var ok bool
+        if t.bloom, ok = decodeBloomFilter(buf); !ok {
+            return errBadSSTable
+        }
+    }
+    buf, err := t.readAt(idxOff, idxLen)
+    if err != nil {
+        return err
+    }
+    for len(buf) > 0 {
+        var ie sstIndexEntry
+        var ok bool
+        if ie.lastKey, buf, ok = readString(buf); !ok {
+            return errBadSSTable
+        }
+        if ie.offset, buf, ok = readUvarint(buf); !ok {
+            return errBadSSTable
+        }
+        if ie.length, buf, ok = readUvarint(buf); !ok {
+            return errBadSSTable
+        }
+        t.index = append(t.index, ie)
+    }
+    return nil
+}
+
+// readHeader returns the header at the start of the table.
+func (t *sstable) readHeader() ([]byte, error) {
+    var n [1]byte
+    if _, err := t.f.ReadAt(n[:], 0); err != nil {
+        return nil, err
+    }
+    hdr := make([]byte, 1+int(n[0]))
+    if int64(len(hdr)) > t.fileSize-sstFooterSize {
+        return nil, errBadSSTable
+    }
+    if _, err := t.f.ReadAt(hdr, 0); err != nil {
+        return nil, err
+    }
+    return hdr, nil
+}
+
+// keyID returns the ID of the key the table is encrypted with, or "".
+func (t *sstable) keyID() string {
+    if t.cipher == nil {
+        return ""
+    }
+    return t.cipher.ID()
+}
+
+// readAt reads the block of length bytes at off, verifying its checksum
+// and decrypting it if the table is encrypted.
+func (t *sstable) readAt(off, length uint64) ([]byte, error) {
+    buf := make([]byte, length)
+    if _, err := t.f.ReadAt(buf, int64(off)); err != nil {
+        return nil, err
+    }
+    if len(buf) < 4 {
+        return nil, errBadSSTable
+    }
+    n := len(buf) - 4
+    if crc32.Checksum(buf[:n], castagnoli) != binary.LittleEndian.Uint32(buf[n:]) {
+        return nil, fmt.Errorf("kv: %s: checksum mismatch at offset %d: %w", t.path, off, ErrCorrupted)
+    }
+    buf = buf[:n]
+    if t.cipher == nil {
+        return buf, nil
+    }
+    out, err := t.cipher.Open(buf[:0:0], buf, offsetAD(off))
+    if err != nil {
+        return nil, fmt.Errorf("kv: %s at offset %d: %w: %w", t.path, off, ErrCorrupted, err)
+    }
+    return out, nil
+}
+
+// readBlock loads and decodes the i-th data block.
+func (t *sstable) readBlock(i int) ([]lsmEntry, error) {
+    ie := t.index[i]
+    buf, err := t.readAt(ie.offset, ie.length)
+    if err != nil {
+        return nil, err
+    }
+    if len(buf) == 0 {
+        return nil, errBadSSTable
+    }
+    codec := Compression(buf[len(buf)-1])
+    if buf, err = decompress(buf[:len(buf)-1], codec); err != nil {
+        return nil, errBadSSTable
+    }
+    var entries []lsmEntry
+    for len(buf) > 0 {
+        var e lsmEntry
+        var ok bool
+        if e, buf, ok = readEntry(buf); !ok {
+            return nil, errBadSSTable
+        }
+        entries = append(entries, e)
+    }
+    return entries, nil
+}
+
+// cachedBlock returns block i, from the one-block cache if possible.
+func (t *sstable) cachedBlock(i int) ([]lsmEntry, error) {
+    t.cacheMu.Lock()
+    if t.cacheIdx == i {
+        entries := t.cacheEntries
+        t.cacheMu.Unlock()
+        return entries, nil
+    }
+    t.cacheMu.Unlock()
+    entries, err := t.readBlock(i)
+    if err != nil {
+        return nil, err
+    }
+    t.cacheMu.Lock()
+    t.cacheIdx, t.cacheEntries = i, entries
+    t.cacheMu.Unlock()
+    return entries, nil
+}
+
+func (t *sstable) seekGE(key string, seq uint64) (lsmEntry, bool, error) {
+    // Every version of key lives in block i, the first that may hold it.
+    i := sort.Search(len(t.index), func(i int) bool {
+        return t.index[i].lastKey >= key
+    })
+    if i == len(t.index) {
+        return lsmEntry{}, false, nil
+    }
+    entries, err := t.cachedBlock(i)
+    if err != nil {
+        return lsmEntry{}, false, err
+    }
+    pivot := lsmEntry{key: key, seq: seq}
+    j := sort.Search(len(entries), func(j int) bool {
+        return !entryLess(entries[j], pivot)
+    })
+    if j < len(entries) {
+        return entries[j], true, nil
+    }
+    // Only versions of key newer than seq were left in block i.
+    if i+1 == len(t.index) {
+        return lsmEntry{}, false, nil
+    }
+    entries, err = t.cachedBlock(i + 1)
+    if err != nil || len(entries) == 0 {
+        return lsmEntry{}, false, err
+    }
+    return entries[0], true, nil
+}
+
+func (t *sstable) seekLT(key string) (lsmEntry, bool, error) {
+    // Block i is the first that may hold keys >= key; everything before
+    // it is < key.
+    i := sort.Search(len(t.index), func(i int) bool {
+        return t.index[i].lastKey >= key
+    })
+    if i < len(t.index) {
+        entries, err := t.cachedBlock(i)
+        if err != nil {
+            return lsmEntry{}, false, err
+        }
+        j := sort.Search(len(entries), func(j int) bool {
+            return entries[j].key >= key
+        })
+        if j > 0 {
+            return entries[j-1], true, nil
+        }
+    }
+    if i == 0 {
+        return lsmEntry{}, false, nil
+    }
+    entries, err := t.cachedBlock(i - 1)
+    if err != nil || len(entries) == 0 {
+        return lsmEntry{}, false, err
+    }
+    return entries[len(entries)-1], true, nil
+}
+
+func (t *sstable) last() (lsmEntry, bool, error) {
+    if len(t.index) == 0 {
+        return lsmEntry{}, false, nil
+    }
+    entries, err := t.cachedBlock(len(t.index) - 1)
+    if err != nil || len(entries) == 0 {
+        return lsmEntry{}, false, err
+    }
+    return entries[len(entries)-1], true, nil
+}
+
+// cursor walks the whole table one block at a time.
+func (t *sstable) cursor() runCursor {
+    return &sstCursor{t: t}
+}
+
+func (t *sstable) filter() *bloomFilter {
+    return t.bloom
+}
+
+func (t *sstable) size() int64 {
+    return t.fileSize
+}
+
+func (t *sstable) close() error {
+    return t.f.Close()
+}
+
+// remove closes the table and deletes its file.
+func (t *sstable) remove() error {
+    t.f.Close()
+    return os.Remove(t.path)
+}
+
+type sstCursor struct {
+    t       *sstable
+    blk     int
+    entries []lsmEntry
+    pos     int
+}
+
+func (c *sstCursor) next() (lsmEntry, bool, error) {
+    for c.pos >= len(c.entries) {
+        if c.blk >= len(c.t.index) {
+            return lsmEntry{}, false, nil
+        }
+        entries, err := c.t.readBlock(c.blk)
+        if err != nil {
+            return lsmEntry{}, false, err
+        }
+        c.entries, c.pos = entries, 0
+        c.blk++
+    }
+    e := c.entries[c.pos]
+    c.pos++
+    return e, true, nil
+}
+
+// appendEntry encodes e onto buf.
+func appendEntry(buf []byte, e lsmEntry) []byte {
+    buf = binary.AppendUvarint(buf, uint64(len(e.key)))
+    buf = append(buf, e.key...)
+    buf = binary.AppendUvarint(buf, e.seq)
+    switch {
+    case e.deleted:
+        buf = append(buf, 1)
+    case e.expires != 0:
+        buf = append(buf, 2)
+        buf = binary.AppendUvarint(buf, uint64(e.expires))
+    default:
+        buf = append(buf, 0)
+    }
+    buf = binary.AppendUvarint(buf, uint64(len(e.value)))
+    buf = append(buf, e.value...)
+    return buf
+}
+
+// readEntry decodes one entry from the front of buf.
+func readEntry(buf []byte) (lsmEntry, []byte, bool) {
+    var e lsmEntry
+    var ok bool
+    if e.key, buf, ok = readString(buf); !ok {
+        return e, buf, false
+    }
+    if e.seq, buf, ok = readUvarint(buf); !ok || len(buf) == 0 {
+        return e, buf, false
+    }
+    kind := buf[0]
+    buf = buf[1:]
+    switch kind {
+    case 0:
+    case 1:
+        e.deleted = true
+    case 2:
+        var x uint64
+        if x, buf, ok = readUvarint(buf); !ok {
+            return e, buf, false
+        }
+        e.expires = int64(x)
+    default:
+        return e, buf, false
+    }
+    if e.value, buf, ok = readString(buf); !ok {
+        return e, buf, false
+    }
+    return e, buf, true
+}
+
+// readUvarint decodes a uvarint from the front of buf.
+func readUvarint(buf []byte) (uint64, []byte, bool) {
+    v, n := binary.Uvarint(buf)
+    if n <= 0 {
+        return 0, buf, false
+    }
+    return v, buf[n:], true
+}
+
+// readString decodes a uvarint length-prefixed string from the front of buf.
+func readString(buf []byte) (string, []byte, bool) {
+    n, rest, ok := readUvarint(buf)
+    if !ok || n > uint64(len(rest)) {
+        return "", buf, false
+    }
+    return string(rest[:n]), rest[n:], true
+}
@@ -0,0 +1,213 @@
+package kv
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestSSTableMultiBlock(t *testing.T) {
+    var entries []lsmEntry
+    for i := 0; i < 2000; i++ {
+        entries = append(entries, lsmEntry{key: fmt.Sprintf("key%05d", i), value: fmt.Sprintf("val%05d", i), seq: uint64(i + 1)})
+    }
+    path := filepath.Join(t.TempDir(), tableName(1))
+    if err := writeSSTable(path, entries, defaultBloomBitsPerKey, NoCompression, nil); err != nil {
+        t.Fatal(err)
+    }
+    tbl, err := openSSTable(path, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer tbl.close()
+    if len(tbl.index) < 2 {
+        t.Fatalf("expected several blocks, got %d", len(tbl.index))
+    }
+
+    for _, i := range []int{0, 999, 1999} {
+        e, ok, err := visibleGet(tbl, entries[i].key, math.MaxUint64)
+        if err != nil || !ok || e != entries[i] {
+            t.Fatalf("get %s: got %+v ok=%v err=%v", entries[i].key, e, ok, err)
+        }
+    }
+    if _, ok, _ := visibleGet(tbl, "key99999", math.MaxUint64); ok {
+        t.Fatal("expected miss for absent key")
+    }
+
+    var n int
+    c := tbl.cursor()
+    for {
+        _, ok, err := c.next()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !ok {
+            break
+        }
+        n++
+    }
+    if n != len(entries) {
+        t.Fatalf("expected %d entries, got %d", len(entries), n)
+    }
+}
+
+func TestSSTableVersions(t *testing.T) {
+    // Many versions per key, enough to fill several blocks.
+    var entries []lsmEntry
+    seq := uint64(10000)
+    for i := 0; i < 20; i++ {
+        for v := 0; v < 50; v++ {
+            entries = append(entries, lsmEntry{key: fmt.Sprintf("key%02d", i), value: fmt.Sprintf("%0100d", v), seq: seq})
+            seq--
+        }
+    }
+    path := filepath.Join(t.TempDir(), tableName(1))
+    if err := writeSSTable(path, entries, defaultBloomBitsPerKey, NoCompression, nil); err != nil {
+        t.Fatal(err)
+    }
+    tbl, err := openSSTable(path, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer tbl.close()
+    if len(tbl.index) < 2 {
+        t.Fatalf("expected several blocks, got %d", len(tbl.index))
+    }
+    for _, want := range []lsmEntry{entries[0], entries[77], entries[len(entries)-1]} {
+        e, ok, err := visibleGet(tbl, want.key, want.seq)
+        if err != nil || !ok || e != want {
+            t.Fatalf("get %s@%d: got %+v ok=%v err=%v", want.key, want.seq, e, ok, err)
+        }
+    }
+    // key05's oldest version is invisible below its seq; ceiling moves on.
+    oldest := entries[5*50+49]
+    e, ok, err := visibleCeiling(tbl, "key05", true, oldest.seq-1)
+    if err != nil || !ok || e.key != "key06" || e.seq >= oldest.seq {
+        t.Fatalf("ceiling: got %+v ok=%v err=%v", e, ok, err)
+    }
+    // Keys before key06 were all written after that point.
+    e, ok, err = visibleLower(tbl, "key07", oldest.seq-1)
+    if err != nil || !ok || e.key != "key06" {
+        t.Fatalf("lower: got %+v ok=%v err=%v", e, ok, err)
+    }
+    if e, ok, _ := visibleLower(tbl, "key06", oldest.seq-1); ok {
+        t.Fatalf("lower: expected miss, got %+v", e)
+    }
+}
+
+func TestMemRunSparseIndex(t *testing.T) {
+    var entries []lsmEntry
+    for i := 0; i < 1000; i += 2 {
+        entries = append(entries, lsmEntry{key: fmt.Sprintf("key%04d", i)})
+    }
+    l := NewLSMStore()
+    r, err := l.newRun(sliceCursor(entries))
+    if err != nil {
+        t.Fatal(err)
+    }
+    m := r.(*memRun)
+    for i := 0; i < 1000; i++ {
+        _, ok, _ := visibleGet(m, fmt.Sprintf("key%04d", i), math.MaxUint64)
+        if ok != (i%2 == 0) {
+            t.Fatalf("key%04d: found=%v", i, ok)
+        }
+    }
+    if i := m.seek("a"); i != 0 {
+        t.Fatalf("seek before first key: got %d", i)
+    }
+    if i := m.seek("z"); i != len(entries) {
+        t.Fatalf("seek past last key: got %d", i)
+    }
+}
+
+func TestSSTableCompression(t *testing.T) {
+    var entries []lsmEntry
+    for i := 0; i < 2000; i++ {
+        entries = append(entries, lsmEntry{key: fmt.Sprintf("key%05d", i), value: `{"user":"someone","active":true,"tags":["a","b"]}`, seq: uint64(i + 1)})
+    }
+    sizes := map[Compression]int64{}
+    for _, codec := range []Compression{NoCompression, FlateCompression} {
+        path := filepath.Join(t.TempDir(), tableName(1))
+        if err := writeSSTable(path, entries, defaultBloomBitsPerKey, codec, nil); err != nil {
+            t.Fatal(err)
+        }
+        tbl, err := openSSTable(path, nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for _, i := range []int{0, 1234, 1999} {
+            e, ok, err := visibleGet(tbl, entries[i].key, math.MaxUint64)
+            if err != nil || !ok || e != entries[i] {
+                t.Fatalf("codec %d: get %s: got %+v ok=%v err=%v", codec, entries[i].key, e, ok, err)
+            }
+        }
+        sizes[codec] = tbl.size()
+        tbl.close()
+    }
+    if sizes[FlateCompression]*2 > sizes[NoCompression] {
+        t.Fatalf("compressed table is %d bytes, uncompressed %d", sizes[FlateCompression], sizes[NoCompression])
+    }
+}
+
+func TestSSTableFooterChecksum(t *testing.T) {
+    entries := []lsmEntry{{key: "k", value: "v", seq: 1}}
+    dir := t.TempDir()
+    // Corrupt the header's key ID length, then one byte of the footer.
+    for i, off := range []int64{0, -sstFooterSize + 3} {
+        path := filepath.Join(dir, tableName(uint64(i+1)))
+        if err := writeSSTable(path, entries, defaultBloomBitsPerKey, NoCompression, nil); err != nil {
+            t.Fatal(err)
+        }
+        data, err := os.ReadFile(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if off < 0 {
+            off += int64(len(data))
+        }
+        data[off] ^= 0x01
+        if err := os.WriteFile(path, data, 0o644); err != nil {
+            t.Fatal(err)
+        }
+        if _, err := openSSTable(path, nil); !errors.Is(err, ErrCorrupted) {
+            t.Fatalf("byte %d flipped: expected ErrCorrupted, got %v", off, err)
+        }
+    }
+}
+
+func TestSSTableChecksum(t *testing.T) {
+    var entries []lsmEntry
+    for i := 0; i < 2000; i++ {
+        entries = append(entries, lsmEntry{key: fmt.Sprintf("key%05d", i), value: fmt.Sprintf("val%05d", i), seq: uint64(i + 1)})
+    }
+    path := filepath.Join(t.TempDir(), tableName(1))
+    if err := writeSSTable(path, entries, defaultBloomBitsPerKey, NoCompression, nil); err != nil {
+        t.Fatal(err)
+    }
+    tbl, err := openSSTable(path, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer tbl.close()
+    // Flip one byte in the middle of the second block.
+    ie := tbl.index[1]
+    f, err := os.OpenFile(path, os.O_RDWR, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var b [1]byte
+    f.ReadAt(b[:], int64(ie.offset+ie.length/2))
+    b[0] ^= 0xff
+    f.WriteAt(b[:], int64(ie.offset+ie.length/2))
+    f.Close()
+
+    if _, _, err := visibleGet(tbl, entries[0].key, math.MaxUint64); err != nil {
+        t.Fatalf("intact block: %v", err)
+    }
+    if _, _, err := visibleGet(tbl, ie.lastKey, math.MaxUint64); !errors.Is(err, ErrCorrupted) {
+        t.Fatalf("corrupt block: expected ErrCorrupted, got %v", err)
+    }
+}
@@ -0,0 +1,311 @@
+// Package kvclient is a client for a FastKVst server speaking the Redis
+// protocol (see package resp). A Client implements kv.KVStore, so code
+// written against a store, such as bench.RunBenchmark, can run against a
+// remote one.
+package kvclient
+
+import (
+    "errors"
+    "io"
+    "math/rand/v2"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+
+    "github.com/thilakshekharshriyan/m/kv"
+)
+
+// ErrClosed is returned by calls on a closed Client.
+var ErrClosed = errors.New("kvclient: client closed")
+
+// Options configures a Client. Zero values select the defaults.
+type Options struct {
+    Addr         string        // server address, host:port
+    PoolSize     int           // maximum open connections (default 16)
+    DialTimeout  time.Duration // default 5s
+    ReadTimeout  time.Duration // per reply (default 3s)
+    WriteTimeout time.Duration // per request (default 3s)
+    MaxRetries   int           // retries after network errors (default 3; < 0 disables)
+    MinBackoff   time.Duration // first retry delay (default 8ms)
+    MaxBackoff   time.Duration // retry delay cap (default 512ms)
+}
+
+func (o *Options) setDefaults() {
+    if o.PoolSize <= 0 {
+        o.PoolSize = 16
+    }
+    if o.DialTimeout <= 0 {
+        o.DialTimeout = 5 * time.Second
+    }
+    if o.ReadTimeout <= 0 {
+        o.ReadTimeout = 3 * time.Second
+    }
+    if o.WriteTimeout <= 0 {
+        o.WriteTimeout = 3 * time.Second
+    }
+    if o.MaxRetries == 0 {
+        o.MaxRetries = 3
+    }
+    if o.MinBackoff <= 0 {
+        o.MinBackoff = 8 * time.Millisecond
+    }
+    if o.MaxBackoff <= 0 {
+        o.MaxBackoff = 512 * time.Millisecond
+    }
+}
+
+// Client is a pool of connections to one server. It is safe for
+// concurrent use.
+type Client struct {
+    opts  Options
+    slots chan struct{} // one token per connection that may be open
+    idle  chan *conn
+    done  chan struct{}
+    once  sync.Once // closes done
+}
+
+// New returns a Client for opts.Addr. Connections are dialed on demand.
+func New(opts Options) *Client {
+    opts.setDefaults()
+    return &Client{
+        opts:  opts,
+        slots: make(chan struct{}, opts.PoolSize),
+        idle:  make(chan *conn, opts.PoolSize),
+        done:  make(chan struct{}),
+    }
+}
+
+// Dial returns a Client for addr with default options, after checking
+// that the server answers.
+func Dial(addr string) (*Client, error) {
+    c := New(Options{Addr: addr})
+    if err := c.Ping(); err != nil {
+        c.Close()
+        return nil, err
+    }
+    return c, nil
+}
+
+// Close closes idle connections; connections in use are closed when
+// their calls finish.
+func (c *Client) Close() error {
+    c.once.Do(func() { close(c.done) })
+    for {
+        select {
+        case cn := <-c.idle:
+            cn.nc.Close()
+        default:
+            return nil
+        }
+    }
+}
+
+// get takes an idle connection or dials one, waiting while PoolSize
+// connections are in use.
+func (c *Client) get() (*conn, error) {
+    select {
+    case <-c.done:
+        return nil, ErrClosed
+    case cn := <-c.idle:
+        return cn, nil
+    case c.slots <- struct{}{}:
+    }
+    cn, err := dial(c.opts.Addr, c.opts.DialTimeout)
+    if err != nil {
+        <-c.slots
+        return nil, err
+    }
+    return cn, nil
+}
+
+// put returns a connection to the pool, or closes it if it is broken or
+// the client is closed.
+func (c *Client) put(cn *conn, broken bool) {
+    select {
+    case <-c.done:
+        broken = true
+    default:
+    }
+    if !broken {
+        select {
+        case c.idle <- cn:
+            return
+        default:
+        }
+    }
+    cn.nc.Close()
+    <-c.slots
+}
+
+// roundTrip sends cmds in one write and reads one reply each. Server
+// error replies are returned in place; err is a network error.
+func (c *Client) roundTrip(cmds [][]string) ([]reply, []error, error) {
+    cn, err := c.get()
+    if err != nil {
+        return nil, nil, err
+    }
+    cn.nc.SetWriteDeadline(time.Now().Add(c.opts.WriteTimeout))
+    for _, args := range cmds {
+        cn.writeCommand(args)
+    }
+    if err := cn.w.Flush(); err != nil {
+        c.put(cn, true)
+        return nil, nil, err
+    }
+    replies := make([]reply, len(cmds))
+    errs := make([]error, len(cmds))
+    for i := range cmds {
+        cn.nc.SetReadDeadline(time.Now().Add(c.opts.ReadTimeout))
+        replies[i], err = cn.readReply()
+        if _, ok := err.(ServerError); ok {
+            errs[i] = mapError(err)
+            continue
+        }
+        if err != nil {
+            c.put(cn, true)
+            return nil, nil, err
+        }
+    }
+    c.put(cn, false)
+    return replies, errs, nil
+}
+
+// do runs cmds, retrying after network errors with exponential backoff
+// if retry is set. Only commands that are safe to repeat may be retried:
+// the server may have applied them before the connection failed.
+func (c *Client) do(retry bool, cmds ...[]string) ([]reply, []error, error) {
+    for attempt := 0; ; attempt++ {
+        replies, errs, err := c.roundTrip(cmds)
+        if err == nil || err == ErrClosed || !retry || attempt >= c.opts.MaxRetries || !retryable(err) {
+            return replies, errs, err
+        }
+        select {
+        case <-time.After(c.backoff(attempt)):
+        case <-c.done:
+            return nil, nil, ErrClosed
+        }
+    }
+}
+
+// backoff returns a random delay up to MinBackoff<<attempt, capped at
+// MaxBackoff ("full jitter").
+func (c *Client) backoff(attempt int) time.Duration {
+    d := c.opts.MaxBackoff
+    if attempt < 30 && c.opts.MinBackoff<<attempt < d {
+        d = c.opts.MinBackoff << attempt
+    }
+    return time.Duration(rand.Int64N(int64(d))) + 1
+}
+
+// retryable reports whether err is a network failure worth retrying,
+// including the server closing or resetting the connection.
+func retryable(err error) bool {
+    var ne net.Error
+    return errors.As(err, &ne) || errors.Is(err, net.ErrClosed) ||
+        errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+        errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// mapError turns a server error reply into a kv sentinel where one fits.
+func mapError(err error) error {
+    if se, ok := err.(ServerError); ok && strings.Contains(string(se), "unsupported") {
+        return kv.ErrUnsupported
+    }
+    return err
+}
+
+// call runs one command and returns its reply.
+func (c *Client) call(retry bool, args ...string) (reply, error) {
+    replies, errs, err := c.do(retry, args)
+    if err != nil {
+        return reply{}, err
+    }
+    return replies[0], errs[0]
+}
+
+// Ping checks that the server answers.
+func (c *Client) Ping() error {
+    _, err := c.call(true, "PING")
+    return err
+}
+
+// Set writes key→value.
+func (c *Client) Set(key, value string) error {
+    _, err := c.call(true, "SET", key, value)
+    return err
+}
+
+// SetWithTTL writes key→value, expiring after ttl (rounded down to a
+// millisecond).
+func (c *Client) SetWithTTL(key, value string, ttl time.Duration) error {
+    if ttl < time.Millisecond {
+        return kv.ErrInvalidTTL
+    }
+    _, err := c.call(true, "SET", key, value, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+    return err
+}
+
+// SetIfAbsent sets key to value if it does not exist. It is not retried,
+// since a retry could not tell its own earlier write from someone else's.
+func (c *Client) SetIfAbsent(key, value string) (bool, error) {
+    r, err := c.call(false, "SET", key, value, "NX")
+    if err != nil {
+        return false, err
+    }
+    return !r.null, nil
+}
+
+// Get returns the value of key, or kv.ErrNotFound.
+func (c *Client) Get(key string) (string, error) {
+    r, err := c.call(true, "GET", key)
+    if err != nil {
+        return "", err
+    }
+    if r.null {
+        return "", kv.ErrNotFound
+    }
+    return r.str, nil
+}
+
+// Delete removes key, returning kv.ErrNotFound if it did not exist. If
+// the delete is retried after a network error, a key removed by the
+// first attempt is reported as not found.
+func (c *Client) Delete(key string) error {
+    r, err := c.call(true, "DEL", key)
+    if err != nil {
+        return err
+    }
+    if r.n == 0 {
+        return kv.ErrNotFound
+    }
+    return nil
+}
+
+// TTL returns the time left before key expires, kv.NoExpiry if it has no
+// TTL, or kv.ErrNotFound. The server reports whole seconds.
+func (c *Client) TTL(key string) (time.Duration, error) {
+    r, err := c.call(true, "TTL", key)
+    switch {
+    case err != nil:
+        return 0, err
+    case r.n == -2:
+        return 0, kv.ErrNotFound
+    case r.n == -1:
+        return kv.NoExpiry, nil
+    }
+    return time.Duration(r.n) * time.Second, nil
+}
+
+// Range is unsupported: the server only scans in hash order.
+func (c *Client) Range(start, end string) ([]string, error) {
+    return nil, kv.ErrUnsupported
+}
+
+// Flush is a no-op. Every call is sent synchronously, so nothing is
+// buffered on the client; the server persists on its own schedule.
+func (c *Client) Flush() error {
+    return nil
+}
@@ -0,0 +1,169 @@
+package kvclient
+
+import (
+    "fmt"
+    "net"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/thilakshekharshriyan/m/bench"
+    "github.com/thilakshekharshriyan/m/kv"
+    "github.com/thilakshekharshriyan/m/resp"
+)
+
+// serve runs a resp.Server for store on ln until the test ends.
+func serve(t *testing.T, store kv.KVStore, ln net.Listener) *resp.Server {
+    s := resp.NewServer(store, resp.Options{})
+    go s.Serve(ln)
+    t.Cleanup(func() { s.Close() })
+    return s
+}
+
+func startServer(t *testing.T, store kv.KVStore) string {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    serve(t, store, ln)
+    return ln.Addr().String()
+}
+
+func TestClient(t *testing.T) {
+    c, err := Dial(startServer(t, kv.NewHashStore()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.Close()
+
+    if _, err := c.Get("a"); err != kv.ErrNotFound {
+        t.Fatalf("expected ErrNotFound, got %v", err)
+    }
+    if err := c.Set("a", "1\r\n\x00"); err != nil {
+        t.Fatal(err)
+    }
+    if v, err := c.Get("a"); err != nil || v != "1\r\n\x00" {
+        t.Fatalf("Get = %q, %v", v, err)
+    }
+    if ok, err := c.SetIfAbsent("a", "2"); ok || err != nil {
+        t.Fatalf("SetIfAbsent existing = %v, %v", ok, err)
+    }
+    if err := c.SetWithTTL("t", "x", time.Hour); err != nil {
+        t.Fatal(err)
+    }
+    if ttl, err := c.TTL("t"); err != nil || ttl != time.Hour {
+        t.Fatalf("TTL = %v, %v", ttl, err)
+    }
+    if err := c.Delete("a"); err != nil {
+        t.Fatal(err)
+    }
+    if err := c.Delete("a"); err != kv.ErrNotFound {
+        t.Fatalf("second Delete: %v", err)
+    }
+    if _, err := c.Range("a", "z"); err != kv.ErrUnsupported {
+        t.Fatalf("Range: %v", err)
+    }
+}
+
+func TestPipeline(t *testing.T) {
+    c := New(Options{Addr: startServer(t, kv.NewBTreeStore())})
+    defer c.Close()
+    p := c.Pipeline()
+    for i := 0; i < 100; i++ {
+        p.Set(fmt.Sprint("k", i), fmt.Sprint(i))
+    }
+    p.Get("k42")
+    p.Get("missing")
+    p.Delete("k1")
+    p.SetWithTTL("t", "x", 0) // rejected by the server
+    res, err := p.Exec()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if p.Len() != 0 || len(res) != 104 {
+        t.Fatalf("%d results, %d left queued", len(res), p.Len())
+    }
+    if res[100].Value != "42" || res[101].Err != kv.ErrNotFound || res[102].Err != nil || res[103].Err == nil {
+        t.Fatalf("results %+v", res[100:])
+    }
+}
+
+func TestRetryAfterRestart(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := ln.Addr().String()
+    store := kv.NewHashStore()
+    s := serve(t, store, ln)
+    c := New(Options{Addr: addr, MinBackoff: time.Millisecond})
+    defer c.Close()
+    if err := c.Set("a", "1"); err != nil {
+        t.Fatal(err)
+    }
+
+    // Restart the server: the pooled connection breaks and is replaced.
+    s.Close()
+    if ln, err = net.Listen("tcp", addr); err != nil {
+        t.Skipf("cannot reuse %s: %v", addr, err)
+    }
+    serve(t, store, ln)
+    if v, err := c.Get("a"); err != nil || v != "1" {
+        t.Fatalf("Get after restart = %q, %v", v, err)
+    }
+}
+
+func TestConcurrentPool(t *testing.T) {
+    c := New(Options{Addr: startServer(t, kv.NewShardedHashStore(4)), PoolSize: 2})
+    defer c.Close()
+    var wg sync.WaitGroup
+    for g := 0; g < 8; g++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := 0; i < 50; i++ {
+                key := fmt.Sprintf("g%d-%d", g, i)
+                if err := c.Set(key, key); err != nil {
+                    t.Error(err)
+                    return
+                }
+                if v, err := c.Get(key); err != nil || v != key {
+                    t.Errorf("Get(%s) = %q, %v", key, v, err)
+                    return
+                }
+            }
+        }()
+    }
+    wg.Wait()
+    // Concurrent Closes must not close done twice.
+    for g := 0; g < 4; g++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            c.Close()
+        }()
+    }
+    wg.Wait()
+    if err := c.Set("x", "y"); err != ErrClosed {
+        t.Fatalf("after Close: %v", err)
+    }
+}
+
+func TestRunBenchmarkRemote(t *testing.T) {
+    c := New(Options{Addr: startServer(t, kv.NewHashStore())})
+    defer c.Close()
+    res, err := bench.RunBenchmark(bench.Config{
+        Store:       c,
+        StoreName:   "remote",
+        NumKeys:     500,
+        Concurrency: 4,
+        KeySize:     16,
+        ValueSize:   32,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if res.WriteOpsPerSec <= 0 || len(res.ReadLatencies) == 0 {
+        t.Fatalf("result %+v", res)
+    }
+}
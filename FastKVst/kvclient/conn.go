@@ -0,0 +1,134 @@
+package kvclient
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "time"
+)
+
+// reply is one decoded RESP reply. Error replies are returned as a
+// ServerError instead.
+type reply struct {
+    str  string
+    n    int64
+    null bool
+    arr  []reply
+}
+
+// ServerError is an error reply from the server, such as
+// "ERR syntax error".
+type ServerError string
+
+func (e ServerError) Error() string {
+    return "kvclient: server: " + string(e)
+}
+
+// conn is one pooled connection.
+type conn struct {
+    nc net.Conn
+    r  *bufio.Reader
+    w  *bufio.Writer
+}
+
+func dial(addr string, timeout time.Duration) (*conn, error) {
+    nc, err := net.DialTimeout("tcp", addr, timeout)
+    if err != nil {
+        return nil, err
+    }
+    return &conn{nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}, nil
+}
+
+// writeCommand buffers one command as a RESP array of bulk strings.
+func (cn *conn) writeCommand(args []string) {
+    cn.w.WriteByte('*')
+    cn.w.WriteString(strconv.Itoa(len(args)))
+    cn.w.WriteString("\r\n")
+    for _, a := range args {
+        cn.w.WriteByte('$')
+        cn.w.WriteString(strconv.Itoa(len(a)))
+        cn.w.WriteString("\r\n")
+        cn.w.WriteString(a)
+        cn.w.WriteString("\r\n")
+    }
+}
+
+// readReply reads one reply. A ServerError leaves the connection usable;
+// any other error means it is broken.
+func (cn *conn) readReply() (reply, error) {
+    line, err := cn.readLine()
+    if err != nil {
+        return reply{}, err
+    }
+    if len(line) == 0 {
+        return reply{}, fmt.Errorf("kvclient: empty reply line")
+    }
+    switch line[0] {
+    case '+':
+        return reply{str: line[1:]}, nil
+    case '-':
+        return reply{}, ServerError(line[1:])
+    case ':':
+        n, err := strconv.ParseInt(line[1:], 10, 64)
+        if err != nil {
+            return reply{}, fmt.Errorf("kvclient: bad integer reply %q", line)
+        }
+        return reply{n: n}, nil
+    case '_':
+        return reply{null: true}, nil
+    case '$':
+        n, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return reply{}, fmt.Errorf("kvclient: bad bulk length %q", line)
+        }
+        if n < 0 {
+            return reply{null: true}, nil
+        }
+        buf := make([]byte, n+2)
+        if _, err := io.ReadFull(cn.r, buf); err != nil {
+            return reply{}, err
+        }
+        return reply{str: string(buf[:n])}, nil
+    case '*', '%':
+        n, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return reply{}, fmt.Errorf("kvclient: bad array length %q", line)
+        }
+        if n < 0 {
+            return reply{null: true}, nil
+        }
+        if line[0] == '%' {
+            n *= 2
+        }
+        r := reply{arr: make([]reply, n)}
+        var firstErr error
+        for i := range r.arr {
+            r.arr[i], err = cn.readReply()
+            if _, ok := err.(ServerError); ok {
+                // Keep reading so the connection stays in sync.
+                if firstErr == nil {
+                    firstErr = err
+                }
+                continue
+            }
+            if err != nil {
+                return reply{}, err
+            }
+        }
+        return r, firstErr
+    }
+    return reply{}, fmt.Errorf("kvclient: unexpected reply %q", line)
+}
+
+func (cn *conn) readLine() (string, error) {
+    line, err := cn.r.ReadString('\n')
+    if err != nil {
+        return "", err
+    }
+    if len(line) < 2 || line[len(line)-2] != '\r' {
+        return "", fmt.Errorf("kvclient: malformed reply line %q", line)
+    }
+    return line[:len(line)-2], nil
+}
@@ -0,0 +1,90 @@
+package kvclient
+
+import (
+    "strconv"
+    "time"
+
+    "github.com/thilakshekharshriyan/m/kv"
+)
+
+// Pipeline queues commands and sends them in a single round trip. The
+// server applies them in order but not atomically: other clients may see
+// some applied and not others. The zero value is not usable; get one from
+// Client.Pipeline.
+type Pipeline struct {
+    c    *Client
+    cmds [][]string
+}
+
+// Result is the outcome of one pipelined command. Value is set for Get.
+type Result struct {
+    Value string
+    Err   error
+}
+
+// Pipeline returns an empty pipeline on c.
+func (c *Client) Pipeline() *Pipeline {
+    return &Pipeline{c: c}
+}
+
+// Set queues a write of key→value.
+func (p *Pipeline) Set(key, value string) {
+    p.cmds = append(p.cmds, []string{"SET", key, value})
+}
+
+// SetWithTTL queues a write of key→value that expires after ttl.
+func (p *Pipeline) SetWithTTL(key, value string, ttl time.Duration) {
+    p.cmds = append(p.cmds, []string{"SET", key, value, "PX", strconv.FormatInt(ttl.Milliseconds(), 10)})
+}
+
+// Get queues a read of key.
+func (p *Pipeline) Get(key string) {
+    p.cmds = append(p.cmds, []string{"GET", key})
+}
+
+// Delete queues a delete of key.
+func (p *Pipeline) Delete(key string) {
+    p.cmds = append(p.cmds, []string{"DEL", key})
+}
+
+// Len returns the number of queued commands.
+func (p *Pipeline) Len() int {
+    return len(p.cmds)
+}
+
+// Exec sends the queued commands and returns one Result each, in order,
+// then empties the pipeline. Errors of single commands, such as
+// kv.ErrNotFound for a Get or Delete of a missing key, are in the
+// results; err is set only if the round trip failed. Every pipelined
+// command may be repeated, so Exec retries after network errors.
+func (p *Pipeline) Exec() ([]Result, error) {
+    if len(p.cmds) == 0 {
+        return nil, nil
+    }
+    cmds := p.cmds
+    p.cmds = nil
+    replies, errs, err := p.c.do(true, cmds...)
+    if err != nil {
+        return nil, err
+    }
+    res := make([]Result, len(cmds))
+    for i, r := range replies {
+        res[i].Err = errs[i]
+        if res[i].Err != nil {
+            continue
+        }
+        switch cmds[i][0] {
+        case "GET":
+            if r.null {
+                res[i].Err = kv.ErrNotFound
+            } else {
+                res[i].Value = r.str
+            }
+        case "DEL":
+            if r.n == 0 {
+                res[i].Err = kv.ErrNotFound
+            }
+        }
+    }
+    return res, nil
+}
@@ -8,12 +8,15 @@ import (
 
 	"github.com/thilakshekharshriyan/m/bench"
 	"github.com/thilakshekharshriyan/m/kv"
+	"github.com/thilakshekharshriyan/m/kvclient"
 )
 
 func main() {
     // Common flags
     numKeys := flag.Int("n", 1e6, "number of keys per store")
     concurrency := flag.Int("c", 4, "number of goroutines")
+    binary := flag.Bool("binary", false, "use random binary values via SetBytes/GetBytes")
+    remote := flag.String("remote", "", "benchmark a kvserver at this address instead of the local stores")
     flag.Parse()
 
     // List all store types and their constructors
@@ -22,11 +25,24 @@ func main() {
         Factory func() kv.KVStore
     }{
         {Name: "hash",     Factory: func() kv.KVStore { return kv.NewHashStore() }},
+        {Name: "sharded",  Factory: func() kv.KVStore { return kv.NewShardedHashStore(0) }},
         {Name: "bptree",   Factory: func() kv.KVStore { return kv.NewBTreeStore() }},
-        //{Name: "lsm",      Factory: func() kv.KVStore { return kv.NewLSMStore() }},
-        //{Name: "skiplist", Factory: func() kv.KVStore { return kv.NewSkipListStore() }},
+        {Name: "lsm",      Factory: func() kv.KVStore { return kv.NewLSMStore() }},
+        {Name: "skiplist", Factory: func() kv.KVStore { return kv.NewSkipListStore() }},
         //{Name: "trie",     Factory: func() kv.KVStore { return kv.NewTrieStore() }},
     }
+    if *remote != "" {
+        // Benchmark only the remote server.
+        stores = stores[:1]
+        stores[0].Name = "remote"
+        stores[0].Factory = func() kv.KVStore {
+            c, err := kvclient.Dial(*remote)
+            if err != nil {
+                log.Fatalf("connecting to %s: %v", *remote, err)
+            }
+            return c
+        }
+    }
 
     var results []bench.Result
 
@@ -42,6 +58,7 @@ func main() {
             Workload:    bench.Random, // could also flag this
             KeySize:     16,            // bytes per key (adjust as needed)
             ValueSize:   128,           // bytes per value (adjust as needed)
+            Binary:      *binary,
         }
 
         res, err := bench.RunBenchmark(cfg)
@@ -61,6 +78,10 @@ func main() {
             }(),
             res.MemAllocBytes,
         )
+        if res.Bloom != nil {
+            fmt.Printf("   %s: bloom filters skipped %d runs, false-positive rate %.4f\n",
+                res.StoreName, res.Bloom.Negatives, res.Bloom.FalsePositiveRate())
+        }
 
         results = append(results, res)
     }
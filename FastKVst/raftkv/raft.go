@@ -0,0 +1,1012 @@
+// Package raftkv replicates a kv.KVStore with the Raft consensus
+// algorithm, giving a linearizable store that stays available while a
+// majority of its nodes can reach each other.
+//
+// A Node runs the algorithm: leader election, log replication, log
+// compaction with snapshots, and membership changes one node at a time
+// (section 4.1 of Ongaro's dissertation). It applies committed entries to
+// a StateMachine. A Store is both the StateMachine for a kv.KVStore and
+// the KVStore its users call: writes are proposed to the leader and
+// return once applied, and reads confirm with a round of heartbeats that
+// the node still leads (the ReadIndex protocol, section 6.4), so they
+// see every write that completed before them without writing the log.
+//
+// Nodes talk through a Transport. Network is an in-process Transport that
+// can partition, drop and delay messages, for tests.
+package raftkv
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "math/rand/v2"
+    "slices"
+    "strings"
+    "sync"
+    "time"
+)
+
+var (
+    // ErrNotLeader is returned by writes to a node that is not the leader.
+    // Leader reports where to send them instead.
+    ErrNotLeader = errors.New("raftkv: not the leader")
+    // ErrLeadershipLost is returned when an entry was overwritten by a new
+    // leader before it committed. It was not applied.
+    ErrLeadershipLost = errors.New("raftkv: leadership lost before commit")
+    // ErrTimeout is returned when an entry did not commit in time. It may
+    // still be applied later.
+    ErrTimeout = errors.New("raftkv: timed out waiting for commit")
+    // ErrStopped is returned by a stopped node.
+    ErrStopped = errors.New("raftkv: node stopped")
+    // ErrConfigPending is returned by a membership change made before the
+    // previous one, or the leader's first entry, has committed.
+    ErrConfigPending = errors.New("raftkv: membership change in progress")
+)
+
+// StateMachine is what a Node replicates. Apply is called with each
+// committed command in log order, on every node; it must be
+// deterministic. Calls are never concurrent.
+type StateMachine interface {
+    // Apply applies cmd and returns a result for the proposer.
+    Apply(cmd []byte) any
+    // Snapshot returns the state machine's state.
+    Snapshot() ([]byte, error)
+    // Restore replaces the state machine's state with a snapshot.
+    Restore(data []byte) error
+}
+
+// Config configures a Node. Zero values select the defaults.
+type Config struct {
+    ID string
+    // Peers is the initial member list, including ID, used when Storage
+    // is empty. Every founding node must be given the same list. A node
+    // joining a running cluster is given none and added with AddMember.
+    Peers     []string
+    Transport Transport
+    Storage   Storage // default NewMemStorage()
+
+    ElectionTimeout   time.Duration // minimum; waits are randomized up to twice this (default 300ms)
+    HeartbeatInterval time.Duration // default 50ms
+    ApplyTimeout      time.Duration // how long a proposal waits to be applied (default 5s)
+    SnapshotThreshold uint64        // applied entries between snapshots (default 8192)
+    MaxAppendEntries  int           // entries per AppendEntries (default 256)
+    Logger            *log.Logger   // nil discards
+}
+
+func (c *Config) setDefaults() {
+    if c.Storage == nil {
+        c.Storage = NewMemStorage()
+    }
+    if c.ElectionTimeout <= 0 {
+        c.ElectionTimeout = 300 * time.Millisecond
+    }
+    if c.HeartbeatInterval <= 0 {
+        c.HeartbeatInterval = 50 * time.Millisecond
+    }
+    if c.ApplyTimeout <= 0 {
+        c.ApplyTimeout = 5 * time.Second
+    }
+    if c.SnapshotThreshold == 0 {
+        c.SnapshotThreshold = 8192
+    }
+    if c.MaxAppendEntries <= 0 {
+        c.MaxAppendEntries = 256
+    }
+    if c.Logger == nil {
+        c.Logger = log.New(io.Discard, "", 0)
+    }
+}
+
+// Role is a node's part in the current term.
+type Role int
+
+const (
+    Follower Role = iota
+    Candidate
+    Leader
+)
+
+func (r Role) String() string {
+    switch r {
+    case Follower:
+        return "follower"
+    case Candidate:
+        return "candidate"
+    case Leader:
+        return "leader"
+    }
+    return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// Status is a snapshot of a node's state.
+type Status struct {
+    ID            string
+    Role          Role
+    Term          uint64
+    Leader        string // "" if unknown
+    Members       []string
+    CommitIndex   uint64
+    AppliedIndex  uint64
+    LastIndex     uint64
+    SnapshotIndex uint64
+}
+
+type result struct {
+    value any
+    err   error
+}
+
+// waiter is a proposal waiting for its entry to be applied.
+type waiter struct {
+    term uint64
+    ch   chan result
+}
+
+// readWait is a read waiting for lastApplied to reach index.
+type readWait struct {
+    index uint64
+    ch    chan struct{}
+}
+
+// Node is one member of a Raft cluster.
+type Node struct {
+    cfg Config
+    sm  StateMachine
+
+    mu          sync.Mutex
+    applyCond   *sync.Cond // signalled when there is something to apply
+    role        Role
+    term        uint64
+    vote        string
+    leader      string
+    lastContact time.Time // last message from the current leader
+    deadline    time.Time // when to start an election
+    beatDue     time.Time // leader: when to send heartbeats
+    log         []Entry   // log[0] holds the snapshot's index and term
+    snap        Snapshot
+    pendingSnap *Snapshot // installed but not yet restored
+    members     []string
+    configIndex uint64 // index of the entry that set members
+    commitIndex uint64
+    lastApplied uint64
+    next        map[string]uint64 // leader: next index to send each peer
+    match       map[string]uint64 // leader: highest index known replicated
+    inflight    map[string]bool   // leader: a replication goroutine is running
+    waiters     map[uint64]waiter
+    reads       []readWait
+    stopped     bool
+    done        chan struct{}
+    wg          sync.WaitGroup
+}
+
+// NewNode starts a node, restoring its state machine from cfg.Storage.
+func NewNode(cfg Config, sm StateMachine) (*Node, error) {
+    cfg.setDefaults()
+    if cfg.ID == "" || strings.Contains(cfg.ID, "\n") {
+        return nil, fmt.Errorf("raftkv: invalid node ID %q", cfg.ID)
+    }
+    if cfg.Transport == nil {
+        return nil, errors.New("raftkv: no transport")
+    }
+    st, err := cfg.Storage.Load()
+    if err != nil {
+        return nil, fmt.Errorf("raftkv: load state: %w", err)
+    }
+    n := &Node{
+        cfg:      cfg,
+        sm:       sm,
+        term:     st.Term,
+        vote:     st.Vote,
+        next:     make(map[string]uint64),
+        match:    make(map[string]uint64),
+        inflight: make(map[string]bool),
+        waiters:  make(map[uint64]waiter),
+        done:     make(chan struct{}),
+    }
+    n.applyCond = sync.NewCond(&n.mu)
+    if st.Snapshot != nil {
+        if err := sm.Restore(st.Snapshot.Data); err != nil {
+            return nil, fmt.Errorf("raftkv: restore snapshot: %w", err)
+        }
+        n.snap = *st.Snapshot
+        n.commitIndex, n.lastApplied = n.snap.Index, n.snap.Index
+    } else {
+        n.snap.Members = slices.Clone(cfg.Peers)
+    }
+    n.log = append([]Entry{{Index: n.snap.Index, Term: n.snap.Term}}, st.Entries...)
+    n.updateMembersLocked()
+    n.resetDeadlineLocked()
+    n.wg.Add(2)
+    go n.tickLoop()
+    go n.applyLoop()
+    return n, nil
+}
+
+// ID returns the node's ID.
+func (n *Node) ID() string {
+    return n.cfg.ID
+}
+
+// Leader returns the ID of the leader as this node last heard, or "".
+func (n *Node) Leader() string {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    return n.leader
+}
+
+// Status returns the node's current state.
+func (n *Node) Status() Status {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    return Status{
+        ID:            n.cfg.ID,
+        Role:          n.role,
+        Term:          n.term,
+        Leader:        n.leader,
+        Members:       slices.Clone(n.members),
+        CommitIndex:   n.commitIndex,
+        AppliedIndex:  n.lastApplied,
+        LastIndex:     n.lastIndex(),
+        SnapshotIndex: n.log[0].Index,
+    }
+}
+
+// Stop stops the node. Its Storage keeps its state, so a node can be
+// restarted by passing the same Storage to NewNode.
+func (n *Node) Stop() {
+    n.mu.Lock()
+    if n.stopped {
+        n.mu.Unlock()
+        return
+    }
+    n.stopped = true
+    close(n.done)
+    n.failWaitersLocked(^uint64(0), ErrStopped)
+    n.applyCond.Broadcast()
+    n.mu.Unlock()
+    n.wg.Wait()
+}
+
+// Apply proposes cmd and waits until it is applied, returning the state
+// machine's result. It fails with ErrNotLeader on followers.
+func (n *Node) Apply(cmd []byte) (any, error) {
+    return n.propose(EntryCommand, cmd)
+}
+
+// Barrier waits until every entry committed before the call has been
+// applied on this node, which must be the leader. Reads of the state
+// machine made after it returns are linearizable. It writes nothing to
+// the log: the leader notes its commit index, confirms that it still
+// leads with a round of heartbeats, and waits to apply up to that index.
+func (n *Node) Barrier() error {
+    timer := time.NewTimer(n.cfg.ApplyTimeout)
+    defer timer.Stop()
+    n.mu.Lock()
+    if err := n.leaderErrLocked(); err != nil {
+        n.mu.Unlock()
+        return err
+    }
+    index, term := n.commitIndex, n.term
+    if t, _ := n.termAt(index); t != term {
+        // Until an entry of its own term commits, a new leader's commit
+        // index can trail what earlier leaders committed; all of that is
+        // in its log.
+        index = n.lastIndex()
+    }
+    acks, need := n.heartbeatLocked(term)
+    n.mu.Unlock()
+    for need > 0 {
+        select {
+        case ok, more := <-acks:
+            if !more {
+                n.mu.Lock()
+                err := n.leaderErrLocked()
+                n.mu.Unlock()
+                if err == nil {
+                    err = ErrTimeout
+                }
+                return err
+            }
+            if ok {
+                need--
+            }
+        case <-timer.C:
+            return ErrTimeout
+        case <-n.done:
+            return ErrStopped
+        }
+    }
+    return n.waitApplied(index, timer.C)
+}
+
+// heartbeatLocked sends every peer an empty AppendEntries for term. It
+// returns a channel that reports, for each reply, whether the peer still
+// follows this leader, closed after the last; and how many such replies
+// make a majority with this node.
+func (n *Node) heartbeatLocked(term uint64) (<-chan bool, int) {
+    need := n.quorum()
+    if n.isMember(n.cfg.ID) {
+        need--
+    }
+    acks := make(chan bool, len(n.members))
+    var sent sync.WaitGroup
+    for _, p := range n.members {
+        if p == n.cfg.ID {
+            continue
+        }
+        prevTerm, _ := n.termAt(n.match[p])
+        req := &AppendRequest{
+            Term:         term,
+            Leader:       n.cfg.ID,
+            PrevLogIndex: n.match[p],
+            PrevLogTerm:  prevTerm,
+            LeaderCommit: n.commitIndex,
+        }
+        sent.Add(1)
+        n.wg.Add(1)
+        go func(peer string) {
+            defer n.wg.Done()
+            defer sent.Done()
+            resp, err := n.cfg.Transport.AppendEntries(peer, req)
+            n.mu.Lock()
+            ok := n.handleReplyLocked(resp, err, term)
+            n.mu.Unlock()
+            acks <- ok
+        }(p)
+    }
+    go func() {
+        sent.Wait()
+        close(acks)
+    }()
+    return acks, need
+}
+
+// waitApplied waits until lastApplied reaches index.
+func (n *Node) waitApplied(index uint64, timeout <-chan time.Time) error {
+    n.mu.Lock()
+    if n.lastApplied >= index {
+        n.mu.Unlock()
+        return nil
+    }
+    ch := make(chan struct{})
+    n.reads = append(n.reads, readWait{index: index, ch: ch})
+    n.mu.Unlock()
+    select {
+    case <-ch:
+        return nil
+    case <-timeout:
+        return ErrTimeout
+    case <-n.done:
+        return ErrStopped
+    }
+}
+
+// releaseReadsLocked wakes the reads that lastApplied has reached.
+func (n *Node) releaseReadsLocked() {
+    n.reads = slices.DeleteFunc(n.reads, func(r readWait) bool {
+        if r.index <= n.lastApplied {
+            close(r.ch)
+            return true
+        }
+        return false
+    })
+}
+
+// AddMember adds a node to the cluster. The node should already be
+// running, with no Peers; it counts towards the majority at once, so add
+// one node at a time and let it catch up before adding the next.
+func (n *Node) AddMember(id string) error {
+    if id == "" || strings.Contains(id, "\n") {
+        return fmt.Errorf("raftkv: invalid node ID %q", id)
+    }
+    return n.changeMembers(id, true)
+}
+
+// RemoveMember removes a node from the cluster. A leader that removes
+// itself steps down once the change commits.
+func (n *Node) RemoveMember(id string) error {
+    return n.changeMembers(id, false)
+}
+
+func (n *Node) changeMembers(id string, add bool) error {
+    n.mu.Lock()
+    if err := n.leaderErrLocked(); err != nil {
+        n.mu.Unlock()
+        return err
+    }
+    // One change at a time, and not before this leader has committed an
+    // entry of its own term: either could let two majorities form.
+    if t, _ := n.termAt(n.commitIndex); n.configIndex > n.commitIndex || t != n.term {
+        n.mu.Unlock()
+        return ErrConfigPending
+    }
+    members := slices.Clone(n.members)
+    i := slices.Index(members, id)
+    switch {
+    case add && i >= 0, !add && i < 0:
+        n.mu.Unlock()
+        return nil
+    case add:
+        members = append(members, id)
+    default:
+        members = slices.Delete(members, i, i+1)
+    }
+    index, w := n.proposeLocked(EntryConfig, []byte(strings.Join(members, "\n")))
+    n.mu.Unlock()
+    _, err := n.wait(index, w)
+    return err
+}
+
+func (n *Node) leaderErrLocked() error {
+    if n.stopped {
+        return ErrStopped
+    }
+    if n.role != Leader {
+        return ErrNotLeader
+    }
+    return nil
+}
+
+func (n *Node) propose(typ EntryType, data []byte) (any, error) {
+    n.mu.Lock()
+    if err := n.leaderErrLocked(); err != nil {
+        n.mu.Unlock()
+        return nil, err
+    }
+    index, w := n.proposeLocked(typ, data)
+    n.mu.Unlock()
+    return n.wait(index, w)
+}
+
+// proposeLocked appends an entry to the leader's log and starts
+// replicating it.
+func (n *Node) proposeLocked(typ EntryType, data []byte) (uint64, waiter) {
+    e := Entry{Index: n.lastIndex() + 1, Term: n.term, Type: typ, Data: data}
+    n.storeEntriesLocked([]Entry{e})
+    w := waiter{term: e.Term, ch: make(chan result, 1)}
+    n.waiters[e.Index] = w
+    n.advanceCommitLocked()
+    for _, p := range n.members {
+        if p != n.cfg.ID {
+            n.replicateLocked(p)
+        }
+    }
+    return e.Index, w
+}
+
+// wait waits for the proposal at index to be applied.
+func (n *Node) wait(index uint64, w waiter) (any, error) {
+    t := time.NewTimer(n.cfg.ApplyTimeout)
+    defer t.Stop()
+    select {
+    case r := <-w.ch:
+        return r.value, r.err
+    case <-t.C:
+        n.mu.Lock()
+        if cur, ok := n.waiters[index]; ok && cur.ch == w.ch {
+            delete(n.waiters, index)
+        }
+        n.mu.Unlock()
+        select {
+        case r := <-w.ch:
+            return r.value, r.err
+        default:
+        }
+        return nil, ErrTimeout
+    }
+}
+
+// failWaitersLocked fails every proposal waiting at or before index.
+func (n *Node) failWaitersLocked(index uint64, err error) {
+    for i, w := range n.waiters {
+        if i <= index {
+            w.ch <- result{err: err}
+            delete(n.waiters, i)
+        }
+    }
+}
+
+func (n *Node) must(err error) {
+    if err != nil {
+        panic(fmt.Sprintf("raftkv: %s: storage: %v", n.cfg.ID, err))
+    }
+}
+
+// Log helpers. The log is never empty: log[0] stands for the snapshot.
+
+func (n *Node) lastIndex() uint64 { return n.log[len(n.log)-1].Index }
+func (n *Node) lastTerm() uint64  { return n.log[len(n.log)-1].Term }
+
+// termAt returns the term of the entry at index, if the log holds it.
+func (n *Node) termAt(index uint64) (uint64, bool) {
+    first := n.log[0].Index
+    if index < first || index > n.lastIndex() {
+        return 0, false
+    }
+    return n.log[index-first].Term, true
+}
+
+// storeEntriesLocked writes entries into the log, replacing any from
+// entries[0].Index on.
+func (n *Node) storeEntriesLocked(entries []Entry) {
+    first := n.log[0].Index
+    n.log = append(n.log[:entries[0].Index-first], entries...)
+    n.must(n.cfg.Storage.Append(entries))
+    n.updateMembersLocked()
+}
+
+// updateMembersLocked takes the member list from the newest config
+// entry: a change takes effect as soon as it is in the log.
+func (n *Node) updateMembersLocked() {
+    n.members, n.configIndex = n.membersAtLocked(n.lastIndex())
+    if n.role != Leader {
+        return
+    }
+    for _, p := range n.members {
+        if _, ok := n.next[p]; !ok && p != n.cfg.ID {
+            n.next[p] = n.lastIndex() + 1
+            n.match[p] = 0
+        }
+    }
+}
+
+// membersAtLocked returns the member list in effect at index and the
+// index of the entry that set it.
+func (n *Node) membersAtLocked(index uint64) ([]string, uint64) {
+    first := n.log[0].Index
+    for i := index; i > first; i-- {
+        if e := n.log[i-first]; e.Type == EntryConfig {
+            return decodeMembers(e.Data), i
+        }
+    }
+    return n.snap.Members, first
+}
+
+func decodeMembers(data []byte) []string {
+    if len(data) == 0 {
+        return nil
+    }
+    return strings.Split(string(data), "\n")
+}
+
+func (n *Node) isMember(id string) bool {
+    return slices.Contains(n.members, id)
+}
+
+func (n *Node) quorum() int {
+    return len(n.members)/2 + 1
+}
+
+func (n *Node) persistStateLocked() {
+    n.must(n.cfg.Storage.SaveState(n.term, n.vote))
+}
+
+func (n *Node) resetDeadlineLocked() {
+    t := n.cfg.ElectionTimeout
+    n.deadline = time.Now().Add(t + rand.N(t))
+}
+
+// stepDownLocked becomes a follower, adopting term if it is newer.
+func (n *Node) stepDownLocked(term uint64) {
+    if term > n.term {
+        n.term, n.vote, n.leader = term, "", ""
+        n.persistStateLocked()
+    }
+    if n.role != Follower {
+        n.role = Follower
+        n.resetDeadlineLocked()
+    }
+}
+
+// tickLoop starts elections and sends heartbeats.
+func (n *Node) tickLoop() {
+    defer n.wg.Done()
+    t := time.NewTicker(n.cfg.HeartbeatInterval / 2)
+    defer t.Stop()
+    for {
+        select {
+        case <-n.done:
+            return
+        case now := <-t.C:
+            n.mu.Lock()
+            if n.role == Leader {
+                if !now.Before(n.beatDue) {
+                    n.broadcastLocked()
+                }
+            } else if !now.Before(n.deadline) && n.isMember(n.cfg.ID) {
+                n.campaignLocked()
+            }
+            n.mu.Unlock()
+        }
+    }
+}
+
+// broadcastLocked sends every peer what it is missing, or a heartbeat.
+func (n *Node) broadcastLocked() {
+    n.beatDue = time.Now().Add(n.cfg.HeartbeatInterval)
+    for _, p := range n.members {
+        if p != n.cfg.ID {
+            n.replicateLocked(p)
+        }
+    }
+}
+
+func (n *Node) campaignLocked() {
+    n.role = Candidate
+    n.term++
+    n.vote = n.cfg.ID
+    n.leader = ""
+    n.persistStateLocked()
+    n.resetDeadlineLocked()
+    n.cfg.Logger.Printf("raftkv: %s: campaigning in term %d", n.cfg.ID, n.term)
+
+    term, votes := n.term, 1
+    if votes >= n.quorum() {
+        n.becomeLeaderLocked()
+        return
+    }
+    req := &VoteRequest{Term: term, Candidate: n.cfg.ID, LastLogIndex: n.lastIndex(), LastLogTerm: n.lastTerm()}
+    for _, p := range n.members {
+        if p == n.cfg.ID {
+            continue
+        }
+        n.wg.Add(1)
+        go func(p string) {
+            defer n.wg.Done()
+            resp, err := n.cfg.Transport.RequestVote(p, req)
+            if err != nil {
+                return
+            }
+            n.mu.Lock()
+            defer n.mu.Unlock()
+            if resp.Term > n.term {
+                n.stepDownLocked(resp.Term)
+                return
+            }
+            if n.stopped || n.role != Candidate || n.term != term || !resp.Granted || !n.isMember(p) {
+                return
+            }
+            if votes++; votes >= n.quorum() {
+                n.becomeLeaderLocked()
+            }
+        }(p)
+    }
+}
+
+func (n *Node) becomeLeaderLocked() {
+    n.cfg.Logger.Printf("raftkv: %s: leader for term %d", n.cfg.ID, n.term)
+    n.role = Leader
+    n.leader = n.cfg.ID
+    clear(n.next)
+    clear(n.match)
+    for _, p := range n.members {
+        if p != n.cfg.ID {
+            n.next[p] = n.lastIndex() + 1
+        }
+    }
+    // Committing an entry of its own term commits everything before it.
+    index, _ := n.proposeLocked(EntryNoop, nil)
+    delete(n.waiters, index)
+    n.broadcastLocked()
+}
+
+// advanceCommitLocked commits the newest entry of the current term that
+// a majority of members holds.
+func (n *Node) advanceCommitLocked() {
+    for i := n.lastIndex(); i > n.commitIndex; i-- {
+        if t, _ := n.termAt(i); t != n.term {
+            break
+        }
+        count := 0
+        for _, m := range n.members {
+            if m == n.cfg.ID || n.match[m] >= i {
+                count++
+            }
+        }
+        if count >= n.quorum() {
+            n.commitIndex = i
+            n.applyCond.Broadcast()
+            break
+        }
+    }
+    if n.role == Leader && !n.isMember(n.cfg.ID) && n.configIndex <= n.commitIndex {
+        n.cfg.Logger.Printf("raftkv: %s: removed from the cluster, stepping down", n.cfg.ID)
+        n.role = Follower
+        n.leader = ""
+    }
+}
+
+// replicateLocked starts sending to peer unless that is already running.
+func (n *Node) replicateLocked(peer string) {
+    if n.inflight[peer] || n.stopped {
+        return
+    }
+    n.inflight[peer] = true
+    n.wg.Add(1)
+    go n.replicateTo(peer, n.term)
+}
+
+// replicateTo sends peer entries, or a snapshot, until it has caught up
+// with the leader's log. The first round doubles as a heartbeat.
+func (n *Node) replicateTo(peer string, term uint64) {
+    defer n.wg.Done()
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    defer func() { n.inflight[peer] = false }()
+    for !n.stopped && n.role == Leader && n.term == term && n.isMember(peer) {
+        next := n.next[peer]
+        var ok bool
+        if next <= n.log[0].Index {
+            ok = n.sendSnapshotLocked(peer, term)
+        } else {
+            ok = n.sendEntriesLocked(peer, term, next)
+        }
+        if !ok || n.next[peer] > n.lastIndex() {
+            return
+        }
+    }
+}
+
+// sendEntriesLocked sends one AppendEntries and handles the reply. It
+// reports whether the node is still leader and the peer answered.
+func (n *Node) sendEntriesLocked(peer string, term, next uint64) bool {
+    first := n.log[0].Index
+    end := min(n.lastIndex(), next-1+uint64(n.cfg.MaxAppendEntries))
+    prevTerm, _ := n.termAt(next - 1)
+    req := &AppendRequest{
+        Term:         term,
+        Leader:       n.cfg.ID,
+        PrevLogIndex: next - 1,
+        PrevLogTerm:  prevTerm,
+        Entries:      slices.Clone(n.log[next-first : end-first+1]),
+        LeaderCommit: n.commitIndex,
+    }
+    n.mu.Unlock()
+    resp, err := n.cfg.Transport.AppendEntries(peer, req)
+    n.mu.Lock()
+    if !n.handleReplyLocked(resp, err, term) {
+        return false
+    }
+    if resp.Success {
+        n.match[peer] = max(n.match[peer], resp.MatchIndex)
+        n.next[peer] = n.match[peer] + 1
+        n.advanceCommitLocked()
+    } else {
+        n.next[peer] = max(resp.ConflictIndex, n.match[peer]+1, 1)
+    }
+    return true
+}
+
+func (n *Node) sendSnapshotLocked(peer string, term uint64) bool {
+    req := &SnapshotRequest{Term: term, Leader: n.cfg.ID, Snapshot: n.snap}
+    n.mu.Unlock()
+    resp, err := n.cfg.Transport.InstallSnapshot(peer, req)
+    n.mu.Lock()
+    if !n.handleReplyLocked(resp, err, term) {
+        return false
+    }
+    n.match[peer] = max(n.match[peer], req.Snapshot.Index)
+    n.next[peer] = n.match[peer] + 1
+    n.advanceCommitLocked()
+    return true
+}
+
+// handleReplyLocked checks a reply's term and reports whether the node
+// is still leader of term and can use it.
+func (n *Node) handleReplyLocked(resp interface{ term() uint64 }, err error, term uint64) bool {
+    if err != nil {
+        return false
+    }
+    if t := resp.term(); t > n.term {
+        n.stepDownLocked(t)
+        return false
+    }
+    return !n.stopped && n.role == Leader && n.term == term
+}
+
+func (r *AppendResponse) term() uint64   { return r.Term }
+func (r *SnapshotResponse) term() uint64 { return r.Term }
+
+// HandleRequestVote handles a candidate's request for this node's vote.
+func (n *Node) HandleRequestVote(req *VoteRequest) (*VoteResponse, error) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    if n.stopped {
+        return nil, ErrStopped
+    }
+    if req.Term > n.term {
+        // Ignore candidates while a leader is known to be alive, so a
+        // removed or partitioned node cannot depose it.
+        if n.role == Leader || (n.leader != "" && time.Since(n.lastContact) < n.cfg.ElectionTimeout) {
+            return &VoteResponse{Term: n.term}, nil
+        }
+        n.stepDownLocked(req.Term)
+    }
+    resp := &VoteResponse{Term: n.term}
+    if req.Term < n.term || (n.vote != "" && n.vote != req.Candidate) {
+        return resp, nil
+    }
+    // Only vote for a candidate whose log is at least as up to date.
+    if req.LastLogTerm < n.lastTerm() || (req.LastLogTerm == n.lastTerm() && req.LastLogIndex < n.lastIndex()) {
+        return resp, nil
+    }
+    if n.vote == "" {
+        n.vote = req.Candidate
+        n.persistStateLocked()
+    }
+    n.resetDeadlineLocked()
+    resp.Granted = true
+    return resp, nil
+}
+
+// acceptLeaderLocked records a message from the leader of term, which is
+// at least the node's own.
+func (n *Node) acceptLeaderLocked(term uint64, leader string) {
+    n.stepDownLocked(term)
+    n.role = Follower
+    n.leader = leader
+    n.lastContact = time.Now()
+    n.resetDeadlineLocked()
+}
+
+// HandleAppendEntries handles entries or a heartbeat from the leader.
+func (n *Node) HandleAppendEntries(req *AppendRequest) (*AppendResponse, error) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    if n.stopped {
+        return nil, ErrStopped
+    }
+    if req.Term < n.term {
+        return &AppendResponse{Term: n.term}, nil
+    }
+    n.acceptLeaderLocked(req.Term, req.Leader)
+    resp := &AppendResponse{Term: n.term}
+
+    prev, entries := req.PrevLogIndex, req.Entries
+    if first := n.log[0].Index; prev < first {
+        // The snapshot covers the start: it is committed, so it matches.
+        for len(entries) > 0 && entries[0].Index <= first {
+            entries = entries[1:]
+        }
+        prev = first
+    } else if prev > n.lastIndex() {
+        resp.ConflictIndex = n.lastIndex() + 1
+        return resp, nil
+    } else if t, _ := n.termAt(prev); t != req.PrevLogTerm {
+        // Skip back over the whole conflicting term.
+        i := prev
+        for i > first+1 {
+            if u, _ := n.termAt(i - 1); u != t {
+                break
+            }
+            i--
+        }
+        resp.ConflictIndex = i
+        return resp, nil
+    }
+    for i, e := range entries {
+        if t, ok := n.termAt(e.Index); ok && t == e.Term {
+            continue
+        }
+        n.storeEntriesLocked(entries[i:])
+        break
+    }
+    last := prev + uint64(len(entries))
+    if c := min(req.LeaderCommit, last); c > n.commitIndex {
+        n.commitIndex = c
+        n.applyCond.Broadcast()
+    }
+    resp.Success = true
+    resp.MatchIndex = last
+    return resp, nil
+}
+
+// HandleInstallSnapshot handles a snapshot from the leader.
+func (n *Node) HandleInstallSnapshot(req *SnapshotRequest) (*SnapshotResponse, error) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    if n.stopped {
+        return nil, ErrStopped
+    }
+    if req.Term < n.term {
+        return &SnapshotResponse{Term: n.term}, nil
+    }
+    n.acceptLeaderLocked(req.Term, req.Leader)
+    s := req.Snapshot
+    if s.Index <= n.commitIndex {
+        return &SnapshotResponse{Term: n.term}, nil
+    }
+    if t, ok := n.termAt(s.Index); ok && t == s.Term {
+        n.log = append([]Entry{{Index: s.Index, Term: s.Term}}, n.log[s.Index-n.log[0].Index+1:]...)
+    } else {
+        n.log = []Entry{{Index: s.Index, Term: s.Term}}
+    }
+    n.snap = s
+    n.must(n.cfg.Storage.SaveSnapshot(s))
+    n.pendingSnap = &s
+    n.commitIndex = s.Index
+    n.updateMembersLocked()
+    n.applyCond.Broadcast()
+    return &SnapshotResponse{Term: n.term}, nil
+}
+
+// applyLoop applies committed entries and installed snapshots to the
+// state machine, and takes snapshots as the log grows.
+func (n *Node) applyLoop() {
+    defer n.wg.Done()
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    for {
+        for !n.stopped && n.pendingSnap == nil && n.lastApplied >= n.commitIndex {
+            n.applyCond.Wait()
+        }
+        if n.stopped {
+            return
+        }
+        if s := n.pendingSnap; s != nil {
+            n.pendingSnap = nil
+            n.mu.Unlock()
+            err := n.sm.Restore(s.Data)
+            n.mu.Lock()
+            if err != nil {
+                panic(fmt.Sprintf("raftkv: %s: restore snapshot: %v", n.cfg.ID, err))
+            }
+            n.lastApplied = max(n.lastApplied, s.Index)
+            n.releaseReadsLocked()
+            // Whether those proposals are in the snapshot is unknown.
+            n.failWaitersLocked(s.Index, ErrTimeout)
+            continue
+        }
+        first := n.log[0].Index
+        entries := slices.Clone(n.log[n.lastApplied+1-first : n.commitIndex+1-first])
+        n.mu.Unlock()
+        results := make([]any, len(entries))
+        for i, e := range entries {
+            if e.Type == EntryCommand {
+                results[i] = n.sm.Apply(e.Data)
+            }
+        }
+        n.mu.Lock()
+        n.lastApplied = max(n.lastApplied, entries[len(entries)-1].Index)
+        n.releaseReadsLocked()
+        for i, e := range entries {
+            w, ok := n.waiters[e.Index]
+            if !ok {
+                continue
+            }
+            delete(n.waiters, e.Index)
+            if w.term == e.Term {
+                w.ch <- result{value: results[i]}
+            } else {
+                w.ch <- result{err: ErrLeadershipLost}
+            }
+        }
+        if n.lastApplied-n.log[0].Index >= n.cfg.SnapshotThreshold {
+            n.snapshotLocked()
+        }
+    }
+}
+
+// snapshotLocked snapshots the state machine at lastApplied and drops
+// the log entries it covers. It is only called from applyLoop, so the
+// state machine does not move while the lock is released.
+func (n *Node) snapshotLocked() {
+    index := n.lastApplied
+    n.mu.Unlock()
+    data, err := n.sm.Snapshot()
+    n.mu.Lock()
+    if err != nil {
+        n.cfg.Logger.Printf("raftkv: %s: snapshot: %v", n.cfg.ID, err)
+        return
+    }
+    first := n.log[0].Index
+    if index <= first || index > n.lastIndex() {
+        return // a snapshot from the leader got there first
+    }
+    members, _ := n.membersAtLocked(index)
+    s := Snapshot{Index: index, Term: n.log[index-first].Term, Members: slices.Clone(members), Data: data}
+    n.log = append([]Entry{{Index: s.Index, Term: s.Term}}, n.log[index-first+1:]...)
+    n.snap = s
+    n.must(n.cfg.Storage.SaveSnapshot(s))
+}
@@ -0,0 +1,492 @@
+package raftkv
+
+import (
+    "errors"
+    "fmt"
+    "slices"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/thilakshekharshriyan/m/kv"
+)
+
+// cluster runs Stores over an in-process Network.
+type cluster struct {
+    t       *testing.T
+    net     *Network
+    mu      sync.Mutex
+    stores  map[string]*Store
+    storage map[string]*MemStorage
+    tweak   func(*Config)
+}
+
+// newCluster starts n founding nodes named a, b, c, ...
+func newCluster(t *testing.T, n int, tweak func(*Config)) *cluster {
+    c := &cluster{
+        t:       t,
+        net:     NewNetwork(),
+        stores:  make(map[string]*Store),
+        storage: make(map[string]*MemStorage),
+        tweak:   tweak,
+    }
+    var ids []string
+    for i := 0; i < n; i++ {
+        ids = append(ids, string(rune('a'+i)))
+    }
+    for _, id := range ids {
+        c.start(id, ids)
+    }
+    t.Cleanup(func() {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+        for _, s := range c.stores {
+            s.Close()
+        }
+    })
+    return c
+}
+
+// start starts id over a fresh store and its saved storage, if any.
+func (c *cluster) start(id string, peers []string) *Store {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    st := c.storage[id]
+    if st == nil {
+        st = NewMemStorage()
+        c.storage[id] = st
+    }
+    cfg := Config{
+        ID:                id,
+        Peers:             peers,
+        Transport:         c.net.Transport(id),
+        Storage:           st,
+        ElectionTimeout:   50 * time.Millisecond,
+        HeartbeatInterval: 10 * time.Millisecond,
+        ApplyTimeout:      2 * time.Second,
+    }
+    if c.tweak != nil {
+        c.tweak(&cfg)
+    }
+    s, err := NewStore(kv.NewBTreeStore(), cfg)
+    if err != nil {
+        c.t.Fatal(err)
+    }
+    c.stores[id] = s
+    c.net.Add(id, s.node)
+    return s
+}
+
+// stop stops id, keeping its storage for a restart.
+func (c *cluster) stop(id string) {
+    c.mu.Lock()
+    s := c.stores[id]
+    delete(c.stores, id)
+    c.mu.Unlock()
+    c.net.Remove(id)
+    s.Close()
+}
+
+func (c *cluster) store(id string) *Store {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.stores[id]
+}
+
+func (c *cluster) running() []string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    var ids []string
+    for id := range c.stores {
+        ids = append(ids, id)
+    }
+    slices.Sort(ids)
+    return ids
+}
+
+// leader waits for one of ids (default: all running nodes) to lead a
+// term newer than any other leader among them.
+func (c *cluster) leader(ids ...string) *Store {
+    c.t.Helper()
+    if len(ids) == 0 {
+        ids = c.running()
+    }
+    var found *Store
+    waitFor(c.t, "a leader", func() bool {
+        found = nil
+        var best uint64
+        for _, id := range ids {
+            st := c.store(id).node.Status()
+            if st.Role != Leader {
+                continue
+            }
+            if st.Term == best {
+                c.t.Fatalf("two leaders in term %d", best)
+            }
+            if st.Term > best {
+                best, found = st.Term, c.store(id)
+            }
+        }
+        return found != nil
+    })
+    return found
+}
+
+// converged waits until every node in ids has applied all of the
+// leader's log and holds the same keys and values.
+func (c *cluster) converged(ids ...string) {
+    c.t.Helper()
+    if len(ids) == 0 {
+        ids = c.running()
+    }
+    waitFor(c.t, "nodes to converge", func() bool {
+        var want []string
+        var last uint64
+        for i, id := range ids {
+            s := c.store(id)
+            st := s.node.Status()
+            if i == 0 {
+                last = st.LastIndex
+            }
+            if st.AppliedIndex != last || st.LastIndex != last {
+                return false
+            }
+            got := dumpStore(c.t, s.store)
+            if i == 0 {
+                want = got
+            } else if !slices.Equal(got, want) {
+                return false
+            }
+        }
+        return true
+    })
+}
+
+// dumpStore lists a store's contents as key=value.
+func dumpStore(t *testing.T, s kv.KVStore) []string {
+    it, err := kv.NewIterator(s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer it.Close()
+    var out []string
+    for it.Next() {
+        out = append(out, it.Key()+"="+it.Value())
+    }
+    return out
+}
+
+// waitFor polls cond until it holds or ten seconds pass.
+func waitFor(t *testing.T, what string, cond func() bool) {
+    t.Helper()
+    deadline := time.Now().Add(10 * time.Second)
+    for !cond() {
+        if time.Now().After(deadline) {
+            t.Fatalf("timed out waiting for %s", what)
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+// retry runs fn on the current leader until it succeeds, for writes
+// that are safe to repeat.
+func (c *cluster) retry(fn func(*Store) error) {
+    c.t.Helper()
+    waitFor(c.t, "write to succeed", func() bool {
+        return fn(c.leader()) == nil
+    })
+}
+
+func TestElection(t *testing.T) {
+    c := newCluster(t, 3, nil)
+    l := c.leader()
+    for _, id := range c.running() {
+        waitFor(t, "followers to learn the leader", func() bool {
+            return c.store(id).node.Leader() == l.node.ID()
+        })
+    }
+
+    c.stop(l.node.ID())
+    l2 := c.leader()
+    if l2.node.ID() == l.node.ID() || l2.node.Status().Term <= l.node.Status().Term {
+        t.Fatalf("no new leader after stopping %s", l.node.ID())
+    }
+}
+
+func TestSingleNode(t *testing.T) {
+    c := newCluster(t, 1, nil)
+    s := c.leader()
+    if err := s.Set("k", "v"); err != nil {
+        t.Fatal(err)
+    }
+    if v, err := s.Get("k"); err != nil || v != "v" {
+        t.Fatalf("Get = %q, %v", v, err)
+    }
+}
+
+func TestReplication(t *testing.T) {
+    c := newCluster(t, 5, nil)
+    l := c.leader()
+    for i := 0; i < 200; i++ {
+        if err := l.Set(fmt.Sprintf("k%03d", i), fmt.Sprint(i)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := l.Delete("k000"); err != nil {
+        t.Fatal(err)
+    }
+    if err := l.Delete("k000"); !errors.Is(err, kv.ErrNotFound) {
+        t.Fatalf("second Delete = %v", err)
+    }
+    c.converged()
+    if got := len(dumpStore(t, c.store("c").store)); got != 199 {
+        t.Fatalf("follower holds %d keys", got)
+    }
+}
+
+func TestFollowerRejects(t *testing.T) {
+    c := newCluster(t, 3, nil)
+    l := c.leader()
+    for _, id := range c.running() {
+        if id == l.node.ID() {
+            continue
+        }
+        f := c.store(id)
+        if err := f.Set("k", "v"); !errors.Is(err, ErrNotLeader) {
+            t.Fatalf("follower Set = %v", err)
+        }
+        if _, err := f.Get("k"); !errors.Is(err, ErrNotLeader) {
+            t.Fatalf("follower Get = %v", err)
+        }
+    }
+}
+
+func TestPartition(t *testing.T) {
+    c := newCluster(t, 5, func(cfg *Config) { cfg.ApplyTimeout = 300 * time.Millisecond })
+    old := c.leader()
+    if err := old.Set("before", "1"); err != nil {
+        t.Fatal(err)
+    }
+
+    // Cut the leader off with one follower: the other three elect a new
+    // leader, and the old one can no longer commit.
+    minority := []string{old.node.ID()}
+    var majority []string
+    for _, id := range c.running() {
+        switch {
+        case id == old.node.ID():
+        case len(minority) < 2:
+            minority = append(minority, id)
+        default:
+            majority = append(majority, id)
+        }
+    }
+    c.net.Partition(minority, majority)
+
+    if err := old.Set("lost", "x"); !errors.Is(err, ErrTimeout) && !errors.Is(err, ErrLeadershipLost) {
+        t.Fatalf("minority Set = %v", err)
+    }
+    l := c.leader(majority...)
+    if err := l.Set("after", "2"); err != nil {
+        t.Fatal(err)
+    }
+    if v, err := l.Get("before"); err != nil || v != "1" {
+        t.Fatalf("new leader Get(before) = %q, %v", v, err)
+    }
+
+    c.net.Heal()
+    waitFor(t, "old leader to step down", func() bool {
+        return old.node.Status().Role != Leader
+    })
+    c.converged()
+    for _, id := range c.running() {
+        if _, err := c.store(id).store.Get("lost"); !errors.Is(err, kv.ErrNotFound) {
+            t.Fatalf("%s applied a write that never committed: %v", id, err)
+        }
+    }
+}
+
+func TestReadIndex(t *testing.T) {
+    c := newCluster(t, 3, func(cfg *Config) { cfg.ApplyTimeout = 300 * time.Millisecond })
+    l := c.leader()
+    if err := l.Set("k", "v"); err != nil {
+        t.Fatal(err)
+    }
+    last := l.node.Status().LastIndex
+    for i := 0; i < 50; i++ {
+        if v, err := l.Get("k"); err != nil || v != "v" {
+            t.Fatalf("Get = %q, %v", v, err)
+        }
+    }
+    if got := l.node.Status().LastIndex; got != last {
+        t.Fatalf("reads grew the log from %d to %d", last, got)
+    }
+
+    // Cut the leader off: it cannot confirm that it still leads.
+    var rest []string
+    for _, id := range c.running() {
+        if id != l.node.ID() {
+            rest = append(rest, id)
+        }
+    }
+    c.net.Partition([]string{l.node.ID()}, rest)
+    if _, err := l.Get("k"); !errors.Is(err, ErrTimeout) && !errors.Is(err, ErrNotLeader) {
+        t.Fatalf("partitioned leader Get = %v", err)
+    }
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+    c := newCluster(t, 3, func(cfg *Config) { cfg.SnapshotThreshold = 16 })
+    l := c.leader()
+    var behind string
+    for _, id := range c.running() {
+        if id != l.node.ID() {
+            behind = id
+            break
+        }
+    }
+    var rest []string
+    for _, id := range c.running() {
+        if id != behind {
+            rest = append(rest, id)
+        }
+    }
+    c.net.Partition(rest)
+    for i := 0; i < 100; i++ {
+        if err := l.Set(fmt.Sprintf("k%03d", i), "v"); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if st := l.node.Status(); st.SnapshotIndex == 0 {
+        t.Fatalf("leader has not snapshotted: %+v", st)
+    }
+    c.net.Heal()
+    c.converged()
+    if st := c.store(behind).node.Status(); st.SnapshotIndex == 0 {
+        t.Fatalf("%s caught up without a snapshot: %+v", behind, st)
+    }
+}
+
+func TestRestart(t *testing.T) {
+    c := newCluster(t, 3, func(cfg *Config) { cfg.SnapshotThreshold = 32 })
+    l := c.leader()
+    for i := 0; i < 50; i++ {
+        if err := l.Set(fmt.Sprintf("k%03d", i), "v1"); err != nil {
+            t.Fatal(err)
+        }
+    }
+    c.converged()
+
+    // Restart every node: state comes back from storage alone.
+    ids := c.running()
+    for _, id := range ids {
+        c.stop(id)
+    }
+    for _, id := range ids {
+        c.start(id, ids)
+    }
+    l = c.leader()
+    if v, err := l.Get("k049"); err != nil || v != "v1" {
+        t.Fatalf("after restart Get = %q, %v", v, err)
+    }
+    c.converged()
+}
+
+func TestMembership(t *testing.T) {
+    c := newCluster(t, 3, nil)
+    l := c.leader()
+    if err := l.Set("k", "v"); err != nil {
+        t.Fatal(err)
+    }
+
+    // A new node starts with no peers and joins through the leader.
+    c.start("d", nil)
+    c.retry(func(s *Store) error { return s.node.AddMember("d") })
+    c.converged()
+    if m := c.store("d").node.Status().Members; len(m) != 4 {
+        t.Fatalf("d sees members %v", m)
+    }
+
+    // The leader removes itself and steps down.
+    l = c.leader()
+    gone := l.node.ID()
+    c.retry(func(s *Store) error { return s.node.RemoveMember(gone) })
+    waitFor(t, "removed leader to step down", func() bool {
+        return c.store(gone).node.Status().Role != Leader
+    })
+    c.stop(gone)
+    l = c.leader()
+    if err := l.Set("k2", "v2"); err != nil {
+        t.Fatal(err)
+    }
+    c.converged()
+    if m := l.node.Status().Members; len(m) != 3 || slices.Contains(m, gone) {
+        t.Fatalf("members after removal: %v", m)
+    }
+}
+
+func TestConfigPending(t *testing.T) {
+    c := newCluster(t, 3, nil)
+    l := c.leader()
+    // With the followers unreachable the first change cannot commit.
+    c.net.Partition([]string{l.node.ID()})
+    go l.node.AddMember("x")
+    waitFor(t, "change to be proposed", func() bool {
+        return len(l.node.Status().Members) == 4
+    })
+    if err := l.node.AddMember("y"); !errors.Is(err, ErrConfigPending) {
+        t.Fatalf("second change = %v", err)
+    }
+}
+
+func TestLossyNetwork(t *testing.T) {
+    c := newCluster(t, 5, func(cfg *Config) { cfg.ApplyTimeout = 500 * time.Millisecond })
+    c.net.SetLoss(0.1)
+    c.net.SetDelay(2 * time.Millisecond)
+    for i := 0; i < 30; i++ {
+        key := fmt.Sprintf("k%02d", i)
+        c.retry(func(s *Store) error { return s.Set(key, "v") })
+    }
+    c.net.SetLoss(0)
+    c.converged()
+    if got := len(dumpStore(t, c.store("a").store)); got != 30 {
+        t.Fatalf("a holds %d keys", got)
+    }
+}
+
+func TestCompareAndSwapCounter(t *testing.T) {
+    c := newCluster(t, 3, nil)
+    l := c.leader()
+    if err := l.Set("n", "0"); err != nil {
+        t.Fatal(err)
+    }
+    const workers, each = 4, 10
+    var wg sync.WaitGroup
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := 0; i < each; {
+                cur, err := l.Get("n")
+                if err != nil {
+                    t.Error(err)
+                    return
+                }
+                var n int
+                fmt.Sscan(cur, &n)
+                ok, err := l.CompareAndSwap("n", cur, fmt.Sprint(n+1))
+                if err != nil {
+                    t.Error(err)
+                    return
+                }
+                if ok {
+                    i++
+                }
+            }
+        }()
+    }
+    wg.Wait()
+    if v, err := l.Get("n"); err != nil || v != fmt.Sprint(workers*each) {
+        t.Fatalf("counter = %q, %v", v, err)
+    }
+}
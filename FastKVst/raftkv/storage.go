@@ -0,0 +1,110 @@
+package raftkv
+
+import "sync"
+
+// EntryType says what a log entry holds.
+type EntryType uint8
+
+const (
+    EntryCommand EntryType = iota // a state machine command
+    EntryNoop                     // appended by a new leader
+    EntryConfig                   // a new member list, one ID per line
+)
+
+// Entry is one entry in the replicated log.
+type Entry struct {
+    Index uint64
+    Term  uint64
+    Type  EntryType
+    Data  []byte
+}
+
+// Snapshot is the state machine's state as of Index, with the member list
+// in effect there.
+type Snapshot struct {
+    Index   uint64
+    Term    uint64
+    Members []string
+    Data    []byte
+}
+
+// State is what a node saves: its vote, latest snapshot and the log after
+// the snapshot.
+type State struct {
+    Term     uint64
+    Vote     string
+    Snapshot *Snapshot // nil if none has been taken
+    Entries  []Entry
+}
+
+// Storage keeps a node's State across restarts. Writes must be durable
+// when they return: Raft's safety depends on a node never forgetting a
+// vote or an acknowledged entry. A node panics if its Storage fails.
+type Storage interface {
+    // Load returns the saved state; a new Storage returns the zero State.
+    Load() (State, error)
+    SaveState(term uint64, vote string) error
+    // Append saves entries, first discarding any saved entry at or after
+    // entries[0].Index.
+    Append(entries []Entry) error
+    // SaveSnapshot saves snap and discards the entries it covers. Later
+    // entries are kept only if the entry at snap.Index has snap.Term.
+    SaveSnapshot(snap Snapshot) error
+}
+
+// MemStorage is a Storage in memory. It survives a Node being stopped
+// and restarted, not the process.
+type MemStorage struct {
+    mu sync.Mutex
+    st State
+}
+
+// NewMemStorage returns an empty MemStorage.
+func NewMemStorage() *MemStorage {
+    return &MemStorage{}
+}
+
+func (m *MemStorage) Load() (State, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    st := m.st
+    st.Entries = append([]Entry(nil), m.st.Entries...)
+    return st, nil
+}
+
+func (m *MemStorage) SaveState(term uint64, vote string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.st.Term, m.st.Vote = term, vote
+    return nil
+}
+
+func (m *MemStorage) Append(entries []Entry) error {
+    if len(entries) == 0 {
+        return nil
+    }
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    first := entries[0].Index
+    keep := len(m.st.Entries)
+    for keep > 0 && m.st.Entries[keep-1].Index >= first {
+        keep--
+    }
+    m.st.Entries = append(m.st.Entries[:keep:keep], entries...)
+    return nil
+}
+
+func (m *MemStorage) SaveSnapshot(snap Snapshot) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    var rest []Entry
+    for i, e := range m.st.Entries {
+        if e.Index == snap.Index && e.Term == snap.Term {
+            rest = append(rest, m.st.Entries[i+1:]...)
+            break
+        }
+    }
+    m.st.Snapshot = &snap
+    m.st.Entries = rest
+    return nil
+}
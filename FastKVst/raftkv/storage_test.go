@@ -0,0 +1,36 @@
+package raftkv
+
+import "testing"
+
+func indexes(entries []Entry) []uint64 {
+    var out []uint64
+    for _, e := range entries {
+        out = append(out, e.Index)
+    }
+    return out
+}
+
+func TestMemStorage(t *testing.T) {
+    m := NewMemStorage()
+    m.SaveState(3, "b")
+    m.Append([]Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 2}})
+    // Appending at 2 replaces 2 and 3.
+    m.Append([]Entry{{Index: 2, Term: 3}})
+    st, _ := m.Load()
+    if st.Term != 3 || st.Vote != "b" || len(st.Entries) != 2 || st.Entries[1].Term != 3 {
+        t.Fatalf("Load = %+v", st)
+    }
+
+    m.Append([]Entry{{Index: 3, Term: 3}, {Index: 4, Term: 3}})
+    m.SaveSnapshot(Snapshot{Index: 2, Term: 3})
+    st, _ = m.Load()
+    if got := indexes(st.Entries); len(got) != 2 || got[0] != 3 || st.Snapshot.Index != 2 {
+        t.Fatalf("after matching snapshot: entries %v, snapshot %+v", got, st.Snapshot)
+    }
+
+    // A snapshot that disagrees with the log replaces all of it.
+    m.SaveSnapshot(Snapshot{Index: 3, Term: 9})
+    if st, _ = m.Load(); len(st.Entries) != 0 || st.Snapshot.Index != 3 {
+        t.Fatalf("after conflicting snapshot: %+v", st)
+    }
+}
@@ -0,0 +1,595 @@
+package raftkv
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/thilakshekharshriyan/m/internal/wire"
+    "github.com/thilakshekharshriyan/m/kv"
+)
+
+// Command kinds in the log. Every command starts with its kind and a
+// varint stamp: the proposer's clock in Unix nanoseconds, which Apply
+// makes all of its expiry decisions against.
+const (
+    cmdSet byte = iota + 1
+    cmdSetTTL
+    cmdDelete
+    cmdBatch
+    cmdCompareAndSwap
+    cmdSetIfAbsent
+    cmdDeleteIfValue
+    cmdExpire
+)
+
+// errBadCommand is returned for a log entry this version cannot decode.
+var errBadCommand = fmt.Errorf("raftkv: malformed command: %w", kv.ErrCorrupted)
+
+// newCmd starts a command of kind, stamped with the current time.
+func newCmd(kind byte) []byte {
+    return binary.AppendVarint([]byte{kind}, time.Now().UnixNano())
+}
+
+// Store is a kv.KVStore replicated by a Node. Writes and reads must be
+// made on the leader; elsewhere they fail with ErrNotLeader. Reads see
+// every write that completed before they started.
+//
+// TTLs are kept by the state machine rather than the wrapped store. A key
+// expires on every node at the first command stamped at or after its
+// deadline, so all nodes agree on what conditional writes see. Reads
+// hide keys that have expired by the local clock.
+type Store struct {
+    node  *Node
+    store kv.KVStore
+    m     *machine
+}
+
+// NewStore starts a node that replicates store. The store's contents are
+// discarded and rebuilt from cfg.Storage's snapshot and log.
+func NewStore(store kv.KVStore, cfg Config) (*Store, error) {
+    if err := clearStore(store); err != nil {
+        return nil, err
+    }
+    m := newMachine(store)
+    node, err := NewNode(cfg, m)
+    if err != nil {
+        return nil, err
+    }
+    return &Store{node: node, store: store, m: m}, nil
+}
+
+// Node returns the store's Raft node, for membership changes and status.
+func (s *Store) Node() *Node {
+    return s.node
+}
+
+// Close stops the node. It does not close the wrapped store.
+func (s *Store) Close() error {
+    s.node.Stop()
+    return nil
+}
+
+// apply proposes cmd and returns the outcome of applying it.
+func (s *Store) apply(cmd []byte) (bool, error) {
+    v, err := s.node.Apply(cmd)
+    if err != nil {
+        return false, err
+    }
+    r := v.(reply)
+    return r.ok, r.err
+}
+
+// Set writes key→value.
+func (s *Store) Set(key, value string) error {
+    _, err := s.apply(wire.AppendStrings(newCmd(cmdSet), key, value))
+    return err
+}
+
+// SetWithTTL writes key→value, expiring ttl after the write is proposed.
+func (s *Store) SetWithTTL(key, value string, ttl time.Duration) error {
+    if ttl <= 0 {
+        return kv.ErrInvalidTTL
+    }
+    cmd := wire.AppendStrings(newCmd(cmdSetTTL), key, value)
+    _, err := s.apply(binary.AppendVarint(cmd, int64(ttl)))
+    return err
+}
+
+// Delete removes key, or returns kv.ErrNotFound.
+func (s *Store) Delete(key string) error {
+    _, err := s.apply(wire.AppendStrings(newCmd(cmdDelete), key))
+    return err
+}
+
+// Write applies b as one log entry. It is atomic on every node whose
+// store is a kv.Batcher.
+func (s *Store) Write(b *kv.WriteBatch) error {
+    cmd := binary.AppendUvarint(newCmd(cmdBatch), uint64(b.Len()))
+    invalid := false
+    b.Each(func(key, value string, ttl time.Duration, withTTL, delete bool) {
+        switch {
+        case withTTL && ttl <= 0:
+            invalid = true
+        case delete:
+            cmd = wire.AppendStrings(append(cmd, cmdDelete), key)
+        case withTTL:
+            cmd = wire.AppendStrings(append(cmd, cmdSetTTL), key, value)
+            cmd = binary.AppendVarint(cmd, int64(ttl))
+        default:
+            cmd = wire.AppendStrings(append(cmd, cmdSet), key, value)
+        }
+    })
+    if invalid {
+        return kv.ErrInvalidTTL
+    }
+    _, err := s.apply(cmd)
+    return err
+}
+
+// CompareAndSwap sets key to new if its current value is old.
+func (s *Store) CompareAndSwap(key, old, new string) (bool, error) {
+    return s.apply(wire.AppendStrings(newCmd(cmdCompareAndSwap), key, old, new))
+}
+
+// SetIfAbsent sets key to value if key does not exist.
+func (s *Store) SetIfAbsent(key, value string) (bool, error) {
+    return s.apply(wire.AppendStrings(newCmd(cmdSetIfAbsent), key, value))
+}
+
+// DeleteIfValue deletes key if its current value is value.
+func (s *Store) DeleteIfValue(key, value string) (bool, error) {
+    return s.apply(wire.AppendStrings(newCmd(cmdDeleteIfValue), key, value))
+}
+
+// Get returns the value of key.
+func (s *Store) Get(key string) (string, error) {
+    if err := s.node.Barrier(); err != nil {
+        return "", err
+    }
+    return s.m.get(key, time.Now().UnixNano())
+}
+
+// Range returns the keys in [start, end).
+func (s *Store) Range(start, end string) ([]string, error) {
+    if err := s.node.Barrier(); err != nil {
+        return nil, err
+    }
+    keys, err := s.store.Range(start, end)
+    if err != nil {
+        return nil, err
+    }
+    now := time.Now().UnixNano()
+    s.m.mu.RLock()
+    defer s.m.mu.RUnlock()
+    live := keys[:0]
+    for _, k := range keys {
+        if s.m.live(k, now) {
+            live = append(live, k)
+        }
+    }
+    return live, nil
+}
+
+// NewIterator iterates the store. It sees every write completed before
+// the call; later ones may or may not be visible.
+func (s *Store) NewIterator() kv.Iterator {
+    if err := s.node.Barrier(); err != nil {
+        return kv.NewErrorIterator(err)
+    }
+    it, err := kv.NewIterator(s.store)
+    if err != nil {
+        return kv.NewErrorIterator(err)
+    }
+    return &liveIterator{Iterator: it, m: s.m}
+}
+
+// TTL returns the time left before key expires.
+func (s *Store) TTL(key string) (time.Duration, error) {
+    if err := s.node.Barrier(); err != nil {
+        return 0, err
+    }
+    return s.m.ttl(key, time.Now().UnixNano())
+}
+
+// ExpiredKeys returns how many keys have expired on this node.
+func (s *Store) ExpiredKeys() uint64 {
+    return s.m.expired.Load()
+}
+
+// StartSweeper removes expired keys every interval by proposing an expiry
+// command whenever this node leads and a key is due. Without it, expired
+// keys are hidden from reads but stay in the store until next written.
+// Call the returned function to stop it.
+func (s *Store) StartSweeper(interval time.Duration) (stop func()) {
+    done, exited := make(chan struct{}), make(chan struct{})
+    go func() {
+        defer close(exited)
+        t := time.NewTicker(interval)
+        defer t.Stop()
+        for {
+            select {
+            case <-done:
+                return
+            case <-t.C:
+                if s.node.Leader() == s.node.ID() && s.m.due(time.Now().UnixNano()) {
+                    // Losing leadership meanwhile just fails the proposal.
+                    s.apply(newCmd(cmdExpire))
+                }
+            }
+        }
+    }()
+    var stopped atomic.Bool
+    return func() {
+        if !stopped.Swap(true) {
+            close(done)
+        }
+        <-exited
+    }
+}
+
+// Flush flushes this node's store.
+func (s *Store) Flush() error {
+    return s.store.Flush()
+}
+
+// reply is the result of applying a command.
+type reply struct {
+    ok  bool
+    err error
+}
+
+// machine is the StateMachine that applies commands to a store. It keeps
+// key deadlines itself, on the proposers' clocks, and writes the store
+// without TTLs so that the store never expires a key on its own.
+type machine struct {
+    store   kv.KVStore
+    mu      sync.RWMutex     // guards expires; held for writing while a command applies
+    expires map[string]int64 // key -> deadline in Unix nanoseconds
+    expired atomic.Uint64
+}
+
+func newMachine(store kv.KVStore) *machine {
+    return &machine{store: store, expires: make(map[string]int64)}
+}
+
+func (m *machine) Apply(cmd []byte) any {
+    if len(cmd) == 0 {
+        return reply{err: errBadCommand}
+    }
+    now, k := binary.Varint(cmd[1:])
+    if k <= 0 {
+        return reply{err: errBadCommand}
+    }
+    kind, buf := cmd[0], cmd[1+k:]
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    switch kind {
+    case cmdSet, cmdSetTTL, cmdDelete:
+        w, rest, ok := decodeWrite(kind, buf)
+        if !ok || len(rest) != 0 {
+            return reply{err: errBadCommand}
+        }
+        err := m.applyWrite(w, now)
+        return reply{ok: err == nil, err: err}
+    case cmdBatch:
+        n, k := binary.Uvarint(buf)
+        if k <= 0 || n > uint64(len(buf)) {
+            return reply{err: errBadCommand}
+        }
+        buf = buf[k:]
+        ws := make([]write, n)
+        for i := range ws {
+            if len(buf) == 0 {
+                return reply{err: errBadCommand}
+            }
+            var ok bool
+            if ws[i], buf, ok = decodeWrite(buf[0], buf[1:]); !ok {
+                return reply{err: errBadCommand}
+            }
+        }
+        err := m.applyBatch(ws, now)
+        return reply{ok: err == nil, err: err}
+    case cmdCompareAndSwap:
+        if a, ok := readStrings(buf, 3); ok {
+            return m.cond(a[0], now, func() (bool, error) { return kv.CompareAndSwap(m.store, a[0], a[1], a[2]) })
+        }
+    case cmdSetIfAbsent:
+        if a, ok := readStrings(buf, 2); ok {
+            return m.cond(a[0], now, func() (bool, error) { return kv.SetIfAbsent(m.store, a[0], a[1]) })
+        }
+    case cmdDeleteIfValue:
+        if a, ok := readStrings(buf, 2); ok {
+            return m.cond(a[0], now, func() (bool, error) { return kv.DeleteIfValue(m.store, a[0], a[1]) })
+        }
+    case cmdExpire:
+        if len(buf) == 0 {
+            err := m.expireAll(now)
+            return reply{ok: err == nil, err: err}
+        }
+    }
+    return reply{err: errBadCommand}
+}
+
+// write is one decoded set, set-with-TTL or delete.
+type write struct {
+    kind       byte
+    key, value string
+    ttl        time.Duration // for cmdSetTTL
+}
+
+func decodeWrite(kind byte, buf []byte) (write, []byte, bool) {
+    w := write{kind: kind}
+    var ok bool
+    if w.key, buf, ok = wire.ReadString(buf); !ok {
+        return w, buf, false
+    }
+    switch kind {
+    case cmdDelete:
+        return w, buf, true
+    case cmdSet, cmdSetTTL:
+        if w.value, buf, ok = wire.ReadString(buf); !ok {
+            return w, buf, false
+        }
+        if kind == cmdSet {
+            return w, buf, true
+        }
+        ttl, k := binary.Varint(buf)
+        if k <= 0 || ttl <= 0 {
+            return w, buf, false
+        }
+        w.ttl = time.Duration(ttl)
+        return w, buf[k:], true
+    }
+    return w, buf, false
+}
+
+// applyWrite applies a single write stamped now.
+func (m *machine) applyWrite(w write, now int64) error {
+    if err := m.expire(w.key, now); err != nil {
+        return err
+    }
+    var err error
+    if w.kind == cmdDelete {
+        err = m.store.Delete(w.key)
+    } else {
+        err = m.store.Set(w.key, w.value)
+    }
+    if err != nil {
+        return err
+    }
+    m.track(w, now)
+    return nil
+}
+
+// applyBatch applies ws as one batch stamped now.
+func (m *machine) applyBatch(ws []write, now int64) error {
+    var b kv.WriteBatch
+    for _, w := range ws {
+        if err := m.expire(w.key, now); err != nil {
+            return err
+        }
+        if w.kind == cmdDelete {
+            b.Delete(w.key)
+        } else {
+            b.Put(w.key, w.value)
+        }
+    }
+    if err := kv.Write(m.store, &b); err != nil {
+        return err
+    }
+    for _, w := range ws {
+        m.track(w, now)
+    }
+    return nil
+}
+
+// cond runs a conditional write on key stamped now. A successful one
+// leaves key without a TTL, as in the kv stores.
+func (m *machine) cond(key string, now int64, op func() (bool, error)) reply {
+    if err := m.expire(key, now); err != nil {
+        return reply{err: err}
+    }
+    ok, err := op()
+    if ok {
+        delete(m.expires, key)
+    }
+    return reply{ok: ok, err: err}
+}
+
+// track records the deadline a write applied at now leaves on its key.
+func (m *machine) track(w write, now int64) {
+    if w.kind == cmdSetTTL {
+        m.expires[w.key] = now + int64(w.ttl)
+    } else {
+        delete(m.expires, w.key)
+    }
+}
+
+// expire deletes key if its deadline is at or before now. Callers hold
+// m.mu for writing.
+func (m *machine) expire(key string, now int64) error {
+    if m.live(key, now) {
+        return nil
+    }
+    if err := m.store.Delete(key); err != nil && !errors.Is(err, kv.ErrNotFound) {
+        return err
+    }
+    delete(m.expires, key)
+    m.expired.Add(1)
+    return nil
+}
+
+// expireAll deletes every key whose deadline is at or before now.
+func (m *machine) expireAll(now int64) error {
+    for key := range m.expires {
+        if err := m.expire(key, now); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// live reports whether key has not expired at now. Callers hold m.mu.
+func (m *machine) live(key string, now int64) bool {
+    d, ok := m.expires[key]
+    return !ok || d > now
+}
+
+// due reports whether any key has expired at now.
+func (m *machine) due(now int64) bool {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    for _, d := range m.expires {
+        if d <= now {
+            return true
+        }
+    }
+    return false
+}
+
+// get reads key, hiding it if it has expired at now.
+func (m *machine) get(key string, now int64) (string, error) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    if !m.live(key, now) {
+        return "", kv.ErrNotFound
+    }
+    return m.store.Get(key)
+}
+
+// ttl returns the time left on key at now.
+func (m *machine) ttl(key string, now int64) (time.Duration, error) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    if !m.live(key, now) {
+        return 0, kv.ErrNotFound
+    }
+    if _, err := m.store.Get(key); err != nil {
+        return 0, err
+    }
+    d, ok := m.expires[key]
+    if !ok {
+        return kv.NoExpiry, nil
+    }
+    return time.Duration(d - now), nil
+}
+
+// Snapshot encodes the deadlines, as a uvarint count of key and varint
+// deadline pairs, followed by a kv.Dump of the store.
+func (m *machine) Snapshot() ([]byte, error) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    hdr := binary.AppendUvarint(nil, uint64(len(m.expires)))
+    for k, d := range m.expires {
+        hdr = binary.AppendVarint(wire.AppendStrings(hdr, k), d)
+    }
+    buf := bytes.NewBuffer(hdr)
+    if err := kv.Dump(m.store, buf); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+func (m *machine) Restore(data []byte) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    n, k := binary.Uvarint(data)
+    if k <= 0 || n > uint64(len(data)) {
+        return errBadCommand
+    }
+    data = data[k:]
+    expires := make(map[string]int64, n)
+    for i := uint64(0); i < n; i++ {
+        key, rest, ok := wire.ReadString(data)
+        if !ok {
+            return errBadCommand
+        }
+        d, k := binary.Varint(rest)
+        if k <= 0 {
+            return errBadCommand
+        }
+        expires[key], data = d, rest[k:]
+    }
+    if err := clearStore(m.store); err != nil {
+        return err
+    }
+    m.expires = expires
+    return kv.Load(m.store, bytes.NewReader(data))
+}
+
+// clearStore deletes every key in s.
+func clearStore(s kv.KVStore) error {
+    it, err := kv.NewIterator(s)
+    if err != nil {
+        return fmt.Errorf("raftkv: clear store: %w", err)
+    }
+    var keys []string
+    for it.Next() {
+        keys = append(keys, it.Key())
+    }
+    err = it.Err()
+    it.Close()
+    if err != nil {
+        return err
+    }
+    for _, k := range keys {
+        if err := s.Delete(k); err != nil && !errors.Is(err, kv.ErrNotFound) {
+            return err
+        }
+    }
+    return nil
+}
+
+// readStrings decodes exactly n strings that fill buf.
+func readStrings(buf []byte, n int) ([]string, bool) {
+    out := make([]string, n)
+    for i := range out {
+        var ok bool
+        if out[i], buf, ok = wire.ReadString(buf); !ok {
+            return nil, false
+        }
+    }
+    return out, len(buf) == 0
+}
+
+// liveIterator hides keys that have expired by the local clock.
+type liveIterator struct {
+    kv.Iterator
+    m *machine
+}
+
+func (it *liveIterator) live() bool {
+    it.m.mu.RLock()
+    defer it.m.mu.RUnlock()
+    return it.m.live(it.Key(), time.Now().UnixNano())
+}
+
+func (it *liveIterator) Seek(key string) bool {
+    if !it.Iterator.Seek(key) {
+        return false
+    }
+    return it.live() || it.Next()
+}
+
+func (it *liveIterator) Next() bool {
+    for it.Iterator.Next() {
+        if it.live() {
+            return true
+        }
+    }
+    return false
+}
+
+func (it *liveIterator) Prev() bool {
+    for it.Iterator.Prev() {
+        if it.live() {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,193 @@
+package raftkv
+
+import (
+    "encoding/binary"
+    "errors"
+    "slices"
+    "testing"
+    "time"
+
+    "github.com/thilakshekharshriyan/m/internal/wire"
+    "github.com/thilakshekharshriyan/m/kv"
+)
+
+// singleStore returns the leader of a one-node cluster.
+func singleStore(t *testing.T) *Store {
+    return newCluster(t, 1, nil).leader()
+}
+
+func TestStoreOps(t *testing.T) {
+    s := singleStore(t)
+    if err := s.Set("a", "1"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Delete("missing"); !errors.Is(err, kv.ErrNotFound) {
+        t.Fatalf("Delete(missing) = %v", err)
+    }
+
+    var b kv.WriteBatch
+    b.Put("b", "2")
+    b.Put("c", "3")
+    b.Delete("a")
+    if err := s.Write(&b); err != nil {
+        t.Fatal(err)
+    }
+    keys, err := s.Range("", "z")
+    if err != nil || !slices.Equal(keys, []string{"b", "c"}) {
+        t.Fatalf("Range = %v, %v", keys, err)
+    }
+    for _, ttl := range []time.Duration{-time.Second, 0} {
+        b.Clear()
+        b.PutWithTTL("d", "4", ttl)
+        if err := s.Write(&b); !errors.Is(err, kv.ErrInvalidTTL) {
+            t.Fatalf("Write with TTL %v = %v", ttl, err)
+        }
+    }
+
+    if ok, err := s.SetIfAbsent("b", "x"); ok || err != nil {
+        t.Fatalf("SetIfAbsent(b) = %v, %v", ok, err)
+    }
+    if ok, err := s.CompareAndSwap("b", "2", "22"); !ok || err != nil {
+        t.Fatalf("CompareAndSwap(b) = %v, %v", ok, err)
+    }
+    if ok, err := s.DeleteIfValue("c", "3"); !ok || err != nil {
+        t.Fatalf("DeleteIfValue(c) = %v, %v", ok, err)
+    }
+    it := s.NewIterator()
+    var got []string
+    for it.Next() {
+        got = append(got, it.Key()+"="+it.Value())
+    }
+    if it.Close(); !slices.Equal(got, []string{"b=22"}) {
+        t.Fatalf("iterated %v", got)
+    }
+}
+
+func TestStoreTTL(t *testing.T) {
+    s := singleStore(t)
+    if err := s.SetWithTTL("k", "v", 0); !errors.Is(err, kv.ErrInvalidTTL) {
+        t.Fatalf("SetWithTTL(0) = %v", err)
+    }
+    if err := kv.SetWithTTL(s, "short", "v", 30*time.Millisecond); err != nil {
+        t.Fatal(err)
+    }
+    if err := kv.SetWithTTL(s, "long", "v", time.Hour); err != nil {
+        t.Fatal(err)
+    }
+    if ttl, err := s.TTL("long"); err != nil || ttl <= 59*time.Minute {
+        t.Fatalf("TTL(long) = %v, %v", ttl, err)
+    }
+    waitFor(t, "short to expire", func() bool {
+        _, err := s.Get("short")
+        return errors.Is(err, kv.ErrNotFound)
+    })
+    if n := s.ExpiredKeys(); n != 0 {
+        t.Fatalf("ExpiredKeys = %d before the key was swept", n)
+    }
+    stop := s.StartSweeper(5 * time.Millisecond)
+    defer stop()
+    waitFor(t, "short to be swept", func() bool {
+        _, err := s.store.Get("short")
+        return errors.Is(err, kv.ErrNotFound) && s.ExpiredKeys() == 1
+    })
+}
+
+// cmdAt encodes a command of kind stamped at stamp.
+func cmdAt(kind byte, stamp int64, args ...string) []byte {
+    return wire.AppendStrings(binary.AppendVarint([]byte{kind}, stamp), args...)
+}
+
+// setTTLAt encodes a set of key→value with ttl, stamped at stamp.
+func setTTLAt(stamp int64, key, value string, ttl time.Duration) []byte {
+    return binary.AppendVarint(cmdAt(cmdSetTTL, stamp, key, value), int64(ttl))
+}
+
+func TestMachineSnapshotRestore(t *testing.T) {
+    now := time.Now().UnixNano()
+    src := newMachine(kv.NewBTreeStore())
+    src.Apply(cmdAt(cmdSet, now, "a", "1"))
+    src.Apply(cmdAt(cmdSet, now, "b", "2"))
+    src.Apply(setTTLAt(now, "c", "3", time.Hour))
+    data, err := src.Snapshot()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    dst := newMachine(kv.NewBTreeStore())
+    dst.store.Set("stale", "x")
+    if err := dst.Restore(data); err != nil {
+        t.Fatal(err)
+    }
+    if got := dumpStore(t, dst.store); !slices.Equal(got, []string{"a=1", "b=2", "c=3"}) {
+        t.Fatalf("restored %v", got)
+    }
+    if ttl, err := dst.ttl("c", now); err != nil || ttl != time.Hour {
+        t.Fatalf("restored TTL = %v, %v", ttl, err)
+    }
+}
+
+// TestMachineDeterministic applies the same log to machines at different
+// times and checks that expiry follows the stamps, not the local clock.
+func TestMachineDeterministic(t *testing.T) {
+    const sec = int64(time.Second)
+    log := [][]byte{
+        setTTLAt(100*sec, "lease", "a", 10*time.Second),
+        cmdAt(cmdSetIfAbsent, 109*sec, "lease", "b"),         // still held
+        cmdAt(cmdCompareAndSwap, 110*sec, "lease", "a", "b"), // expired
+        cmdAt(cmdSetIfAbsent, 110*sec, "lease", "c"),         // taken
+        setTTLAt(120*sec, "tmp", "x", time.Second),
+        cmdAt(cmdDeleteIfValue, 125*sec, "tmp", "x"),         // expired
+        setTTLAt(130*sec, "gone", "y", time.Second),
+        cmdAt(cmdExpire, 140*sec),
+    }
+    want := []bool{true, false, false, true, true, false, true, true}
+    var dumps [][]string
+    for i := 0; i < 2; i++ {
+        m := newMachine(kv.NewBTreeStore())
+        for j, cmd := range log {
+            r := m.Apply(cmd).(reply)
+            if r.err != nil || r.ok != want[j] {
+                t.Fatalf("machine %d: command %d = %+v; want ok=%v", i, j, r, want[j])
+            }
+        }
+        if n := m.expired.Load(); n != 3 {
+            t.Fatalf("machine %d: expired %d keys", i, n)
+        }
+        dumps = append(dumps, dumpStore(t, m.store))
+        time.Sleep(10 * time.Millisecond)
+    }
+    if !slices.Equal(dumps[0], []string{"lease=c"}) || !slices.Equal(dumps[0], dumps[1]) {
+        t.Fatalf("machines diverged: %v, %v", dumps[0], dumps[1])
+    }
+}
+
+func TestMachineBadCommand(t *testing.T) {
+    m := newMachine(kv.NewBTreeStore())
+    for _, cmd := range [][]byte{
+        nil,
+        {cmdSet},
+        {0xff, 0},
+        {cmdSet, 0, 5, 'a'},
+        {cmdBatch, 0, 2, cmdDelete, 1, 'a'},
+        cmdAt(cmdCompareAndSwap, 0, "a", "b"),
+        binary.AppendVarint(cmdAt(cmdSetTTL, 0, "a", "b"), 0),
+        cmdAt(cmdExpire, 0, "a"),
+    } {
+        if r := m.Apply(cmd).(reply); !errors.Is(r.err, kv.ErrCorrupted) {
+            t.Errorf("Apply(%v) = %+v", cmd, r)
+        }
+    }
+}
+
+func TestNewStoreClears(t *testing.T) {
+    store := kv.NewBTreeStore()
+    store.Set("old", "x")
+    s, err := NewStore(store, Config{ID: "a", Peers: []string{"a"}, Transport: NewNetwork().Transport("a")})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+    if _, err := store.Get("old"); !errors.Is(err, kv.ErrNotFound) {
+        t.Fatalf("old contents survived: %v", err)
+    }
+}
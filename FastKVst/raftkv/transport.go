@@ -0,0 +1,202 @@
+package raftkv
+
+import (
+    "errors"
+    "math/rand/v2"
+    "sync"
+    "time"
+)
+
+// ErrUnreachable is returned by a Transport that cannot deliver a message.
+var ErrUnreachable = errors.New("raftkv: node unreachable")
+
+// VoteRequest asks for a node's vote in an election.
+type VoteRequest struct {
+    Term         uint64
+    Candidate    string
+    LastLogIndex uint64
+    LastLogTerm  uint64
+}
+
+// VoteResponse answers a VoteRequest.
+type VoteResponse struct {
+    Term    uint64
+    Granted bool
+}
+
+// AppendRequest carries log entries, or none as a heartbeat, from the
+// leader.
+type AppendRequest struct {
+    Term         uint64
+    Leader       string
+    PrevLogIndex uint64
+    PrevLogTerm  uint64
+    Entries      []Entry
+    LeaderCommit uint64
+}
+
+// AppendResponse answers an AppendRequest. On success MatchIndex is the
+// last index known to match the leader; on failure ConflictIndex is
+// where the leader should retry from.
+type AppendResponse struct {
+    Term          uint64
+    Success       bool
+    MatchIndex    uint64
+    ConflictIndex uint64
+}
+
+// SnapshotRequest sends a snapshot to a node too far behind for the
+// leader's log.
+type SnapshotRequest struct {
+    Term     uint64
+    Leader   string
+    Snapshot Snapshot
+}
+
+// SnapshotResponse answers a SnapshotRequest.
+type SnapshotResponse struct {
+    Term uint64
+}
+
+// Transport delivers messages to other nodes by ID. Calls may block but
+// should time out rather than hang, and may run concurrently.
+type Transport interface {
+    RequestVote(to string, req *VoteRequest) (*VoteResponse, error)
+    AppendEntries(to string, req *AppendRequest) (*AppendResponse, error)
+    InstallSnapshot(to string, req *SnapshotRequest) (*SnapshotResponse, error)
+}
+
+// Handler receives messages delivered by a Transport. *Node implements it.
+type Handler interface {
+    HandleRequestVote(req *VoteRequest) (*VoteResponse, error)
+    HandleAppendEntries(req *AppendRequest) (*AppendResponse, error)
+    HandleInstallSnapshot(req *SnapshotRequest) (*SnapshotResponse, error)
+}
+
+// Network connects nodes in one process, for tests and simulations. It
+// can partition nodes from each other, drop messages and delay them.
+type Network struct {
+    mu    sync.RWMutex
+    nodes map[string]Handler
+    group map[string]int // partition group; nil when healed
+    loss  float64
+    delay time.Duration
+}
+
+// NewNetwork returns an empty, fully connected network.
+func NewNetwork() *Network {
+    return &Network{nodes: make(map[string]Handler)}
+}
+
+// Add connects a node's handler under id, replacing any earlier one.
+func (n *Network) Add(id string, h Handler) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    n.nodes[id] = h
+}
+
+// Remove disconnects id.
+func (n *Network) Remove(id string) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    delete(n.nodes, id)
+}
+
+// Partition splits the network: nodes can only reach nodes in the same
+// group. Nodes in no group cannot reach anyone.
+func (n *Network) Partition(groups ...[]string) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    n.group = make(map[string]int)
+    for i, g := range groups {
+        for _, id := range g {
+            n.group[id] = i + 1
+        }
+    }
+}
+
+// Heal removes any partition.
+func (n *Network) Heal() {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    n.group = nil
+}
+
+// SetLoss drops each request or reply with probability p.
+func (n *Network) SetLoss(p float64) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    n.loss = p
+}
+
+// SetDelay delays each message by a random duration up to d.
+func (n *Network) SetDelay(d time.Duration) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    n.delay = d
+}
+
+// Transport returns the transport for node from.
+func (n *Network) Transport(from string) Transport {
+    return &memTransport{net: n, from: from}
+}
+
+// route returns the handler for to if from can reach it, after any
+// simulated delay, or nil if the message is lost.
+func (n *Network) route(from, to string) Handler {
+    n.mu.RLock()
+    delay, loss := n.delay, n.loss
+    n.mu.RUnlock()
+    if delay > 0 {
+        time.Sleep(rand.N(delay))
+    }
+    n.mu.RLock()
+    defer n.mu.RUnlock()
+    h := n.nodes[to]
+    if h == nil || n.nodes[from] == nil {
+        return nil
+    }
+    if n.group != nil && (n.group[from] == 0 || n.group[from] != n.group[to]) {
+        return nil
+    }
+    if loss > 0 && rand.Float64() < loss {
+        return nil
+    }
+    return h
+}
+
+type memTransport struct {
+    net  *Network
+    from string
+}
+
+// call delivers one request and its reply, either of which can be lost.
+func call[Req, Resp any](t *memTransport, to string, req *Req, handle func(Handler, *Req) (*Resp, error)) (*Resp, error) {
+    h := t.net.route(t.from, to)
+    if h == nil {
+        return nil, ErrUnreachable
+    }
+    resp, err := handle(h, req)
+    if err != nil {
+        return nil, err
+    }
+    if t.net.route(to, t.from) == nil {
+        return nil, ErrUnreachable
+    }
+    return resp, nil
+}
+
+func (t *memTransport) RequestVote(to string, req *VoteRequest) (*VoteResponse, error) {
+    return call(t, to, req, Handler.HandleRequestVote)
+}
+
+func (t *memTransport) AppendEntries(to string, req *AppendRequest) (*AppendResponse, error) {
+    // Copy the slice so the receiver cannot alias the sender's log.
+    r := *req
+    r.Entries = append([]Entry(nil), req.Entries...)
+    return call(t, to, &r, Handler.HandleAppendEntries)
+}
+
+func (t *memTransport) InstallSnapshot(to string, req *SnapshotRequest) (*SnapshotResponse, error) {
+    return call(t, to, req, Handler.HandleInstallSnapshot)
+}
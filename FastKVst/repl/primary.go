@@ -0,0 +1,455 @@
+package repl
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "math/rand/v2"
+    "net"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/thilakshekharshriyan/m/kv"
+)
+
+// PrimaryOptions configures a Primary. Zero values select the defaults.
+type PrimaryOptions struct {
+    Backlog   int           // minimum records kept for catching up replicas (default 100000)
+    Heartbeat time.Duration // interval between heartbeats to idle replicas (default 1s)
+    Logger    *log.Logger   // replica connection errors; nil discards them
+}
+
+func (o *PrimaryOptions) setDefaults() {
+    if o.Backlog <= 0 {
+        o.Backlog = 100000
+    }
+    if o.Heartbeat <= 0 {
+        o.Heartbeat = time.Second
+    }
+    if o.Logger == nil {
+        o.Logger = log.New(io.Discard, "", 0)
+    }
+}
+
+// ReplicaStatus describes one connected replica.
+type ReplicaStatus struct {
+    ID      string
+    Addr    string
+    Acked   uint64        // last sequence the replica applied
+    Lag     uint64        // records the replica is behind the primary
+    LagTime time.Duration // age of the oldest write it has not applied; 0 if caught up
+}
+
+// Primary wraps the store that takes writes and streams them to
+// replicas. All writes must go through the Primary.
+type Primary struct {
+    store kv.KVStore
+    opts  PrimaryOptions
+    runID string
+
+    mu       sync.Mutex // serializes writes so log order is apply order
+    seq      uint64
+    backlog  []record    // the newest records, contiguous in seq
+    times    []time.Time // when each backlog record was written
+    notify   chan struct{} // closed and replaced on every write
+    replicas map[*replicaConn]struct{}
+    ln       net.Listener
+    closed   bool
+    done     chan struct{}
+    wg       sync.WaitGroup
+}
+
+// NewPrimary wraps store.
+func NewPrimary(store kv.KVStore, opts PrimaryOptions) *Primary {
+    opts.setDefaults()
+    return &Primary{
+        store:    store,
+        opts:     opts,
+        runID:    fmt.Sprintf("%016x", rand.Uint64()),
+        notify:   make(chan struct{}),
+        done:     make(chan struct{}),
+        replicas: make(map[*replicaConn]struct{}),
+    }
+}
+
+// RunID returns the random ID this Primary's sequence numbers belong to.
+func (p *Primary) RunID() string {
+    return p.runID
+}
+
+// Seq returns the sequence number of the last write.
+func (p *Primary) Seq() uint64 {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.seq
+}
+
+// logLocked records a write that has just been applied.
+func (p *Primary) logLocked(ops []op) {
+    p.seq++
+    p.backlog = append(p.backlog, record{seq: p.seq, ops: ops})
+    p.times = append(p.times, time.Now())
+    // Trim in bulk so the copy is amortized over Backlog writes.
+    if len(p.backlog) >= 2*p.opts.Backlog {
+        n := len(p.backlog) - p.opts.Backlog
+        p.backlog = append([]record(nil), p.backlog[n:]...)
+        p.times = append([]time.Time(nil), p.times[n:]...)
+    }
+    close(p.notify)
+    p.notify = make(chan struct{})
+}
+
+// Set writes and replicates key→value.
+func (p *Primary) Set(key, value string) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if err := p.store.Set(key, value); err != nil {
+        return err
+    }
+    p.logLocked([]op{{key: key, value: value}})
+    return nil
+}
+
+// SetWithTTL writes and replicates key→value with a TTL. Replicas expire
+// the key at the same wall-clock time as the primary.
+func (p *Primary) SetWithTTL(key, value string, ttl time.Duration) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if err := kv.SetWithTTL(p.store, key, value, ttl); err != nil {
+        return err
+    }
+    p.logLocked([]op{{key: key, value: value, expires: time.Now().Add(ttl).UnixNano()}})
+    return nil
+}
+
+// TTL reports the time left on key, if the store supports TTLs.
+func (p *Primary) TTL(key string) (time.Duration, error) {
+    e, ok := p.store.(kv.Expirer)
+    if !ok {
+        return 0, kv.ErrUnsupported
+    }
+    return e.TTL(key)
+}
+
+// ExpiredKeys returns how many keys have expired in the store.
+func (p *Primary) ExpiredKeys() uint64 {
+    if e, ok := p.store.(kv.Expirer); ok {
+        return e.ExpiredKeys()
+    }
+    return 0
+}
+
+// Get reads from the primary's store.
+func (p *Primary) Get(key string) (string, error) {
+    return p.store.Get(key)
+}
+
+// Delete deletes and replicates the delete of key.
+func (p *Primary) Delete(key string) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if err := p.store.Delete(key); err != nil {
+        return err
+    }
+    p.logLocked([]op{{key: key, delete: true}})
+    return nil
+}
+
+// Write applies b and replicates it as one record.
+func (p *Primary) Write(b *kv.WriteBatch) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if err := kv.Write(p.store, b); err != nil {
+        return err
+    }
+    now := time.Now()
+    ops := make([]op, 0, b.Len())
+    b.Each(func(key, value string, ttl time.Duration, withTTL, delete bool) {
+        o := op{key: key, value: value, delete: delete}
+        if withTTL {
+            o.expires = now.Add(ttl).UnixNano()
+        }
+        ops = append(ops, o)
+    })
+    p.logLocked(ops)
+    return nil
+}
+
+// Range reads from the primary's store.
+func (p *Primary) Range(start, end string) ([]string, error) {
+    return p.store.Range(start, end)
+}
+
+// NewIterator iterates the primary's store.
+func (p *Primary) NewIterator() kv.Iterator {
+    it, err := kv.NewIterator(p.store)
+    if err != nil {
+        return kv.NewErrorIterator(err)
+    }
+    return it
+}
+
+// Flush flushes the primary's store. Replicas flush on their own.
+func (p *Primary) Flush() error {
+    return p.store.Flush()
+}
+
+// Serve accepts replicas on ln until Close.
+func (p *Primary) Serve(ln net.Listener) error {
+    p.mu.Lock()
+    if p.closed {
+        p.mu.Unlock()
+        ln.Close()
+        return ErrClosed
+    }
+    p.ln = ln
+    p.mu.Unlock()
+    for {
+        nc, err := ln.Accept()
+        if err != nil {
+            p.mu.Lock()
+            closed := p.closed
+            p.mu.Unlock()
+            if closed {
+                return ErrClosed
+            }
+            return err
+        }
+        rc := &replicaConn{p: p, nc: nc, addr: nc.RemoteAddr().String()}
+        p.mu.Lock()
+        if p.closed {
+            p.mu.Unlock()
+            nc.Close()
+            return ErrClosed
+        }
+        p.replicas[rc] = struct{}{}
+        p.wg.Add(1)
+        p.mu.Unlock()
+        go rc.serve()
+    }
+}
+
+// Close stops serving replicas and disconnects them. Writes still go to
+// the store but are no longer replicated; the store is not closed.
+func (p *Primary) Close() error {
+    p.mu.Lock()
+    if p.closed {
+        p.mu.Unlock()
+        return nil
+    }
+    p.closed = true
+    if p.ln != nil {
+        p.ln.Close()
+    }
+    for rc := range p.replicas {
+        rc.nc.Close()
+    }
+    close(p.done)
+    p.mu.Unlock()
+    p.wg.Wait()
+    return nil
+}
+
+// Replicas returns the status of every connected replica, by ID.
+func (p *Primary) Replicas() []ReplicaStatus {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    var out []ReplicaStatus
+    for rc := range p.replicas {
+        rc.mu.Lock()
+        st := ReplicaStatus{ID: rc.id, Addr: rc.addr, Acked: rc.acked}
+        rc.mu.Unlock()
+        if st.Acked < p.seq {
+            st.Lag = p.seq - st.Acked
+            if i := p.backlogIndex(st.Acked + 1); i >= 0 {
+                st.LagTime = time.Since(p.times[i])
+            } else if len(p.times) > 0 {
+                st.LagTime = time.Since(p.times[0])
+            }
+        }
+        out = append(out, st)
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+    return out
+}
+
+// backlogIndex returns the position of seq in the backlog, or -1.
+func (p *Primary) backlogIndex(seq uint64) int {
+    if len(p.backlog) == 0 || seq < p.backlog[0].seq || seq > p.seq {
+        return -1
+    }
+    return int(seq - p.backlog[0].seq)
+}
+
+// replicaConn streams to one replica.
+type replicaConn struct {
+    p    *Primary
+    nc   net.Conn
+    addr string
+
+    mu    sync.Mutex
+    id    string
+    acked uint64
+}
+
+func (rc *replicaConn) serve() {
+    p := rc.p
+    defer p.wg.Done()
+    defer func() {
+        p.mu.Lock()
+        delete(p.replicas, rc)
+        p.mu.Unlock()
+        rc.nc.Close()
+    }()
+    r := bufio.NewReader(rc.nc)
+    typ, payload, err := readFrame(r)
+    if err != nil || typ != frameHello {
+        p.opts.Logger.Printf("repl: %s: bad hello: %v", rc.addr, err)
+        return
+    }
+    sent, run, id, err := readRun(payload)
+    if err != nil {
+        return
+    }
+    // A replica of another run counts in other sequence numbers.
+    resync := run != p.runID
+    if resync {
+        sent = 0
+    }
+    rc.mu.Lock()
+    rc.id, rc.acked = string(id), sent
+    rc.mu.Unlock()
+
+    go rc.readAcks(r)
+    if err := rc.stream(sent, resync); err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, ErrClosed) {
+        p.opts.Logger.Printf("repl: %s: %v", rc.addr, err)
+    }
+}
+
+// readAcks records acknowledgements until the connection fails.
+func (rc *replicaConn) readAcks(r *bufio.Reader) {
+    for {
+        typ, payload, err := readFrame(r)
+        if err != nil {
+            rc.nc.Close()
+            return
+        }
+        if typ != frameAck {
+            continue
+        }
+        if seq, _, err := readSeq(payload); err == nil {
+            rc.mu.Lock()
+            rc.acked = seq
+            rc.mu.Unlock()
+        }
+    }
+}
+
+// stream sends everything after sent, starting with a snapshot if resync
+// is set, then tails new writes.
+func (rc *replicaConn) stream(sent uint64, resync bool) error {
+    p := rc.p
+    w := bufio.NewWriter(rc.nc)
+    heartbeat := time.NewTicker(p.opts.Heartbeat)
+    defer heartbeat.Stop()
+    for {
+        p.mu.Lock()
+        if p.closed {
+            p.mu.Unlock()
+            return ErrClosed
+        }
+        notify, seq := p.notify, p.seq
+        var pending []record
+        snapshot := false
+        switch i := p.backlogIndex(sent + 1); {
+        case !resync && sent == seq:
+        case resync || i < 0:
+            // New, from another run or out of the backlog: start over
+            // from a snapshot.
+            snapshot = true
+        default:
+            pending = p.backlog[i:]
+        }
+        p.mu.Unlock()
+
+        if snapshot {
+            if err := rc.sendSnapshot(w, seq); err != nil {
+                return err
+            }
+            sent, resync = seq, false
+            continue
+        }
+        for _, rec := range pending {
+            if err := writeFrame(w, frameRecord, rec.encode()); err != nil {
+                return err
+            }
+            sent = rec.seq
+        }
+        if err := w.Flush(); err != nil {
+            return err
+        }
+        if sent < seq {
+            continue
+        }
+        select {
+        case <-p.done:
+            return ErrClosed
+        case <-notify:
+        case <-heartbeat.C:
+            if err := writeFrame(w, frameHeartbeat, seqPayload(sent, nil)); err != nil {
+                return err
+            }
+            if err := w.Flush(); err != nil {
+                return err
+            }
+        }
+    }
+}
+
+// sendSnapshot scans the store into snapshot frames, starting after
+// record seq, without holding up writes. The scan may see writes made
+// while it runs; the replica replays the records up to where it ended
+// before using the snapshot, which makes it exact.
+func (rc *replicaConn) sendSnapshot(w *bufio.Writer, seq uint64) error {
+    p := rc.p
+    if err := writeFrame(w, frameSnapshot, runPayload(seq, p.runID, nil)); err != nil {
+        return err
+    }
+    chunk := record{seq: seq}
+    size := 0
+    var count uint64
+    send := func() error {
+        if len(chunk.ops) == 0 {
+            return nil
+        }
+        err := writeFrame(w, frameSnapshotChunk, chunk.encode())
+        chunk.ops, size = chunk.ops[:0], 0
+        return err
+    }
+    err := kv.EachEntry(p.store, func(key, value string, expires int64) error {
+        chunk.ops = append(chunk.ops, op{key: key, value: value, expires: expires})
+        size += len(key) + len(value)
+        count++
+        if size >= snapshotChunk {
+            return send()
+        }
+        return nil
+    })
+    if err == nil {
+        err = send()
+    }
+    if err != nil {
+        return err
+    }
+    p.mu.Lock()
+    end := p.seq
+    p.mu.Unlock()
+    if err := writeFrame(w, frameSnapshotEnd, seqPayload(end, binary.AppendUvarint(nil, count))); err != nil {
+        return err
+    }
+    return w.Flush()
+}
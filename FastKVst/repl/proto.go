@@ -0,0 +1,210 @@
+// Package repl replicates a kv.KVStore asynchronously from a primary to
+// read-only replicas over TCP.
+//
+// The Primary wraps the store that takes writes. Each write is applied,
+// numbered with the next sequence number and kept in an in-memory
+// backlog. Sequence numbers start over with every Primary, so each one
+// also picks a random run ID. A replica connects with the run ID and
+// last sequence it applied; the primary streams every later record, or,
+// if the replica is new, comes from another run or has fallen out of the
+// backlog, a full snapshot followed by the records after it. The
+// snapshot is a scan of the live store, sent in chunks while writes go
+// on; the replica loads it into a fresh store and replays the records
+// written during the scan before switching over. Replicas acknowledge
+// what they have applied, which the primary reports as replication lag.
+package repl
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+
+    "github.com/thilakshekharshriyan/m/internal/wire"
+    "github.com/thilakshekharshriyan/m/kv"
+)
+
+// Frame types. A frame is u8 type | u32 len | payload | u32 crc, where
+// crc is the CRC32C of the type, length and payload.
+const (
+    frameHello       byte = iota + 1 // replica: u64 applied seq, run ID, id
+    frameSnapshot                    // primary: u64 seq the scan starts after, run ID
+    frameRecord                      // primary: u64 seq, ops
+    frameHeartbeat                   // primary: u64 latest seq
+    frameAck                         // replica: u64 applied seq
+    frameSnapshotChunk               // primary: u64 snapshot seq, ops
+    frameSnapshotEnd                 // primary: u64 seq the scan ended at, uvarint key count
+)
+
+const (
+    maxFrame      = 1 << 30   // bounds a frame's payload
+    snapshotChunk = 256 << 10 // target payload size of a snapshot chunk
+)
+
+var (
+    // ErrBadFrame is returned for a frame that fails its checksum or
+    // cannot be decoded.
+    ErrBadFrame = fmt.Errorf("repl: bad frame: %w", kv.ErrCorrupted)
+    // ErrClosed is returned by a closed Primary or Replica.
+    ErrClosed = errors.New("repl: closed")
+    // ErrReadOnly is returned by writes to a Replica.
+    ErrReadOnly = errors.New("repl: replica is read-only")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func writeFrame(w *bufio.Writer, typ byte, payload []byte) error {
+    var hdr [5]byte
+    hdr[0] = typ
+    binary.LittleEndian.PutUint32(hdr[1:], uint32(len(payload)))
+    crc := crc32.Update(crc32.Checksum(hdr[:], castagnoli), castagnoli, payload)
+    w.Write(hdr[:])
+    w.Write(payload)
+    _, err := w.Write(binary.LittleEndian.AppendUint32(nil, crc))
+    return err
+}
+
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+    var hdr [5]byte
+    if _, err := io.ReadFull(r, hdr[:]); err != nil {
+        return 0, nil, err
+    }
+    n := binary.LittleEndian.Uint32(hdr[1:])
+    if n > maxFrame {
+        return 0, nil, ErrBadFrame
+    }
+    buf := make([]byte, n+4)
+    if _, err := io.ReadFull(r, buf); err != nil {
+        return 0, nil, err
+    }
+    crc := crc32.Update(crc32.Checksum(hdr[:], castagnoli), castagnoli, buf[:n])
+    if crc != binary.LittleEndian.Uint32(buf[n:]) {
+        return 0, nil, ErrBadFrame
+    }
+    return hdr[0], buf[:n], nil
+}
+
+// op is one write in a record.
+type op struct {
+    key, value string
+    delete     bool
+    expires    int64 // Unix nanoseconds; 0 for none
+}
+
+// record is one replicated write: a single operation or a whole batch,
+// applied atomically on replicas that support batches.
+type record struct {
+    seq uint64
+    ops []op
+}
+
+// Op kinds in an encoded record.
+const (
+    opSet byte = iota
+    opDelete
+    opSetTTL
+)
+
+func (rec record) encode() []byte {
+    buf := binary.LittleEndian.AppendUint64(nil, rec.seq)
+    buf = binary.AppendUvarint(buf, uint64(len(rec.ops)))
+    for _, o := range rec.ops {
+        switch {
+        case o.delete:
+            buf = append(buf, opDelete)
+        case o.expires != 0:
+            buf = append(buf, opSetTTL)
+        default:
+            buf = append(buf, opSet)
+        }
+        if o.delete {
+            buf = wire.AppendStrings(buf, o.key)
+            continue
+        }
+        buf = wire.AppendStrings(buf, o.key, o.value)
+        if o.expires != 0 {
+            buf = binary.AppendVarint(buf, o.expires)
+        }
+    }
+    return buf
+}
+
+func decodeRecord(buf []byte) (record, error) {
+    var rec record
+    if len(buf) < 8 {
+        return rec, ErrBadFrame
+    }
+    rec.seq = binary.LittleEndian.Uint64(buf)
+    buf = buf[8:]
+    n, k := binary.Uvarint(buf)
+    if k <= 0 || n > uint64(len(buf)) {
+        return rec, ErrBadFrame
+    }
+    buf = buf[k:]
+    rec.ops = make([]op, n)
+    for i := range rec.ops {
+        if len(buf) == 0 {
+            return rec, ErrBadFrame
+        }
+        kind := buf[0]
+        buf = buf[1:]
+        var o op
+        var ok bool
+        if o.key, buf, ok = wire.ReadString(buf); !ok {
+            return rec, ErrBadFrame
+        }
+        switch kind {
+        case opDelete:
+            o.delete = true
+        case opSet, opSetTTL:
+            if o.value, buf, ok = wire.ReadString(buf); !ok {
+                return rec, ErrBadFrame
+            }
+            if kind == opSetTTL {
+                if o.expires, k = binary.Varint(buf); k <= 0 {
+                    return rec, ErrBadFrame
+                }
+                buf = buf[k:]
+            }
+        default:
+            return rec, ErrBadFrame
+        }
+        rec.ops[i] = o
+    }
+    return rec, nil
+}
+
+// seqPayload encodes a sequence number followed by extra bytes.
+func seqPayload(seq uint64, extra []byte) []byte {
+    return append(binary.LittleEndian.AppendUint64(nil, seq), extra...)
+}
+
+// readSeq decodes the sequence number at the front of a payload.
+func readSeq(payload []byte) (uint64, []byte, error) {
+    if len(payload) < 8 {
+        return 0, nil, ErrBadFrame
+    }
+    return binary.LittleEndian.Uint64(payload), payload[8:], nil
+}
+
+// runPayload encodes a sequence number and the run ID it belongs to,
+// followed by extra bytes.
+func runPayload(seq uint64, run string, extra []byte) []byte {
+    buf := wire.AppendStrings(binary.LittleEndian.AppendUint64(nil, seq), run)
+    return append(buf, extra...)
+}
+
+// readRun decodes the front of a payload written by runPayload.
+func readRun(payload []byte) (uint64, string, []byte, error) {
+    seq, rest, err := readSeq(payload)
+    if err != nil {
+        return 0, "", nil, err
+    }
+    run, rest, ok := wire.ReadString(rest)
+    if !ok {
+        return 0, "", nil, ErrBadFrame
+    }
+    return seq, run, rest, nil
+}
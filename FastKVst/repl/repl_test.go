@@ -0,0 +1,365 @@
+package repl
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "fmt"
+    "net"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/thilakshekharshriyan/m/kv"
+)
+
+// startPrimary serves a primary over a fresh BTreeStore on a loopback
+// port until the test ends.
+func startPrimary(t *testing.T, opts PrimaryOptions) (*Primary, string) {
+    return servePrimary(t, kv.NewBTreeStore(), "127.0.0.1:0", opts)
+}
+
+// servePrimary serves a primary over store on addr until the test ends.
+func servePrimary(t *testing.T, store kv.KVStore, addr string, opts PrimaryOptions) (*Primary, string) {
+    ln, err := net.Listen("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    p := NewPrimary(store, opts)
+    done := make(chan error, 1)
+    go func() { done <- p.Serve(ln) }()
+    t.Cleanup(func() {
+        p.Close()
+        if err := <-done; err != ErrClosed {
+            t.Errorf("Serve returned %v", err)
+        }
+    })
+    return p, ln.Addr().String()
+}
+
+func startReplica(t *testing.T, addr, id string) *Replica {
+    r := StartReplica(addr, ReplicaOptions{ID: id, MinBackoff: time.Millisecond, MaxBackoff: 20 * time.Millisecond})
+    t.Cleanup(func() { r.Close() })
+    return r
+}
+
+// waitFor polls cond until it holds or five seconds pass.
+func waitFor(t *testing.T, what string, cond func() bool) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for !cond() {
+        if time.Now().After(deadline) {
+            t.Fatalf("timed out waiting for %s", what)
+        }
+        time.Sleep(2 * time.Millisecond)
+    }
+}
+
+// caughtUp waits until r has applied everything written to p.
+func caughtUp(t *testing.T, p *Primary, r *Replica) {
+    t.Helper()
+    waitFor(t, "replica to catch up", func() bool { return r.Seq() == p.Seq() })
+}
+
+// sameContents checks that r holds exactly what p holds.
+func sameContents(t *testing.T, p *Primary, r *Replica) {
+    t.Helper()
+    want, err := p.Range("", "\xff")
+    if err != nil {
+        t.Fatal(err)
+    }
+    got, err := r.Range("", "\xff")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if fmt.Sprint(got) != fmt.Sprint(want) {
+        t.Fatalf("replica keys %v, primary keys %v", got, want)
+    }
+    for _, k := range want {
+        pv, _ := p.Get(k)
+        if rv, err := r.Get(k); err != nil || rv != pv {
+            t.Fatalf("replica %q = %q, %v; primary has %q", k, rv, err, pv)
+        }
+    }
+}
+
+func TestReplication(t *testing.T) {
+    p, addr := startPrimary(t, PrimaryOptions{})
+    r := startReplica(t, addr, "r1")
+
+    for i := 0; i < 100; i++ {
+        if err := p.Set(fmt.Sprintf("k%03d", i), fmt.Sprint(i)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    for i := 0; i < 100; i += 3 {
+        if err := p.Delete(fmt.Sprintf("k%03d", i)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    var b kv.WriteBatch
+    b.Put("batch1", "a")
+    b.Put("batch2", "b")
+    b.Delete("k001")
+    if err := p.Write(&b); err != nil {
+        t.Fatal(err)
+    }
+    if err := p.Delete("missing"); !errors.Is(err, kv.ErrNotFound) {
+        t.Fatalf("Delete(missing) = %v", err)
+    }
+
+    caughtUp(t, p, r)
+    sameContents(t, p, r)
+    if _, err := r.Get("k001"); !errors.Is(err, kv.ErrNotFound) {
+        t.Fatalf("batched delete not replicated: %v", err)
+    }
+}
+
+func TestReplicaReadOnly(t *testing.T) {
+    _, addr := startPrimary(t, PrimaryOptions{})
+    r := startReplica(t, addr, "r1")
+    if err := r.Set("k", "v"); !errors.Is(err, ErrReadOnly) {
+        t.Fatalf("Set = %v", err)
+    }
+    if err := r.Delete("k"); !errors.Is(err, ErrReadOnly) {
+        t.Fatalf("Delete = %v", err)
+    }
+    if err := kv.SetWithTTL(r, "k", "v", time.Minute); !errors.Is(err, ErrReadOnly) {
+        t.Fatalf("SetWithTTL = %v", err)
+    }
+}
+
+func TestSnapshotBootstrap(t *testing.T) {
+    // A tiny backlog forces a late replica to start from a snapshot.
+    p, addr := startPrimary(t, PrimaryOptions{Backlog: 4})
+    for i := 0; i < 50; i++ {
+        p.Set(fmt.Sprintf("k%02d", i), fmt.Sprint(i))
+    }
+    r := startReplica(t, addr, "late")
+    caughtUp(t, p, r)
+    sameContents(t, p, r)
+
+    // Then it tails the live stream.
+    p.Set("after", "snapshot")
+    p.Delete("k00")
+    caughtUp(t, p, r)
+    sameContents(t, p, r)
+}
+
+func TestPrefilledPrimary(t *testing.T) {
+    store := kv.NewBTreeStore()
+    store.Set("before", "primary")
+    p, addr := servePrimary(t, store, "127.0.0.1:0", PrimaryOptions{})
+    r := startReplica(t, addr, "r1")
+    waitFor(t, "existing data", func() bool {
+        _, err := r.Get("before")
+        return err == nil
+    })
+    sameContents(t, p, r)
+}
+
+// gatedStore holds up iterators until open is closed, and says on
+// started when one is waiting.
+type gatedStore struct {
+    *kv.BTreeStore
+    started chan struct{}
+    open    chan struct{}
+}
+
+func (s *gatedStore) NewIterator() kv.Iterator {
+    select {
+    case s.started <- struct{}{}:
+    default:
+    }
+    <-s.open
+    return s.BTreeStore.NewIterator()
+}
+
+func TestSnapshotWhileWriting(t *testing.T) {
+    store := &gatedStore{BTreeStore: kv.NewBTreeStore(), started: make(chan struct{}, 1), open: make(chan struct{})}
+    value := strings.Repeat("v", 200)
+    for i := 0; i < 3000; i++ {
+        store.Set(fmt.Sprintf("k%04d", i), value)
+    }
+    p, addr := servePrimary(t, store, "127.0.0.1:0", PrimaryOptions{})
+    r := startReplica(t, addr, "r1")
+    <-store.started
+
+    // Writes go on while the snapshot is taken, and reach the replica.
+    done := make(chan error, 1)
+    go func() {
+        if err := p.Set("k0000", "changed"); err != nil {
+            done <- err
+            return
+        }
+        if err := p.Delete("k0001"); err != nil {
+            done <- err
+            return
+        }
+        done <- p.Set("new", "key")
+    }()
+    select {
+    case err := <-done:
+        close(store.open)
+        if err != nil {
+            t.Fatal(err)
+        }
+    case <-time.After(5 * time.Second):
+        close(store.open)
+        t.Fatal("writes blocked by the snapshot")
+    }
+    caughtUp(t, p, r)
+    sameContents(t, p, r)
+}
+
+func TestPrimaryRestart(t *testing.T) {
+    p1, addr := startPrimary(t, PrimaryOptions{})
+    r := startReplica(t, addr, "r1")
+    for i := 0; i < 10; i++ {
+        p1.Set(fmt.Sprint("old", i), "v")
+    }
+    caughtUp(t, p1, r)
+    p1.Close()
+
+    // A new primary counts from 0 again: its seq 11 is not p1's.
+    store := kv.NewBTreeStore()
+    store.Set("new", "data")
+    p2, _ := servePrimary(t, store, addr, PrimaryOptions{})
+    for i := 0; i < 11; i++ {
+        p2.Set(fmt.Sprint("x", i), "v")
+    }
+    waitFor(t, "resync with the new primary", func() bool {
+        _, err := r.Get("x10")
+        return err == nil
+    })
+    caughtUp(t, p2, r)
+    sameContents(t, p2, r)
+}
+
+func TestReplicaFallsBehind(t *testing.T) {
+    p, addr := startPrimary(t, PrimaryOptions{Backlog: 4})
+    r := startReplica(t, addr, "r1")
+    p.Set("first", "1")
+    caughtUp(t, p, r)
+
+    // Write past the backlog under the primary's lock, so none of it is
+    // streamed, then cut the connection: the replica must re-snapshot.
+    r.connMu.Lock()
+    nc := r.nc
+    r.connMu.Unlock()
+    p.mu.Lock()
+    for i := 0; i < 20; i++ {
+        p.store.Set(fmt.Sprintf("k%02d", i), "v")
+        p.logLocked([]op{{key: fmt.Sprintf("k%02d", i), value: "v"}})
+    }
+    nc.Close()
+    p.mu.Unlock()
+
+    caughtUp(t, p, r)
+    sameContents(t, p, r)
+}
+
+func TestTTLReplication(t *testing.T) {
+    p, addr := startPrimary(t, PrimaryOptions{})
+    r := startReplica(t, addr, "r1")
+    if err := kv.SetWithTTL(p, "short", "v", 50*time.Millisecond); err != nil {
+        t.Fatal(err)
+    }
+    if err := kv.SetWithTTL(p, "long", "v", time.Hour); err != nil {
+        t.Fatal(err)
+    }
+    caughtUp(t, p, r)
+    ttl, err := r.TTL("long")
+    if err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+        t.Fatalf("replica TTL(long) = %v, %v", ttl, err)
+    }
+    waitFor(t, "short to expire on the replica", func() bool {
+        _, err := r.Get("short")
+        return errors.Is(err, kv.ErrNotFound)
+    })
+}
+
+func TestReplicaLag(t *testing.T) {
+    p, addr := startPrimary(t, PrimaryOptions{Heartbeat: 10 * time.Millisecond})
+    r1 := startReplica(t, addr, "r1")
+    r2 := startReplica(t, addr, "r2")
+    waitFor(t, "replicas to connect", func() bool { return len(p.Replicas()) == 2 })
+
+    for i := 0; i < 10; i++ {
+        p.Set(fmt.Sprint(i), "v")
+    }
+    caughtUp(t, p, r1)
+    caughtUp(t, p, r2)
+    waitFor(t, "acks", func() bool {
+        for _, st := range p.Replicas() {
+            if st.Acked != p.Seq() || st.Lag != 0 || st.LagTime != 0 {
+                return false
+            }
+        }
+        return true
+    })
+    st := p.Replicas()
+    if st[0].ID != "r1" || st[1].ID != "r2" {
+        t.Fatalf("Replicas() = %+v", st)
+    }
+    if r1.Lag() != 0 {
+        t.Fatalf("r1.Lag() = %d", r1.Lag())
+    }
+
+    // A replica that never acknowledges shows lag.
+    r2.Close()
+    waitFor(t, "r2 to disconnect", func() bool { return len(p.Replicas()) == 1 })
+    stalled := stallReplica(t, addr, p)
+    waitFor(t, "stalled replica to connect", func() bool { return len(p.Replicas()) == 2 })
+    for i := 0; i < 5; i++ {
+        p.Set(fmt.Sprint(i), "w")
+    }
+    caughtUp(t, p, r1)
+    waitFor(t, "lag to show", func() bool {
+        for _, st := range p.Replicas() {
+            if st.ID == stalled && st.Lag == 5 && st.LagTime > 0 {
+                return true
+            }
+        }
+        return false
+    })
+}
+
+// stallReplica connects as a replica that has applied everything written
+// to p so far and never acknowledges anything.
+func stallReplica(t *testing.T, addr string, p *Primary) string {
+    nc, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { nc.Close() })
+    w := bufio.NewWriter(nc)
+    writeFrame(w, frameHello, runPayload(p.Seq(), p.RunID(), []byte("stalled")))
+    if err := w.Flush(); err != nil {
+        t.Fatal(err)
+    }
+    return "stalled"
+}
+
+func TestFrameCorruption(t *testing.T) {
+    rec := record{seq: 7, ops: []op{{key: "a", value: "b"}, {key: "c", delete: true}, {key: "d", value: "e", expires: 42}}}
+    var buf bytes.Buffer
+    w := bufio.NewWriter(&buf)
+    writeFrame(w, frameRecord, rec.encode())
+    w.Flush()
+    frame := buf.Bytes()
+
+    typ, payload, err := readFrame(bufio.NewReader(bytes.NewReader(frame)))
+    if err != nil || typ != frameRecord {
+        t.Fatalf("readFrame = %d, %v", typ, err)
+    }
+    got, err := decodeRecord(payload)
+    if err != nil || fmt.Sprint(got) != fmt.Sprint(rec) {
+        t.Fatalf("decodeRecord = %+v, %v", got, err)
+    }
+
+    frame[8] ^= 0xff
+    if _, _, err := readFrame(bufio.NewReader(bytes.NewReader(frame))); !errors.Is(err, kv.ErrCorrupted) {
+        t.Fatalf("corrupt frame: %v", err)
+    }
+}
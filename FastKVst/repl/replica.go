@@ -0,0 +1,399 @@
+package repl
+
+import (
+    "bufio"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "log"
+    "math/rand/v2"
+    "net"
+    "sync"
+    "time"
+
+    "github.com/thilakshekharshriyan/m/kv"
+)
+
+// ReplicaOptions configures a Replica. Zero values select the defaults.
+type ReplicaOptions struct {
+    // NewStore returns an empty store to load a snapshot into (default
+    // kv.NewBTreeStore). It must support TTLs if the primary uses them.
+    NewStore    func() kv.KVStore
+    ID          string        // reported to the primary (default: local address)
+    DialTimeout time.Duration // default 5s
+    MinBackoff  time.Duration // first reconnect delay (default 50ms)
+    MaxBackoff  time.Duration // reconnect delay cap (default 5s)
+    Logger      *log.Logger   // connection errors; nil discards them
+}
+
+func (o *ReplicaOptions) setDefaults() {
+    if o.NewStore == nil {
+        o.NewStore = func() kv.KVStore { return kv.NewBTreeStore() }
+    }
+    if o.DialTimeout <= 0 {
+        o.DialTimeout = 5 * time.Second
+    }
+    if o.MinBackoff <= 0 {
+        o.MinBackoff = 50 * time.Millisecond
+    }
+    if o.MaxBackoff <= 0 {
+        o.MaxBackoff = 5 * time.Second
+    }
+    if o.Logger == nil {
+        o.Logger = log.New(io.Discard, "", 0)
+    }
+}
+
+// Replica is a read-only copy of a primary's store, kept up to date in
+// the background. Writes fail with ErrReadOnly.
+type Replica struct {
+    addr string
+    opts ReplicaOptions
+
+    mu      sync.RWMutex // guards store; held for writing while a record applies
+    store   kv.KVStore
+    runID   string // run ID seq belongs to; "" before the first snapshot
+    seq     uint64 // last applied sequence
+    primary uint64 // latest sequence the primary has reported
+
+    connMu sync.Mutex
+    nc     net.Conn
+    closed bool
+    done   chan struct{}
+    wg     sync.WaitGroup
+}
+
+// StartReplica starts replicating from the primary at addr. It returns
+// at once; the replica is empty until its first snapshot or record
+// arrives, and reconnects with backoff whenever the connection drops.
+func StartReplica(addr string, opts ReplicaOptions) *Replica {
+    opts.setDefaults()
+    r := &Replica{addr: addr, opts: opts, store: opts.NewStore(), done: make(chan struct{})}
+    r.wg.Add(1)
+    go r.run()
+    return r
+}
+
+// Seq returns the sequence number of the last applied write.
+func (r *Replica) Seq() uint64 {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.seq
+}
+
+// Lag returns how many writes the replica is behind the primary, as of
+// the primary's last record or heartbeat.
+func (r *Replica) Lag() uint64 {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    if r.primary <= r.seq {
+        return 0
+    }
+    return r.primary - r.seq
+}
+
+// Get reads key from the replica.
+func (r *Replica) Get(key string) (string, error) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.store.Get(key)
+}
+
+// Range reads from the replica.
+func (r *Replica) Range(start, end string) ([]string, error) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.store.Range(start, end)
+}
+
+// NewIterator iterates the replica's current store. Records applied
+// while it is open may or may not be visible, as with the store itself.
+func (r *Replica) NewIterator() kv.Iterator {
+    r.mu.RLock()
+    store := r.store
+    r.mu.RUnlock()
+    it, err := kv.NewIterator(store)
+    if err != nil {
+        return kv.NewErrorIterator(err)
+    }
+    return it
+}
+
+// TTL reports the time left on key, if the replica's store supports TTLs.
+func (r *Replica) TTL(key string) (time.Duration, error) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    e, ok := r.store.(kv.Expirer)
+    if !ok {
+        return 0, kv.ErrUnsupported
+    }
+    return e.TTL(key)
+}
+
+// ExpiredKeys returns how many keys have expired in the replica's store.
+// Keys expire independently on each replica.
+func (r *Replica) ExpiredKeys() uint64 {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    if e, ok := r.store.(kv.Expirer); ok {
+        return e.ExpiredKeys()
+    }
+    return 0
+}
+
+// SetWithTTL fails with ErrReadOnly.
+func (r *Replica) SetWithTTL(key, value string, ttl time.Duration) error {
+    return ErrReadOnly
+}
+
+// Set fails with ErrReadOnly.
+func (r *Replica) Set(key, value string) error {
+    return ErrReadOnly
+}
+
+// Delete fails with ErrReadOnly.
+func (r *Replica) Delete(key string) error {
+    return ErrReadOnly
+}
+
+// Flush flushes the replica's store.
+func (r *Replica) Flush() error {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.store.Flush()
+}
+
+// Close stops replicating. The replica's data stays readable.
+func (r *Replica) Close() error {
+    r.connMu.Lock()
+    if r.closed {
+        r.connMu.Unlock()
+        return nil
+    }
+    r.closed = true
+    close(r.done)
+    if r.nc != nil {
+        r.nc.Close()
+    }
+    r.connMu.Unlock()
+    r.wg.Wait()
+    return nil
+}
+
+// run connects to the primary until Close, backing off between failed
+// attempts.
+func (r *Replica) run() {
+    defer r.wg.Done()
+    for attempt := 0; ; {
+        progressed, err := r.session()
+        select {
+        case <-r.done:
+            return
+        default:
+        }
+        r.opts.Logger.Printf("repl: replica of %s: %v", r.addr, err)
+        if progressed {
+            attempt = 0
+        }
+        select {
+        case <-time.After(r.backoff(attempt)):
+        case <-r.done:
+            return
+        }
+        attempt++
+    }
+}
+
+// backoff returns a random delay up to MinBackoff<<attempt, capped at
+// MaxBackoff.
+func (r *Replica) backoff(attempt int) time.Duration {
+    d := r.opts.MaxBackoff
+    if attempt < 30 && r.opts.MinBackoff<<attempt < d {
+        d = r.opts.MinBackoff << attempt
+    }
+    return time.Duration(rand.Int64N(int64(d))) + 1
+}
+
+// session runs one connection and reports whether it applied anything.
+func (r *Replica) session() (bool, error) {
+    nc, err := net.DialTimeout("tcp", r.addr, r.opts.DialTimeout)
+    if err != nil {
+        return false, err
+    }
+    r.connMu.Lock()
+    if r.closed {
+        r.connMu.Unlock()
+        nc.Close()
+        return false, ErrClosed
+    }
+    r.nc = nc
+    r.connMu.Unlock()
+    defer nc.Close()
+
+    id := r.opts.ID
+    if id == "" {
+        id = nc.LocalAddr().String()
+    }
+    br, bw := bufio.NewReader(nc), bufio.NewWriter(nc)
+    r.mu.RLock()
+    hello := runPayload(r.seq, r.runID, []byte(id))
+    r.mu.RUnlock()
+    if err := writeFrame(bw, frameHello, hello); err != nil {
+        return false, err
+    }
+    if err := bw.Flush(); err != nil {
+        return false, err
+    }
+    progressed := false
+    var load *snapshotLoad
+    for {
+        typ, payload, err := readFrame(br)
+        if err != nil {
+            return progressed, err
+        }
+        switch typ {
+        case frameSnapshot:
+            seq, run, _, err := readRun(payload)
+            if err != nil {
+                return progressed, err
+            }
+            load = &snapshotLoad{store: r.opts.NewStore(), run: run, seq: seq}
+        case frameSnapshotChunk:
+            rec, err := decodeRecord(payload)
+            if err != nil {
+                return progressed, err
+            }
+            if load == nil || load.done || rec.seq != load.seq {
+                return progressed, ErrBadFrame
+            }
+            if err := writeOps(load.store, rec.ops); err != nil {
+                return progressed, fmt.Errorf("repl: load snapshot: %w", err)
+            }
+            load.count += uint64(len(rec.ops))
+        case frameSnapshotEnd:
+            end, rest, err := readSeq(payload)
+            if err != nil {
+                return progressed, err
+            }
+            count, k := binary.Uvarint(rest)
+            if load == nil || load.done || k <= 0 || count != load.count || end < load.seq {
+                return progressed, ErrBadFrame
+            }
+            load.end, load.done = end, true
+            if load.seq == end {
+                r.install(load)
+                load = nil
+            }
+        case frameRecord:
+            rec, err := decodeRecord(payload)
+            if err != nil {
+                return progressed, err
+            }
+            if load == nil {
+                if err := r.apply(rec); err != nil {
+                    return progressed, err
+                }
+                break
+            }
+            if err := load.apply(rec); err != nil {
+                return progressed, err
+            }
+            if load.seq == load.end {
+                r.install(load)
+                load = nil
+            }
+        case frameHeartbeat:
+            seq, _, err := readSeq(payload)
+            if err != nil {
+                return progressed, err
+            }
+            r.mu.Lock()
+            r.primary = seq
+            r.mu.Unlock()
+            continue
+        default:
+            return progressed, ErrBadFrame
+        }
+        progressed = true
+        // Acknowledge once caught up with what has arrived, rather than
+        // after every record of a burst.
+        if br.Buffered() == 0 {
+            if err := writeFrame(bw, frameAck, seqPayload(r.Seq(), nil)); err != nil {
+                return progressed, err
+            }
+            if err := bw.Flush(); err != nil {
+                return progressed, err
+            }
+        }
+    }
+}
+
+// snapshotLoad is a snapshot being received into a fresh store, so
+// readers see the old contents until the new ones are complete. The
+// primary scans its store while writes go on, so the snapshot is only
+// exact once the records up to where the scan ended are replayed on it.
+type snapshotLoad struct {
+    store kv.KVStore
+    run   string
+    seq   uint64 // last record replayed; the scan started after it
+    end   uint64 // where the scan ended
+    count uint64 // keys received
+    done  bool   // the scan has ended
+}
+
+// apply replays one record, which must be the next in sequence, on a
+// loaded snapshot.
+func (l *snapshotLoad) apply(rec record) error {
+    if !l.done || rec.seq != l.seq+1 {
+        return fmt.Errorf("repl: record %d during snapshot at %d: %w", rec.seq, l.seq, ErrBadFrame)
+    }
+    if err := writeOps(l.store, rec.ops); err != nil {
+        return fmt.Errorf("repl: apply record %d: %w", rec.seq, err)
+    }
+    l.seq = rec.seq
+    return nil
+}
+
+// install replaces the replica's contents with a complete snapshot.
+func (r *Replica) install(l *snapshotLoad) {
+    r.mu.Lock()
+    r.store, r.runID, r.seq, r.primary = l.store, l.run, l.seq, l.seq
+    r.mu.Unlock()
+}
+
+// apply writes one record, which must be the next in sequence.
+func (r *Replica) apply(rec record) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if rec.seq != r.seq+1 {
+        return fmt.Errorf("repl: record %d after %d: %w", rec.seq, r.seq, ErrBadFrame)
+    }
+    if err := writeOps(r.store, rec.ops); err != nil {
+        return fmt.Errorf("repl: apply record %d: %w", rec.seq, err)
+    }
+    r.seq = rec.seq
+    r.primary = max(r.primary, rec.seq)
+    return nil
+}
+
+// writeOps writes ops to s as one batch.
+func writeOps(s kv.KVStore, ops []op) error {
+    var b kv.WriteBatch
+    now := time.Now()
+    for _, o := range ops {
+        switch {
+        case o.delete:
+            b.Delete(o.key)
+        case o.expires != 0:
+            // Expire at the primary's time; drop what already has.
+            if ttl := time.Unix(0, o.expires).Sub(now); ttl > 0 {
+                b.PutWithTTL(o.key, o.value, ttl)
+            } else {
+                b.Delete(o.key)
+            }
+        default:
+            b.Put(o.key, o.value)
+        }
+    }
+    return kv.Write(s, &b)
+}
@@ -0,0 +1,542 @@
+package resp
+
+import (
+    "errors"
+    "hash/fnv"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/thilakshekharshriyan/m/kv"
+)
+
+// command is a handler and its arity in Redis convention: the number of
+// arguments including the command name, or -n for at least n.
+type command struct {
+    arity int
+    run   func(c *conn, args []string)
+}
+
+var commands = map[string]command{
+    "PING":    {-1, cmdPing},
+    "ECHO":    {2, cmdEcho},
+    "HELLO":   {-1, cmdHello},
+    "QUIT":    {1, cmdQuit},
+    "SELECT":  {2, cmdSelect},
+    "COMMAND": {-1, cmdEmpty},
+    "CONFIG":  {-2, cmdConfig},
+    "CLIENT":  {-2, cmdClient},
+    "GET":     {2, cmdGet},
+    "SET":     {-3, cmdSet},
+    "DEL":     {-2, cmdDel},
+    "EXISTS":  {-2, cmdExists},
+    "MGET":    {-2, cmdMGet},
+    "MSET":    {-3, cmdMSet},
+    "EXPIRE":  {3, cmdExpire},
+    "TTL":     {2, cmdTTL},
+    "SCAN":    {-2, cmdScan},
+}
+
+// dispatch runs one command; args[0] is its name.
+func (c *conn) dispatch(args []string) {
+    name := strings.ToUpper(args[0])
+    cmd, ok := commands[name]
+    if !ok {
+        c.w.error("ERR unknown command '" + args[0] + "'")
+        return
+    }
+    if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+        c.w.error("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+        return
+    }
+    cmd.run(c, args)
+}
+
+// storeError replies with a store error.
+func (c *conn) storeError(err error) {
+    if errors.Is(err, kv.ErrUnsupported) {
+        c.w.error("ERR operation unsupported by this store")
+        return
+    }
+    c.w.error("ERR " + err.Error())
+}
+
+func cmdPing(c *conn, args []string) {
+    switch len(args) {
+    case 1:
+        c.w.simple("PONG")
+    case 2:
+        c.w.bulk(args[1])
+    default:
+        c.w.error("ERR wrong number of arguments for 'ping' command")
+    }
+}
+
+func cmdEcho(c *conn, args []string) {
+    c.w.bulk(args[1])
+}
+
+func cmdQuit(c *conn, args []string) {
+    c.w.simple("OK")
+    c.quit = true
+}
+
+func cmdSelect(c *conn, args []string) {
+    if args[1] != "0" {
+        c.w.error("ERR DB index is out of range")
+        return
+    }
+    c.w.simple("OK")
+}
+
+// cmdEmpty answers introspection commands clients send on connect with an
+// empty array.
+func cmdEmpty(c *conn, args []string) {
+    c.w.array(0)
+}
+
+func cmdConfig(c *conn, args []string) {
+    if strings.EqualFold(args[1], "GET") {
+        c.w.mapLen(0)
+        return
+    }
+    c.w.error("ERR CONFIG " + args[1] + " is not supported")
+}
+
+func cmdClient(c *conn, args []string) {
+    switch strings.ToUpper(args[1]) {
+    case "ID":
+        c.w.int(c.id)
+    case "SETNAME", "SETINFO":
+        c.w.simple("OK")
+    default:
+        c.w.error("ERR CLIENT " + args[1] + " is not supported")
+    }
+}
+
+// cmdHello switches protocol version: HELLO [protover [AUTH user pass]
+// [SETNAME name]]. Authentication is not supported.
+func cmdHello(c *conn, args []string) {
+    if len(args) > 1 {
+        v, err := strconv.Atoi(args[1])
+        if err != nil || v < 2 || v > 3 {
+            c.w.error("NOPROTO unsupported protocol version")
+            return
+        }
+        for i := 2; i < len(args); i++ {
+            switch strings.ToUpper(args[i]) {
+            case "AUTH":
+                c.w.error("ERR AUTH is not supported")
+                return
+            case "SETNAME":
+                i++
+            default:
+                c.w.error("ERR syntax error in HELLO")
+                return
+            }
+        }
+        c.w.proto = v
+    }
+    c.w.mapLen(7)
+    c.w.bulk("server")
+    c.w.bulk("fastkvst")
+    c.w.bulk("version")
+    c.w.bulk("1.0.0")
+    c.w.bulk("proto")
+    c.w.int(int64(c.w.proto))
+    c.w.bulk("id")
+    c.w.int(c.id)
+    c.w.bulk("mode")
+    c.w.bulk("standalone")
+    c.w.bulk("role")
+    c.w.bulk("master")
+    c.w.bulk("modules")
+    c.w.array(0)
+}
+
+func cmdGet(c *conn, args []string) {
+    v, err := c.s.store.Get(args[1])
+    switch {
+    case err == kv.ErrNotFound:
+        c.w.null()
+    case err != nil:
+        c.storeError(err)
+    default:
+        c.w.bulk(v)
+    }
+}
+
+// cmdSet implements SET key value [NX|XX] [EX seconds|PX milliseconds].
+// NX and XX need a store with conditional writes; NX with an expiry needs
+// a kv.TTLCondWriter, and XX cannot be combined with one.
+func cmdSet(c *conn, args []string) {
+    key, value := args[1], args[2]
+    var nx, xx bool
+    var ttl time.Duration
+    for i := 3; i < len(args); i++ {
+        switch opt := strings.ToUpper(args[i]); opt {
+        case "NX":
+            nx = true
+        case "XX":
+            xx = true
+        case "EX", "PX":
+            if i+1 == len(args) || ttl != 0 {
+                c.w.error("ERR syntax error")
+                return
+            }
+            n, err := strconv.ParseInt(args[i+1], 10, 64)
+            if err != nil || n <= 0 {
+                c.w.error("ERR invalid expire time in 'set' command")
+                return
+            }
+            i++
+            ttl = time.Duration(n) * time.Millisecond
+            if opt == "EX" {
+                ttl = time.Duration(n) * time.Second
+            }
+        default:
+            c.w.error("ERR syntax error")
+            return
+        }
+    }
+    if nx && xx {
+        c.w.error("ERR syntax error")
+        return
+    }
+    if xx && ttl != 0 {
+        c.w.error("ERR XX cannot be combined with an expiry on this server")
+        return
+    }
+
+    var ok bool
+    var err error
+    switch {
+    case nx && ttl != 0:
+        ok, err = kv.SetIfAbsentWithTTL(c.s.store, key, value, ttl)
+    case ttl != 0:
+        ok, err = true, kv.SetWithTTL(c.s.store, key, value, ttl)
+    case nx:
+        ok, err = kv.SetIfAbsent(c.s.store, key, value)
+    case xx:
+        ok, err = setIfPresent(c.s.store, key, value)
+    default:
+        ok, err = true, c.s.store.Set(key, value)
+    }
+    switch {
+    case err != nil:
+        c.storeError(err)
+    case !ok:
+        c.w.null()
+    default:
+        c.w.simple("OK")
+    }
+}
+
+// setIfPresent sets key only if it exists, retrying the compare-and-swap
+// while the value changes under it.
+func setIfPresent(s kv.KVStore, key, value string) (bool, error) {
+    if _, ok := s.(kv.CondWriter); !ok {
+        return false, kv.ErrUnsupported
+    }
+    for {
+        cur, err := s.Get(key)
+        if err == kv.ErrNotFound {
+            return false, nil
+        }
+        if err != nil {
+            return false, err
+        }
+        if ok, err := kv.CompareAndSwap(s, key, cur, value); ok || err != nil {
+            return ok, err
+        }
+    }
+}
+
+// cmdDel deletes keys and replies with how many existed.
+func cmdDel(c *conn, args []string) {
+    var n int64
+    for _, key := range args[1:] {
+        // Not every store reports deleting a missing key, so look first.
+        if _, err := c.s.store.Get(key); err == kv.ErrNotFound {
+            continue
+        } else if err != nil {
+            c.storeError(err)
+            return
+        }
+        err := c.s.store.Delete(key)
+        if err == kv.ErrNotFound {
+            continue
+        }
+        if err != nil {
+            c.storeError(err)
+            return
+        }
+        n++
+    }
+    c.w.int(n)
+}
+
+func cmdExists(c *conn, args []string) {
+    var n int64
+    for _, key := range args[1:] {
+        _, err := c.s.store.Get(key)
+        if err == kv.ErrNotFound {
+            continue
+        }
+        if err != nil {
+            c.storeError(err)
+            return
+        }
+        n++
+    }
+    c.w.int(n)
+}
+
+func cmdMGet(c *conn, args []string) {
+    vals := make([]string, len(args)-1)
+    found := make([]bool, len(vals))
+    for i, key := range args[1:] {
+        v, err := c.s.store.Get(key)
+        if err == kv.ErrNotFound {
+            continue
+        }
+        if err != nil {
+            c.storeError(err)
+            return
+        }
+        vals[i], found[i] = v, true
+    }
+    c.w.array(len(vals))
+    for i, v := range vals {
+        if found[i] {
+            c.w.bulk(v)
+        } else {
+            c.w.null()
+        }
+    }
+}
+
+// cmdMSet writes every pair as one batch, atomically if the store
+// supports batches.
+func cmdMSet(c *conn, args []string) {
+    if len(args)%2 != 1 {
+        c.w.error("ERR wrong number of arguments for 'mset' command")
+        return
+    }
+    var b kv.WriteBatch
+    for i := 1; i < len(args); i += 2 {
+        b.Put(args[i], args[i+1])
+    }
+    err := kv.Write(c.s.store, &b)
+    if err == kv.ErrUnsupported {
+        err = nil
+        for i := 1; i < len(args) && err == nil; i += 2 {
+            err = c.s.store.Set(args[i], args[i+1])
+        }
+    }
+    if err != nil {
+        c.storeError(err)
+        return
+    }
+    c.w.simple("OK")
+}
+
+// cmdExpire sets a TTL on an existing key. A non-positive TTL deletes it.
+func cmdExpire(c *conn, args []string) {
+    secs, err := strconv.ParseInt(args[2], 10, 64)
+    if err != nil {
+        c.w.error("ERR value is not an integer or out of range")
+        return
+    }
+    ok, err := kv.Expire(c.s.store, args[1], time.Duration(secs)*time.Second)
+    if err != nil {
+        c.storeError(err)
+        return
+    }
+    if ok {
+        c.w.int(1)
+    } else {
+        c.w.int(0)
+    }
+}
+
+// cmdTTL replies with the seconds left, -1 for a key without expiry or
+// -2 for a missing key.
+func cmdTTL(c *conn, args []string) {
+    e, ok := c.s.store.(kv.Expirer)
+    if !ok {
+        if _, err := c.s.store.Get(args[1]); err == kv.ErrNotFound {
+            c.w.int(-2)
+        } else {
+            c.w.int(-1)
+        }
+        return
+    }
+    ttl, err := e.TTL(args[1])
+    switch {
+    case err == kv.ErrNotFound:
+        c.w.int(-2)
+    case err != nil:
+        c.storeError(err)
+    case ttl == kv.NoExpiry:
+        c.w.int(-1)
+    default:
+        c.w.int(int64((ttl + time.Second - 1) / time.Second))
+    }
+}
+
+// cmdScan implements SCAN cursor [MATCH pattern] [COUNT count]. Keys are
+// visited in order of their FNV-1a hash and the cursor is the hash to
+// resume from, so scans work the same whatever order a store iterates
+// in. Each call walks the whole store. As in Redis, a key present for
+// the whole scan is returned at least once, and keys written during it
+// may or may not be.
+func cmdScan(c *conn, args []string) {
+    cursor, err := strconv.ParseUint(args[1], 10, 64)
+    if err != nil {
+        c.w.error("ERR invalid cursor")
+        return
+    }
+    pattern, count := "*", 10
+    for i := 2; i < len(args); i += 2 {
+        if i+1 == len(args) {
+            c.w.error("ERR syntax error")
+            return
+        }
+        switch strings.ToUpper(args[i]) {
+        case "MATCH":
+            pattern = args[i+1]
+        case "COUNT":
+            if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+                c.w.error("ERR syntax error")
+                return
+            }
+        default:
+            c.w.error("ERR syntax error")
+            return
+        }
+    }
+    it, err := kv.NewIterator(c.s.store)
+    if err != nil {
+        c.storeError(err)
+        return
+    }
+    defer it.Close()
+    type hashed struct {
+        h   uint64
+        key string
+    }
+    var todo []hashed
+    for it.Next() {
+        if h := keyHash(it.Key()); h >= cursor {
+            todo = append(todo, hashed{h, it.Key()})
+        }
+    }
+    if err := it.Err(); err != nil {
+        c.storeError(err)
+        return
+    }
+    sort.Slice(todo, func(i, j int) bool { return todo[i].h < todo[j].h })
+    // Keys sharing the last hash stay on this page: the cursor cannot
+    // split them.
+    n := min(count, len(todo))
+    for n < len(todo) && todo[n].h == todo[n-1].h {
+        n++
+    }
+    next := uint64(0)
+    if n < len(todo) {
+        next = todo[n].h
+    }
+    var keys []string
+    for _, k := range todo[:n] {
+        if globMatch(pattern, k.key) {
+            keys = append(keys, k.key)
+        }
+    }
+    c.w.array(2)
+    c.w.bulk(strconv.FormatUint(next, 10))
+    c.w.array(len(keys))
+    for _, k := range keys {
+        c.w.bulk(k)
+    }
+}
+
+// keyHash orders keys for SCAN.
+func keyHash(key string) uint64 {
+    h := fnv.New64a()
+    h.Write([]byte(key))
+    return h.Sum64()
+}
+
+// globMatch reports whether s matches a Redis glob pattern: * and ? match
+// any run of bytes and any single byte, [...] a byte class (with ^
+// negation and a-z ranges), and \ escapes the next byte.
+func globMatch(pattern, s string) bool {
+    for len(pattern) > 0 {
+        switch pattern[0] {
+        case '*':
+            for len(pattern) > 0 && pattern[0] == '*' {
+                pattern = pattern[1:]
+            }
+            if pattern == "" {
+                return true
+            }
+            for i := 0; i <= len(s); i++ {
+                if globMatch(pattern, s[i:]) {
+                    return true
+                }
+            }
+            return false
+        case '?':
+            if s == "" {
+                return false
+            }
+        case '[':
+            if s == "" {
+                return false
+            }
+            end := strings.IndexByte(pattern[1:], ']')
+            if end < 0 {
+                return false
+            }
+            class := pattern[1 : end+1]
+            neg := strings.HasPrefix(class, "^")
+            if neg {
+                class = class[1:]
+            }
+            if classMatch(class, s[0]) == neg {
+                return false
+            }
+            pattern = pattern[end+1:]
+        case '\\':
+            if len(pattern) > 1 {
+                pattern = pattern[1:]
+            }
+            fallthrough
+        default:
+            if s == "" || s[0] != pattern[0] {
+                return false
+            }
+        }
+        pattern, s = pattern[1:], s[1:]
+    }
+    return s == ""
+}
+
+// classMatch reports whether b is in a [...] class body.
+func classMatch(class string, b byte) bool {
+    for i := 0; i < len(class); i++ {
+        if i+2 < len(class) && class[i+1] == '-' {
+            if class[i] <= b && b <= class[i+2] {
+                return true
+            }
+            i += 2
+            continue
+        }
+        if class[i] == b {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,162 @@
+// Package resp serves a kv.KVStore over the Redis protocol (RESP2 and
+// RESP3), so existing Redis clients and tools can talk to FastKVst.
+package resp
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+)
+
+// ErrProtocol is returned for malformed client input. The server replies
+// with an error and closes the connection.
+var ErrProtocol = errors.New("resp: protocol error")
+
+// maxArgs bounds the number of arguments in one command.
+const maxArgs = 1 << 20
+
+// reader parses client commands: RESP arrays of bulk strings, or inline
+// commands (a line of space-separated words) as sent by telnet.
+type reader struct {
+    r          *bufio.Reader
+    maxBulkLen int
+}
+
+func newReader(r io.Reader, maxBulkLen int) *reader {
+    return &reader{r: bufio.NewReaderSize(r, 16<<10), maxBulkLen: maxBulkLen}
+}
+
+// buffered reports whether more input is already waiting, i.e. the client
+// is pipelining and replies can stay buffered.
+func (r *reader) buffered() bool {
+    return r.r.Buffered() > 0
+}
+
+// readCommand returns the next command's arguments. An empty inline line
+// yields no arguments.
+func (r *reader) readCommand() ([]string, error) {
+    line, err := r.readLine()
+    if err != nil {
+        return nil, err
+    }
+    if len(line) == 0 || line[0] != '*' {
+        return strings.Fields(line), nil
+    }
+    n, err := strconv.Atoi(line[1:])
+    if err != nil || n > maxArgs {
+        return nil, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+    }
+    // The count is the client's claim; grow past a small hint only as
+    // arguments actually arrive.
+    args := make([]string, 0, min(max(n, 0), 1024))
+    for i := 0; i < n; i++ {
+        line, err := r.readLine()
+        if err != nil {
+            return nil, err
+        }
+        if len(line) == 0 || line[0] != '$' {
+            return nil, fmt.Errorf("%w: expected '$', got %q", ErrProtocol, line)
+        }
+        size, err := strconv.Atoi(line[1:])
+        if err != nil || size < 0 || size > r.maxBulkLen {
+            return nil, fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+        }
+        buf := make([]byte, size+2)
+        if _, err := io.ReadFull(r.r, buf); err != nil {
+            return nil, err
+        }
+        if buf[size] != '\r' || buf[size+1] != '\n' {
+            return nil, fmt.Errorf("%w: bulk string not terminated", ErrProtocol)
+        }
+        args = append(args, string(buf[:size]))
+    }
+    return args, nil
+}
+
+// readLine reads a line without its \r\n (or bare \n).
+func (r *reader) readLine() (string, error) {
+    line, err := r.r.ReadSlice('\n')
+    if err == bufio.ErrBufferFull {
+        return "", fmt.Errorf("%w: line too long", ErrProtocol)
+    }
+    if err != nil {
+        return "", err
+    }
+    line = line[:len(line)-1]
+    if n := len(line); n > 0 && line[n-1] == '\r' {
+        line = line[:n-1]
+    }
+    return string(line), nil
+}
+
+// writer encodes replies in the connection's protocol version. RESP2
+// has no null or map types; they are sent as a null bulk string and a
+// flat array of key/value pairs.
+type writer struct {
+    w     *bufio.Writer
+    proto int // 2 or 3
+}
+
+func newWriter(w io.Writer) *writer {
+    return &writer{w: bufio.NewWriterSize(w, 16<<10), proto: 2}
+}
+
+func (w *writer) simple(s string) {
+    w.w.WriteByte('+')
+    w.w.WriteString(s)
+    w.w.WriteString("\r\n")
+}
+
+// error writes an error reply; msg should start with an error code such
+// as ERR.
+func (w *writer) error(msg string) {
+    w.w.WriteByte('-')
+    w.w.WriteString(strings.NewReplacer("\r", " ", "\n", " ").Replace(msg))
+    w.w.WriteString("\r\n")
+}
+
+func (w *writer) int(n int64) {
+    w.w.WriteByte(':')
+    w.w.WriteString(strconv.FormatInt(n, 10))
+    w.w.WriteString("\r\n")
+}
+
+func (w *writer) bulk(s string) {
+    w.w.WriteByte('$')
+    w.w.WriteString(strconv.Itoa(len(s)))
+    w.w.WriteString("\r\n")
+    w.w.WriteString(s)
+    w.w.WriteString("\r\n")
+}
+
+func (w *writer) null() {
+    if w.proto >= 3 {
+        w.w.WriteString("_\r\n")
+        return
+    }
+    w.w.WriteString("$-1\r\n")
+}
+
+func (w *writer) array(n int) {
+    w.w.WriteByte('*')
+    w.w.WriteString(strconv.Itoa(n))
+    w.w.WriteString("\r\n")
+}
+
+// mapLen starts a map of n key/value pairs.
+func (w *writer) mapLen(n int) {
+    if w.proto >= 3 {
+        w.w.WriteByte('%')
+        w.w.WriteString(strconv.Itoa(n))
+        w.w.WriteString("\r\n")
+        return
+    }
+    w.array(2 * n)
+}
+
+func (w *writer) flush() error {
+    return w.w.Flush()
+}
@@ -0,0 +1,204 @@
+package resp
+
+import (
+    "errors"
+    "io"
+    "log"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/thilakshekharshriyan/m/kv"
+)
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("resp: server closed")
+
+// Options configures a Server. Zero values select the defaults.
+type Options struct {
+    MaxConns    int           // concurrent connections (default 10000)
+    IdleTimeout time.Duration // close connections idle this long; 0 never
+    MaxBulkLen  int           // largest accepted argument in bytes (default 64 MiB)
+    Logger      *log.Logger   // connection errors; nil discards them
+}
+
+func (o *Options) setDefaults() {
+    if o.MaxConns <= 0 {
+        o.MaxConns = 10000
+    }
+    if o.MaxBulkLen <= 0 {
+        o.MaxBulkLen = 64 << 20
+    }
+    if o.Logger == nil {
+        o.Logger = log.New(io.Discard, "", 0)
+    }
+}
+
+// Server serves one kv.KVStore to any number of clients. Each connection
+// reads commands in order and buffers replies while more input is
+// waiting, so pipelined commands are answered in a single write.
+type Server struct {
+    store  kv.KVStore
+    opts   Options
+    nextID atomic.Int64
+
+    mu     sync.Mutex
+    ln     net.Listener
+    conns  map[net.Conn]struct{}
+    closed bool
+    wg     sync.WaitGroup
+}
+
+// NewServer returns a Server for store.
+func NewServer(store kv.KVStore, opts Options) *Server {
+    opts.setDefaults()
+    return &Server{store: store, opts: opts, conns: make(map[net.Conn]struct{})}
+}
+
+// ListenAndServe listens on the TCP address addr and serves clients.
+func (s *Server) ListenAndServe(addr string) error {
+    ln, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    return s.Serve(ln)
+}
+
+// Serve accepts connections on ln until Close is called, then returns
+// ErrServerClosed. Clients over the MaxConns limit get an error reply and
+// are disconnected.
+func (s *Server) Serve(ln net.Listener) error {
+    s.mu.Lock()
+    if s.closed {
+        s.mu.Unlock()
+        ln.Close()
+        return ErrServerClosed
+    }
+    s.ln = ln
+    s.mu.Unlock()
+
+    for {
+        nc, err := ln.Accept()
+        if err != nil {
+            s.mu.Lock()
+            closed := s.closed
+            s.mu.Unlock()
+            if closed {
+                return ErrServerClosed
+            }
+            var ne net.Error
+            if errors.As(err, &ne) && ne.Timeout() {
+                time.Sleep(10 * time.Millisecond)
+                continue
+            }
+            return err
+        }
+        if !s.track(nc) {
+            w := newWriter(nc)
+            w.error("ERR max number of clients reached")
+            w.flush()
+            nc.Close()
+            continue
+        }
+        go s.serveConn(nc)
+    }
+}
+
+// track registers a new connection, reporting false if the server is
+// closed or full.
+func (s *Server) track(nc net.Conn) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.closed || len(s.conns) >= s.opts.MaxConns {
+        return false
+    }
+    s.conns[nc] = struct{}{}
+    s.wg.Add(1)
+    return true
+}
+
+func (s *Server) untrack(nc net.Conn) {
+    s.mu.Lock()
+    delete(s.conns, nc)
+    s.mu.Unlock()
+    s.wg.Done()
+}
+
+// Addr returns the listener's address, or nil before Serve.
+func (s *Server) Addr() net.Addr {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.ln == nil {
+        return nil
+    }
+    return s.ln.Addr()
+}
+
+// Close stops accepting, closes every connection and waits for their
+// handlers to return. It does not close the store.
+func (s *Server) Close() error {
+    s.mu.Lock()
+    if s.closed {
+        s.mu.Unlock()
+        return nil
+    }
+    s.closed = true
+    var err error
+    if s.ln != nil {
+        err = s.ln.Close()
+    }
+    for nc := range s.conns {
+        nc.Close()
+    }
+    s.mu.Unlock()
+    s.wg.Wait()
+    return err
+}
+
+// conn is the per-connection state.
+type conn struct {
+    s    *Server
+    nc   net.Conn
+    id   int64
+    r    *reader
+    w    *writer
+    quit bool
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+    defer s.untrack(nc)
+    defer nc.Close()
+    c := &conn{
+        s:  s,
+        nc: nc,
+        id: s.nextID.Add(1),
+        r:  newReader(nc, s.opts.MaxBulkLen),
+        w:  newWriter(nc),
+    }
+    for !c.quit {
+        if s.opts.IdleTimeout > 0 {
+            nc.SetReadDeadline(time.Now().Add(s.opts.IdleTimeout))
+        }
+        args, err := c.r.readCommand()
+        if err != nil {
+            if errors.Is(err, ErrProtocol) {
+                c.w.error("ERR " + err.Error())
+                c.w.flush()
+            }
+            if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+                s.opts.Logger.Printf("resp: %s: %v", nc.RemoteAddr(), err)
+            }
+            return
+        }
+        if len(args) > 0 {
+            c.dispatch(args)
+        }
+        if !c.r.buffered() {
+            if err := c.w.flush(); err != nil {
+                return
+            }
+        }
+    }
+    c.w.flush()
+}
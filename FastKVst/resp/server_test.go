@@ -0,0 +1,287 @@
+package resp
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "net"
+    "sort"
+    "strings"
+    "testing"
+
+    "github.com/thilakshekharshriyan/m/kv"
+)
+
+// startServer serves store on a loopback port until the test ends and
+// returns its address.
+func startServer(t *testing.T, store kv.KVStore, opts Options) string {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    s := NewServer(store, opts)
+    done := make(chan error, 1)
+    go func() { done <- s.Serve(ln) }()
+    t.Cleanup(func() {
+        s.Close()
+        if err := <-done; err != ErrServerClosed {
+            t.Errorf("Serve returned %v", err)
+        }
+    })
+    return ln.Addr().String()
+}
+
+// client sends raw commands and reads raw replies.
+type client struct {
+    t  *testing.T
+    nc net.Conn
+    r  *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+    nc, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { nc.Close() })
+    return &client{t: t, nc: nc, r: bufio.NewReader(nc)}
+}
+
+// encode builds a RESP array of bulk strings.
+func encode(args ...string) string {
+    var b strings.Builder
+    fmt.Fprintf(&b, "*%d\r\n", len(args))
+    for _, a := range args {
+        fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+    }
+    return b.String()
+}
+
+func (c *client) send(raw string) {
+    if _, err := c.nc.Write([]byte(raw)); err != nil {
+        c.t.Fatal(err)
+    }
+}
+
+// reply reads one reply, rendered compactly: aggregates as [a b], nulls as
+// nil, errors with their leading '-'.
+func (c *client) reply() string {
+    line, err := c.r.ReadString('\n')
+    if err != nil {
+        c.t.Fatal(err)
+    }
+    line = strings.TrimSuffix(line, "\r\n")
+    switch line[0] {
+    case '+', ':':
+        return line[1:]
+    case '-':
+        return line
+    case '_':
+        return "nil"
+    case '$':
+        var n int
+        fmt.Sscan(line[1:], &n)
+        if n < 0 {
+            return "nil"
+        }
+        buf := make([]byte, n+2)
+        if _, err := io.ReadFull(c.r, buf); err != nil {
+            c.t.Fatal(err)
+        }
+        return string(buf[:n])
+    case '*', '%':
+        var n int
+        fmt.Sscan(line[1:], &n)
+        if line[0] == '%' {
+            n *= 2
+        }
+        parts := make([]string, n)
+        for i := range parts {
+            parts[i] = c.reply()
+        }
+        return "[" + strings.Join(parts, " ") + "]"
+    }
+    c.t.Fatalf("unexpected reply %q", line)
+    return ""
+}
+
+func (c *client) do(args ...string) string {
+    c.send(encode(args...))
+    return c.reply()
+}
+
+func TestCommands(t *testing.T) {
+    addr := startServer(t, kv.NewBTreeStore(), Options{})
+    c := dial(t, addr)
+    for _, tc := range []struct {
+        args []string
+        want string
+    }{
+        {[]string{"PING"}, "PONG"},
+        {[]string{"echo", "hi"}, "hi"},
+        {[]string{"GET", "a"}, "nil"},
+        {[]string{"SET", "a", "1"}, "OK"},
+        {[]string{"set", "a", "2", "NX"}, "nil"},
+        {[]string{"SET", "b", "x", "XX"}, "nil"},
+        {[]string{"SET", "a", "3", "XX"}, "OK"},
+        {[]string{"GET", "a"}, "3"},
+        {[]string{"SET", "lock", "1", "NX", "EX", "50"}, "OK"},
+        {[]string{"SET", "lock", "2", "PX", "10", "NX"}, "nil"},
+        {[]string{"TTL", "lock"}, "50"},
+        {[]string{"SET", "lock", "2", "XX", "EX", "5"}, "-ERR XX cannot be combined with an expiry on this server"},
+        {[]string{"MSET", "b", "2", "c", "bin\x00\r\n"}, "OK"},
+        {[]string{"MGET", "a", "nope", "c"}, "[3 nil bin\x00\r\n]"},
+        {[]string{"EXISTS", "a", "b", "nope"}, "2"},
+        {[]string{"TTL", "a"}, "-1"},
+        {[]string{"EXPIRE", "a", "100"}, "1"},
+        {[]string{"TTL", "a"}, "100"},
+        {[]string{"EXPIRE", "nope", "100"}, "0"},
+        {[]string{"EXPIRE", "c", "0"}, "1"},
+        {[]string{"GET", "c"}, "nil"},
+        {[]string{"DEL", "a", "b", "nope"}, "2"},
+        {[]string{"TTL", "a"}, "-2"},
+        {[]string{"SET", "k", "v", "EX", "0"}, "-ERR invalid expire time in 'set' command"},
+        {[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+        {[]string{"NOSUCH"}, "-ERR unknown command 'NOSUCH'"},
+    } {
+        if got := c.do(tc.args...); got != tc.want {
+            t.Fatalf("%q: got %q, want %q", tc.args, got, tc.want)
+        }
+    }
+
+    // Inline commands, as typed into telnet.
+    c.send("SET inline yes\r\nGET inline\r\n")
+    if got := c.reply() + " " + c.reply(); got != "OK yes" {
+        t.Fatalf("inline: got %q", got)
+    }
+}
+
+// plainStore hides every optional interface of the store it wraps.
+type plainStore struct{ kv.KVStore }
+
+func TestUnsupported(t *testing.T) {
+    addr := startServer(t, plainStore{kv.NewHashStore()}, Options{})
+    c := dial(t, addr)
+    for _, args := range [][]string{{"SET", "a", "1", "EX", "10"}, {"SET", "a", "1", "NX"}, {"EXPIRE", "a", "10"}} {
+        if got := c.do(args...); got != "-ERR operation unsupported by this store" {
+            t.Fatalf("%q: got %q", args, got)
+        }
+    }
+}
+
+func TestHelloResp3(t *testing.T) {
+    addr := startServer(t, kv.NewHashStore(), Options{})
+    c := dial(t, addr)
+    if got := c.do("GET", "x"); got != "nil" {
+        t.Fatalf("RESP2 null: %q", got)
+    }
+    if got := c.do("HELLO", "3"); !strings.HasPrefix(got, "[server fastkvst version 1.0.0 proto 3 ") {
+        t.Fatalf("HELLO 3: %q", got)
+    }
+    c.send(encode("GET", "x"))
+    if line, _ := c.r.ReadString('\n'); line != "_\r\n" {
+        t.Fatalf("RESP3 null: %q", line)
+    }
+    if got := c.do("HELLO", "4"); got != "-NOPROTO unsupported protocol version" {
+        t.Fatalf("HELLO 4: %q", got)
+    }
+}
+
+func TestPipelining(t *testing.T) {
+    addr := startServer(t, kv.NewHashStore(), Options{})
+    c := dial(t, addr)
+    var batch strings.Builder
+    for i := 0; i < 1000; i++ {
+        batch.WriteString(encode("SET", fmt.Sprint("key", i), fmt.Sprint(i)))
+        batch.WriteString(encode("GET", fmt.Sprint("key", i)))
+    }
+    go c.send(batch.String())
+    for i := 0; i < 1000; i++ {
+        if got := c.reply(); got != "OK" {
+            t.Fatalf("SET %d: %q", i, got)
+        }
+        if got := c.reply(); got != fmt.Sprint(i) {
+            t.Fatalf("GET %d: %q", i, got)
+        }
+    }
+}
+
+func TestScan(t *testing.T) {
+    store := kv.NewHashStore()
+    for i := 0; i < 95; i++ {
+        store.Set(fmt.Sprintf("user:%02d", i), "x")
+    }
+    store.Set("other", "x")
+    addr := startServer(t, store, Options{})
+    c := dial(t, addr)
+
+    var keys []string
+    cursor := "0"
+    for {
+        c.send(encode("SCAN", cursor, "MATCH", "user:*", "COUNT", "20"))
+        line, _ := c.r.ReadString('\n')
+        if line != "*2\r\n" {
+            t.Fatalf("SCAN reply %q", line)
+        }
+        cursor = c.reply()
+        page := c.reply()
+        keys = append(keys, strings.Fields(strings.Trim(page, "[]"))...)
+        if cursor == "0" {
+            break
+        }
+    }
+    sort.Strings(keys)
+    if len(keys) != 95 || keys[0] != "user:00" || keys[94] != "user:94" {
+        t.Fatalf("scanned %d keys: %v", len(keys), keys)
+    }
+}
+
+func TestMaxConns(t *testing.T) {
+    addr := startServer(t, kv.NewHashStore(), Options{MaxConns: 1})
+    c1 := dial(t, addr)
+    if got := c1.do("PING"); got != "PONG" {
+        t.Fatalf("first client: %q", got)
+    }
+    c2 := dial(t, addr)
+    if got := c2.reply(); got != "-ERR max number of clients reached" {
+        t.Fatalf("second client: %q", got)
+    }
+    if got := c1.do("QUIT"); got != "OK" {
+        t.Fatalf("QUIT: %q", got)
+    }
+}
+
+func TestProtocolError(t *testing.T) {
+    addr := startServer(t, kv.NewHashStore(), Options{MaxBulkLen: 8})
+    c := dial(t, addr)
+    c.send(encode("SET", "k", "much too long"))
+    if got := c.reply(); !strings.HasPrefix(got, "-ERR resp: protocol error") {
+        t.Fatalf("got %q", got)
+    }
+    if _, err := c.r.ReadByte(); err == nil {
+        t.Fatal("connection left open after protocol error")
+    }
+}
+
+func TestGlobMatch(t *testing.T) {
+    for _, tc := range []struct {
+        pattern, s string
+        want       bool
+    }{
+        {"*", "", true},
+        {"user:*", "user:1", true},
+        {"user:*", "use", false},
+        {"h?llo", "hello", true},
+        {"h?llo", "hllo", false},
+        {"h[ae]llo", "hallo", true},
+        {"h[^e]llo", "hello", false},
+        {"h[a-c]llo", "hbllo", true},
+        {`a\*b`, "a*b", true},
+        {`a\*b`, "axb", false},
+        {"*x*y", "aaxbby", true},
+    } {
+        if got := globMatch(tc.pattern, tc.s); got != tc.want {
+            t.Errorf("globMatch(%q, %q) = %v", tc.pattern, tc.s, got)
+        }
+    }
+}
@@ -0,0 +1,529 @@
+// Package wal implements an append-only write-ahead log split into
+// segment files. Every record carries a CRC32C checksum so that a torn or
+// corrupt tail left by a crash is detected and discarded on recovery.
+// Records can be encrypted with keys from an encrypt.KeyProvider.
+package wal
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/thilakshekharshriyan/m/encrypt"
+)
+
+// Segment file layout:
+//
+//   [header: magic u32 | version u32 [| idLen u8 | keyID]] [record] [record] ...
+//
+// Each record is crc u32 | length u32 | payload, where the checksum
+// covers the length field and the payload. Version 1 segments hold plain
+// payloads. Version 2 segments name the key in their header and each
+// payload is sealed with it, authenticated together with the segment
+// number and the record's offset so records cannot be moved.
+const (
+    segmentMagic     = 0x4c41574b // "KWAL"
+    segmentVersion   = 1
+    segmentEncrypted = 2
+    headerSize       = 8 // fixed part of the header
+    recordHeader     = 8
+    segmentSuffix    = ".wal"
+
+    defaultSegmentSize  = 64 << 20
+    defaultSyncInterval = 100 * time.Millisecond
+)
+
+var (
+    // ErrCorrupt is returned when a record before the tail of the log fails
+    // its checksum, i.e. damage that cannot be explained by a crash.
+    ErrCorrupt = errors.New("wal: corrupt record")
+    // ErrClosed is returned by operations on a closed log.
+    ErrClosed = errors.New("wal: log closed")
+    // ErrNoKeys is returned when reading an encrypted segment without a
+    // KeyProvider.
+    ErrNoKeys = errors.New("wal: encrypted segment but no key provider")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// SyncPolicy controls when appended records are fsynced.
+type SyncPolicy int
+
+const (
+    SyncAlways   SyncPolicy = iota // fsync after every Append
+    SyncInterval                   // fsync in the background every Options.SyncInterval
+    SyncNever                      // leave flushing to the OS
+)
+
+// Options configures a Log.
+type Options struct {
+    SegmentSize  int64         // rotate segments after this many bytes (default 64MiB)
+    Sync         SyncPolicy    // fsync policy (default SyncAlways)
+    SyncInterval time.Duration // period for SyncInterval (default 100ms)
+
+    // Keys, if set, encrypts new segments with its current key. Segments
+    // written under older keys, or unencrypted, remain readable.
+    Keys encrypt.KeyProvider
+}
+
+// Log is a segmented write-ahead log. It is safe for concurrent use.
+type Log struct {
+    mu      sync.Mutex
+    dir     string
+    opts    Options
+    seg     *os.File // segment currently appended to
+    segNum  uint64
+    segSize int64
+    hdrSize int64           // header size of the current segment
+    cipher  *encrypt.Cipher // seals records of the current segment; nil if plain
+    dirty   bool            // appended data not yet fsynced
+    failed  error           // set when a failed append could not be undone
+    closed  bool
+
+    stop chan struct{}
+    done chan struct{}
+}
+
+// Open opens the log in dir, creating it if needed. A truncated or corrupt
+// tail in the newest segment is cut off so appends resume after the last
+// valid record.
+func Open(dir string, opts Options) (*Log, error) {
+    if opts.SegmentSize <= 0 {
+        opts.SegmentSize = defaultSegmentSize
+    }
+    if opts.SyncInterval <= 0 {
+        opts.SyncInterval = defaultSyncInterval
+    }
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return nil, err
+    }
+    l := &Log{dir: dir, opts: opts}
+
+    segs, err := l.segments()
+    if err != nil {
+        return nil, err
+    }
+    if len(segs) == 0 {
+        if err := l.createSegment(1); err != nil {
+            return nil, err
+        }
+    } else if err := l.openTail(segs[len(segs)-1]); err != nil {
+        return nil, err
+    } else if l.stale() {
+        // Start a segment under the current key rather than appending
+        // to one written under another.
+        if err := l.rotate(); err != nil {
+            l.seg.Close()
+            return nil, err
+        }
+    }
+
+    if opts.Sync == SyncInterval {
+        l.stop = make(chan struct{})
+        l.done = make(chan struct{})
+        go l.syncLoop()
+    }
+    return l, nil
+}
+
+// Append writes one record to the log, rotating to a new segment when the
+// current one is full.
+func (l *Log) Append(rec []byte) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.closed {
+        return ErrClosed
+    }
+    if l.failed != nil {
+        return l.failed
+    }
+    size := int64(recordHeader + len(rec))
+    if l.cipher != nil {
+        size += int64(l.cipher.Overhead())
+    }
+    if l.segSize > l.hdrSize && l.segSize+size > l.opts.SegmentSize {
+        if err := l.rotate(); err != nil {
+            return err
+        }
+    }
+    if l.cipher != nil {
+        // Seal only now: rotation moves the record to a new segment.
+        rec = l.cipher.Seal(nil, rec, recordAD(l.segNum, l.segSize))
+    }
+
+    buf := make([]byte, recordHeader+len(rec))
+    binary.LittleEndian.PutUint32(buf[4:], uint32(len(rec)))
+    copy(buf[recordHeader:], rec)
+    binary.LittleEndian.PutUint32(buf[0:], crc32.Checksum(buf[4:], crcTable))
+    if _, err := l.seg.Write(buf); err != nil {
+        l.undoLocked(err)
+        return err
+    }
+    l.segSize += size
+    l.dirty = true
+    if l.opts.Sync == SyncAlways {
+        return l.syncLocked()
+    }
+    return nil
+}
+
+// undoLocked cuts a partly written record off the segment, so the next
+// one starts at segSize as its checksum and sealing expect. If that fails
+// too, the log refuses further appends.
+func (l *Log) undoLocked(cause error) {
+    if err := l.seg.Truncate(l.segSize); err != nil {
+        l.failed = fmt.Errorf("wal: append failed (%v) and could not be undone: %w", cause, err)
+        return
+    }
+    if _, err := l.seg.Seek(l.segSize, io.SeekStart); err != nil {
+        l.failed = fmt.Errorf("wal: append failed (%v) and could not be undone: %w", cause, err)
+    }
+}
+
+// Sync fsyncs any appended records.
+func (l *Log) Sync() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.closed {
+        return ErrClosed
+    }
+    return l.syncLocked()
+}
+
+// Replay calls fn for every record in the log, oldest first. Replay stops
+// at the first error returned by fn. Corruption anywhere but the tail of
+// the newest segment (already trimmed by Open) yields ErrCorrupt.
+func (l *Log) Replay(fn func(rec []byte) error) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.closed {
+        return ErrClosed
+    }
+    segs, err := l.segments()
+    if err != nil {
+        return err
+    }
+    for _, num := range segs {
+        f, err := os.Open(l.segmentPath(num))
+        if err != nil {
+            return err
+        }
+        _, _, err = scanSegment(f, num, l.opts.Keys, fn)
+        f.Close()
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Checkpoint starts a fresh segment and deletes all older ones. Callers use
+// it once everything logged so far has been persisted elsewhere.
+func (l *Log) Checkpoint() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.closed {
+        return ErrClosed
+    }
+    if err := l.rotate(); err != nil {
+        return err
+    }
+    segs, err := l.segments()
+    if err != nil {
+        return err
+    }
+    for _, num := range segs {
+        if num < l.segNum {
+            if err := os.Remove(l.segmentPath(num)); err != nil {
+                return err
+            }
+        }
+    }
+    return syncDir(l.dir)
+}
+
+// Close syncs and closes the log.
+func (l *Log) Close() error {
+    l.mu.Lock()
+    if l.closed {
+        l.mu.Unlock()
+        return nil
+    }
+    l.closed = true
+    l.mu.Unlock()
+
+    if l.stop != nil {
+        close(l.stop)
+        <-l.done
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    err := l.syncLocked()
+    if cerr := l.seg.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
+
+func (l *Log) syncLoop() {
+    defer close(l.done)
+    t := time.NewTicker(l.opts.SyncInterval)
+    defer t.Stop()
+    for {
+        select {
+        case <-l.stop:
+            return
+        case <-t.C:
+            l.mu.Lock()
+            l.syncLocked()
+            l.mu.Unlock()
+        }
+    }
+}
+
+func (l *Log) syncLocked() error {
+    if !l.dirty {
+        return nil
+    }
+    if err := l.seg.Sync(); err != nil {
+        return err
+    }
+    l.dirty = false
+    return nil
+}
+
+// rotate seals the current segment and starts the next one.
+func (l *Log) rotate() error {
+    if err := l.syncLocked(); err != nil {
+        return err
+    }
+    if err := l.seg.Close(); err != nil {
+        return err
+    }
+    return l.createSegment(l.segNum + 1)
+}
+
+func (l *Log) createSegment(num uint64) error {
+    var c *encrypt.Cipher
+    if l.opts.Keys != nil {
+        var err error
+        if c, err = encrypt.Current(l.opts.Keys); err != nil {
+            return err
+        }
+    }
+    f, err := os.OpenFile(l.segmentPath(num), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+    if err != nil {
+        return err
+    }
+    hdr := make([]byte, headerSize)
+    binary.LittleEndian.PutUint32(hdr[0:], segmentMagic)
+    binary.LittleEndian.PutUint32(hdr[4:], segmentVersion)
+    if c != nil {
+        binary.LittleEndian.PutUint32(hdr[4:], segmentEncrypted)
+        hdr = append(hdr, byte(len(c.ID())))
+        hdr = append(hdr, c.ID()...)
+    }
+    if _, err := f.Write(hdr); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        return err
+    }
+    if err := syncDir(l.dir); err != nil {
+        f.Close()
+        return err
+    }
+    l.seg, l.segNum, l.segSize, l.hdrSize, l.dirty = f, num, int64(len(hdr)), int64(len(hdr)), false
+    l.cipher = c
+    return nil
+}
+
+// stale reports whether the current segment is not encrypted under the
+// provider's current key.
+func (l *Log) stale() bool {
+    if l.opts.Keys == nil {
+        return false
+    }
+    id, _, err := l.opts.Keys.CurrentKey()
+    return err == nil && (l.cipher == nil || l.cipher.ID() != id)
+}
+
+// recordAD is the additional data authenticated with a sealed record.
+func recordAD(seg uint64, off int64) []byte {
+    ad := make([]byte, 16)
+    binary.LittleEndian.PutUint64(ad[0:], seg)
+    binary.LittleEndian.PutUint64(ad[8:], uint64(off))
+    return ad
+}
+
+// openTail opens the newest segment for appending, truncating any
+// incomplete or corrupt records at its end.
+func (l *Log) openTail(num uint64) error {
+    f, err := os.OpenFile(l.segmentPath(num), os.O_RDWR, 0o644)
+    if err != nil {
+        return err
+    }
+    valid, c, err := scanSegment(f, num, l.opts.Keys, func([]byte) error { return nil })
+    if errors.Is(err, ErrCorrupt) || errors.Is(err, errBadHeader) {
+        err = nil // discard the damaged tail
+    }
+    if err != nil {
+        f.Close()
+        return err
+    }
+    if valid < headerSize {
+        // Header itself was torn; rewrite it.
+        f.Close()
+        if err := os.Remove(l.segmentPath(num)); err != nil {
+            return err
+        }
+        return l.createSegment(num)
+    }
+    if err := f.Truncate(valid); err != nil {
+        f.Close()
+        return err
+    }
+    if _, err := f.Seek(valid, io.SeekStart); err != nil {
+        f.Close()
+        return err
+    }
+    l.seg, l.segNum, l.segSize, l.cipher = f, num, valid, c
+    l.hdrSize = headerSize
+    if c != nil {
+        l.hdrSize += int64(1 + len(c.ID()))
+    }
+    return f.Sync()
+}
+
+var errBadHeader = fmt.Errorf("%w: bad segment header", ErrCorrupt)
+
+// scanSegment reads records from segment num in f, calling fn for each
+// valid one, decrypted if the segment is encrypted. It returns the offset
+// just past the last valid record and the segment's cipher (nil if it is
+// not encrypted). A short or checksum-failing record ends the scan with
+// ErrCorrupt; a record that passes its checksum but fails to decrypt
+// yields encrypt.ErrDecrypt, since a crash cannot explain it.
+func scanSegment(f *os.File, num uint64, keys encrypt.KeyProvider, fn func([]byte) error) (int64, *encrypt.Cipher, error) {
+    st, err := f.Stat()
+    if err != nil {
+        return 0, nil, err
+    }
+    r := &offsetReader{r: bufio.NewReader(f)}
+    hdr := make([]byte, headerSize)
+    if _, err := io.ReadFull(r, hdr); err != nil {
+        return 0, nil, errBadHeader
+    }
+    if binary.LittleEndian.Uint32(hdr[0:]) != segmentMagic {
+        return 0, nil, errBadHeader
+    }
+    var c *encrypt.Cipher
+    switch binary.LittleEndian.Uint32(hdr[4:]) {
+    case segmentVersion:
+    case segmentEncrypted:
+        id := make([]byte, 1)
+        if _, err := io.ReadFull(r, id); err != nil {
+            return 0, nil, errBadHeader
+        }
+        id = make([]byte, id[0])
+        if _, err := io.ReadFull(r, id); err != nil {
+            return 0, nil, errBadHeader
+        }
+        if keys == nil {
+            return 0, nil, ErrNoKeys
+        }
+        if c, err = encrypt.ForID(keys, string(id)); err != nil {
+            return 0, nil, err
+        }
+    default:
+        return 0, nil, errBadHeader
+    }
+    valid := r.n
+    rh := make([]byte, recordHeader)
+    for {
+        if _, err := io.ReadFull(r, rh); err != nil {
+            if err == io.EOF {
+                return valid, c, nil
+            }
+            return valid, c, ErrCorrupt
+        }
+        n := binary.LittleEndian.Uint32(rh[4:])
+        if int64(n) > st.Size()-r.n {
+            return valid, c, ErrCorrupt
+        }
+        payload := make([]byte, n)
+        if _, err := io.ReadFull(r, payload); err != nil {
+            return valid, c, ErrCorrupt
+        }
+        crc := crc32.Update(crc32.Checksum(rh[4:], crcTable), crcTable, payload)
+        if crc != binary.LittleEndian.Uint32(rh[0:]) {
+            return valid, c, ErrCorrupt
+        }
+        if c != nil {
+            if payload, err = c.Open(payload[:0:0], payload, recordAD(num, valid)); err != nil {
+                return valid, c, fmt.Errorf("wal: segment %d offset %d: %w", num, valid, err)
+            }
+        }
+        if err := fn(payload); err != nil {
+            return valid, c, err
+        }
+        valid = r.n
+    }
+}
+
+// segments lists segment numbers in dir in ascending order.
+func (l *Log) segments() ([]uint64, error) {
+    ents, err := os.ReadDir(l.dir)
+    if err != nil {
+        return nil, err
+    }
+    var nums []uint64
+    for _, e := range ents {
+        name := e.Name()
+        if !strings.HasSuffix(name, segmentSuffix) {
+            continue
+        }
+        var num uint64
+        if _, err := fmt.Sscanf(name, "%016d"+segmentSuffix, &num); err != nil {
+            continue
+        }
+        nums = append(nums, num)
+    }
+    sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+    return nums, nil
+}
+
+func (l *Log) segmentPath(num uint64) string {
+    return filepath.Join(l.dir, fmt.Sprintf("%016d%s", num, segmentSuffix))
+}
+
+// offsetReader counts bytes consumed from r.
+type offsetReader struct {
+    r io.Reader
+    n int64
+}
+
+func (o *offsetReader) Read(p []byte) (int, error) {
+    n, err := o.r.Read(p)
+    o.n += int64(n)
+    return n, err
+}
+
+func syncDir(dir string) error {
+    d, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    defer d.Close()
+    return d.Sync()
+}
@@ -0,0 +1,225 @@
+package wal
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/thilakshekharshriyan/m/encrypt"
+)
+
+func replayAll(t *testing.T, l *Log) []string {
+    t.Helper()
+    var recs []string
+    if err := l.Replay(func(rec []byte) error {
+        recs = append(recs, string(rec))
+        return nil
+    }); err != nil {
+        t.Fatal(err)
+    }
+    return recs
+}
+
+func TestLogAppendReplay(t *testing.T) {
+    dir := t.TempDir()
+    l, err := Open(dir, Options{SegmentSize: 64})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 20; i++ {
+        if err := l.Append([]byte(fmt.Sprintf("rec-%02d", i))); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := l.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    segs, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+    if len(segs) < 2 {
+        t.Fatalf("expected segment rotation, got %d segments", len(segs))
+    }
+
+    l, err = Open(dir, Options{SegmentSize: 64, Sync: SyncNever})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    recs := replayAll(t, l)
+    if len(recs) != 20 || recs[0] != "rec-00" || recs[19] != "rec-19" {
+        t.Fatalf("unexpected replay: %v", recs)
+    }
+}
+
+func TestLogTornTail(t *testing.T) {
+    dir := t.TempDir()
+    l, err := Open(dir, Options{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    l.Append([]byte("one"))
+    l.Append([]byte("two"))
+    l.Close()
+
+    // Simulate a crash mid-write: chop the last record in half.
+    path := l.segmentPath(1)
+    st, _ := os.Stat(path)
+    if err := os.Truncate(path, st.Size()-2); err != nil {
+        t.Fatal(err)
+    }
+
+    l, err = Open(dir, Options{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if recs := replayAll(t, l); len(recs) != 1 || recs[0] != "one" {
+        t.Fatalf("expected torn record discarded, got %v", recs)
+    }
+    // Appends continue after the last valid record.
+    l.Append([]byte("three"))
+    l.Close()
+    l, _ = Open(dir, Options{})
+    defer l.Close()
+    if recs := replayAll(t, l); len(recs) != 2 || recs[1] != "three" {
+        t.Fatalf("unexpected replay after repair: %v", recs)
+    }
+}
+
+func TestLogFailedAppend(t *testing.T) {
+    dir := t.TempDir()
+    l, err := Open(dir, Options{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    l.Append([]byte("one"))
+
+    // A read-only handle makes both the write and its undo fail.
+    seg := l.seg
+    ro, err := os.Open(l.segmentPath(1))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ro.Close()
+    l.seg = ro
+    if err := l.Append([]byte("two")); err == nil {
+        t.Fatal("append to a read-only segment succeeded")
+    }
+    l.seg = seg
+    if err := l.Append([]byte("three")); err == nil {
+        t.Fatal("append after an unrecoverable failure succeeded")
+    }
+    l.Close()
+
+    l, err = Open(dir, Options{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    if recs := replayAll(t, l); len(recs) != 1 || recs[0] != "one" {
+        t.Fatalf("unexpected replay: %v", recs)
+    }
+}
+
+func TestLogCorruptTail(t *testing.T) {
+    dir := t.TempDir()
+    l, _ := Open(dir, Options{})
+    l.Append([]byte("good"))
+    l.Append([]byte("flipped"))
+    l.Close()
+
+    path := l.segmentPath(1)
+    data, _ := os.ReadFile(path)
+    data[len(data)-1] ^= 0xff
+    os.WriteFile(path, data, 0o644)
+
+    l, err := Open(dir, Options{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    if recs := replayAll(t, l); len(recs) != 1 || recs[0] != "good" {
+        t.Fatalf("expected corrupt record discarded, got %v", recs)
+    }
+}
+
+func TestLogCheckpoint(t *testing.T) {
+    dir := t.TempDir()
+    l, _ := Open(dir, Options{Sync: SyncInterval})
+    l.Append([]byte("old"))
+    if err := l.Checkpoint(); err != nil {
+        t.Fatal(err)
+    }
+    l.Append([]byte("new"))
+    defer l.Close()
+    if recs := replayAll(t, l); len(recs) != 1 || recs[0] != "new" {
+        t.Fatalf("expected only post-checkpoint records, got %v", recs)
+    }
+}
+
+// mapKeys is a KeyProvider over fixed keys.
+type mapKeys struct {
+    current string
+    keys    map[string][]byte
+}
+
+func (m *mapKeys) CurrentKey() (string, []byte, error) {
+    return m.current, m.keys[m.current], nil
+}
+
+func (m *mapKeys) Key(id string) ([]byte, error) {
+    if k, ok := m.keys[id]; ok {
+        return k, nil
+    }
+    return nil, encrypt.ErrUnknownKey
+}
+
+func TestLogEncrypted(t *testing.T) {
+    dir := t.TempDir()
+    keys := &mapKeys{current: "a", keys: map[string][]byte{"a": bytes.Repeat([]byte{1}, encrypt.KeySize)}}
+    l, err := Open(dir, Options{SegmentSize: 128, Keys: keys})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 10; i++ {
+        l.Append([]byte(fmt.Sprintf("secret-%02d", i)))
+    }
+    l.Close()
+
+    segs, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+    for _, seg := range segs {
+        data, _ := os.ReadFile(seg)
+        if bytes.Contains(data, []byte("secret")) {
+            t.Fatalf("%s holds plaintext", seg)
+        }
+    }
+
+    // After rotation new records use the new key; old ones stay readable.
+    keys.keys["b"] = bytes.Repeat([]byte{2}, encrypt.KeySize)
+    keys.current = "b"
+    l, err = Open(dir, Options{SegmentSize: 128, Keys: keys})
+    if err != nil {
+        t.Fatal(err)
+    }
+    l.Append([]byte("secret-10"))
+    recs := replayAll(t, l)
+    if len(recs) != 11 || recs[0] != "secret-00" || recs[10] != "secret-10" {
+        t.Fatalf("unexpected replay: %v", recs)
+    }
+    l.Close()
+
+    if _, err := Open(dir, Options{}); !errors.Is(err, ErrNoKeys) {
+        t.Fatalf("open without keys: expected ErrNoKeys, got %v", err)
+    }
+    delete(keys.keys, "a")
+    l, err = Open(dir, Options{Keys: keys})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    if err := l.Replay(func([]byte) error { return nil }); !errors.Is(err, encrypt.ErrUnknownKey) {
+        t.Fatalf("replay without old key: expected ErrUnknownKey, got %v", err)
+    }
+}